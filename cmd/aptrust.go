@@ -9,7 +9,6 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"runtime/debug"
 	"strings"
 	"time"
 
@@ -65,94 +64,109 @@ func (svc *ServiceContext) submitToAPTrust(c *gin.Context) {
 	}
 	svc.logInfo(js, "Metadata is a acceptable aptrust submission")
 
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("ERROR: Panic recovered: %v", r)
-				debug.PrintStack()
-				svc.logFatal(js, fmt.Sprintf("Panic recovered during APTrust submission: %v", r))
-			}
-		}()
-
-		// first, register a new submission. This gets the submission identifer is used as the
-		// top-level directory name for assembling the sumission files
-		regResp, err := svc.registerSubmission(js, &md)
-		if err != nil {
-			svc.logFatal(js, err.Error())
-			return
-		}
-		svc.logInfo(js, fmt.Sprintf("Submission registered %+v", regResp))
-
-		// create a top-level submission directory that will contain subdirectories for each metadata record being submitted
-		// each metadata record beig submistted will be named like virginia.edu.tracksys-xmlmetadata-109241 and contain the following:
-		//   * one tif file per master file
-		//   * optional "aptrust-description.txt" and "aptrust-title.txt" that are used to populate aptrust-info.txt
-		//   * one metadata xml file
-		//   * one manifest-md5.txt has one line per file above; m5dchecksum filename
-		submitBaseDir := path.Join(svc.ProcessingDir, "bags", regResp.SubmissionIdentifier)
-		svc.logInfo(js, fmt.Sprintf("Create new submission base directory %s", submitBaseDir))
-		if pathExists(submitBaseDir) {
-			svc.logInfo(js, fmt.Sprintf("Clean up pre-existing submission directory %s", submitBaseDir))
-			if err := os.RemoveAll(submitBaseDir); err != nil {
-				svc.logFatal(js, fmt.Sprintf("Unable to clean up existing submission directory %s: %s", submitBaseDir, err.Error()))
-				c.String(http.StatusInternalServerError, err.Error())
-				return
-			}
-		} else {
-			if err := ensureDirExists(submitBaseDir, 0777); err != nil {
-				svc.logFatal(js, fmt.Sprintf("Unable to create submission directory %s: %s", submitBaseDir, err.Error()))
-				c.String(http.StatusInternalServerError, err.Error())
-				return
-			}
-		}
+	err = svc.enqueueJob(js, "APTrustSubmit", apTrustRequest{MetadataID: md.ID})
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		bagFolderList := make([]string, 0)
-		svc.logInfo(js, fmt.Sprintf("Load child record IDs from collection %s for APTrust submission", md.PID))
-		var inCollectionMD []metadata
-		if err := svc.GDB.Where("parent_metadata_id=?", md.ID).Find(&inCollectionMD).Error; err != nil {
-			svc.logFatal(js, fmt.Sprintf("Unable to load child metadata records for collection %d: %s", md.ID, err.Error()))
-			return
-		}
+	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+}
 
-		svc.logInfo(js, fmt.Sprintf("Collection %d has %d items; build submission directory for each", md.ID, len(inCollectionMD)))
-		for _, tgtMD := range inCollectionMD {
-			if err := svc.buildAPTrustSubmissionDirectory(js, submitBaseDir, &tgtMD); err != nil {
-				svc.logError(js, fmt.Sprintf("Metadata %d APTrust submission failed: %s", md.ID, err.Error()))
-			} else {
-				bagFolderList = append(bagFolderList, getSubmissionDirectoryName(&tgtMD))
-			}
-		}
-		svc.logInfo(js, "All submission directories have been created")
+type apTrustRequest struct {
+	MetadataID int64
+}
 
-		if err := svc.uploadToAPTrustBucket(js, submitBaseDir, regResp); err != nil {
-			svc.logFatal(js, err.Error())
-			return
-		}
+func (svc *ServiceContext) runAPTrustSubmit(js *jobStatus, payload []byte) error {
+	var req apTrustRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid APTrustSubmit payload: %s", err.Error())
+	}
 
-		if err := svc.initiateSubmission(js, regResp.SubmissionIdentifier, bagFolderList); err != nil {
-			svc.logFatal(js, err.Error())
-			return
-		}
+	var md metadata
+	err = svc.GDB.First(&md, req.MetadataID).Error
+	if err != nil {
+		return fmt.Errorf("unable to load metadata %d: %s", req.MetadataID, err.Error())
+	}
 
-		svc.logInfo(js, "Add submission ID to all metadata records just submitted")
-		md.APTrustSubmissionID = regResp.SubmissionIdentifier
-		if err := svc.GDB.Model(&md).Update("apt_submission_id", regResp.SubmissionIdentifier).Error; err != nil {
-			svc.logError(js, fmt.Sprintf("Unable to add submission id %s to metadata %d: %s", regResp.SubmissionIdentifier, md.ID, err.Error()))
+	// first, register a new submission. This gets the submission identifer is used as the
+	// top-level directory name for assembling the sumission files
+	regResp, err := svc.registerSubmission(js, &md)
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		return nil
+	}
+	svc.logInfo(js, fmt.Sprintf("Submission registered %+v", regResp))
+
+	// create a top-level submission directory that will contain subdirectories for each metadata record being submitted
+	// each metadata record beig submistted will be named like virginia.edu.tracksys-xmlmetadata-109241 and contain the following:
+	//   * one tif file per master file
+	//   * optional "aptrust-description.txt" and "aptrust-title.txt" that are used to populate aptrust-info.txt
+	//   * one metadata xml file
+	//   * one manifest-md5.txt has one line per file above; m5dchecksum filename
+	//   * one manifest-sha256.txt has one line per file above; sha256checksum filename
+	submitBaseDir := path.Join(svc.ProcessingDir, "bags", regResp.SubmissionIdentifier)
+	svc.logInfo(js, fmt.Sprintf("Create new submission base directory %s", submitBaseDir))
+	if pathExists(submitBaseDir) {
+		svc.logInfo(js, fmt.Sprintf("Clean up pre-existing submission directory %s", submitBaseDir))
+		if err := os.RemoveAll(submitBaseDir); err != nil {
+			svc.logFatal(js, fmt.Sprintf("Unable to clean up existing submission directory %s: %s", submitBaseDir, err.Error()))
+			return nil
 		}
-		q := "update metadata set apt_submission_id=? where parent_metadata_id=?"
-		if err := svc.GDB.Exec(q, regResp.SubmissionIdentifier, md.ID).Error; err != nil {
-			svc.logError(js, fmt.Sprintf("Unable to add submission id %s to child metdata records of parent %d: %s", regResp.SubmissionIdentifier, md.ID, err.Error()))
+	} else {
+		if err := ensureDirExists(submitBaseDir, 0777); err != nil {
+			svc.logFatal(js, fmt.Sprintf("Unable to create submission directory %s: %s", submitBaseDir, err.Error()))
+			return nil
 		}
+	}
 
-		svc.logInfo(js, "Cleanup assembly directories")
-		if err := os.RemoveAll(submitBaseDir); err != nil {
-			svc.logError(js, fmt.Sprintf("Unable to clean up submission directory %s: %s", submitBaseDir, err.Error()))
+	bagFolderList := make([]string, 0)
+	svc.logInfo(js, fmt.Sprintf("Load child record IDs from collection %s for APTrust submission", md.PID))
+	var inCollectionMD []metadata
+	if err := svc.GDB.Where("parent_metadata_id=?", md.ID).Find(&inCollectionMD).Error; err != nil {
+		svc.logFatal(js, fmt.Sprintf("Unable to load child metadata records for collection %d: %s", md.ID, err.Error()))
+		return nil
+	}
+
+	svc.logInfo(js, fmt.Sprintf("Collection %d has %d items; build submission directory for each", md.ID, len(inCollectionMD)))
+	for _, tgtMD := range inCollectionMD {
+		if err := svc.buildAPTrustSubmissionDirectory(js, submitBaseDir, &tgtMD); err != nil {
+			svc.logError(js, fmt.Sprintf("Metadata %d APTrust submission failed: %s", md.ID, err.Error()))
+		} else {
+			bagFolderList = append(bagFolderList, getSubmissionDirectoryName(&tgtMD))
 		}
+	}
+	svc.logInfo(js, "All submission directories have been created")
 
-		svc.jobDone(js)
-	}()
+	if err := svc.uploadToAPTrustBucket(js, submitBaseDir, regResp); err != nil {
+		svc.logFatal(js, err.Error())
+		return nil
+	}
 
-	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+	if err := svc.initiateSubmission(js, regResp.SubmissionIdentifier, bagFolderList); err != nil {
+		svc.logFatal(js, err.Error())
+		return nil
+	}
+
+	svc.logInfo(js, "Add submission ID to all metadata records just submitted")
+	md.APTrustSubmissionID = regResp.SubmissionIdentifier
+	if err := svc.GDB.Model(&md).Update("apt_submission_id", regResp.SubmissionIdentifier).Error; err != nil {
+		svc.logError(js, fmt.Sprintf("Unable to add submission id %s to metadata %d: %s", regResp.SubmissionIdentifier, md.ID, err.Error()))
+	}
+	q := "update metadata set apt_submission_id=? where parent_metadata_id=?"
+	if err := svc.GDB.Exec(q, regResp.SubmissionIdentifier, md.ID).Error; err != nil {
+		svc.logError(js, fmt.Sprintf("Unable to add submission id %s to child metdata records of parent %d: %s", regResp.SubmissionIdentifier, md.ID, err.Error()))
+	}
+
+	svc.logInfo(js, "Cleanup assembly directories")
+	if err := os.RemoveAll(submitBaseDir); err != nil {
+		svc.logError(js, fmt.Sprintf("Unable to clean up submission directory %s: %s", submitBaseDir, err.Error()))
+	}
+
+	svc.jobDone(js)
+	return nil
 }
 
 func (svc *ServiceContext) validateAPTrustSubmissionRequest(md *metadata) error {
@@ -235,8 +249,9 @@ func (svc *ServiceContext) buildAPTrustSubmissionDirectory(js *jobStatus, submit
 		return fmt.Errorf("unable to create submission directory %s: %s", submitAssembleDir, err.Error())
 	}
 
-	// init a map of filename => checksum
+	// init maps of filename => checksum
 	checksums := make(map[string]string, 0)
+	sha256s := make(map[string]string, 0)
 
 	// add aptrust-title.txt with with content being the title of the md record...
 	titlePath := filepath.Join(submitAssembleDir, "aptrust-title.txt")
@@ -245,6 +260,7 @@ func (svc *ServiceContext) buildAPTrustSubmissionDirectory(js *jobStatus, submit
 	} else {
 		titleMD5 := md5Checksum(titlePath)
 		checksums["aptrust-title.txt"] = titleMD5
+		sha256s["aptrust-title.txt"] = sha256Checksum(titlePath)
 	}
 
 	// Add metadata record to submission directory...
@@ -276,6 +292,7 @@ func (svc *ServiceContext) buildAPTrustSubmissionDirectory(js *jobStatus, submit
 		}
 		md5 := md5Checksum(mdPath)
 		checksums["metadata.json"] = md5
+		sha256s["metadata.json"] = sha256Checksum(mdPath)
 	} else {
 		svc.logInfo(js, "Add MODS XML metadata")
 		mods, err := svc.getModsMetadata(md)
@@ -289,6 +306,7 @@ func (svc *ServiceContext) buildAPTrustSubmissionDirectory(js *jobStatus, submit
 		}
 		md5 := md5Checksum(mdPath)
 		checksums[mdName] = md5
+		sha256s[mdName] = sha256Checksum(mdPath)
 	}
 
 	masterFiles := svc.getBestMasterFiles(js, uint64(md.ID))
@@ -303,15 +321,27 @@ func (svc *ServiceContext) buildAPTrustSubmissionDirectory(js *jobStatus, submit
 		if pathExists(archiveFile) == false {
 			return fmt.Errorf("%s not found", archiveFile)
 		}
-		origMD5 := md5Checksum(archiveFile)
-		md5, err := copyFile(archiveFile, destFile, 0744)
+		// the checksums of the archive data read during the copy are checked against a second read of the copy
+		origSums, err := copyFileWithChecksums(archiveFile, destFile, 0744)
 		if err != nil {
 			return fmt.Errorf("copy %s to %s failed: %s", archiveFile, destFile, err.Error())
 		}
-		if md5 != origMD5 {
-			return fmt.Errorf("copy %s MD5 checksum %s does not match original %s", destFile, md5, origMD5)
+		sums, err := computeChecksums(destFile)
+		if err != nil {
+			return err
+		}
+		if sums.MD5 != origSums.MD5 {
+			return fmt.Errorf("copy %s MD5 checksum %s does not match original %s", destFile, sums.MD5, origSums.MD5)
 		}
-		checksums[mf.Filename] = md5
+		origSHA256, err := svc.getMasterFileSHA256(mf.ID)
+		if err != nil {
+			return fmt.Errorf("unable to get %s SHA-256 checksum: %s", mf.Filename, err.Error())
+		}
+		if origSHA256 != "" && sums.SHA256 != origSHA256 {
+			return fmt.Errorf("copy %s SHA-256 checksum %s does not match original %s", destFile, sums.SHA256, origSHA256)
+		}
+		checksums[mf.Filename] = sums.MD5
+		sha256s[mf.Filename] = sums.SHA256
 	}
 
 	md5FileName := path.Join(submitAssembleDir, "manifest-md5.txt")
@@ -323,6 +353,17 @@ func (svc *ServiceContext) buildAPTrustSubmissionDirectory(js *jobStatus, submit
 	}
 	os.WriteFile(md5FileName, []byte(md5Data), 0644)
 
+	sha256FileName := path.Join(submitAssembleDir, "manifest-sha256.txt")
+	svc.logInfo(js, fmt.Sprintf("Create manifest %s", sha256FileName))
+	sha256Data := ""
+	for fn, sha256 := range sha256s {
+		sha256Data += fmt.Sprintf("%s %s\n", sha256, fn)
+	}
+	err := os.WriteFile(sha256FileName, []byte(sha256Data), 0644)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %s", sha256FileName, err.Error())
+	}
+
 	svc.logInfo(js, fmt.Sprintf("Submission directory for %d is complete", md.ID))
 	return nil
 }
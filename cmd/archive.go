@@ -2,6 +2,7 @@ package main
 
 import (
 	"archive/zip"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -90,7 +91,12 @@ func (svc *ServiceContext) downloadFromArchive(c *gin.Context) {
 
 	if strings.ToLower(req.Filename) == "all" {
 		svc.logInfo(js, fmt.Sprintf("%s requests to download all master files from unit %d", req.ComputeID, unitID))
-		go svc.copyAllFromArchive(js, &tgtUnit, destPath, req.Deliver)
+		err = svc.enqueueJob(js, "CopyArchivedFilesToProduction", archiveCopyRequest{UnitID: unitID, All: true, DestDir: destPath, Deliver: req.Deliver})
+		if err != nil {
+			svc.logFatal(js, err.Error())
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
 		c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
 		return
 	}
@@ -105,14 +111,12 @@ func (svc *ServiceContext) downloadFromArchive(c *gin.Context) {
 
 	if len(req.Files) > 0 {
 		svc.logInfo(js, fmt.Sprintf("%s requests to download %d master files from unit %d", req.ComputeID, len(req.Files), unitID))
-		go func() {
-			for _, filename := range req.Files {
-				svc.logInfo(js, fmt.Sprintf("Downloading %s from unit %d", filename, unitID))
-				svc.copyFileFromArchive(js, &tgtUnit, filename, destPath)
-			}
-			svc.logInfo(js, fmt.Sprintf("%d Masterfiles from unit %d copied to %s", len(req.Files), unitID, destPath))
-			svc.jobDone(js)
-		}()
+		err = svc.enqueueJob(js, "CopyArchivedFilesToProduction", archiveCopyRequest{UnitID: unitID, Files: req.Files, DestDir: destPath})
+		if err != nil {
+			svc.logFatal(js, err.Error())
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
 		c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
 		return
 	}
@@ -121,6 +125,43 @@ func (svc *ServiceContext) downloadFromArchive(c *gin.Context) {
 	c.String(http.StatusBadRequest, "missing files and filename in request")
 }
 
+type archiveCopyRequest struct {
+	UnitID  int64
+	All     bool
+	Files   []string
+	DestDir string
+	Deliver bool
+}
+
+func (svc *ServiceContext) runCopyFromArchive(js *jobStatus, payload []byte) error {
+	var req archiveCopyRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid CopyArchivedFilesToProduction payload: %s", err.Error())
+	}
+
+	var tgtUnit unit
+	err = svc.GDB.Preload("MasterFiles", func(db *gorm.DB) *gorm.DB {
+		return db.Order("master_files.filename ASC")
+	}).First(&tgtUnit, req.UnitID).Error
+	if err != nil {
+		return fmt.Errorf("unable to load unit ID %d: %s", req.UnitID, err.Error())
+	}
+
+	if req.All {
+		svc.copyAllFromArchive(js, &tgtUnit, req.DestDir, req.Deliver)
+		return nil
+	}
+
+	for _, filename := range req.Files {
+		svc.logInfo(js, fmt.Sprintf("Downloading %s from unit %d", filename, req.UnitID))
+		svc.copyFileFromArchive(js, &tgtUnit, filename, req.DestDir)
+	}
+	svc.logInfo(js, fmt.Sprintf("%d Masterfiles from unit %d copied to %s", len(req.Files), req.UnitID, req.DestDir))
+	svc.jobDone(js)
+	return nil
+}
+
 func (svc *ServiceContext) copyFileFromArchive(js *jobStatus, tgtUnit *unit, fileName, destDir string) {
 	srcDir := fmt.Sprintf("%09d", tgtUnit.ID)
 	if strings.Contains(tgtUnit.StaffNotes, "Archive: ") {
@@ -296,14 +337,14 @@ func (svc *ServiceContext) copyArchivedFile(js *jobStatus, unitDir, filename, de
 		return fmt.Errorf("%s not found", archiveFile)
 	}
 
-	archiveMD5 := md5Checksum(archiveFile)
 	destFile := path.Join(destDir, filename)
-	copyMD5, err := copyFile(archiveFile, destFile, 0666)
+	sums, err := copyFileWithChecksums(archiveFile, destFile, 0666)
 	if err != nil {
 		return err
 	}
-	if copyMD5 != archiveMD5 {
-		svc.logError(js, fmt.Sprintf("MD5 checksum does not match on copied file %s", destFile))
+	err = verifyCopiedFile(destFile, sums)
+	if err != nil {
+		svc.logError(js, fmt.Sprintf("MD5 checksum does not match on copied file %s: %s", destFile, err.Error()))
 	}
 	return nil
 }
@@ -331,11 +372,23 @@ func (svc *ServiceContext) archiveFineArtsFile(srcPath string, fineArtsDir strin
 		return "", fmt.Errorf("unable to create %s: %s", archiveUnitDir, err.Error())
 	}
 
-	newMD5, err := copyFile(srcPath, archiveFile, 0664)
+	sums, err := copyFileWithChecksums(srcPath, archiveFile, 0664)
 	if err != nil {
 		return "", err
 	}
+	err = verifyCopiedFile(archiveFile, sums)
+	if err != nil {
+		os.Remove(archiveFile)
+		return "", err
+	}
+	newMD5 := sums.MD5
 	log.Printf("INFO: %s archived to %s. MD5 checksum [%s]", tgtMF.Filename, archiveFile, newMD5)
+	err = svc.saveMasterFileSHA256(tgtMF.ID, sums.SHA256)
+	if err != nil {
+		// remove the copy so it is archived again, with its checksum, when retried
+		os.Remove(archiveFile)
+		return "", fmt.Errorf("unable to save SHA-256 checksum for %s: %s", tgtMF.Filename, err.Error())
+	}
 
 	now := time.Now()
 	tgtMF.DateArchived = &now
@@ -346,7 +399,7 @@ func (svc *ServiceContext) archiveFineArtsFile(srcPath string, fineArtsDir strin
 	return newMD5, nil
 }
 
-// archiveFile will create the unit directory, copy the target file, set the archived date and return an MD5 checksum
+// archiveFile will create the unit directory, copy the target file, verify the archived copy, set the archived date and return an MD5 checksum
 func (svc *ServiceContext) archiveFile(js *jobStatus, srcPath string, unitID int64, tgtMF *masterFile) (string, error) {
 	archiveUnitDir := path.Join(svc.ArchiveDir, fmt.Sprintf("%09d", unitID))
 	archiveFile := path.Join(archiveUnitDir, tgtMF.Filename)
@@ -357,12 +410,24 @@ func (svc *ServiceContext) archiveFile(js *jobStatus, srcPath string, unitID int
 		return "", fmt.Errorf("unable to create %s: %s", archiveUnitDir, err.Error())
 	}
 
-	newMD5, err := copyFile(srcPath, archiveFile, 0664)
+	sums, err := copyFileWithChecksums(srcPath, archiveFile, 0664)
 	if err != nil {
 		return "", err
 	}
+	err = verifyCopiedFile(archiveFile, sums)
+	if err != nil {
+		return "", err
+	}
+	newMD5 := sums.MD5
+	newSHA256 := sums.SHA256
 	svc.logInfo(js, fmt.Sprintf("%s archived to %s. MD5 checksum [%s]", tgtMF.Filename, archiveFile, newMD5))
 
+	err = svc.saveMasterFileSHA256(tgtMF.ID, newSHA256)
+	if err != nil {
+		return "", fmt.Errorf("unable to save SHA-256 checksum for %s: %s", tgtMF.Filename, err.Error())
+	}
+	svc.logInfo(js, fmt.Sprintf("%s SHA-256 checksum [%s]", tgtMF.Filename, newSHA256))
+
 	svc.logInfo(js, "Calculate pHash")
 	updateFields := []string{"DateArchived"}
 	pHash, err := calculatePHash(archiveFile)
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -24,14 +26,25 @@ type masterFileAudit struct {
 	AuditChecksum  string      `json:"auditChecksum"`
 	IIIFExists     bool        `gorm:"column:iiif_exists" json:"iiifExists"`
 	AuditedAt      time.Time   `json:"auditedAt"`
+	// only set when checksum verification of the IIIF image was requested and a checksum was recorded for it
+	IIIFChecksumMatch *bool `gorm:"-" json:"iiifChecksumMatch,omitempty"`
+	// SHA-256 of the archive; the match is only set when a SHA-256 checksum was recorded for the master file
+	AuditSHA256 string `gorm:"-" json:"auditSHA256,omitempty"`
+	SHA256Match *bool  `gorm:"-" json:"sha256Match,omitempty"`
 }
 
 type auditRequest struct {
-	Type   string `json:"type"`
-	Data   string `json:"data"`
-	Email  string `json:"email"`
-	Offset int    `json:"offset"`
-	Limit  int    `json:"limit"`
+	Type       string `json:"type"`
+	Data       string `json:"data"`
+	Email      string `json:"email"`
+	Offset     int    `json:"offset"`
+	Limit      int    `json:"limit"`
+	VerifyIIIF bool   `json:"verifyIIIF"`
+}
+
+type unitAuditRequest struct {
+	UnitID     int64
+	VerifyIIIF bool
 }
 
 type auditItem struct {
@@ -40,23 +53,27 @@ type auditItem struct {
 	UnitID     int64
 	Filename   string
 	MD5        string
+	Filesize   int64
 	StaffNotes string
 }
 
 type auditYearResults struct {
-	StartedAt            string
-	Offset               int
-	Limit                int
-	Year                 string
-	MasterFileCount      uint
-	MasterFileErrorCount uint
-	ChecksumErrorCount   uint
-	MissingChecksumCount uint
-	MissingArchiveCount  uint
-	MissingIIIFCount     uint
-	SuccessCount         uint
-	FatalError           string
-	FinishedAt           string
+	StartedAt              string
+	Offset                 int
+	Limit                  int
+	Year                   string
+	MasterFileCount        uint
+	MasterFileErrorCount   uint
+	ChecksumErrorCount     uint
+	MissingChecksumCount   uint
+	MissingArchiveCount    uint
+	MissingIIIFCount       uint
+	VerifyIIIF             bool
+	IIIFChecksumErrorCount uint
+	SuccessCount           uint
+	FatalError             string
+	FinishedAt             string
+	Rolling                bool
 }
 
 type auditFixLimit struct {
@@ -239,23 +256,37 @@ func (svc *ServiceContext) auditMasterFiles(c *gin.Context) {
 			c.String(http.StatusBadRequest, "non-zero offset requires non-zero limit")
 			return
 		}
-		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					log.Printf("ERROR: Panic recovered during audit year %s: %v", req.Data, r)
-					debug.PrintStack()
-				}
-			}()
-			svc.auditYear(req)
-		}()
-		c.String(http.StatusOK, fmt.Sprintf("audit year %s started for %s", req.Data, req.Email))
+		js, err := svc.createJobStatus("AuditYear", "", 0)
+		if err != nil {
+			log.Printf("ERROR: unable to create AuditYear job status: %s", err.Error())
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		err = svc.enqueueJob(js, "AuditYear", req)
+		if err != nil {
+			svc.logFatal(js, err.Error())
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
 	case "unit":
 		unitID, _ := strconv.ParseInt(req.Data, 10, 64)
-		go svc.auditUnitMasterFiles(unitID)
-		c.String(http.StatusOK, fmt.Sprintf("audit unit %d started", unitID))
+		js, err := svc.createJobStatus("AuditUnitMasterFiles", "Unit", unitID)
+		if err != nil {
+			log.Printf("ERROR: unable to create AuditUnitMasterFiles job status: %s", err.Error())
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		err = svc.enqueueJob(js, "AuditUnitMasterFiles", unitAuditRequest{UnitID: unitID, VerifyIIIF: req.VerifyIIIF})
+		if err != nil {
+			svc.logFatal(js, err.Error())
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
 	default:
 		mfID, _ := strconv.ParseInt(req.Data, 10, 64)
-		audit, err := svc.auditMasterFile(mfID)
+		audit, err := svc.auditMasterFile(mfID, req.VerifyIIIF)
 		if err != nil {
 			log.Printf("ERROR: %s", err.Error())
 			c.String(http.StatusInternalServerError, err.Error())
@@ -265,7 +296,7 @@ func (svc *ServiceContext) auditMasterFiles(c *gin.Context) {
 	}
 }
 
-func (svc *ServiceContext) auditMasterFile(mfID int64) (*masterFileAudit, error) {
+func (svc *ServiceContext) auditMasterFile(mfID int64, verifyIIIF bool) (*masterFileAudit, error) {
 	log.Printf("INFO: audit master file %d", mfID)
 	var mf auditItem
 	mfQ := "select master_files.id as id, pid, filename, md5, unit_id, u.staff_notes as staff_notes from master_files"
@@ -274,26 +305,31 @@ func (svc *ServiceContext) auditMasterFile(mfID int64) (*masterFileAudit, error)
 	if err != nil {
 		return nil, err
 	}
-	return svc.performAudit(&mf)
+	run, err := svc.startAuditRun(nil, "masterfile")
+	if err != nil {
+		return nil, err
+	}
+	defer svc.finishAuditRun(run)
+	return svc.performAudit(context.Background(), run.ID, &mf, verifyIIIF)
 }
 
-func (svc *ServiceContext) auditUnitMasterFiles(unitID int64) {
-	js, err := svc.createJobStatus("AuditUnitMasterFiles", "Unit", unitID)
+func (svc *ServiceContext) runAuditUnitMasterFiles(js *jobStatus, payload []byte) error {
+	var req unitAuditRequest
+	err := json.Unmarshal(payload, &req)
 	if err != nil {
-		log.Printf("ERROR: unable to create job js: %s", err.Error())
-		return
+		return fmt.Errorf("invalid AuditUnitMasterFiles payload: %s", err.Error())
 	}
+	unitID := req.UnitID
+
 	svc.logInfo(js, fmt.Sprintf("Begin audit master files from unit %d", unitID))
 	var tgtUnit unit
 	err = svc.GDB.First(&tgtUnit, unitID).Error
 	if err != nil {
-		svc.logFatal(js, fmt.Sprintf("Unable to load unit %d: %s", unitID, err.Error()))
-		return
+		return fmt.Errorf("unable to load unit %d: %s", unitID, err.Error())
 	}
 
 	if tgtUnit.Reorder {
-		svc.logFatal(js, "Cannot audit reorders")
-		return
+		return fmt.Errorf("cannot audit reorders")
 	}
 
 	var unitMasterFiles []auditItem
@@ -301,45 +337,88 @@ func (svc *ServiceContext) auditUnitMasterFiles(unitID int64) {
 	mfQ += " inner join units u on u.id = unit_id where unit_id = ?"
 	err = svc.GDB.Raw(mfQ, unitID).Scan(&unitMasterFiles).Error
 	if err != nil {
-		svc.logFatal(js, fmt.Sprintf("Unable to load unit master files: %s", err.Error()))
-		return
+		return fmt.Errorf("unable to load unit master files: %s", err.Error())
 	}
 
+	run, err := svc.startAuditRun(js, "unit")
+	if err != nil {
+		return err
+	}
 	for _, mf := range unitMasterFiles {
+		if js.canceled() {
+			return nil
+		}
 		svc.logInfo(js, fmt.Sprintf("Audit master file %d", mf.ID))
-		_, err := svc.performAudit(&mf)
+		res, err := svc.performAudit(js.context(), run.ID, &mf, req.VerifyIIIF)
 		if err != nil {
 			svc.logError(js, fmt.Sprintf("Audit failed: %s", err.Error()))
+		} else if res.IIIFChecksumMatch != nil && *res.IIIFChecksumMatch == false {
+			svc.logError(js, fmt.Sprintf("IIIF image for master file %d does not match the checksum recorded when it was published", mf.ID))
 		}
 	}
 
+	svc.finishAuditRun(run)
 	svc.jobDone(js)
+	return nil
 }
 
-func (svc *ServiceContext) auditYear(req auditRequest) {
+func (svc *ServiceContext) runAuditYear(js *jobStatus, payload []byte) error {
+	var req auditRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid AuditYear payload: %s", err.Error())
+	}
 	year := req.Data
-	log.Printf("INFO: %s requets master files audit from year %s offest %d limit %d", req.Email, year, req.Offset, req.Limit)
+	svc.logInfo(js, fmt.Sprintf("%s requets master files audit from year %s offest %d limit %d", req.Email, year, req.Offset, req.Limit))
 
 	auditSummary := auditYearResults{StartedAt: time.Now().Format("2006-01-02 03:04:05 PM"),
-		Year: year, Offset: req.Offset, Limit: req.Limit}
+		Year: year, Offset: req.Offset, Limit: req.Limit, VerifyIIIF: req.VerifyIIIF}
 
 	mfQ := svc.GDB.Model(&masterFile{}).Joins("inner join units u on u.id = unit_id").
 		Where("year(master_files.created_at) = ? and master_files.date_archived is not null and original_mf_id is null", year)
-	if req.Offset > 0 {
-		mfQ = mfQ.Offset(req.Offset)
+
+	run, err := svc.startAuditRun(js, "year")
+	if err != nil {
+		return err
 	}
-	if req.Limit > 0 {
-		mfQ = mfQ.Limit(req.Limit)
+
+	// a restarted job continues its audit run after the last master file it audited
+	offset := req.Offset
+	limit := req.Limit
+	if run.LastMasterFileID > 0 {
+		err = svc.getAuditRunTotals(run.ID, &auditSummary)
+		if err != nil {
+			return fmt.Errorf("unable to get totals for audit run %d: %s", run.ID, err.Error())
+		}
+		svc.logInfo(js, fmt.Sprintf("Resume audit after master file %d; %d master files already audited", run.LastMasterFileID, auditSummary.MasterFileCount))
+		mfQ = mfQ.Where("master_files.id > ?", run.LastMasterFileID)
+		offset = 0
+		if limit > 0 {
+			// stop at the requested limit; a limit of zero would audit everything so audit nothing more
+			limit = max(limit-int(auditSummary.MasterFileCount), 0)
+			if limit == 0 {
+				mfQ = mfQ.Where("1=0")
+			}
+		}
+	}
+	if offset > 0 {
+		mfQ = mfQ.Offset(offset)
+	}
+	if limit > 0 {
+		mfQ = mfQ.Limit(limit)
 	}
 
 	var hits []auditItem
 	batchSize := 1000
-	err := mfQ.FindInBatches(&hits, batchSize, func(tx *gorm.DB, batch int) error {
-		log.Printf("INFO: processing batch %d of master files from year %s; total processed: %d", batch, year, auditSummary.MasterFileCount)
+	err = mfQ.FindInBatches(&hits, batchSize, func(tx *gorm.DB, batch int) error {
+		if js.canceled() {
+			return js.context().Err()
+		}
+		svc.logInfo(js, fmt.Sprintf("Processing batch %d of master files from year %s; total processed: %d", batch, year, auditSummary.MasterFileCount))
 		for _, mf := range hits {
 			auditSummary.MasterFileCount++
 
-			res, err := svc.performAudit(&mf)
+			res, err := svc.performAudit(js.context(), run.ID, &mf, req.VerifyIIIF)
 			if err != nil {
 				log.Printf("ERROR: unable to audit master file %d: %s", mf.ID, err.Error())
 				auditSummary.MasterFileErrorCount++
@@ -358,30 +437,40 @@ func (svc *ServiceContext) auditYear(req auditRequest) {
 				if res.IIIFExists == false {
 					auditSummary.MissingIIIFCount++
 				}
+				iiifChecksumError := res.IIIFChecksumMatch != nil && *res.IIIFChecksumMatch == false
+				if iiifChecksumError {
+					auditSummary.IIIFChecksumErrorCount++
+				}
 
-				if res.ArchiveExists && res.ChecksumMatch && res.IIIFExists {
+				if res.ArchiveExists && res.ChecksumMatch && res.IIIFExists && iiifChecksumError == false {
 					auditSummary.SuccessCount++
 				}
 			}
 		}
 
+		svc.saveAuditRunCursor(run, hits[len(hits)-1].ID)
+
 		// return error will stop future batches
 		return nil
 	}).Error
 
 	if err != nil {
-		log.Printf("ERROR: unable to get master files for year %s: %s", year, err.Error())
-		auditSummary.FatalError = err.Error()
-		return
+		return fmt.Errorf("unable to audit master files for year %s after %d processed: %s", year, auditSummary.MasterFileCount, err.Error())
 	}
 
+	svc.finishAuditRun(run)
 	auditSummary.FinishedAt = time.Now().Format("2006-01-02 03:04:05 PM")
 	svc.sendAuditResultsEmail(req.Email, auditSummary)
 
-	log.Printf("INFO: audit for year %s is done", year)
+	svc.logInfo(js, fmt.Sprintf("Audit for year %s is done", year))
+	svc.jobDone(js)
+	return nil
 }
 
-func (svc *ServiceContext) performAudit(mf *auditItem) (*masterFileAudit, error) {
+// performAudit checks the archive and IIIF files for a master file and saves the results. If verifyIIIF is
+// set, the published IIIF image is downloaded and checked against the checksum recorded when it was published.
+// The master file audit record holds the latest results; every audit is also added to the history of the audit run.
+func (svc *ServiceContext) performAudit(ctx context.Context, runID int64, mf *auditItem, verifyIIIF bool) (*masterFileAudit, error) {
 	var auditRec *masterFileAudit
 	err := svc.GDB.Where("master_file_id=?", mf.ID).Find(&auditRec).Limit(1).Error
 	if err != nil {
@@ -396,19 +485,7 @@ func (svc *ServiceContext) performAudit(mf *auditItem) (*masterFileAudit, error)
 	auditRec.ChecksumMatch = false
 	auditRec.AuditChecksum = ""
 
-	srcDir := fmt.Sprintf("%09d", mf.UnitID)
-	if strings.Contains(mf.StaffNotes, "Archive: ") {
-		srcDir = strings.Split(mf.StaffNotes, "Archive: ")[1]
-	}
-
-	archiveFile := path.Join(svc.ArchiveDir, srcDir, mf.Filename)
-	if strings.Contains(mf.Filename, "ARCH") || strings.Contains(mf.Filename, "AVRN") || strings.Contains(mf.Filename, "VRC") {
-		if strings.Contains(mf.Filename, "_") {
-			overrideDir := strings.Split(mf.Filename, "_")[0]
-			archiveFile = path.Join(svc.ArchiveDir, overrideDir, mf.Filename)
-			log.Printf("INFO: audit masterfile %s is archived in non-standard location %s", mf.Filename, archiveFile)
-		}
-	}
+	archiveFile := svc.getAuditArchiveFile(mf)
 
 	if pathExists(archiveFile) == false {
 		// log.Printf("WARNING: audit finds that masterfile %d is missing archive %s", mf.ID, archiveFile)
@@ -417,13 +494,41 @@ func (svc *ServiceContext) performAudit(mf *auditItem) (*masterFileAudit, error)
 		auditRec.AuditChecksum = ""
 	} else {
 		auditRec.ArchiveExists = true
-		auditRec.AuditChecksum = md5Checksum(archiveFile)
+		sums, err := computeChecksums(archiveFile)
+		if err != nil {
+			// the archive could not be read; record the failed check in the run history before giving up
+			histErr := svc.saveAuditHistory(runID, auditRec, err.Error())
+			if histErr != nil {
+				log.Printf("ERROR: unable to save audit history for master file %d: %s", mf.ID, histErr.Error())
+			}
+			return nil, err
+		}
+		auditRec.AuditChecksum = sums.MD5
 		if auditRec.AuditChecksum != mf.MD5 {
 			auditRec.ChecksumMatch = false
 			// log.Printf("WARNING: master file %d audit finds a checksum mismatch record %s vs archive %s", mf.ID, mf.MD5, auditRec.AuditChecksum)
 		} else {
 			auditRec.ChecksumMatch = true
 		}
+
+		// the SHA-256 checksum must match too if one was recorded. Files without one get it
+		// recorded once the MD5 checksum has verified the archive is unchanged.
+		storedSHA256, err := svc.getMasterFileSHA256(mf.ID)
+		if err != nil {
+			log.Printf("ERROR: unable to get sha256 checksum for master file %d: %s", mf.ID, err.Error())
+		} else {
+			auditRec.AuditSHA256 = sums.SHA256
+			if storedSHA256 != "" {
+				match := auditRec.AuditSHA256 == storedSHA256
+				auditRec.SHA256Match = &match
+				auditRec.ChecksumMatch = auditRec.ChecksumMatch && match
+			} else if auditRec.ChecksumMatch {
+				err = svc.saveMasterFileSHA256(mf.ID, auditRec.AuditSHA256)
+				if err != nil {
+					log.Printf("ERROR: unable to save sha256 checksum for master file %d: %s", mf.ID, err.Error())
+				}
+			}
+		}
 	}
 
 	iiifInfo := svc.getIIIFContext(mf.PID)
@@ -435,6 +540,11 @@ func (svc *ServiceContext) performAudit(mf *auditItem) (*masterFileAudit, error)
 		if iiifExist == false {
 			auditRec.IIIFExists = false
 			// log.Printf("WARNING: master file %d audit finds no iiif file", mf.ID)
+		} else if verifyIIIF {
+			auditRec.IIIFChecksumMatch, err = svc.verifyIIIFChecksum(ctx, iiifInfo.S3Key())
+			if err != nil {
+				log.Printf("ERROR: unable to verify iiif checksum for master file %d: %s", mf.ID, err.Error())
+			}
 		}
 	}
 
@@ -445,6 +555,13 @@ func (svc *ServiceContext) performAudit(mf *auditItem) (*masterFileAudit, error)
 		// update an existing audit
 		err = svc.GDB.Save(auditRec).Error
 	}
+	if err != nil {
+		return nil, err
+	}
 
-	return auditRec, err
+	err = svc.saveAuditHistory(runID, auditRec, "")
+	if err != nil {
+		return nil, fmt.Errorf("unable to save audit history for master file %d: %s", mf.ID, err.Error())
+	}
+	return auditRec, nil
 }
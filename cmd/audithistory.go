@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// auditRun is a single fixity audit request; a year, unit or master file audit
+type auditRun struct {
+	ID          int64      `json:"id"`
+	JobStatusID *int64     `gorm:"index" json:"jobID,omitempty"`
+	Type        string     `json:"type"`
+	StartedAt   time.Time  `json:"startedAt"`
+	FinishedAt  *time.Time `json:"finishedAt"`
+	// the last master file audited. Restarted year audits resume after it; each rolling audit
+	// run continues from the cursor of the previous run.
+	LastMasterFileID int64 `json:"-"`
+}
+
+// masterFileAuditHistory is the immutable result of auditing one master file during an audit run.
+// The master_file_audits table only keeps the latest result for each master file.
+type masterFileAuditHistory struct {
+	ID                int64     `json:"id"`
+	AuditRunID        int64     `gorm:"index" json:"runID"`
+	MasterFileID      int64     `gorm:"index" json:"masterFileID"`
+	AuditedAt         time.Time `json:"auditedAt"`
+	ArchiveExists     bool      `json:"archiveExists"`
+	ChecksumExists    bool      `json:"checksumExists"`
+	ChecksumMatch     bool      `json:"checksumMatch"`
+	AuditChecksum     string    `json:"auditChecksum"`
+	AuditSHA256       string    `json:"auditSHA256"`
+	SHA256Match       *bool     `json:"sha256Match"`
+	IIIFExists        bool      `gorm:"column:iiif_exists" json:"iiifExists"`
+	IIIFChecksumMatch *bool     `gorm:"column:iiif_checksum_match" json:"iiifChecksumMatch"`
+	Error             string    `json:"error,omitempty"`
+}
+
+// startAuditRun creates a run for an audit. Jobs that are restarted continue the run they already started.
+func (svc *ServiceContext) startAuditRun(js *jobStatus, auditType string) (*auditRun, error) {
+	var run auditRun
+	if js != nil {
+		err := svc.GDB.Where("job_status_id=?", js.ID).Limit(1).Find(&run).Error
+		if err != nil {
+			return nil, fmt.Errorf("unable to check for existing audit run: %s", err.Error())
+		}
+		if run.ID > 0 {
+			return &run, nil
+		}
+		run.JobStatusID = &js.ID
+	}
+	run.Type = auditType
+	run.StartedAt = time.Now()
+	err := svc.GDB.Create(&run).Error
+	if err != nil {
+		return nil, fmt.Errorf("unable to create audit run: %s", err.Error())
+	}
+	return &run, nil
+}
+
+func (svc *ServiceContext) finishAuditRun(run *auditRun) {
+	now := time.Now()
+	run.FinishedAt = &now
+	err := svc.GDB.Model(run).Select("FinishedAt").Updates(*run).Error
+	if err != nil {
+		log.Printf("ERROR: unable to finish audit run %d: %s", run.ID, err.Error())
+	}
+}
+
+// saveAuditRunCursor records the last master file audited by a run
+func (svc *ServiceContext) saveAuditRunCursor(run *auditRun, lastMasterFileID int64) {
+	run.LastMasterFileID = lastMasterFileID
+	err := svc.GDB.Model(run).Select("LastMasterFileID").Updates(*run).Error
+	if err != nil {
+		log.Printf("ERROR: unable to save audit run %d cursor: %s", run.ID, err.Error())
+	}
+}
+
+// getAuditRunTotals totals the latest audit history of each master file in an audit run. Audits
+// that failed with an error are only counted as master file errors.
+func (svc *ServiceContext) getAuditRunTotals(runID int64, summary *auditYearResults) error {
+	totalsQ := "count(*) as master_file_count, coalesce(sum(error!=''),0) as master_file_error_count,"
+	totalsQ += " coalesce(sum(error='' and archive_exists=0),0) as missing_archive_count,"
+	totalsQ += " coalesce(sum(error='' and archive_exists=1 and checksum_exists=0),0) as missing_checksum_count,"
+	totalsQ += " coalesce(sum(error='' and archive_exists=1 and checksum_exists=1 and checksum_match=0),0) as checksum_error_count,"
+	totalsQ += " coalesce(sum(error='' and iiif_exists=0),0) as missing_iiif_count,"
+	totalsQ += " coalesce(sum(error='' and iiif_checksum_match=0),0) as iiif_checksum_error_count,"
+	totalsQ += " coalesce(sum(error='' and archive_exists=1 and checksum_match=1 and iiif_exists=1 and (iiif_checksum_match is null or iiif_checksum_match=1)),0) as success_count"
+	latestQ := svc.GDB.Model(&masterFileAuditHistory{}).Select("max(id) as id").Where("audit_run_id=?", runID).Group("master_file_id")
+	return svc.GDB.Model(&masterFileAuditHistory{}).Select(totalsQ).
+		Joins("inner join (?) latest on latest.id = master_file_audit_histories.id", latestQ).
+		Scan(summary).Error
+}
+
+func (svc *ServiceContext) saveAuditHistory(runID int64, audit *masterFileAudit, auditErr string) error {
+	hist := masterFileAuditHistory{
+		AuditRunID:        runID,
+		MasterFileID:      audit.MasterFileID,
+		AuditedAt:         audit.AuditedAt,
+		ArchiveExists:     audit.ArchiveExists,
+		ChecksumExists:    audit.ChecksumExists,
+		ChecksumMatch:     audit.ChecksumMatch,
+		AuditChecksum:     audit.AuditChecksum,
+		AuditSHA256:       audit.AuditSHA256,
+		SHA256Match:       audit.SHA256Match,
+		IIIFExists:        audit.IIIFExists,
+		IIIFChecksumMatch: audit.IIIFChecksumMatch,
+		Error:             auditErr,
+	}
+	return svc.GDB.Create(&hist).Error
+}
+
+// getMasterFileAudits returns the current audit summary and the audit history of a master file, newest first
+func (svc *ServiceContext) getMasterFileAudits(c *gin.Context) {
+	mfID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	var mf masterFile
+	err := svc.GDB.First(&mf, mfID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.String(http.StatusNotFound, "not found")
+		} else {
+			c.String(http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	var current masterFileAudit
+	err = svc.GDB.Where("master_file_id=?", mfID).Limit(1).Find(&current).Error
+	if err != nil {
+		log.Printf("ERROR: unable to get audit for master file %d: %s", mfID, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	history := make([]masterFileAuditHistory, 0)
+	err = svc.GDB.Where("master_file_id=?", mfID).Order("audited_at desc, id desc").Find(&history).Error
+	if err != nil {
+		log.Printf("ERROR: unable to get audit history for master file %d: %s", mfID, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	type auditTimeline struct {
+		MasterFileID int64                    `json:"masterFileID"`
+		Filename     string                   `json:"filename"`
+		MD5          string                   `json:"md5"`
+		SHA256       string                   `json:"sha256"`
+		Current      *masterFileAudit         `json:"current"`
+		History      []masterFileAuditHistory `json:"history"`
+	}
+	out := auditTimeline{MasterFileID: mf.ID, Filename: mf.Filename, MD5: mf.MD5, History: history}
+	out.SHA256, _ = svc.getMasterFileSHA256(mf.ID)
+	if current.ID > 0 {
+		out.Current = &current
+	}
+	c.JSON(http.StatusOK, out)
+}
@@ -3,22 +3,18 @@ package main
 import (
 	"encoding/csv"
 	"fmt"
-	"log"
-	"net/http"
 	"os"
 	"path"
 	"regexp"
-	"runtime/debug"
 	"strings"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"golang.org/x/exp/slices"
 )
 
 // SAMPLE LOCAL CALL
 // curl -X POST http://localhost:8180/script -H "Content-Type: application/json" --data '{"computeID": "lf6f", "name": "createBondLocations", "params": {"fileName": "boxes9-12.csv"}}'
-func (svc *ServiceContext) createBondLocations(c *gin.Context, js *jobStatus, params map[string]any) error {
+func (svc *ServiceContext) createBondLocations(js *jobStatus, params map[string]any) error {
 	svc.logInfo(js, "start script to create locations for bond papers")
 	csvFileName, found := params["fileName"].(string)
 	if found == false {
@@ -84,8 +80,6 @@ func (svc *ServiceContext) createBondLocations(c *gin.Context, js *jobStatus, pa
 	}
 
 	svc.logInfo(js, fmt.Sprintf("%d locations created", cnt))
-	svc.jobDone(js)
-	c.String(http.StatusOK, fmt.Sprintf("%d locations created; check tracksys job %d status for details\n", cnt, js.ID))
 	return nil
 }
 
@@ -100,7 +94,7 @@ func (svc *ServiceContext) createBondLocations(c *gin.Context, js *jobStatus, pa
 //   - folder: (OPTIONAL) folder to ingest. If omitted, the entire box will be ingested
 //
 // EXAMPLE: curl -X POST https://dpg-jobs.lib.virginia.edu/script -H "Content-Type: application/json" --data '{"computeID": "lf6f", "name": "createBondUnits", "params": {"orderID": 12288, "src": "/mnt/work/bondpapers", "fileName": "boxes9-12.csv", "box": "9"}}'
-func (svc *ServiceContext) createBondUnits(c *gin.Context, js *jobStatus, params map[string]any) error {
+func (svc *ServiceContext) createBondUnits(js *jobStatus, params map[string]any) error {
 	svc.logInfo(js, "start script to create units for bond papers")
 	bondRoot, found := params["src"].(string)
 	if found == false {
@@ -140,93 +134,81 @@ func (svc *ServiceContext) createBondUnits(c *gin.Context, js *jobStatus, params
 		svc.logInfo(js, fmt.Sprintf("process units from folder %s", tgtFolder))
 	}
 
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("ERROR: panic recovered during createBondUnits: %v", r)
-				debug.PrintStack()
-				svc.logFatal(js, fmt.Sprintf("Panic recovered during createBondUnits: %v", r))
-			}
-		}()
-
-		cnt := 0
-		indendedUseID := int64(110) // digital collection building
-		chunkRegex := regexp.MustCompile(`\s\((Doc\s)?[1-9]{1}\sof\s[1-9]{1}\)$`)
-		for i, line := range recs {
-			if i == 0 {
-				continue
-			}
+	cnt := 0
+	indendedUseID := int64(110) // digital collection building
+	chunkRegex := regexp.MustCompile(`\s\((Doc\s)?[1-9]{1}\sof\s[1-9]{1}\)$`)
+	for i, line := range recs {
+		if i == 0 {
+			continue
+		}
 
-			// title may appear multiple times with different prefix / suffix
-			// suffix looks like (Doc # of #) or (# of #). Strip it and ignore
-			title := line[1]
-			title = chunkRegex.ReplaceAllString(title, "")
+		// title may appear multiple times with different prefix / suffix
+		// suffix looks like (Doc # of #) or (# of #). Strip it and ignore
+		title := line[1]
+		title = chunkRegex.ReplaceAllString(title, "")
 
-			// extract box/folder info
-			boxFolder := line[8]
-			bits := strings.Split(boxFolder, " ")
-			boxNum := bits[1]
-			folderNum := bits[3]
-			callNum := fmt.Sprintf("MSS 13347 Box %s", boxNum)
-			ingestFolder := fmt.Sprintf("mss13347-b%s-f%s", boxNum, folderNum) // directory name for src images
+		// extract box/folder info
+		boxFolder := line[8]
+		bits := strings.Split(boxFolder, " ")
+		boxNum := bits[1]
+		folderNum := bits[3]
+		callNum := fmt.Sprintf("MSS 13347 Box %s", boxNum)
+		ingestFolder := fmt.Sprintf("mss13347-b%s-f%s", boxNum, folderNum) // directory name for src images
 
-			if tgtBox != "" && tgtBox != boxNum {
-				continue
-			}
-			if tgtFolder != "" && tgtFolder != folderNum {
-				continue
-			}
+		if tgtBox != "" && tgtBox != boxNum {
+			continue
+		}
+		if tgtFolder != "" && tgtFolder != folderNum {
+			continue
+		}
 
-			svc.logInfo(js, fmt.Sprintf("processing csv line %d", i))
+		svc.logInfo(js, fmt.Sprintf("processing csv line %d", i))
 
-			// get the image list, clean it up and sort
-			var images []string
-			for _, img := range strings.Split(line[10], "|") {
-				img = strings.TrimSpace(img)
-				if img != "" {
-					images = append(images, img)
-				}
-			}
-			if len(images) == 0 || images == nil {
-				svc.logInfo(js, fmt.Sprintf("%s has no images and is being skipped", boxFolder))
-				continue
+		// get the image list, clean it up and sort
+		var images []string
+		for _, img := range strings.Split(line[10], "|") {
+			img = strings.TrimSpace(img)
+			if img != "" {
+				images = append(images, img)
 			}
-			images = sortImages(images)
-			svc.logInfo(js, fmt.Sprintf("first page in new record [%s]", images[0]))
+		}
+		if len(images) == 0 || images == nil {
+			svc.logInfo(js, fmt.Sprintf("%s has no images and is being skipped", boxFolder))
+			continue
+		}
+		images = sortImages(images)
+		svc.logInfo(js, fmt.Sprintf("first page in new record [%s]", images[0]))
+
+		// get parent metadata record...
+		var tgtMD metadata
+		err = svc.GDB.Where("call_number=?", callNum).First(&tgtMD).Error
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("unable to find metadata %s", callNum))
+			continue
+		}
 
-			// get parent metadata record...
-			var tgtMD metadata
-			err = svc.GDB.Where("call_number=?", callNum).First(&tgtMD).Error
+		// see if a unit for this record already exists: IMPORTANT; titles are held in staff_notes and may be duplicated
+		// need to pull all that match metadata and title, then check page info to see if its already been processed.
+		var tgtUnits []unit
+		svc.GDB.Where("metadata_id=? and staff_notes=?", tgtMD.ID, title).Find(&tgtUnits)
+		if len(tgtUnits) == 0 {
+			svc.logInfo(js, fmt.Sprintf("create unit for %s", ingestFolder))
+			si := fmt.Sprintf("Ingest from: %s\nImages: %s", ingestFolder, strings.Join(images, ","))
+			newUnit := unit{OrderID: tgtOrder.ID, MetadataID: &tgtMD.ID, UnitStatus: "approved", IntendedUseID: &indendedUseID,
+				CompleteScan: true, StaffNotes: title, SpecialInstructions: si}
+			err = svc.GDB.Create(&newUnit).Error
 			if err != nil {
-				svc.logError(js, fmt.Sprintf("unable to find metadata %s", callNum))
+				svc.logError(js, fmt.Sprintf("unable to create unit for %s: %s", ingestFolder, err.Error()))
 				continue
 			}
-
-			// see if a unit for this record already exists: IMPORTANT; titles are held in staff_notes and may be duplicated
-			// need to pull all that match metadata and title, then check page info to see if its already been processed.
-			var tgtUnits []unit
-			svc.GDB.Where("metadata_id=? and staff_notes=?", tgtMD.ID, title).Find(&tgtUnits)
-			if len(tgtUnits) == 0 {
-				svc.logInfo(js, fmt.Sprintf("create unit for %s", ingestFolder))
-				si := fmt.Sprintf("Ingest from: %s\nImages: %s", ingestFolder, strings.Join(images, ","))
-				newUnit := unit{OrderID: tgtOrder.ID, MetadataID: &tgtMD.ID, UnitStatus: "approved", IntendedUseID: &indendedUseID,
-					CompleteScan: true, StaffNotes: title, SpecialInstructions: si}
-				err = svc.GDB.Create(&newUnit).Error
-				if err != nil {
-					svc.logError(js, fmt.Sprintf("unable to create unit for %s: %s", ingestFolder, err.Error()))
-					continue
-				}
-				svc.logInfo(js, fmt.Sprintf("created unit %d for %s", newUnit.ID, ingestFolder))
-				cnt++
-			} else {
-				svc.logInfo(js, fmt.Sprintf("%d units exist for metadata %d title [%s]", len(tgtUnits), tgtMD.ID, title))
-			}
+			svc.logInfo(js, fmt.Sprintf("created unit %d for %s", newUnit.ID, ingestFolder))
+			cnt++
+		} else {
+			svc.logInfo(js, fmt.Sprintf("%d units exist for metadata %d title [%s]", len(tgtUnits), tgtMD.ID, title))
 		}
+	}
 
-		svc.logInfo(js, fmt.Sprintf("%d units created", cnt))
-		svc.jobDone(js)
-	}()
-	c.String(http.StatusOK, fmt.Sprintf("createBondUnits started; check tracksys job %d status for details\n", js.ID))
+	svc.logInfo(js, fmt.Sprintf("%d units created", cnt))
 	return nil
 }
 
@@ -238,7 +220,7 @@ func (svc *ServiceContext) createBondUnits(c *gin.Context, js *jobStatus, params
 //   - folder: (OPTIONAL) folder to ingest. If omitted, the entire box will be ingested
 //
 // EXAMPLE: curl -X POST https://dpg-jobs.lib.virginia.edu/script -H "Content-Type: application/json" --data '{"computeID": "lf6f", "name": "ingestBondImages", "params": {"orderID": 12288, "src": "/mnt/work/bondpapers/Jan 2024 Delivery", "box": "9", "folder": "21"}}'
-func (svc *ServiceContext) ingestBondImages(c *gin.Context, js *jobStatus, params map[string]any) error {
+func (svc *ServiceContext) ingestBondImages(js *jobStatus, params map[string]any) error {
 	svc.logInfo(js, "start script to ingest bond images")
 	bondRoot, found := params["src"].(string)
 	if found == false {
@@ -272,7 +254,7 @@ func (svc *ServiceContext) ingestBondImages(c *gin.Context, js *jobStatus, param
 	var tgtMD metadata
 	err = svc.GDB.Preload("Locations").Where("call_number=?", callNum).First(&tgtMD).Error
 	if err != nil {
-		svc.logFatal(js, fmt.Sprintf("unable to find metadata %s", callNum))
+		return fmt.Errorf("unable to find metadata %s", callNum)
 	}
 
 	tgtFolder, found := params["folder"].(string)
@@ -282,162 +264,149 @@ func (svc *ServiceContext) ingestBondImages(c *gin.Context, js *jobStatus, param
 		svc.logInfo(js, "ingest images from all available folders")
 	}
 
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("ERROR: panic recovered during bond image ingest: %v", r)
-				debug.PrintStack()
-				svc.logFatal(js, fmt.Sprintf("Panic recovered during ingest: %v", r))
-			}
-		}()
+	//get all of the unis associated with the target order / meetadata record (box)
+	var boxUnits []unit
+	err = svc.GDB.Where("order_id=? and metadata_id=?", tgtOrder.ID, tgtMD.ID).Find(&boxUnits).Error
+	if err != nil {
+		return fmt.Errorf("unable to load units for order %d, metadata %d: %s", tgtOrder.ID, tgtMD.ID, err.Error())
+	}
 
-		//get all of the unis associated with the target order / meetadata record (box)
-		var boxUnits []unit
-		err = svc.GDB.Where("order_id=? and metadata_id=?", tgtOrder.ID, tgtMD.ID).Find(&boxUnits).Error
-		if err != nil {
-			svc.logFatal(js, fmt.Sprintf("unable to load units for order %d, metadata %d: %s", tgtOrder.ID, tgtMD.ID, err.Error()))
-			return
+	cnt := 0
+	for _, tgtUnit := range boxUnits {
+		if tgtUnit.UnitStatus != "approved" {
+			svc.logInfo(js, fmt.Sprintf("skipping unit %d with status [%s]", tgtUnit.ID, tgtUnit.UnitStatus))
+			continue
+		}
+		unitIngestFrom := extractBondImageFolder(&tgtUnit)
+		if unitIngestFrom == "" {
+			svc.logInfo(js, fmt.Sprintf("skipping unit %d that does not have source image folder in special instructions", tgtUnit.ID))
+			continue
 		}
 
-		cnt := 0
-		for _, tgtUnit := range boxUnits {
-			if tgtUnit.UnitStatus != "approved" {
-				svc.logInfo(js, fmt.Sprintf("skipping unit %d with status [%s]", tgtUnit.ID, tgtUnit.UnitStatus))
-				continue
-			}
-			unitIngestFrom := extractBondImageFolder(&tgtUnit)
-			if unitIngestFrom == "" {
-				svc.logInfo(js, fmt.Sprintf("skipping unit %d that does not have source image folder in special instructions", tgtUnit.ID))
+		if tgtFolder != "" {
+			tgtIngestFrom := fmt.Sprintf("mss13347-b%s-f%s", tgtBox, tgtFolder)
+			if unitIngestFrom != tgtIngestFrom {
 				continue
 			}
+		}
 
-			if tgtFolder != "" {
-				tgtIngestFrom := fmt.Sprintf("mss13347-b%s-f%s", tgtBox, tgtFolder)
-				if unitIngestFrom != tgtIngestFrom {
-					continue
-				}
-			}
+		srcDir := path.Join(bondRoot, fmt.Sprintf("Box %s", tgtBox), unitIngestFrom, "TIFF")
+		svc.logInfo(js, fmt.Sprintf("ingest folder %s into unit %d", srcDir, tgtUnit.ID))
+		if pathExists(srcDir) == false {
+			svc.logError(js, fmt.Sprintf("image source dir %s does not exist", srcDir))
+			continue
+		}
 
-			srcDir := path.Join(bondRoot, fmt.Sprintf("Box %s", tgtBox), unitIngestFrom, "TIFF")
-			svc.logInfo(js, fmt.Sprintf("ingest folder %s into unit %d", srcDir, tgtUnit.ID))
-			if pathExists(srcDir) == false {
-				svc.logError(js, fmt.Sprintf("image source dir %s does not exist", srcDir))
+		srcImages := extractBondUnitImageList(&tgtUnit)
+		mfPageNum := 0
+		for _, imgFN := range srcImages {
+			mfPageNum++
+			srcImg := path.Join(srcDir, strings.TrimSpace(imgFN))
+			svc.logInfo(js, fmt.Sprintf("ingest %s", srcImg))
+			if pathExists(srcImg) == false {
+				svc.logError(js, fmt.Sprintf("image %s does not exist", srcImg))
 				continue
 			}
 
-			srcImages := extractBondUnitImageList(&tgtUnit)
-			mfPageNum := 0
-			for _, imgFN := range srcImages {
-				mfPageNum++
-				srcImg := path.Join(srcDir, strings.TrimSpace(imgFN))
-				svc.logInfo(js, fmt.Sprintf("ingest %s", srcImg))
-				if pathExists(srcImg) == false {
-					svc.logError(js, fmt.Sprintf("image %s does not exist", srcImg))
-					continue
+			tsMasterFileName := fmt.Sprintf("%09d_%04d.tif", tgtUnit.ID, mfPageNum)
+			newMF, err := svc.loadMasterFile(tsMasterFileName)
+			if err != nil {
+				svc.logError(js, fmt.Sprintf("error loading masterfile %s: %s", tsMasterFileName, err.Error()))
+				continue
+			}
+			if newMF.ID == 0 {
+				svc.logInfo(js, fmt.Sprintf("Create new master file %s", tsMasterFileName))
+				newMD5 := md5Checksum(srcImg)
+				newFileSize := getFileSize(srcImg)
+				desc := ""
+				if mfPageNum == 1 {
+					desc = tgtUnit.StaffNotes
 				}
-
-				tsMasterFileName := fmt.Sprintf("%09d_%04d.tif", tgtUnit.ID, mfPageNum)
-				newMF, err := svc.loadMasterFile(tsMasterFileName)
+				newMF = &masterFile{UnitID: tgtUnit.ID, MetadataID: tgtUnit.MetadataID, Filename: tsMasterFileName,
+					Filesize: newFileSize, MD5: newMD5, Title: fmt.Sprintf("%d", mfPageNum), Description: desc}
+				err = svc.GDB.Create(&newMF).Error
 				if err != nil {
-					svc.logError(js, fmt.Sprintf("error loading masterfile %s: %s", tsMasterFileName, err.Error()))
+					svc.logError(js, fmt.Sprintf("unable to create masterfile %s: %s", tsMasterFileName, err.Error()))
 					continue
 				}
-				if newMF.ID == 0 {
-					svc.logInfo(js, fmt.Sprintf("Create new master file %s", tsMasterFileName))
-					newMD5 := md5Checksum(srcImg)
-					newFileSize := getFileSize(srcImg)
-					desc := ""
-					if mfPageNum == 1 {
-						desc = tgtUnit.StaffNotes
-					}
-					newMF = &masterFile{UnitID: tgtUnit.ID, MetadataID: tgtUnit.MetadataID, Filename: tsMasterFileName,
-						Filesize: newFileSize, MD5: newMD5, Title: fmt.Sprintf("%d", mfPageNum), Description: desc}
-					err = svc.GDB.Create(&newMF).Error
-					if err != nil {
-						svc.logError(js, fmt.Sprintf("unable to create masterfile %s: %s", tsMasterFileName, err.Error()))
-						continue
-					}
-				} else {
-					svc.logInfo(js, fmt.Sprintf("master file %s already exists", tsMasterFileName))
-				}
+			} else {
+				svc.logInfo(js, fmt.Sprintf("master file %s already exists", tsMasterFileName))
+			}
 
-				if newMF.ImageTechMeta.ID == 0 {
-					svc.logInfo(js, "Create image tech metadata")
-					err = svc.createImageTechMetadata(newMF, srcImg)
-					if err != nil {
-						svc.logError(js, fmt.Sprintf("Unable to create image tech metadata: %s", err.Error()))
-					}
-				} else {
-					svc.logInfo(js, "Image tech metadata already exists")
+			if newMF.ImageTechMeta.ID == 0 {
+				svc.logInfo(js, "Create image tech metadata")
+				err = svc.createImageTechMetadata(js, newMF, srcImg)
+				if err != nil {
+					svc.logError(js, fmt.Sprintf("Unable to create image tech metadata: %s", err.Error()))
 				}
+			} else {
+				svc.logInfo(js, "Image tech metadata already exists")
+			}
 
-				if len(newMF.Locations) == 0 {
-					var tgtLoc *location
-					bits := strings.Split(unitIngestFrom, "-")
-					unitFolder := strings.Replace(bits[len(bits)-1], "f", "", 1)
-					for _, loc := range tgtMD.Locations {
-						if loc.ContainerID == tgtBox && loc.FolderID == unitFolder {
-							tgtLoc = &loc
-							break
-						}
+			if len(newMF.Locations) == 0 {
+				var tgtLoc *location
+				bits := strings.Split(unitIngestFrom, "-")
+				unitFolder := strings.Replace(bits[len(bits)-1], "f", "", 1)
+				for _, loc := range tgtMD.Locations {
+					if loc.ContainerID == tgtBox && loc.FolderID == unitFolder {
+						tgtLoc = &loc
+						break
 					}
-					if tgtLoc == nil {
-						svc.logError(js, fmt.Sprintf("location record not found for %s", unitIngestFrom))
-					} else {
-						err = svc.GDB.Exec("INSERT into master_file_locations (master_file_id, location_id) values (?,?)", newMF.ID, tgtLoc.ID).Error
-						if err != nil {
-							svc.logError(js, fmt.Sprintf("Unable to link location %d to masterfile %d: %s", tgtLoc.ID, newMF.ID, err.Error()))
-						}
-					}
-				} else {
-					svc.logInfo(js, "Masterfile already has location info")
 				}
-
-				err = svc.publishToIIIF(js, newMF, srcImg, false)
-				if err != nil {
-					svc.logError(js, fmt.Sprintf("Unable to publish masterfile %d to IIIF: %s", newMF.ID, err.Error()))
-				}
-
-				archiveMD5, err := svc.archiveFile(js, srcImg, tgtUnit.ID, newMF)
-				if err != nil {
-					svc.logError(js, fmt.Sprintf("Unable to archive masterfile %d %s: %s", newMF.ID, srcImg, err.Error()))
+				if tgtLoc == nil {
+					svc.logError(js, fmt.Sprintf("location record not found for %s", unitIngestFrom))
 				} else {
-					if archiveMD5 != newMF.MD5 {
-						svc.logError(js, fmt.Sprintf("Archive MD5 does not match source MD5 for masterfile %d", newMF.ID))
+					err = svc.GDB.Exec("INSERT into master_file_locations (master_file_id, location_id) values (?,?)", newMF.ID, tgtLoc.ID).Error
+					if err != nil {
+						svc.logError(js, fmt.Sprintf("Unable to link location %d to masterfile %d: %s", tgtLoc.ID, newMF.ID, err.Error()))
 					}
 				}
+			} else {
+				svc.logInfo(js, "Masterfile already has location info")
+			}
+
+			err = svc.publishToIIIF(js, newMF, srcImg, false)
+			if err != nil {
+				svc.logError(js, fmt.Sprintf("Unable to publish masterfile %d to IIIF: %s", newMF.ID, err.Error()))
 			}
-			if len(srcImages) != mfPageNum {
-				svc.logError(js, fmt.Sprintf("Masterfile count mismatch for unit %d: %d images vs %d masterfiles", tgtUnit.ID, len(srcImages), mfPageNum))
+
+			archiveMD5, err := svc.archiveFile(js, srcImg, tgtUnit.ID, newMF)
+			if err != nil {
+				svc.logError(js, fmt.Sprintf("Unable to archive masterfile %d %s: %s", newMF.ID, srcImg, err.Error()))
 			} else {
-				svc.logInfo(js, fmt.Sprintf("Unit %d ingested; marking complete", tgtMD.ID))
-				now := time.Now()
-				tgtUnit.DateArchived = &now
-				tgtUnit.UnitStatus = "done"
-				err = svc.GDB.Model(&tgtUnit).Select("DateArchived", "UnitStatus").Updates(tgtUnit).Error
-				if err != nil {
-					svc.logError(js, fmt.Sprintf("unable to update status of completed unit %d: %s", tgtUnit.ID, err.Error()))
+				if archiveMD5 != newMF.MD5 {
+					svc.logError(js, fmt.Sprintf("Archive MD5 does not match source MD5 for masterfile %d", newMF.ID))
 				}
 			}
-			cnt++
 		}
+		if len(srcImages) != mfPageNum {
+			svc.logError(js, fmt.Sprintf("Masterfile count mismatch for unit %d: %d images vs %d masterfiles", tgtUnit.ID, len(srcImages), mfPageNum))
+		} else {
+			svc.logInfo(js, fmt.Sprintf("Unit %d ingested; marking complete", tgtMD.ID))
+			now := time.Now()
+			tgtUnit.DateArchived = &now
+			tgtUnit.UnitStatus = "done"
+			err = svc.GDB.Model(&tgtUnit).Select("DateArchived", "UnitStatus").Updates(tgtUnit).Error
+			if err != nil {
+				svc.logError(js, fmt.Sprintf("unable to update status of completed unit %d: %s", tgtUnit.ID, err.Error()))
+			}
+		}
+		cnt++
+	}
 
-		svc.logInfo(js, fmt.Sprintf("%d units ingested", cnt))
-		svc.jobDone(js)
-	}()
-
-	c.String(http.StatusOK, fmt.Sprintf("ingestBondImages started; check tracksys job %d status for details\n", js.ID))
+	svc.logInfo(js, fmt.Sprintf("%d units ingested", cnt))
 	return nil
 }
 
-// generateBondMapping generate a CVS mapping for the bon project. Columns: original file, tracksys pid
+// generateBondMapping generate a CVS mapping for the bon project. Columns: original file, tracksys pid.
+// The CSV is written to bondpapers/bond-mapping-[orderID].csv in the processing directory
 // params:
 //   - orderID: the target TS order ID. By default, all units will be exported
 //   - box: (OPTIONAL) which box of images use
 //   - folder: (OPTIONAL) which folder to export
 //
 // EXAMPLE: curl -X POST https://dpg-jobs.lib.virginia.edu/script -H "Content-Type: application/json" --data '{"computeID": "lf6f", "name": "generateBondMapping", "params": {"orderID": 12288, "box": "9"}}'
-func (svc *ServiceContext) generateBondMapping(c *gin.Context, js *jobStatus, params map[string]any) error {
+func (svc *ServiceContext) generateBondMapping(js *jobStatus, params map[string]any) error {
 	svc.logInfo(js, "start script to export a bond to tracksys mapping csv")
 	rawOrderID, found := params["orderID"].(float64)
 	if found == false {
@@ -480,8 +449,14 @@ func (svc *ServiceContext) generateBondMapping(c *gin.Context, js *jobStatus, pa
 		}
 	}
 
-	c.Header("Content-Type", "text/csv")
-	cw := csv.NewWriter(c.Writer)
+	csvPath := path.Join(svc.ProcessingDir, "bondpapers", fmt.Sprintf("bond-mapping-%d.csv", tgtOrder.ID))
+	svc.logInfo(js, fmt.Sprintf("write mapping to %s", csvPath))
+	csvFile, err := os.Create(csvPath)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %s", csvPath, err.Error())
+	}
+	defer csvFile.Close()
+	cw := csv.NewWriter(csvFile)
 	csvHead := []string{"original file", "tracksys pid"}
 	cw.Write(csvHead)
 	cnt := 0
@@ -512,9 +487,8 @@ func (svc *ServiceContext) generateBondMapping(c *gin.Context, js *jobStatus, pa
 		}
 		cnt++
 	}
-	svc.logInfo(js, fmt.Sprintf("%d unit mappings exported", cnt))
-	svc.jobDone(js)
 	cw.Flush()
+	svc.logInfo(js, fmt.Sprintf("%d unit mappings exported to %s", cnt, csvPath))
 
 	return nil
 }
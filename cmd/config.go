@@ -7,11 +7,12 @@ import (
 
 // DBConfig wraps up all of the DB configuration
 type DBConfig struct {
-	Host string
-	Port int
-	User string
-	Pass string
-	Name string
+	Host    string
+	Port    int
+	User    string
+	Pass    string
+	Name    string
+	Migrate bool
 }
 
 // SMTPConfig wraps up all of the smpt configuration
@@ -24,11 +25,22 @@ type SMTPConfig struct {
 	FakeSMTP bool
 }
 
-// IIIFConfig contains the all config for IIIF; manifest, staging and S3
+// IIIFConfig contains the all config for IIIF; manifest, staging and image storage
 type IIIFConfig struct {
-	StagingDir  string
-	Bucket      string
-	ManifestURL string
+	StagingDir       string
+	Storage          string
+	Bucket           string
+	StorageDir       string
+	ManifestURL      string
+	ManifestStoreURL string
+	ImageURL         string
+}
+
+// AuditConfig contains the daily throughput of the rolling fixity audit. It is disabled when both limits are zero.
+type AuditConfig struct {
+	FilesPerDay int
+	GBPerDay    float64
+	Email       string
 }
 
 // ArchivesSpaceConfig contains the configuration data for AS
@@ -72,14 +84,20 @@ type ServiceConfig struct {
 	ProcessingDir string
 	DeliveryDir   string
 	APTrust       APTrustConfig
+	Audit         AuditConfig
 	HathiTrust    HathiTrustConfig
 	ArchivesSpace ArchivesSpaceConfig
 	TrackSys      TrackSysConfig
 	ReindexURL    string
 	XMLReindexURL string
 	OcrURL        string
+	OcrTimeout    int
+	OcrEngine     string
 	PdfURL        string
 	ServiceURL    string
+	JobWorkers    int
+	JP2Workers    int
+	QARulesFile   string
 }
 
 // LoadConfiguration will load the service configuration from the commandline
@@ -89,18 +107,28 @@ func LoadConfiguration() *ServiceConfig {
 	var cfg ServiceConfig
 	flag.IntVar(&cfg.Port, "port", 8080, "API service port (default 8080)")
 	flag.StringVar(&cfg.ServiceURL, "service", "", "This service base URL")
+	flag.IntVar(&cfg.JobWorkers, "workers", 4, "Number of concurrent background job workers")
+	flag.IntVar(&cfg.JP2Workers, "jp2workers", 5, "Number of concurrent JP2 conversions across all jobs")
 
 	// working directories
 	flag.StringVar(&cfg.ArchiveDir, "archive", "", "Archive directory")
 	flag.StringVar(&cfg.DeliveryDir, "delivery", "", "Delivery directory")
 	flag.StringVar(&cfg.ProcessingDir, "work", "", "Processing directory")
+	flag.StringVar(&cfg.QARulesFile, "qarules", "", "JSON file with finalization QA rules (optional)")
 
 	// other external services
 	flag.StringVar(&cfg.XMLReindexURL, "xmlreindex", "https://virgo4-image-tracksys-reprocess-ws.internal.lib.virginia.edu/api/reindex", "XML reindex webhook")
 	flag.StringVar(&cfg.ReindexURL, "reindex", "https://virgo4-sirsi-cache-reprocess-ws.internal.lib.virginia.edu", "Reindex URL")
 	flag.StringVar(&cfg.OcrURL, "ocr", "http://docker1.lib.virginia.edu:8389/ocr", "OCR service URL")
+	flag.IntVar(&cfg.OcrTimeout, "ocrtimeout", 720, "Minutes to wait for an OCR callback before failing the job")
+	flag.StringVar(&cfg.OcrEngine, "ocrengine", "remote", "OCR engine for finalization and HathiTrust packaging; remote or local (with coordinates)")
 	flag.StringVar(&cfg.PdfURL, "pdf", "https://pdfservice.lib.virginia.edu/pdf", "PDF service URL")
 
+	// rolling fixity audit
+	flag.IntVar(&cfg.Audit.FilesPerDay, "auditfiles", 0, "Master files per day to re-verify in the rolling fixity audit; 0 for no file limit")
+	flag.Float64Var(&cfg.Audit.GBPerDay, "auditgb", 0, "GB of master files per day to re-verify in the rolling fixity audit; 0 for no size limit")
+	flag.StringVar(&cfg.Audit.Email, "auditemail", "", "Recipient of the weekly rolling fixity audit summary")
+
 	// ArchivesSpace
 	flag.StringVar(&cfg.ArchivesSpace.User, "asuser", "", "ArchivesSpace user")
 	flag.StringVar(&cfg.ArchivesSpace.Pass, "aspass", "", "ArchivesSpace password")
@@ -126,8 +154,12 @@ func LoadConfiguration() *ServiceConfig {
 
 	// IIIF (buckets:  iiif-assets iiif-assets-staging)
 	flag.StringVar(&cfg.IIIF.ManifestURL, "iiifman", "https://iiifman.lib.virginia.edu", "IIIF manifest URL")
+	flag.StringVar(&cfg.IIIF.ManifestStoreURL, "iiifmanstore", "", "Public URL of the IIIF storage that published manifests are served from; defaults to iiifman")
+	flag.StringVar(&cfg.IIIF.ImageURL, "iiifimage", "https://iiif.lib.virginia.edu/iiif", "IIIF image server URL used in generated manifests")
 	flag.StringVar(&cfg.IIIF.StagingDir, "iiifstage", "", "IIIF JP2 image statging directory")
+	flag.StringVar(&cfg.IIIF.Storage, "iiifstore", "s3", "IIIF image storage type; s3 or file")
 	flag.StringVar(&cfg.IIIF.Bucket, "iiifbucket", "iiif-assets", "S3 bucket for IIIF asset storage")
+	flag.StringVar(&cfg.IIIF.StorageDir, "iiifdir", "", "Directory for IIIF asset storage when iiifstore is file")
 
 	// SMTP
 	flag.BoolVar(&cfg.SMTP.FakeSMTP, "stubsmtp", false, "Log email insted of sending (dev mode)")
@@ -141,6 +173,7 @@ func LoadConfiguration() *ServiceConfig {
 	flag.StringVar(&cfg.DB.Host, "dbhost", "", "Database host")
 	flag.IntVar(&cfg.DB.Port, "dbport", 3306, "Database port")
 	flag.StringVar(&cfg.DB.Name, "dbname", "", "Database name")
+	flag.BoolVar(&cfg.DB.Migrate, "dbmigrate", false, "Create or update the job service tables in the TrackSys database at startup")
 	flag.StringVar(&cfg.DB.User, "dbuser", "", "Database user")
 	flag.StringVar(&cfg.DB.Pass, "dbpass", "", "Database password")
 
@@ -167,12 +200,33 @@ func LoadConfiguration() *ServiceConfig {
 	if cfg.IIIF.ManifestURL == "" {
 		log.Fatal("Parameter iiifman is required")
 	}
+	if cfg.IIIF.ManifestStoreURL == "" {
+		cfg.IIIF.ManifestStoreURL = cfg.IIIF.ManifestURL
+	}
 	if cfg.ProcessingDir == "" {
 		log.Fatal("Parameter work is required")
 	}
 	if cfg.ServiceURL == "" {
 		log.Fatal("Parameter service is required")
 	}
+	if cfg.JobWorkers < 1 {
+		log.Fatal("Parameter workers must be at least 1")
+	}
+	if cfg.JP2Workers < 1 {
+		log.Fatal("Parameter jp2workers must be at least 1")
+	}
+	if cfg.OcrTimeout < 1 {
+		log.Fatal("Parameter ocrtimeout must be at least 1")
+	}
+	if cfg.OcrEngine != "local" && cfg.OcrEngine != "remote" {
+		log.Fatal("Parameter ocrengine must be local or remote")
+	}
+	if cfg.Audit.FilesPerDay < 0 || cfg.Audit.GBPerDay < 0 {
+		log.Fatal("Parameters auditfiles and auditgb cannot be negative")
+	}
+	if (cfg.Audit.FilesPerDay > 0 || cfg.Audit.GBPerDay > 0) && cfg.Audit.Email == "" {
+		log.Fatal("Parameter auditemail is required for the rolling fixity audit")
+	}
 	if cfg.ArchivesSpace.User == "" {
 		log.Fatal("Parameter asuser is required")
 	}
@@ -191,6 +245,12 @@ func LoadConfiguration() *ServiceConfig {
 	if cfg.IIIF.StagingDir == "" {
 		log.Fatal("Parameter iiifstaging is required")
 	}
+	if cfg.IIIF.Storage != "s3" && cfg.IIIF.Storage != "file" {
+		log.Fatal("Parameter iiifstore must be s3 or file")
+	}
+	if cfg.IIIF.Storage == "file" && cfg.IIIF.StorageDir == "" {
+		log.Fatal("Parameter iiifdir is required for file iiif storage")
+	}
 	if cfg.TrackSys.JWTKey == "" {
 		log.Fatal("Parameter jwtkey is required")
 	}
@@ -203,22 +263,35 @@ func LoadConfiguration() *ServiceConfig {
 
 	log.Printf("[CONFIG] port          = [%d]", cfg.Port)
 	log.Printf("[CONFIG] service       = [%s]", cfg.ServiceURL)
+	log.Printf("[CONFIG] workers       = [%d]", cfg.JobWorkers)
+	log.Printf("[CONFIG] jp2workers    = [%d]", cfg.JP2Workers)
 	log.Printf("[CONFIG] dbhost        = [%s]", cfg.DB.Host)
 	log.Printf("[CONFIG] dbport        = [%d]", cfg.DB.Port)
 	log.Printf("[CONFIG] dbname        = [%s]", cfg.DB.Name)
+	log.Printf("[CONFIG] dbmigrate     = [%t]", cfg.DB.Migrate)
 	log.Printf("[CONFIG] dbuser        = [%s]", cfg.DB.User)
 	log.Printf("[CONFIG] archive       = [%s]", cfg.ArchiveDir)
 	log.Printf("[CONFIG] delivery      = [%s]", cfg.DeliveryDir)
 	log.Printf("[CONFIG] iiifman       = [%s]", cfg.IIIF.ManifestURL)
+	log.Printf("[CONFIG] iiifmanstore  = [%s]", cfg.IIIF.ManifestStoreURL)
+	log.Printf("[CONFIG] iiifimage     = [%s]", cfg.IIIF.ImageURL)
 	log.Printf("[CONFIG] iiifstaging   = [%s]", cfg.IIIF.StagingDir)
+	log.Printf("[CONFIG] iiifstore     = [%s]", cfg.IIIF.Storage)
 	log.Printf("[CONFIG] iiifbucket    = [%s]", cfg.IIIF.Bucket)
+	log.Printf("[CONFIG] iiifdir       = [%s]", cfg.IIIF.StorageDir)
 	log.Printf("[CONFIG] work          = [%s]", cfg.ProcessingDir)
+	log.Printf("[CONFIG] qarules       = [%s]", cfg.QARulesFile)
 	log.Printf("[CONFIG] reindex       = [%s]", cfg.ReindexURL)
 	log.Printf("[CONFIG] xmlreindex    = [%s]", cfg.XMLReindexURL)
 	log.Printf("[CONFIG] ocr           = [%s]", cfg.OcrURL)
+	log.Printf("[CONFIG] ocrtimeout    = [%d]", cfg.OcrTimeout)
+	log.Printf("[CONFIG] ocrengine     = [%s]", cfg.OcrEngine)
 	log.Printf("[CONFIG] pdf           = [%s]", cfg.PdfURL)
 	log.Printf("[CONFIG] tsapi         = [%s]", cfg.TrackSys.API)
 	log.Printf("[CONFIG] tsimaging     = [%s]", cfg.TrackSys.Imaging)
+	log.Printf("[CONFIG] auditfiles    = [%d]", cfg.Audit.FilesPerDay)
+	log.Printf("[CONFIG] auditgb       = [%.2f]", cfg.Audit.GBPerDay)
+	log.Printf("[CONFIG] auditemail    = [%s]", cfg.Audit.Email)
 	log.Printf("[CONFIG] asuser        = [%s]", cfg.ArchivesSpace.User)
 	log.Printf("[CONFIG] htftps        = [%s]", cfg.HathiTrust.FTPS)
 	log.Printf("[CONFIG] htuser        = [%s]", cfg.HathiTrust.User)
@@ -8,7 +8,6 @@ import (
 	"os"
 	"os/exec"
 	"path"
-	"runtime/debug"
 	"strconv"
 	"strings"
 	"time"
@@ -84,58 +83,79 @@ func (svc *ServiceContext) exportCollection(c *gin.Context) {
 		return
 	}
 
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("ERROR: Panic recovered: %v", r)
-				debug.PrintStack()
-				svc.logFatal(js, fmt.Sprintf("Panic recovered during collection %d export: %v", collectionMetadataID, r))
-			}
-		}()
+	err = svc.enqueueJob(js, "CollectionExport", collectionExportRequest{CollectionMetadataID: collectionMetadataID, CollectionID: collectionID, ExportDir: exportBaseDir})
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		svc.logInfo(js, fmt.Sprintf("Export collection %s to %s", collectionID, exportBaseDir))
-		out := metadataToJSON(&collRec)
+	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+}
 
-		svc.logInfo(js, fmt.Sprintf("Load child records for %d to begin export process", collectionMetadataID))
-		var collRecs []metadata
-		err = svc.GDB.Preload("Locations").Preload("ExternalSystem").Where("parent_metadata_id=?", collectionMetadataID).Find(&collRecs).Error
-		if err != nil {
-			svc.logFatal(js, fmt.Sprintf("Unable to load child metadata records for collection %d: %s", collectionMetadataID, err.Error()))
-			return
-		}
+type collectionExportRequest struct {
+	CollectionMetadataID int64
+	CollectionID         string
+	ExportDir            string
+}
 
-		svc.logInfo(js, fmt.Sprintf("Collection collection %s has %d children", collectionID, len(collRecs)))
-		for _, md := range collRecs {
-			svc.logInfo(js, fmt.Sprintf("Process child %s", md.PID))
-			jsonRec := metadataToJSON(&md)
-			out.Children = append(out.Children, jsonRec)
+func (svc *ServiceContext) runExportCollection(js *jobStatus, payload []byte) error {
+	var req collectionExportRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid CollectionExport payload: %s", err.Error())
+	}
+	collectionMetadataID := req.CollectionMetadataID
+	collectionID := req.CollectionID
+	exportBaseDir := req.ExportDir
 
-			err = svc.exportMasterFiles(js, &md, exportBaseDir)
-			if err != nil {
-				svc.logFatal(js, fmt.Sprintf("Download images for %s failed: %s", md.PID, err.Error()))
-				return
-			}
-		}
+	var collRec metadata
+	err = svc.GDB.Preload("Locations").Preload("ExternalSystem").First(&collRec, collectionMetadataID).Error
+	if err != nil {
+		return fmt.Errorf("get collection %d failed: %s", collectionMetadataID, err.Error())
+	}
 
-		svc.logInfo(js, "Convert metadata to json")
-		metadataBytes, err := json.MarshalIndent(out, "", "   ")
-		if err != nil {
-			svc.logFatal(js, err.Error())
-			return
-		}
+	svc.logInfo(js, fmt.Sprintf("Export collection %s to %s", collectionID, exportBaseDir))
+	out := metadataToJSON(&collRec)
 
-		metadataFileName := path.Join(exportBaseDir, "metadata.json")
-		svc.logInfo(js, fmt.Sprintf("Write json netadata to %s", metadataFileName))
-		err = os.WriteFile(metadataFileName, metadataBytes, 0644)
+	svc.logInfo(js, fmt.Sprintf("Load child records for %d to begin export process", collectionMetadataID))
+	var collRecs []metadata
+	err = svc.GDB.Preload("Locations").Preload("ExternalSystem").Where("parent_metadata_id=?", collectionMetadataID).Find(&collRecs).Error
+	if err != nil {
+		svc.logFatal(js, fmt.Sprintf("Unable to load child metadata records for collection %d: %s", collectionMetadataID, err.Error()))
+		return nil
+	}
+
+	svc.logInfo(js, fmt.Sprintf("Collection collection %s has %d children", collectionID, len(collRecs)))
+	for _, md := range collRecs {
+		svc.logInfo(js, fmt.Sprintf("Process child %s", md.PID))
+		jsonRec := metadataToJSON(&md)
+		out.Children = append(out.Children, jsonRec)
+
+		err = svc.exportMasterFiles(js, &md, exportBaseDir)
 		if err != nil {
-			svc.logFatal(js, fmt.Sprintf("Unable to write metadata file %s: %s", metadataFileName, err.Error()))
-			return
+			svc.logFatal(js, fmt.Sprintf("Download images for %s failed: %s", md.PID, err.Error()))
+			return nil
 		}
+	}
 
-		svc.jobDone(js)
-	}()
+	svc.logInfo(js, "Convert metadata to json")
+	metadataBytes, err := json.MarshalIndent(out, "", "   ")
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		return nil
+	}
 
-	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+	metadataFileName := path.Join(exportBaseDir, "metadata.json")
+	svc.logInfo(js, fmt.Sprintf("Write json netadata to %s", metadataFileName))
+	err = os.WriteFile(metadataFileName, metadataBytes, 0644)
+	if err != nil {
+		svc.logFatal(js, fmt.Sprintf("Unable to write metadata file %s: %s", metadataFileName, err.Error()))
+		return nil
+	}
+
+	svc.jobDone(js)
+	return nil
 }
 
 func (svc *ServiceContext) exportMasterFiles(js *jobStatus, md *metadata, exportBaseDir string) error {
@@ -160,11 +180,11 @@ func (svc *ServiceContext) exportMasterFiles(js *jobStatus, md *metadata, export
 		if pathExists(archiveFile) == false {
 			return fmt.Errorf("%s not found", archiveFile)
 		}
-		origMD5 := md5Checksum(archiveFile)
-		md5, err := copyFile(archiveFile, destFile, 0744)
+		origMD5, err := copyFile(archiveFile, destFile, 0744)
 		if err != nil {
 			return fmt.Errorf("copy %s to %s failed: %s", archiveFile, destFile, err.Error())
 		}
+		md5 := md5Checksum(destFile)
 		if md5 != origMD5 {
 			return fmt.Errorf("copy %s MD5 checksum %s does not match original %s", destFile, md5, origMD5)
 		}
@@ -180,7 +200,7 @@ func (svc *ServiceContext) exportMasterFiles(js *jobStatus, md *metadata, export
 		}
 	}
 	cmdArray := []string{"cf", destTar, "-C", exportBaseDir, mdSubdir}
-	cmd := exec.Command("tar", cmdArray...)
+	cmd := exec.CommandContext(js.context(), "tar", cmdArray...)
 	svc.logInfo(js, fmt.Sprintf("%+v", cmd))
 	_, err = cmd.Output()
 	if err != nil {
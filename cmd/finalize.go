@@ -1,19 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"path"
-	"path/filepath"
-	"regexp"
 	"runtime/debug"
-	"sort"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 func (svc *ServiceContext) finalizeUnit(c *gin.Context) {
@@ -39,6 +38,13 @@ func (svc *ServiceContext) finalizeUnit(c *gin.Context) {
 		c.String(http.StatusBadRequest, "Unit is already finalizing")
 		return
 	}
+	var queuedCnt int64
+	svc.GDB.Model(&jobStatus{}).Where("originator_type=? and originator_id=? and name=? and status=?", "Unit", unitID, "FinalizeUnit", "pending").Count(&queuedCnt)
+	if queuedCnt > 0 {
+		svc.logFatal(js, "Unit is already queued for finalization.")
+		c.String(http.StatusBadRequest, "Unit is already queued for finalization")
+		return
+	}
 	if tgtUnit.Reorder {
 		svc.logFatal(js, "Unit is a re-order and should not be finalized.")
 		c.String(http.StatusBadRequest, "Unit is a re-order and should not be finalized")
@@ -52,123 +58,253 @@ func (svc *ServiceContext) finalizeUnit(c *gin.Context) {
 	}
 	svc.logInfo(js, fmt.Sprintf("Unit %d %s finalization", unitID, act))
 
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("ERROR: Panic recovered: %v", r)
-				debug.PrintStack()
-				svc.setUnitFatal(js, &tgtUnit, fmt.Sprintf("%v", r))
-			}
-		}()
+	err = svc.enqueueJob(js, "FinalizeUnit", unitJobRequest{UnitID: unitID})
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		svc.logInfo(js, "Check for presence of finalization directory")
-		srcDir := path.Join(svc.ProcessingDir, "finalization", fmt.Sprintf("%09d", unitID))
-		if pathExists(srcDir) == false {
-			svc.setUnitFatal(js, &tgtUnit, fmt.Sprintf("Finalization directory %s does not exist.", srcDir))
-			return
-		}
+	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+}
 
-		if tgtUnit.UnitStatus == "approved" {
-			svc.GDB.Model(order{ID: tgtUnit.OrderID}).Update("date_finalization_begun", time.Now())
-			svc.logInfo(js, fmt.Sprintf("Date Finalization Begun updated for order %d", tgtUnit.OrderID))
-		} else if tgtUnit.UnitStatus != "error" {
-			svc.setUnitFatal(js, &tgtUnit, "Unit has not been approved.")
-			return
+// finalizeCheckpoint records the completion of a finalization stage for a unit. When a failed
+// finalization is restarted, stages with a checkpoint are skipped.
+type finalizeCheckpoint struct {
+	ID          int64
+	UnitID      int64 `gorm:"index"`
+	Stage       string
+	JobStatusID int64
+	StartedAt   time.Time
+	CompletedAt time.Time
+}
+
+// finalizeStage is one step of the finalization pipeline. A returned error fails finalization
+type finalizeStage struct {
+	name string
+	// needsSource is true for stages that work from the files in the finalization directory
+	needsSource bool
+	run         func(js *jobStatus, tgtUnit *unit, srcDir string) error
+}
+
+// getFinalizeStages returns the ordered list of finalization stages. The QA stages share the rules resolved for the unit.
+func (svc *ServiceContext) getFinalizeStages(qa unitQARules) []finalizeStage {
+	return []finalizeStage{
+		{name: "qaUnit", run: svc.finalizeQAUnit},
+		{name: "qaFilesystem", needsSource: true, run: func(js *jobStatus, tgtUnit *unit, srcDir string) error {
+			return svc.qaFilesystem(js, tgtUnit, srcDir, qa)
+		}},
+		{name: "validateTIFFs", needsSource: true, run: func(js *jobStatus, tgtUnit *unit, srcDir string) error {
+			return svc.validateTIFFs(js, srcDir, qa.rules)
+		}},
+		{name: "importImages", needsSource: true, run: svc.importImages},
+		{name: "ocr", run: svc.finalizeOCR},
+		{name: "publish", run: svc.finalizePublish},
+		{name: "deliverables", run: svc.finalizeDeliverables},
+		{name: "orderDelivery", run: svc.finalizeOrderDelivery},
+		{name: "complete", run: svc.finalizeComplete},
+	}
+}
+
+func (svc *ServiceContext) runFinalizeUnit(js *jobStatus, payload []byte) error {
+	var req unitJobRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid FinalizeUnit payload: %s", err.Error())
+	}
+	unitID := req.UnitID
+
+	var tgtUnit unit
+	err = svc.GDB.Preload("Metadata").Preload("Metadata.OcrHint").
+		Preload("Order").Preload("IntendedUse").First(&tgtUnit, unitID).Error
+	if err != nil {
+		return fmt.Errorf("unable to load unit %d: %s", unitID, err.Error())
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR: Panic recovered: %v", r)
+			debug.PrintStack()
+			svc.setUnitFatal(js, &tgtUnit, fmt.Sprintf("%v", r))
 		}
-		svc.setUnitStatus(&tgtUnit, "finalizing")
-		svc.logInfo(js, "Status set to finalizing")
+	}()
 
-		err = svc.qaUnit(js, &tgtUnit)
+	// a unit that is already finalizing here is one that was interrupted by a service restart.
+	// it, and units that previously failed, resume at the first stage without a checkpoint
+	completed := make(map[string]finalizeCheckpoint)
+	if tgtUnit.UnitStatus == "approved" {
+		svc.GDB.Where("unit_id=?", unitID).Delete(&finalizeCheckpoint{})
+	} else if tgtUnit.UnitStatus == "error" || tgtUnit.UnitStatus == "finalizing" {
+		var checkpoints []finalizeCheckpoint
+		err = svc.GDB.Where("unit_id=?", unitID).Find(&checkpoints).Error
 		if err != nil {
-			svc.setUnitFatal(js, &tgtUnit, err.Error())
-			return
+			svc.setUnitFatal(js, &tgtUnit, fmt.Sprintf("Unable to load finalization checkpoints: %s", err.Error()))
+			return nil
 		}
+		for _, cp := range checkpoints {
+			completed[cp.Stage] = cp
+		}
+	} else {
+		svc.setUnitFatal(js, &tgtUnit, "Unit has not been approved.")
+		return nil
+	}
 
-		err = svc.qaFilesystem(js, &tgtUnit, srcDir)
-		if err != nil {
-			svc.setUnitFatal(js, &tgtUnit, err.Error())
-			return
+	stages := svc.getFinalizeStages(svc.getUnitQARules(&tgtUnit))
+	srcDir := path.Join(svc.ProcessingDir, "finalization", fmt.Sprintf("%09d", unitID))
+	for _, stage := range stages {
+		if _, done := completed[stage.name]; done == false && stage.needsSource {
+			svc.logInfo(js, "Check for presence of finalization directory")
+			if pathExists(srcDir) == false {
+				svc.setUnitFatal(js, &tgtUnit, fmt.Sprintf("Finalization directory %s does not exist.", srcDir))
+				return nil
+			}
+			break
+		}
+	}
+
+	if tgtUnit.UnitStatus == "approved" {
+		svc.GDB.Model(order{ID: tgtUnit.OrderID}).Update("date_finalization_begun", time.Now())
+		svc.logInfo(js, fmt.Sprintf("Date Finalization Begun updated for order %d", tgtUnit.OrderID))
+	}
+	svc.setUnitStatus(&tgtUnit, "finalizing")
+	svc.logInfo(js, "Status set to finalizing")
+
+	finalizeStart := time.Now()
+	for idx, stage := range stages {
+		if cp, done := completed[stage.name]; done {
+			svc.logInfo(js, fmt.Sprintf("Stage %d/%d %s was completed by job %d at %s; skipping", idx+1, len(stages), stage.name,
+				cp.JobStatusID, cp.CompletedAt.Format("2006-01-02 03:04:05 PM")))
+			continue
+		}
+		if js.canceled() {
+			svc.setUnitFatal(js, &tgtUnit, fmt.Sprintf("Finalization canceled before stage %s", stage.name))
+			return nil
 		}
 
-		// Create all of the master files, publish to IIIF then archive the unit
-		err = svc.importImages(js, &tgtUnit, srcDir)
+		svc.logInfo(js, fmt.Sprintf("Stage %d/%d %s begins", idx+1, len(stages), stage.name))
+		stageStart := time.Now()
+		err = stage.run(js, &tgtUnit, srcDir)
+		if errors.Is(err, errJobWaiting) {
+			// the unit stays finalizing; the job resumes at this stage when the external work is done
+			svc.logInfo(js, fmt.Sprintf("Stage %d/%d %s is waiting on an external service", idx+1, len(stages), stage.name))
+			return err
+		}
 		if err != nil {
 			svc.setUnitFatal(js, &tgtUnit, err.Error())
-			return
+			return nil
 		}
 
-		// If OCR has been requested, do it AFTER archive (OCR requires tif to be in archive)
-		// but before deliverable generation (deliverables require OCR text to be present)
-		if tgtUnit.OcrMasterFiles {
-			err = svc.requestUnitOCR(js, tgtUnit.Metadata.PID, tgtUnit.ID, tgtUnit.Metadata.OcrLanguageHint)
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("Unable to request OCR: %s", err.Error()))
-			}
+		cp := finalizeCheckpoint{UnitID: unitID, Stage: stage.name, JobStatusID: js.ID, StartedAt: stageStart, CompletedAt: time.Now()}
+		err = svc.GDB.Create(&cp).Error
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("Unable to save checkpoint for stage %s: %s", stage.name, err.Error()))
 		}
+		svc.logInfo(js, fmt.Sprintf("Stage %d/%d %s completed in %.2f seconds", idx+1, len(stages), stage.name, cp.CompletedAt.Sub(stageStart).Seconds()))
+	}
+	svc.logInfo(js, fmt.Sprintf("All finalization stages completed in %.2f seconds", time.Since(finalizeStart).Seconds()))
 
-		// Is this item flagged for publication into Virgo?
-		if tgtUnit.IncludeInDL {
-			// NOTE: neither publish method will trigger a logFatal, but will log and return
-			// an error if one was encountered. Ignore it here as a problem publishing should
-			// not cause finalization to fail; the error log is enough.
-			switch tgtUnit.Metadata.Type {
-			case "SirsiMetadata":
-				svc.publishSirsiToVirgo(js, tgtUnit.Metadata, &tgtUnit)
-			case "XmlMetadata":
-				svc.publishXMLToVirgo(js, tgtUnit.Metadata, &tgtUnit)
-			default:
-				svc.logError(js, fmt.Sprintf("Unit is flagged for inclusion in DL, but metadata %d type %s is not supported", tgtUnit.Metadata.ID, tgtUnit.Metadata.Type))
-			}
-		}
+	// Cleanup any tmo directories and move unit to ready_to_delete, then end the outstanding job
+	svc.cleanupWorkDirectories(js, tgtUnit.ID)
+	svc.jobDone(js)
+	return nil
+}
 
-		// If desc is not digital collection building, create patron deliverables regardless of any other settings
-		if tgtUnit.IntendedUse.ID != 110 {
-			if tgtUnit.DatePatronDeliverablesReady == nil {
-				if tgtUnit.IntendedUse.DeliverableFormat == "pdf" {
-					err = svc.createPatronPDF(js, &tgtUnit)
-					if err != nil {
-						svc.setUnitFatal(js, &tgtUnit, fmt.Sprintf("Unable to create patron PDF: %s", err.Error()))
-						return
-					}
-				} else {
-					err = svc.zipPatronDeliverables(js, &tgtUnit)
-					if err != nil {
-						svc.setUnitFatal(js, &tgtUnit, fmt.Sprintf("Unable to create patron ZIP: %s", err.Error()))
-						return
-					}
-				}
+func (svc *ServiceContext) finalizeQAUnit(js *jobStatus, tgtUnit *unit, srcDir string) error {
+	return svc.qaUnit(js, tgtUnit)
+}
 
-				now := time.Now()
-				tgtUnit.DatePatronDeliverablesReady = &now
-				svc.GDB.Model(&tgtUnit).Select("DatePatronDeliverablesReady").Updates(tgtUnit)
-				svc.logInfo(js, "All patron deliverables created")
-			} else {
-				svc.logInfo(js, "Patron deliverables already generated")
-			}
+// finalizeOCR runs OCR if it has been flagged for the unit. This is done AFTER archive (OCR
+// requires tif to be in archive) but before deliverable generation (deliverables require OCR text to be present).
+// An OCR failure is logged but does not fail finalization.
+func (svc *ServiceContext) finalizeOCR(js *jobStatus, tgtUnit *unit, srcDir string) error {
+	if tgtUnit.OcrMasterFiles == false {
+		svc.logInfo(js, "OCR has not been requested")
+		return nil
+	}
+	engine := svc.getUnitOCREngine(js, tgtUnit.Metadata.OcrLanguageHint)
+	svc.logInfo(js, fmt.Sprintf("Use %s OCR engine", engine.name()))
+	err := engine.ocrUnit(js, tgtUnit)
+	if errors.Is(err, errJobWaiting) {
+		return err
+	}
+	if err != nil {
+		svc.logError(js, fmt.Sprintf("Unable to OCR unit: %s", err.Error()))
+		return nil
+	}
+	err = svc.generateUnitOCRQuality(js, tgtUnit.ID, tgtUnit.Metadata.OcrLanguageHint)
+	if err != nil {
+		svc.logError(js, fmt.Sprintf("Unable to check OCR quality: %s", err.Error()))
+	}
+	return nil
+}
 
-			// check for completeness, fees and generate manifest PDF. Same for all patron deliverables
-			err = svc.checkOrderReadyForDelivery(js, tgtUnit.OrderID)
-			if err != nil {
-				svc.setUnitFatal(js, &tgtUnit, err.Error())
-				return
-			}
-		}
+// finalizePublish publishes the unit to Virgo if it is flagged for inclusion in the DL
+func (svc *ServiceContext) finalizePublish(js *jobStatus, tgtUnit *unit, srcDir string) error {
+	if tgtUnit.IncludeInDL == false {
+		svc.logInfo(js, "Unit is not flagged for inclusion in the DL")
+		return nil
+	}
 
-		// At this point, finalization has completed and project (if it exists) can be validated.
-		// any project validation failures will fail the finalization job. for units that have no projects,
-		// finalization is done now and will be marked as successful. Note that only the ID is passed in. This
-		// forces the unit to be reloaded to pick up any changes that may have occurred during teh finalize
-		if err := svc.unitFinishedFinalization(js, tgtUnit.ID); err != nil {
-			svc.setUnitFatal(js, &tgtUnit, err.Error())
-			return
+	// NOTE: neither publish method will trigger a logFatal, but will log and return
+	// an error if one was encountered. Ignore it here as a problem publishing should
+	// not cause finalization to fail; the error log is enough.
+	switch tgtUnit.Metadata.Type {
+	case "SirsiMetadata":
+		svc.publishSirsiToVirgo(js, tgtUnit.Metadata, tgtUnit)
+	case "XmlMetadata":
+		svc.publishXMLToVirgo(js, tgtUnit.Metadata, tgtUnit)
+	default:
+		svc.logError(js, fmt.Sprintf("Unit is flagged for inclusion in DL, but metadata %d type %s is not supported", tgtUnit.Metadata.ID, tgtUnit.Metadata.Type))
+	}
+	return nil
+}
+
+// finalizeDeliverables creates patron deliverables for all units with an intended use that requires them;
+// by default that is everything but digital collection building
+func (svc *ServiceContext) finalizeDeliverables(js *jobStatus, tgtUnit *unit, srcDir string) error {
+	if svc.QARules.deliverablesRequired(tgtUnit) == false {
+		svc.logInfo(js, "Unit intended use does not require patron deliverables")
+		return nil
+	}
+	if tgtUnit.DatePatronDeliverablesReady != nil {
+		svc.logInfo(js, "Patron deliverables already generated")
+		return nil
+	}
+
+	if tgtUnit.IntendedUse.DeliverableFormat == "pdf" {
+		err := svc.createPatronPDF(js, tgtUnit)
+		if err != nil {
+			return fmt.Errorf("Unable to create patron PDF: %s", err.Error())
 		}
+	} else {
+		err := svc.zipPatronDeliverables(js, tgtUnit)
+		if err != nil {
+			return fmt.Errorf("Unable to create patron ZIP: %s", err.Error())
+		}
+	}
 
-		// Cleanup any tmo directories and move unit to ready_to_delete, then end the outstanding job
-		svc.cleanupWorkDirectories(js, tgtUnit.ID)
-		svc.jobDone(js)
-	}()
+	now := time.Now()
+	tgtUnit.DatePatronDeliverablesReady = &now
+	svc.GDB.Model(tgtUnit).Select("DatePatronDeliverablesReady").Updates(*tgtUnit)
+	svc.logInfo(js, "All patron deliverables created")
+	return nil
+}
 
-	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+// finalizeOrderDelivery checks for completeness, fees and generates the manifest PDF. Same for all patron deliverables
+func (svc *ServiceContext) finalizeOrderDelivery(js *jobStatus, tgtUnit *unit, srcDir string) error {
+	if svc.QARules.deliverablesRequired(tgtUnit) == false {
+		svc.logInfo(js, "Unit intended use does not require patron deliverables; no order delivery check needed")
+		return nil
+	}
+	return svc.checkOrderReadyForDelivery(js, tgtUnit.OrderID)
+}
+
+// finalizeComplete validates the project (if it exists). Any project validation failures will fail
+// the finalization job. For units that have no projects, finalization is done now and will be marked
+// as successful. Note that only the ID is passed in. This forces the unit to be reloaded to pick up
+// any changes that may have occurred during the finalize
+func (svc *ServiceContext) finalizeComplete(js *jobStatus, tgtUnit *unit, srcDir string) error {
+	return svc.unitFinishedFinalization(js, tgtUnit.ID)
 }
 
 func (svc *ServiceContext) setUnitFatal(js *jobStatus, tgtUnit *unit, errMsg string) {
@@ -215,6 +351,22 @@ func (svc *ServiceContext) setUnitStatus(tgtUnit *unit, status string) {
 	svc.GDB.Model(&tgtUnit).Select("UnitStatus").Updates(tgtUnit)
 }
 
+// qaIssue is a single problem found by the unit or filesystem QA checks
+type qaIssue struct {
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+// preflightResponse is the result of a finalization dry run
+type preflightResponse struct {
+	UnitID   int64          `json:"unitID"`
+	Passed   bool           `json:"passed"`
+	Failures []qaIssue      `json:"failures"`
+	Warnings []qaIssue      `json:"warnings"`
+	RuleSet  string         `json:"ruleSet"`
+	Rules    []qaRuleResult `json:"rules"`
+}
+
 func (svc *ServiceContext) qaUnit(js *jobStatus, tgtUnit *unit) error {
 	svc.logInfo(js, "QA unit data")
 
@@ -230,38 +382,9 @@ func (svc *ServiceContext) qaUnit(js *jobStatus, tgtUnit *unit) error {
 	}
 
 	hasFailures := false
-	svc.logInfo(js, "Verify availability policy")
-	if tgtUnit.IncludeInDL && tgtUnit.Metadata.AvailabilityPolicyID == 0 && tgtUnit.Metadata.Type != "ExternalMetadata" {
-		svc.logError(js, "Availability policy must be set for all units flagged for inclusion in the DL")
-		hasFailures = true
-	}
-
-	svc.logInfo(js, "Verify intended use")
-	if tgtUnit.IntendedUseID == nil {
-		svc.logError(js, "Unit has no intended use.  All units that participate in this workflow must have an intended use.")
-		hasFailures = true
-	}
-
-	// fail for no ocr hint or incompatible hint / ocr Settings
-	svc.logInfo(js, "Verify OCR settings")
-	if tgtUnit.Metadata.OcrHintID == 0 {
-		svc.logError(js, fmt.Sprintf("Unit metadata %d has no OCR Hint. This is a required setting.", *tgtUnit.MetadataID))
-		hasFailures = true
-	} else {
-		if tgtUnit.OcrMasterFiles {
-			if tgtUnit.Metadata.OcrHint.OcrCandidate == false {
-				svc.logError(js, "Unit is flagged to perform OCR, but the metadata setting indicates OCR is not possible.")
-				hasFailures = true
-			}
-			if tgtUnit.Metadata.OcrLanguageHint == "" {
-				svc.logError(js, "Unit is flagged to perform OCR, but the required language hint for metadata #{tgtUnit.metadata.id} is not set")
-				hasFailures = true
-			}
-		}
-	}
-
-	if tgtUnit.IncludeInDL && tgtUnit.ThrowAway {
-		svc.logError(js, "Throw away units cannot be flagged for publication to the DL.")
+	svc.logInfo(js, "Verify availability policy, intended use and OCR settings")
+	for _, issue := range unitQAFailures(tgtUnit) {
+		svc.logError(js, issue.Message)
 		hasFailures = true
 	}
 
@@ -286,101 +409,187 @@ func (svc *ServiceContext) qaUnit(js *jobStatus, tgtUnit *unit) error {
 	return nil
 }
 
+// unitQAFailures checks the unit settings that must be correct before finalization. The unit must have metadata.
+func unitQAFailures(tgtUnit *unit) []qaIssue {
+	out := make([]qaIssue, 0)
+	if tgtUnit.IncludeInDL && tgtUnit.Metadata.AvailabilityPolicyID == 0 && tgtUnit.Metadata.Type != "ExternalMetadata" {
+		out = append(out, qaIssue{Check: "availabilityPolicy", Message: "Availability policy must be set for all units flagged for inclusion in the DL"})
+	}
+
+	if tgtUnit.IntendedUseID == nil {
+		out = append(out, qaIssue{Check: "intendedUse", Message: "Unit has no intended use.  All units that participate in this workflow must have an intended use."})
+	}
+
+	// fail for no ocr hint or incompatible hint / ocr Settings
+	if tgtUnit.Metadata.OcrHintID == 0 {
+		out = append(out, qaIssue{Check: "ocrHint", Message: fmt.Sprintf("Unit metadata %d has no OCR Hint. This is a required setting.", *tgtUnit.MetadataID)})
+	} else if tgtUnit.OcrMasterFiles {
+		if tgtUnit.Metadata.OcrHint.OcrCandidate == false {
+			out = append(out, qaIssue{Check: "ocrHint", Message: "Unit is flagged to perform OCR, but the metadata setting indicates OCR is not possible."})
+		}
+		if tgtUnit.Metadata.OcrLanguageHint == "" {
+			out = append(out, qaIssue{Check: "ocrLanguage", Message: fmt.Sprintf("Unit is flagged to perform OCR, but the required language hint for metadata %d is not set", *tgtUnit.MetadataID)})
+		}
+	}
+
+	if tgtUnit.IncludeInDL && tgtUnit.ThrowAway {
+		out = append(out, qaIssue{Check: "throwAway", Message: "Throw away units cannot be flagged for publication to the DL."})
+	}
+	return out
+}
+
 func (svc *ServiceContext) autoPublish(js *jobStatus, tgtUnit *unit) {
 	svc.logInfo(js, "Checking unit for auto-publish")
-	if tgtUnit.CompleteScan == false {
-		svc.logInfo(js, "Unit is not a complete scan and cannot be auto-published")
+	canPublish, reason := svc.canAutoPublish(tgtUnit)
+	svc.logInfo(js, reason)
+	if canPublish == false {
 		return
 	}
 
+	if tgtUnit.Metadata.AvailabilityPolicyID == 0 {
+		tgtUnit.Metadata.AvailabilityPolicyID = 1
+		svc.GDB.Model(tgtUnit.Metadata).Select("AvailabilityPolicyID").Updates(*tgtUnit.Metadata)
+	}
+	tgtUnit.IncludeInDL = true
+	svc.GDB.Model(tgtUnit).Select("IncludeInDL").Updates(*tgtUnit)
+}
+
+// canAutoPublish determines if a unit is eligible for auto-publish and returns the reason
+func (svc *ServiceContext) canAutoPublish(tgtUnit *unit) (bool, string) {
+	if tgtUnit.CompleteScan == false {
+		return false, "Unit is not a complete scan and cannot be auto-published"
+	}
+
 	if tgtUnit.Metadata.IsManuscript || tgtUnit.Metadata.IsPersonalItem {
-		svc.logInfo(js, "Unit is for a manuscript or personal item and cannot be auto-published")
-		return
+		return false, "Unit is for a manuscript or personal item and cannot be auto-published"
 	}
 
 	if tgtUnit.Metadata.Type != "SirsiMetadata" {
-		svc.logInfo(js, "Unit metadata is not from Sirsi and cannot be auto-published")
-		return
+		return false, "Unit metadata is not from Sirsi and cannot be auto-published"
 	}
 
-	// Check publication year before 1923
+	// Check publication year before the cutoff (1923 by default)
+	cutoff := svc.QARules.AutoPublishCutoffYear
 	pubYear := svc.getMarcPublicationYear(tgtUnit.Metadata)
-	if pubYear != 0 && pubYear < 1923 {
-		svc.logInfo(js, "Unit is a candidate for auto-publishing")
-		if tgtUnit.Metadata.AvailabilityPolicyID == 0 {
-			tgtUnit.Metadata.AvailabilityPolicyID = 1
-			svc.GDB.Model(tgtUnit.Metadata).Select("AvailabilityPolicyID").Updates(*tgtUnit.Metadata)
+	if pubYear != 0 && pubYear < cutoff {
+		return true, "Unit is a candidate for auto-publishing"
+	}
+	return false, fmt.Sprintf("Unit has no date or a date after %d and cannot be auto-published", cutoff)
+}
+
+func (svc *ServiceContext) qaFilesystem(js *jobStatus, tgtUnit *unit, srcDir string, qa unitQARules) error {
+	svc.logInfo(js, fmt.Sprintf("QA filesystem using %s rules", qa.name))
+	results, err := svc.evaluateQARules(js.context(), tgtUnit, qa.rules, srcDir)
+	if err != nil {
+		return err
+	}
+	hasFailures := false
+	for _, res := range results {
+		if res.Passed {
+			svc.logInfo(js, fmt.Sprintf("Rule %s passed", res.Rule))
+			continue
 		}
-		tgtUnit.IncludeInDL = true
-		svc.GDB.Model(tgtUnit).Select("IncludeInDL").Updates(*tgtUnit)
-	} else {
-		svc.logInfo(js, "Unit has no date or a date after 1923 and cannot be auto-published")
+		hasFailures = true
+		for _, msg := range res.Failures {
+			svc.logError(js, msg)
+		}
+	}
+	if hasFailures {
+		return fmt.Errorf("Unit  has failed the Filesystem QA")
 	}
+	svc.logInfo(js, "Filesystem QA tests passed")
+	return nil
 }
 
-func (svc *ServiceContext) qaFilesystem(js *jobStatus, tgtUnit *unit, srcDir string) error {
-	svc.logInfo(js, "QA filesystem")
+// finalizePreflight runs the finalization QA checks against a unit without changing it, its order or
+// its publication settings. All failures and warnings are returned instead of being logged to a job.
+func (svc *ServiceContext) finalizePreflight(c *gin.Context) {
+	unitID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	log.Printf("INFO: finalization preflight for unit %d", unitID)
 
-	// Checking for:
-	// 1. Existence of TIF files.
-	// 2. The TIF sequence has no gaps and starts at 1.
-	// 3. All TIF files conform to the naming convention.
-	// 4. No file is less than 1MB (1MB being a size arbitrarily determined to represent a "too small" file)
-	// 5. No non-tif / non-txt files present
-	hasFailures := false
-	minSize := int64(1024 * 1024)
-	mfRegex := regexp.MustCompile(fmt.Sprintf(`^%09d_\w{4,}\.tif$`, tgtUnit.ID))
-	tifFiles := make([]string, 0)
-	err := filepath.Walk(srcDir, func(fPath string, f os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	var tgtUnit unit
+	err := svc.GDB.Preload("Metadata").Preload("Metadata.OcrHint").
+		Preload("Order").Preload("IntendedUse").First(&tgtUnit, unitID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.String(http.StatusNotFound, fmt.Sprintf("unit %d not found", unitID))
+		} else {
+			log.Printf("ERROR: unable to load unit %d: %s", unitID, err.Error())
+			c.String(http.StatusInternalServerError, err.Error())
 		}
-		if f.IsDir() == false && f.Name() != ".DS_Store" {
-			ext := filepath.Ext(f.Name())
-			if ext == ".tif" {
-				if mfRegex.MatchString(f.Name()) == false {
-					hasFailures = true
-					svc.logError(js, fmt.Sprintf("Incorrectly named .tif file found: %s", path.Join(fPath, f.Name())))
-				} else {
-					tifFiles = append(tifFiles, f.Name())
-				}
-				if f.Size() < minSize {
-					hasFailures = true
-					svc.logError(js, fmt.Sprintf("%s filesize is less than %d and is very likely an incorrect file.", path.Join(fPath, f.Name()), minSize))
+		return
+	}
+
+	resp := preflightResponse{UnitID: unitID, Failures: make([]qaIssue, 0), Warnings: make([]qaIssue, 0), Rules: make([]qaRuleResult, 0)}
+	if tgtUnit.Reorder {
+		resp.Failures = append(resp.Failures, qaIssue{Check: "reorder", Message: "Unit is a re-order and should not be finalized."})
+	}
+	switch tgtUnit.UnitStatus {
+	case "approved":
+	case "error":
+		resp.Warnings = append(resp.Warnings, qaIssue{Check: "unitStatus", Message: "Unit previously failed finalization; it will resume at the first incomplete stage."})
+	case "finalizing":
+		resp.Failures = append(resp.Failures, qaIssue{Check: "unitStatus", Message: "Unit is already finalizing."})
+	default:
+		resp.Failures = append(resp.Failures, qaIssue{Check: "unitStatus", Message: "Unit has not been approved."})
+	}
+
+	if tgtUnit.MetadataID == nil || tgtUnit.Metadata == nil {
+		resp.Failures = append(resp.Failures, qaIssue{Check: "metadata", Message: "Unit is not assigned to a metadata record"})
+	} else {
+		// evaluate the unit as it would be after auto-publish, using copies so nothing is changed
+		checkUnit := tgtUnit
+		checkMD := *tgtUnit.Metadata
+		checkUnit.Metadata = &checkMD
+		if checkUnit.IncludeInDL == false && checkUnit.Reorder == false {
+			canPublish, reason := svc.canAutoPublish(&checkUnit)
+			if canPublish {
+				resp.Warnings = append(resp.Warnings, qaIssue{Check: "autoPublish", Message: "Unit will be auto-published to the DL"})
+				if checkMD.AvailabilityPolicyID == 0 {
+					checkMD.AvailabilityPolicyID = 1
 				}
-			} else if ext != ".txt" {
-				hasFailures = true
-				svc.logError(js, fmt.Sprintf("Unexpected file found: %s", path.Join(fPath, f.Name())))
+				checkUnit.IncludeInDL = true
+			} else {
+				resp.Warnings = append(resp.Warnings, qaIssue{Check: "autoPublish", Message: reason})
 			}
 		}
-		return nil
-	})
-
-	if err != nil {
-		return err
+		resp.Failures = append(resp.Failures, unitQAFailures(&checkUnit)...)
 	}
-	if len(tifFiles) == 0 {
-		svc.logError(js, fmt.Sprintf("No .tif files found in %s", srcDir))
-		hasFailures = true
+
+	if tgtUnit.Order.DateOrderApproved == nil {
+		resp.Warnings = append(resp.Warnings, qaIssue{Check: "orderStatus", Message: fmt.Sprintf("Order %d is not marked as approved; finalization will approve it.", tgtUnit.OrderID)})
 	}
 
-	sort.Strings(tifFiles)
-	seq := 0
-	for _, fn := range tifFiles {
-		mfPageNum, err := getMasterFilePageNum(fn)
+	srcDir := path.Join(svc.ProcessingDir, "finalization", fmt.Sprintf("%09d", unitID))
+	if pathExists(srcDir) == false {
+		resp.Failures = append(resp.Failures, qaIssue{Check: "finalizationDirectory", Message: fmt.Sprintf("Finalization directory %s does not exist.", srcDir)})
+	} else {
+		qa := svc.getUnitQARules(&tgtUnit)
+		resp.RuleSet = qa.name
+		resp.Rules, err = svc.evaluateQARules(c.Request.Context(), &tgtUnit, qa.rules, srcDir)
 		if err != nil {
-			hasFailures = true
-			svc.logError(js, fmt.Sprintf("Invalid .tif filename found: %s", fn))
-		} else if seq+1 != mfPageNum {
-			hasFailures = true
-			svc.logError(js, fmt.Sprintf("Out of sequence .tif file found: %s", fn))
+			resp.Failures = append(resp.Failures, qaIssue{Check: "finalizationDirectory", Message: fmt.Sprintf("Unable to check %s: %s", srcDir, err.Error())})
+		}
+		for _, res := range resp.Rules {
+			for _, msg := range res.Failures {
+				resp.Failures = append(resp.Failures, qaIssue{Check: res.Rule, Message: msg})
+			}
 		}
-		seq++
-	}
 
-	if hasFailures {
-		return fmt.Errorf("Unit  has failed the Filesystem QA")
+		tifResults, err := checkTIFFDirectory(nil, srcDir, qa.rules.RequireICCProfile)
+		if err != nil {
+			resp.Failures = append(resp.Failures, qaIssue{Check: "tiffStructure", Message: fmt.Sprintf("Unable to validate .tif files in %s: %s", srcDir, err.Error())})
+		}
+		for _, res := range tifResults {
+			for _, msg := range res.Problems {
+				resp.Failures = append(resp.Failures, qaIssue{Check: "tiffStructure", Message: fmt.Sprintf("%s: %s", res.File, msg)})
+			}
+			for _, msg := range res.Warnings {
+				resp.Warnings = append(resp.Warnings, qaIssue{Check: "tiffStructure", Message: fmt.Sprintf("%s: %s", res.File, msg)})
+			}
+		}
 	}
-	svc.logInfo(js, "Filesystem QA tests passed")
-	return nil
+
+	resp.Passed = len(resp.Failures) == 0
+	c.JSON(http.StatusOK, resp)
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// masterFileFixity holds the SHA-256 checksum of an archived master file. The MD5 checksum is
+// kept on the master file itself.
+type masterFileFixity struct {
+	ID           int64
+	MasterFileID int64 `gorm:"uniqueIndex"`
+	SHA256       string
+	ComputedAt   time.Time
+}
+
+type sha256BackfillRequest struct {
+	Limit     int `json:"limit"`
+	BatchSize int `json:"batchSize"`
+}
+
+func (svc *ServiceContext) getMasterFileSHA256(mfID int64) (string, error) {
+	var fixity masterFileFixity
+	err := svc.GDB.Where("master_file_id=?", mfID).Limit(1).Find(&fixity).Error
+	if err != nil {
+		return "", err
+	}
+	return fixity.SHA256, nil
+}
+
+func (svc *ServiceContext) saveMasterFileSHA256(mfID int64, sha256 string) error {
+	var fixity masterFileFixity
+	err := svc.GDB.Where("master_file_id=?", mfID).Limit(1).Find(&fixity).Error
+	if err != nil {
+		return err
+	}
+	fixity.MasterFileID = mfID
+	fixity.SHA256 = sha256
+	fixity.ComputedAt = time.Now()
+	return svc.GDB.Save(&fixity).Error
+}
+
+// getAuditArchiveFile returns the archive path for a master file, including units archived to a
+// directory named in the staff notes and fine arts files archived by filename prefix
+func (svc *ServiceContext) getAuditArchiveFile(mf *auditItem) string {
+	srcDir := fmt.Sprintf("%09d", mf.UnitID)
+	if strings.Contains(mf.StaffNotes, "Archive: ") {
+		srcDir = strings.Split(mf.StaffNotes, "Archive: ")[1]
+	}
+	archiveFile := path.Join(svc.ArchiveDir, srcDir, mf.Filename)
+	if strings.Contains(mf.Filename, "ARCH") || strings.Contains(mf.Filename, "AVRN") || strings.Contains(mf.Filename, "VRC") {
+		if strings.Contains(mf.Filename, "_") {
+			overrideDir := strings.Split(mf.Filename, "_")[0]
+			archiveFile = path.Join(svc.ArchiveDir, overrideDir, mf.Filename)
+		}
+	}
+	return archiveFile
+}
+
+// curl -X POST https://dpg-jobs.lib.virginia.edu/audit/fix/sha256 -H "Content-Type: application/json" --data '{"limit": 10000}'
+func (svc *ServiceContext) backfillSHA256(c *gin.Context) {
+	var req sha256BackfillRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		log.Printf("ERROR: unable to parse sha256 backfill request: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.BatchSize <= 0 {
+		req.BatchSize = 500
+	}
+
+	js, err := svc.createJobStatus("BackfillSHA256", "", 0)
+	if err != nil {
+		log.Printf("ERROR: unable to create BackfillSHA256 job status: %s", err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = svc.enqueueJob(js, "BackfillSHA256", req)
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+}
+
+// runBackfillSHA256 computes the SHA-256 checksum of archived master files that do not have one. The
+// archive MD5 is checked first so a checksum is never recorded for a file that has already changed.
+// Files are processed in batches ordered by ID; a restarted job picks up the files that are still missing.
+func (svc *ServiceContext) runBackfillSHA256(js *jobStatus, payload []byte) error {
+	var req sha256BackfillRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid BackfillSHA256 payload: %s", err.Error())
+	}
+	svc.logInfo(js, fmt.Sprintf("Backfill master file SHA-256 checksums in batches of %d; limit %d", req.BatchSize, req.Limit))
+
+	hasFixity := svc.GDB.Model(&masterFileFixity{}).Select("master_file_id")
+	lastID := int64(0)
+	processed := 0
+	saved := 0
+	failed := 0
+	for req.Limit == 0 || processed < req.Limit {
+		batchSize := req.BatchSize
+		if req.Limit > 0 && req.Limit-processed < batchSize {
+			batchSize = req.Limit - processed
+		}
+		var batch []auditItem
+		err = svc.GDB.Table("master_files").
+			Select("master_files.id as id, pid, filename, md5, unit_id, u.staff_notes as staff_notes").
+			Joins("inner join units u on u.id = unit_id").
+			Where("master_files.id > ? and master_files.date_archived is not null and master_files.deaccessioned_at is null", lastID).
+			Where("master_files.id not in (?)", hasFixity).
+			Order("master_files.id asc").Limit(batchSize).Scan(&batch).Error
+		if err != nil {
+			return fmt.Errorf("unable to get master files without sha256 checksums: %s", err.Error())
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, mf := range batch {
+			if js.canceled() {
+				return js.context().Err()
+			}
+			processed++
+			lastID = mf.ID
+			archiveFile := svc.getAuditArchiveFile(&mf)
+			if pathExists(archiveFile) == false {
+				svc.logError(js, fmt.Sprintf("Master file %d archive %s not found", mf.ID, archiveFile))
+				failed++
+				continue
+			}
+			if mf.MD5 == "" {
+				svc.logError(js, fmt.Sprintf("Master file %d has no md5 checksum to verify %s against", mf.ID, archiveFile))
+				failed++
+				continue
+			}
+			sums, err := computeChecksums(archiveFile)
+			if err != nil {
+				svc.logError(js, err.Error())
+				failed++
+				continue
+			}
+			if sums.MD5 != mf.MD5 {
+				svc.logError(js, fmt.Sprintf("Master file %d archive %s does not match its md5 checksum", mf.ID, archiveFile))
+				failed++
+				continue
+			}
+			err = svc.saveMasterFileSHA256(mf.ID, sums.SHA256)
+			if err != nil {
+				svc.logError(js, fmt.Sprintf("Unable to save sha256 checksum for master file %d: %s", mf.ID, err.Error()))
+				failed++
+				continue
+			}
+			saved++
+		}
+		svc.logInfo(js, fmt.Sprintf("Processed %d master files; %d checksums saved, %d failed", processed, saved, failed))
+	}
+
+	svc.logInfo(js, fmt.Sprintf("SHA-256 backfill complete; %d master files processed, %d checksums saved, %d failed", processed, saved, failed))
+	svc.jobDone(js)
+	return nil
+}
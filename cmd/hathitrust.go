@@ -2,8 +2,10 @@ package main
 
 import (
 	"archive/zip"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
@@ -12,7 +14,6 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
-	"runtime/debug"
 	"slices"
 	"strings"
 	"time"
@@ -231,109 +232,119 @@ func (svc *ServiceContext) submitHathiTrustMetadata(c *gin.Context) {
 
 	svc.logInfo(js, fmt.Sprintf("%s requests %s hathitrust metadata submission %s", req.ComputeID, req.Mode, submissionInfo))
 
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("ERROR: panic recovered during hathitrust metadata submission: %v", r)
-				debug.PrintStack()
-				svc.logFatal(js, fmt.Sprintf("Panic recovered while submitting hathitrust metadata: %v", r))
-			}
-		}()
+	err = svc.enqueueJob(js, "HathiTrustMetadata", req)
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		dateStr := time.Now().Format("20060102")
-		uploadFN := fmt.Sprintf("UVA-2_%s", dateStr)
-		if req.Name != "" {
-			uploadFN += fmt.Sprintf("_%s", req.Name)
-		}
-		uploadFN += ".xml"
-		localMetadataPath := path.Join(svc.ProcessingDir, "hathitrust", uploadFN)
-		svc.logInfo(js, fmt.Sprintf("Write local copy of metadata submission to %s", localMetadataPath))
-		if pathExists(localMetadataPath) {
-			svc.logInfo(js, fmt.Sprintf("%s already exists; removing", localMetadataPath))
-			os.Remove(localMetadataPath)
-		}
-		metadataFile, err := os.Create(localMetadataPath)
+	c.String(http.StatusOK, "submit request started")
+}
+
+func (svc *ServiceContext) runHathiTrustMetadata(js *jobStatus, payload []byte) error {
+	var req hathiTrustRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid HathiTrustMetadata payload: %s", err.Error())
+	}
+	submitUser, err := svc.validateHathiTrustRequestor(req.ComputeID)
+	if err != nil {
+		return err
+	}
+
+	dateStr := time.Now().Format("20060102")
+	uploadFN := fmt.Sprintf("UVA-2_%s", dateStr)
+	if req.Name != "" {
+		uploadFN += fmt.Sprintf("_%s", req.Name)
+	}
+	uploadFN += ".xml"
+	localMetadataPath := path.Join(svc.ProcessingDir, "hathitrust", uploadFN)
+	svc.logInfo(js, fmt.Sprintf("Write local copy of metadata submission to %s", localMetadataPath))
+	if pathExists(localMetadataPath) {
+		svc.logInfo(js, fmt.Sprintf("%s already exists; removing", localMetadataPath))
+		os.Remove(localMetadataPath)
+	}
+	metadataFile, err := os.Create(localMetadataPath)
+	if err != nil {
+		svc.logFatal(js, fmt.Sprintf("Unable to create metadaa file: %s", err.Error()))
+		return nil
+	}
+
+	metadataFile.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<collection xmlns=\"http://www.loc.gov/MARC21/slim\">")
+	updatedIDs := make([]int64, 0)
+	generatedCatKeys := make([]string, 0)
+	for _, mdID := range req.MetadataIDs {
+		var tgtMD metadata
+		err = svc.GDB.First(&tgtMD, mdID).Error
 		if err != nil {
-			svc.logFatal(js, fmt.Sprintf("Unable to create metadaa file: %s", err.Error()))
-			return
+			svc.logError(js, fmt.Sprintf("Unable to load metadata %d: %s", mdID, err.Error()))
+			continue
 		}
 
-		metadataFile.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<collection xmlns=\"http://www.loc.gov/MARC21/slim\">")
-		updatedIDs := make([]int64, 0)
-		generatedCatKeys := make([]string, 0)
-		for _, mdID := range req.MetadataIDs {
-			var tgtMD metadata
-			err = svc.GDB.First(&tgtMD, mdID).Error
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("Unable to load metadata %d: %s", mdID, err.Error()))
-				continue
-			}
+		// NOTE: skip any barcodes that are not like Xnnnnnn (these have a dash; ex: 500878-2001)
+		// Multi-volume items have different metadata records. Each has the same cat key, but different barocdes. The
+		// MARC record for the cat key will list all barcodes, so don't request the same cat key multiple times
+		if strings.Contains(tgtMD.Barcode, "-") {
+			svc.logInfo(js, fmt.Sprintf("Skipping record with barcode that has an autogenerated item ID: %s", tgtMD.Barcode))
+			continue
+		}
 
-			// NOTE: skip any barcodes that are not like Xnnnnnn (these have a dash; ex: 500878-2001)
-			// Multi-volume items have different metadata records. Each has the same cat key, but different barocdes. The
-			// MARC record for the cat key will list all barcodes, so don't request the same cat key multiple times
-			if strings.Contains(tgtMD.Barcode, "-") {
-				svc.logInfo(js, fmt.Sprintf("Skipping record with barcode that has an autogenerated item ID: %s", tgtMD.Barcode))
-				continue
-			}
+		if slices.Contains(generatedCatKeys, tgtMD.CatalogKey) {
+			svc.logInfo(js, fmt.Sprintf("Catalog key %s has already been submitted; skipping", tgtMD.CatalogKey))
+			continue
+		}
 
-			if slices.Contains(generatedCatKeys, tgtMD.CatalogKey) {
-				svc.logInfo(js, fmt.Sprintf("Catalog key %s has already been submitted; skipping", tgtMD.CatalogKey))
-				continue
-			}
+		generatedCatKeys = append(generatedCatKeys, tgtMD.CatalogKey)
+		xml, err := svc.getMARCMetadata(tgtMD)
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("Unable to retrieve MARC XML for %d: %s", mdID, err.Error()))
+			continue
+		}
+		fmt.Fprintf(metadataFile, "\n%s", xml)
+		updatedIDs = append(updatedIDs, tgtMD.ID)
+	}
+	metadataFile.WriteString("\n</collection>")
+	metadataFile.Close()
+	mdSize := getFileSize(localMetadataPath)
+	svc.logInfo(js, fmt.Sprintf("Metadata for %d records with size %d has been written to %s", len(updatedIDs), mdSize, localMetadataPath))
+
+	if req.Mode == "dev" {
+		// In dev mode, there is nothing more to do. just log the location where the metadata file can be found
+		svc.logInfo(js, "Metadata request is in dev mode. File not submitted, no email sent and status not updated")
+
+	} else if len(updatedIDs) > 0 {
+		upErr := svc.uploadMetadataToHathiTrust(js, req.Mode, localMetadataPath, uploadFN)
+		if upErr != nil {
+			svc.logFatal(js, fmt.Sprintf("FTPS upload failed: %s", err.Error()))
+			return nil
+		}
 
-			generatedCatKeys = append(generatedCatKeys, tgtMD.CatalogKey)
-			xml, err := svc.getMARCMetadata(tgtMD)
+		if req.Mode == "prod" {
+			svc.logInfo(js, "Send email notification to hathitrust")
+			err = svc.sendHathiTrustUploadEmail(submitUser, uploadFN, mdSize, len(updatedIDs))
 			if err != nil {
-				svc.logError(js, fmt.Sprintf("Unable to retrieve MARC XML for %d: %s", mdID, err.Error()))
-				continue
-			}
-			fmt.Fprintf(metadataFile, "\n%s", xml)
-			updatedIDs = append(updatedIDs, tgtMD.ID)
-		}
-		metadataFile.WriteString("\n</collection>")
-		metadataFile.Close()
-		mdSize := getFileSize(localMetadataPath)
-		svc.logInfo(js, fmt.Sprintf("Metadata for %d records with size %d has been written to %s", len(updatedIDs), mdSize, localMetadataPath))
-
-		if req.Mode == "dev" {
-			// In dev mode, there is nothing more to do. just log the location where the metadata file can be found
-			svc.logInfo(js, "Metadata request is in dev mode. File not submitted, no email sent and status not updated")
-
-		} else if len(updatedIDs) > 0 {
-			upErr := svc.uploadMetadataToHathiTrust(js, req.Mode, localMetadataPath, uploadFN)
-			if upErr != nil {
-				svc.logFatal(js, fmt.Sprintf("FTPS upload failed: %s", err.Error()))
-				return
+				svc.logFatal(js, fmt.Sprintf("Unable to send email to HathiTrust: %s", err.Error()))
+				return nil
 			}
 
-			if req.Mode == "prod" {
-				svc.logInfo(js, "Send email notification to hathitrust")
-				err = svc.sendHathiTrustUploadEmail(submitUser, uploadFN, mdSize, len(updatedIDs))
-				if err != nil {
-					svc.logFatal(js, fmt.Sprintf("Unable to send email to HathiTrust: %s", err.Error()))
-					return
-				}
-
-				svc.logInfo(js, "Update metadata submitted dates")
-				now := time.Now()
-				err = svc.GDB.Model(&hathitrustStatus{}).Where("metadata_id in ?", updatedIDs).
-					Updates(hathitrustStatus{MetadataSubmittedAt: &now, MetadataStatus: "submitted"}).Error
-				if err != nil {
-					svc.logError(js, fmt.Sprintf("Unable to update HathiTrust status records: %s", err.Error()))
-				}
-			} else {
-				svc.logInfo(js, fmt.Sprintf("metadata request is in mode=%s, no email sent and status not updated", req.Mode))
+			svc.logInfo(js, "Update metadata submitted dates")
+			now := time.Now()
+			err = svc.GDB.Model(&hathitrustStatus{}).Where("metadata_id in ?", updatedIDs).
+				Updates(hathitrustStatus{MetadataSubmittedAt: &now, MetadataStatus: "submitted"}).Error
+			if err != nil {
+				svc.logError(js, fmt.Sprintf("Unable to update HathiTrust status records: %s", err.Error()))
 			}
 		} else {
-			svc.logFatal(js, "No metadata records uploaded")
-			return
+			svc.logInfo(js, fmt.Sprintf("metadata request is in mode=%s, no email sent and status not updated", req.Mode))
 		}
+	} else {
+		svc.logFatal(js, "No metadata records uploaded")
+		return nil
+	}
 
-		svc.jobDone(js)
-	}()
-
-	c.String(http.StatusOK, "submit request started")
+	svc.jobDone(js)
+	return nil
 }
 
 func (svc *ServiceContext) uploadMetadataToHathiTrust(js *jobStatus, mode, srcPath, destName string) error {
@@ -418,266 +429,312 @@ func (svc *ServiceContext) createHathiTrustPackage(c *gin.Context) {
 
 	svc.logInfo(js, fmt.Sprintf("%s requests hathitrust package generation %s", req.ComputeID, submissionInfo))
 
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("ERROR: Panic recovered: %v", r)
-				debug.PrintStack()
-				svc.logFatal(js, fmt.Sprintf("Panic recovered while generating hathitrust packages: %v", r))
-			}
-		}()
+	err = svc.enqueueJob(js, "HathiTrustPackage", req)
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		packagedIDs := make([]int64, 0)
-		for _, mdID := range req.MetadataIDs {
-			svc.logInfo(js, fmt.Sprintf("Validate metadata record %d", mdID))
-			var md metadata
-			err = svc.GDB.Preload("OcrHint").Find(&md, mdID).Error
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("Unable to get metadata %d: %s", mdID, err.Error()))
-				continue
-			}
+	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+}
 
-			if md.Barcode == "" {
-				svc.failHathiTrustPackage(js, md.ID, "required barcode is missing")
-				continue
-			}
+func (svc *ServiceContext) runHathiTrustPackage(js *jobStatus, payload []byte) error {
+	var req hathiTrustRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid HathiTrustPackage payload: %s", err.Error())
+	}
 
-			if md.OcrHint == nil {
-				svc.failHathiTrustPackage(js, md.ID, "required OCRHint setting is missing")
-				continue
-			}
+	packagedIDs := make([]int64, 0)
+	for _, mdID := range req.MetadataIDs {
+		if js.canceled() {
+			return fmt.Errorf("packaging stopped with %d of %d packages created", len(packagedIDs), len(req.MetadataIDs))
+		}
+		svc.logInfo(js, fmt.Sprintf("Validate metadata record %d", mdID))
+		var md metadata
+		err = svc.GDB.Preload("OcrHint").Find(&md, mdID).Error
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("Unable to get metadata %d: %s", mdID, err.Error()))
+			continue
+		}
 
-			svc.logInfo(js, "Find target units")
-			var units []unit
-			err = svc.GDB.Where("metadata_id=? and unit_status != ? and reorder = ? and intended_use_id=?", mdID, "canceled", false, 110).Find(&units).Error
-			if err != nil {
-				svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to get a unit: %s", err.Error()))
-				continue
-			}
+		if md.Barcode == "" {
+			svc.failHathiTrustPackage(js, md.ID, "required barcode is missing")
+			continue
+		}
+
+		if md.OcrHint == nil {
+			svc.failHathiTrustPackage(js, md.ID, "required OCRHint setting is missing")
+			continue
+		}
+
+		svc.logInfo(js, "Find target units")
+		var units []unit
+		err = svc.GDB.Where("metadata_id=? and unit_status != ? and reorder = ? and intended_use_id=?", mdID, "canceled", false, 110).Find(&units).Error
+		if err != nil {
+			svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to get a unit: %s", err.Error()))
+			continue
+		}
+
+		if len(units) == 0 {
+			svc.failHathiTrustPackage(js, md.ID, "no units found")
+			continue
+		}
 
-			if len(units) == 0 {
-				svc.failHathiTrustPackage(js, md.ID, "no units found")
-				continue
+		svc.logInfo(js, fmt.Sprintf("%d units found; validate orderID and do necessary OCR", len(units)))
+		var unitIDs []int64
+		var orderID int64
+		for _, tgtUnit := range units {
+			unitIDs = append(unitIDs, tgtUnit.ID)
+			if orderID == 0 {
+				orderID = tgtUnit.OrderID
+			} else if orderID != tgtUnit.OrderID {
+				svc.logError(js, "Units are from multiple orders")
+				orderID = 0
+				break
 			}
 
-			svc.logInfo(js, fmt.Sprintf("%d units found; validate orderID and do necessary OCR", len(units)))
-			var unitIDs []int64
-			var orderID int64
-			for _, tgtUnit := range units {
-				unitIDs = append(unitIDs, tgtUnit.ID)
-				if orderID == 0 {
-					orderID = tgtUnit.OrderID
-				} else if orderID != tgtUnit.OrderID {
-					svc.logError(js, "Units are from multiple orders")
-					orderID = 0
-					break
+			if md.OcrHint.OcrCandidate {
+				svc.logInfo(js, fmt.Sprintf("This metadata record is an OCR candidate; check master files in unit %d to see if OCR needs to be done", tgtUnit.ID))
+				var mfOCRCnt int64
+				err = svc.GDB.Table("master_files").Where("unit_id=? and NOT ISNULL(transcription_text) and transcription_text !=?", tgtUnit.ID, "").Count(&mfOCRCnt).Error
+				if err != nil {
+					svc.logInfo(js, fmt.Sprintf("Unable to determine OCR status for unit %d, assume it needs to be done: %s", tgtUnit.ID, err.Error()))
+					mfOCRCnt = 0
 				}
-
-				if md.OcrHint.OcrCandidate {
-					svc.logInfo(js, fmt.Sprintf("This metadata record is an OCR candidate; check master files in unit %d to see if OCR needs to be done", tgtUnit.ID))
-					var mfOCRCnt int64
-					err = svc.GDB.Table("master_files").Where("unit_id=? and NOT ISNULL(transcription_text) and transcription_text !=?", tgtUnit.ID, "").Count(&mfOCRCnt).Error
-					if err != nil {
-						svc.logInfo(js, fmt.Sprintf("Unable to determine OCR status for unit %d, assume it needs to be done: %s", tgtUnit.ID, err.Error()))
-						mfOCRCnt = 0
+				if mfOCRCnt == 0 {
+					// with the remote engine, the job is re-queued to package again once the OCR service has called back with the results
+					engine := svc.getUnitOCREngine(js, md.OcrLanguageHint)
+					svc.logInfo(js, fmt.Sprintf("Use %s OCR engine for unit %d", engine.name(), tgtUnit.ID))
+					tgtUnit.Metadata = &md
+					err = engine.ocrUnit(js, &tgtUnit)
+					if errors.Is(err, errJobWaiting) {
+						return err
 					}
-					if mfOCRCnt == 0 {
-						// note; this call will not return until all master files in the unit have OCR results
-						err = svc.requestUnitOCR(js, md.PID, tgtUnit.ID, md.OcrLanguageHint)
-						if err != nil {
-							svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to request ocr for unit %d: %s", tgtUnit.ID, err.Error()))
-						}
+					if err != nil {
+						svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to ocr unit %d: %s", tgtUnit.ID, err.Error()))
 					}
 				}
 			}
+		}
 
-			if orderID == 0 {
-				svc.failHathiTrustPackage(js, md.ID, "unable to determine package order")
-				continue
-			}
+		if orderID == 0 {
+			svc.failHathiTrustPackage(js, md.ID, "unable to determine package order")
+			continue
+		}
 
-			// date archived on the order should be latest date that images were compressed.
-			// load the unit and get that date and use it for the manifest
-			var tgtOrder order
-			err = svc.GDB.First(&tgtOrder, orderID).Error
+		// date archived on the order should be latest date that images were compressed.
+		// load the unit and get that date and use it for the manifest
+		var tgtOrder order
+		err = svc.GDB.First(&tgtOrder, orderID).Error
+		if err != nil {
+			svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unabel to find order %d for metadata %s: %s", orderID, md.PID, err.Error()))
+			continue
+		}
+		compressDate := tgtOrder.DateArchivingComplete
+		if compressDate == nil {
+			svc.failHathiTrustPackage(js, md.ID, "unable to determine compression date")
+			continue
+		}
+
+		svc.logInfo(js, fmt.Sprintf("Load master files from digitial collection units for metadata %d", mdID))
+		var masterFiles []masterFile
+		err = svc.GDB.Where("unit_id in ?", unitIDs).Find(&masterFiles).Error
+		if err != nil {
+			svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to load master files: %s", err.Error()))
+			continue
+		}
+
+		if len(masterFiles) == 0 {
+			svc.failHathiTrustPackage(js, md.ID, "no master files found")
+			continue
+		}
+
+		// Setup package assembly directory; /digiserv-production/hathitrust/order_[order_id]/[barcode]
+		// final package data will reside at /digiserv-production/hathitrust/order_[order_id]/[barcode].zip
+		orderDir := fmt.Sprintf("order_%d", orderID)
+		assembleDir := path.Join(svc.ProcessingDir, "hathitrust", orderDir, md.Barcode)
+		packageName := fmt.Sprintf("%s.zip", md.Barcode)
+		packageFilename := path.Join(svc.ProcessingDir, "hathitrust", orderDir, packageName)
+		if pathExists(assembleDir) {
+			svc.logInfo(js, fmt.Sprintf("Clean up pre-existing package assembly directory %s", assembleDir))
+			err := os.RemoveAll(assembleDir)
 			if err != nil {
-				svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unabel to find order %d for metadata %s: %s", orderID, md.PID, err.Error()))
-				continue
-			}
-			compressDate := tgtOrder.DateArchivingComplete
-			if compressDate == nil {
-				svc.failHathiTrustPackage(js, md.ID, "unable to determine compression date")
-				continue
+				svc.logError(js, fmt.Sprintf("Unable to cleanup prior package assembly directory %s: %s", assembleDir, err.Error()))
 			}
-
-			svc.logInfo(js, fmt.Sprintf("Load master files from digitial collection units for metadata %d", mdID))
-			var masterFiles []masterFile
-			err = svc.GDB.Where("unit_id in ?", unitIDs).Find(&masterFiles).Error
+		}
+		if pathExists(packageFilename) {
+			svc.logInfo(js, fmt.Sprintf("Clean up pre-existing package %s", packageFilename))
+			err = os.Remove(packageFilename)
 			if err != nil {
-				svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to load master files: %s", err.Error()))
-				continue
+				svc.logError(js, fmt.Sprintf("Unable to cleanup prior package %s: %s", packageFilename, err.Error()))
 			}
+		}
 
-			if len(masterFiles) == 0 {
-				svc.failHathiTrustPackage(js, md.ID, "no master files found")
-				continue
-			}
+		svc.logInfo(js, fmt.Sprintf("Ensure package assembly directory %s exists", assembleDir))
+		err = ensureDirExists(assembleDir, 0777)
+		if err != nil {
+			svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to create package assembly directory %s: %s", assembleDir, err.Error()))
+			continue
+		}
 
-			// Setup package assembly directory; /digiserv-production/hathitrust/order_[order_id]/[barcode]
-			// final package data will reside at /digiserv-production/hathitrust/order_[order_id]/[barcode].zip
-			orderDir := fmt.Sprintf("order_%d", orderID)
-			assembleDir := path.Join(svc.ProcessingDir, "hathitrust", orderDir, md.Barcode)
-			packageName := fmt.Sprintf("%s.zip", md.Barcode)
-			packageFilename := path.Join(svc.ProcessingDir, "hathitrust", orderDir, packageName)
-			if pathExists(assembleDir) {
-				svc.logInfo(js, fmt.Sprintf("Clean up pre-existing package assembly directory %s", assembleDir))
-				err := os.RemoveAll(assembleDir)
-				if err != nil {
-					svc.logError(js, fmt.Sprintf("Unable to cleanup prior package assembly directory %s: %s", assembleDir, err.Error()))
-				}
-			}
-			if pathExists(packageFilename) {
-				svc.logInfo(js, fmt.Sprintf("Clean up pre-existing package %s", packageFilename))
-				err = os.Remove(packageFilename)
-				if err != nil {
-					svc.logError(js, fmt.Sprintf("Unable to cleanup prior package %s: %s", packageFilename, err.Error()))
-				}
-			}
+		// Create the package ZIP file
+		svc.logInfo(js, fmt.Sprintf("Package will be generated here %s", packageFilename))
+		zipFile, err := os.Create(packageFilename)
+		if err != nil {
+			svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to create package zip %s: %s", packageFilename, err.Error()))
+			continue
+		}
+		zipWriter := zip.NewWriter(zipFile)
+		defer zipFile.Close()
+		defer zipWriter.Close()
 
-			svc.logInfo(js, fmt.Sprintf("Ensure package assembly directory %s exists", assembleDir))
-			err = ensureDirExists(assembleDir, 0777)
-			if err != nil {
-				svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to create package assembly directory %s: %s", assembleDir, err.Error()))
-				continue
-			}
+		// Create the checksum file; it will appended as files are processed
+		checksumPath := path.Join(assembleDir, "checksum.md5")
+		checksumFile, err := os.Create(checksumPath)
+		if err != nil {
+			svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to create checksum file %s: %s", checksumPath, err.Error()))
+			continue
+		}
+		checksumFile.Chmod(0666)
+		defer checksumFile.Close()
 
-			// Create the package ZIP file
-			svc.logInfo(js, fmt.Sprintf("Package will be generated here %s", packageFilename))
-			zipFile, err := os.Create(packageFilename)
+		// Write the meta.yml file
+		lastCaptureDate := masterFiles[len(masterFiles)-1].CreatedAt
+		ymlMD5, err := svc.writeMetaYML(assembleDir, &lastCaptureDate, compressDate)
+		if err != nil {
+			svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to write meta.yml: %s", err.Error()))
+			continue
+		}
+		checksumFile.WriteString(fmt.Sprintf("%s  meta.yml\n", ymlMD5))
+
+		masterFileError := false
+		coordinateCnt := 0
+		for idx, mf := range masterFiles {
+			if js.canceled() {
+				svc.failHathiTrustPackage(js, md.ID, "packaging canceled")
+				masterFileError = true
+				break
+			}
+
+			// download jp2 from iiif to assembly directory, then add it to the zip
+			destFN := fmt.Sprintf("%08d.jp2", (idx + 1))
+			destPath := path.Join(assembleDir, destFN)
+			iiifInfo := svc.getIIIFContext(mf.PID)
+			err = svc.downlodFromIIIF(js, iiifInfo.S3Key(), destPath)
 			if err != nil {
-				svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to create package zip %s: %s", packageFilename, err.Error()))
-				continue
+				svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to download masterfile %s from iiif: %s", mf.Filename, err.Error()))
+				masterFileError = true
+				break
 			}
-			zipWriter := zip.NewWriter(zipFile)
-			defer zipFile.Close()
-			defer zipWriter.Close()
 
-			// Create the checksum file; it will appended as files are processed
-			checksumPath := path.Join(assembleDir, "checksum.md5")
-			checksumFile, err := os.Create(checksumPath)
+			// check the downloaded jp2 to see if it has an alpha channel. If it does, remove it.
+			err = svc.removeAlphaChannel(js, destPath)
 			if err != nil {
-				svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to create checksum file %s: %s", checksumPath, err.Error()))
-				continue
+				svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to check/remove alpha channel for %s: %s", destPath, err.Error()))
+				masterFileError = true
+				break
 			}
-			checksumFile.Chmod(0666)
-			defer checksumFile.Close()
 
-			// Write the meta.yml file
-			lastCaptureDate := masterFiles[len(masterFiles)-1].CreatedAt
-			ymlMD5, err := svc.writeMetaYML(assembleDir, &lastCaptureDate, compressDate)
+			_, err := addFileToZip(packageFilename, zipWriter, assembleDir, destFN)
 			if err != nil {
-				svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to write meta.yml: %s", err.Error()))
-				continue
+				svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to add %s to zip file: %s", destPath, err.Error()))
+				masterFileError = true
+				break
 			}
-			checksumFile.WriteString(fmt.Sprintf("%s  meta.yml\n", ymlMD5))
-
-			masterFileError := false
-			for idx, mf := range masterFiles {
-				// download jp2 from iiif to assembly directory, then add it to the zip
-				destFN := fmt.Sprintf("%08d.jp2", (idx + 1))
-				destPath := path.Join(assembleDir, destFN)
-				iiifInfo := svc.getIIIFContext(mf.PID)
-				err = svc.downlodFromIIIF(js, iiifInfo.S3Key(), destPath)
-				if err != nil {
-					svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to download masterfile %s from iiif: %s", mf.Filename, err.Error()))
-					masterFileError = true
-					break
-				}
+			checksumFile.WriteString(fmt.Sprintf("%s  %s\n", md5Checksum(destPath), destFN))
 
-				// check the downloaded jp2 to see if it has an alpha channel. If it does, remove it.
-				err = svc.removeAlphaChannel(js, destPath)
+			// if applicable, copy ocr text to the package dir. make the name match the image name
+			if md.OcrHint.OcrCandidate {
+				txtFileName := fmt.Sprintf("%08d.txt", (idx + 1))
+				destTxtPath := path.Join(assembleDir, txtFileName)
+				err = os.WriteFile(destTxtPath, []byte(mf.TranscriptionText), 0666)
 				if err != nil {
-					svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to check/remove alpha channel for %s: %s", destPath, err.Error()))
+					svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to write ocr text to %s: %s", destTxtPath, err.Error()))
 					masterFileError = true
 					break
 				}
-
-				_, err := addFileToZip(packageFilename, zipWriter, assembleDir, destFN)
+				_, err := addFileToZip(packageFilename, zipWriter, assembleDir, txtFileName)
 				if err != nil {
-					svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to add %s to zip file: %s", destPath, err.Error()))
+					svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to add ocr text file %s to zip: %s", destTxtPath, err.Error()))
 					masterFileError = true
 					break
 				}
-				checksumFile.WriteString(fmt.Sprintf("%s  %s\n", md5Checksum(destPath), destFN))
-
-				// if applicable, copy ocr text to the package dir. make the name match the image name
-				if md.OcrHint.OcrCandidate {
-					txtFileName := fmt.Sprintf("%08d.txt", (idx + 1))
-					destTxtPath := path.Join(assembleDir, txtFileName)
-					err = os.WriteFile(destTxtPath, []byte(mf.TranscriptionText), 0666)
+				checksumFile.WriteString(fmt.Sprintf("%s  %s\n", md5Checksum(destTxtPath), txtFileName))
+
+				// include coordinate OCR if it has been generated for the master file
+				altoFile := svc.getArchiveALTOFileName(&mf)
+				if pathExists(altoFile) {
+					xmlFileName := fmt.Sprintf("%08d.xml", (idx + 1))
+					destXMLPath := path.Join(assembleDir, xmlFileName)
+					xmlMD5, err := copyFile(altoFile, destXMLPath, 0666)
 					if err != nil {
-						svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to write ocr text to %s: %s", destTxtPath, err.Error()))
+						svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to copy ocr coordinates %s: %s", altoFile, err.Error()))
 						masterFileError = true
 						break
 					}
-					_, err := addFileToZip(packageFilename, zipWriter, assembleDir, txtFileName)
+					_, err = addFileToZip(packageFilename, zipWriter, assembleDir, xmlFileName)
 					if err != nil {
-						svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to add ocr text file %s to zip: %s", destTxtPath, err.Error()))
+						svc.failHathiTrustPackage(js, md.ID, fmt.Sprintf("unable to add ocr coordinates file %s to zip: %s", destXMLPath, err.Error()))
 						masterFileError = true
 						break
 					}
-					checksumFile.WriteString(fmt.Sprintf("%s  %s\n", md5Checksum(destTxtPath), txtFileName))
+					checksumFile.WriteString(fmt.Sprintf("%s  %s\n", xmlMD5, xmlFileName))
+					coordinateCnt++
 				}
 			}
+		}
 
-			if masterFileError {
-				continue
-			}
+		if masterFileError {
+			continue
+		}
+		if md.OcrHint.OcrCandidate {
+			svc.logInfo(js, fmt.Sprintf("%d of %d master files include coordinate ocr", coordinateCnt, len(masterFiles)))
+		}
 
-			addFileToZip(packageFilename, zipWriter, assembleDir, "meta.yml")
-			addFileToZip(packageFilename, zipWriter, assembleDir, "checksum.md5")
-			svc.logInfo(js, fmt.Sprintf("%s successfully generated", packageFilename))
+		addFileToZip(packageFilename, zipWriter, assembleDir, "meta.yml")
+		addFileToZip(packageFilename, zipWriter, assembleDir, "checksum.md5")
+		svc.logInfo(js, fmt.Sprintf("%s successfully generated", packageFilename))
 
-			checksumFile.Close()
-			zipWriter.Close()
-			zipFile.Close()
-			packagedIDs = append(packagedIDs, mdID)
+		checksumFile.Close()
+		zipWriter.Close()
+		zipFile.Close()
+		packagedIDs = append(packagedIDs, mdID)
 
-			defer func() {
-				svc.logInfo(js, fmt.Sprintf("Cleaning up assembly directory %s", assembleDir))
-				err = os.RemoveAll(assembleDir)
-				if err != nil {
-					svc.logError(js, fmt.Sprintf("Unable to clean up assembly directory: %s", err.Error()))
-				}
-			}()
-		}
-
-		if len(packagedIDs) > 0 {
-			svc.logInfo(js, "Update metadata package created dates")
-			now := time.Now()
-			err = svc.GDB.Model(&hathitrustStatus{}).Where("metadata_id in ?", packagedIDs).
-				Updates(hathitrustStatus{PackageCreatedAt: &now}).Error
+		defer func() {
+			svc.logInfo(js, fmt.Sprintf("Cleaning up assembly directory %s", assembleDir))
+			err = os.RemoveAll(assembleDir)
 			if err != nil {
-				svc.logError(js, fmt.Sprintf("Unable to update HathiTrust status records: %s", err.Error()))
+				svc.logError(js, fmt.Sprintf("Unable to clean up assembly directory: %s", err.Error()))
 			}
-			if len(packagedIDs) != len(req.MetadataIDs) {
-				svc.logError(js, fmt.Sprintf("Not all packages created: Total: %d, Uploaded: %d", len(packagedIDs), len(req.MetadataIDs)))
-			}
-		} else {
-			svc.logFatal(js, "No packages created")
-			return
-		}
+		}()
+	}
 
-		svc.jobDone(js)
-	}()
+	if len(packagedIDs) > 0 {
+		svc.logInfo(js, "Update metadata package created dates")
+		now := time.Now()
+		err = svc.GDB.Model(&hathitrustStatus{}).Where("metadata_id in ?", packagedIDs).
+			Updates(hathitrustStatus{PackageCreatedAt: &now}).Error
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("Unable to update HathiTrust status records: %s", err.Error()))
+		}
+		if len(packagedIDs) != len(req.MetadataIDs) {
+			svc.logError(js, fmt.Sprintf("Not all packages created: Total: %d, Uploaded: %d", len(packagedIDs), len(req.MetadataIDs)))
+		}
+	} else {
+		svc.logFatal(js, "No packages created")
+		return nil
+	}
 
-	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+	svc.jobDone(js)
+	return nil
 }
 
 func (svc *ServiceContext) removeAlphaChannel(js *jobStatus, imgPath string) error {
 	svc.logInfo(js, fmt.Sprintf("Check %s for an alpha channel", imgPath))
 	cmdArray := []string{"-format", "%[channels]", imgPath}
-	out, err := exec.Command("identify", cmdArray...).CombinedOutput()
+	out, err := exec.CommandContext(js.context(), "identify", cmdArray...).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("alpha channel check for %s failed: %s", imgPath, out)
 	}
@@ -686,7 +743,7 @@ func (svc *ServiceContext) removeAlphaChannel(js *jobStatus, imgPath string) err
 	if strings.Contains(strChannel, "srgba") {
 		svc.logInfo(js, fmt.Sprintf("Alpha channel present on %s; removing", imgPath))
 		cmdArray := []string{imgPath, "-alpha", "off", imgPath}
-		out, err := exec.Command("magick", cmdArray...).CombinedOutput()
+		out, err := exec.CommandContext(js.context(), "magick", cmdArray...).CombinedOutput()
 		if err != nil {
 			return fmt.Errorf("remove alpha channel for %s failed: %s", imgPath, out)
 		}
@@ -756,98 +813,105 @@ func (svc *ServiceContext) submitHathiTrustPackage(c *gin.Context) {
 		svc.logInfo(js, fmt.Sprintf("%s requests hathitrust package submission of barcodes %v from order %d", req.ComputeID, req.Barcodes, req.OrderID))
 	}
 
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("ERROR: panic recovered during hathitrust package submission: %v", r)
-				debug.PrintStack()
-				svc.logFatal(js, fmt.Sprintf("Panic recovered while submitting hathitrust packages: %v", r))
-			}
-		}()
+	err = svc.enqueueJob(js, "HathiTrustPackgeSubmit", req)
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		svc.logInfo(js, "get a list of packages in the submission directory")
-		priorSubmissions, err := svc.getHathiTrustDirectoryContent()
+	c.String(http.StatusOK, "package submit request started")
+}
 
-		submitted := 0
-		err = filepath.WalkDir(orderDir, func(filePath string, d fs.DirEntry, err error) error {
-			if d.IsDir() {
-				return nil
-			}
-			if filepath.Ext(d.Name()) != ".zip" {
-				return nil
-			}
+func (svc *ServiceContext) runHathiTrustPackageSubmit(js *jobStatus, payload []byte) error {
+	var req hathiTrustSubmitRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid HathiTrustPackgeSubmit payload: %s", err.Error())
+	}
+	orderDir := path.Join(svc.ProcessingDir, "hathitrust", fmt.Sprintf("order_%d", req.OrderID))
 
-			doSubmit := false
-			tgtBC := strings.TrimSuffix(d.Name(), filepath.Ext(d.Name()))
-			if len(req.Barcodes) > 0 {
-				for _, bc := range req.Barcodes {
-					if bc == tgtBC {
-						doSubmit = true
-						break
-					}
-				}
-			} else {
-				doSubmit = true
-			}
+	svc.logInfo(js, "get a list of packages in the submission directory")
+	priorSubmissions, err := svc.getHathiTrustDirectoryContent(js.context())
 
-			if doSubmit == false {
-				return nil
-			}
+	submitted := 0
+	err = filepath.WalkDir(orderDir, func(filePath string, d fs.DirEntry, err error) error {
+		if d.IsDir() {
+			return nil
+		}
+		if filepath.Ext(d.Name()) != ".zip" {
+			return nil
+		}
 
-			for _, ps := range priorSubmissions {
-				subName := strings.TrimSuffix(ps.Name, ".zip")
-				if subName == tgtBC {
-					svc.logInfo(js, fmt.Sprintf("package for %s already exists in the submission directory", tgtBC))
-					doSubmit = false
+		doSubmit := false
+		tgtBC := strings.TrimSuffix(d.Name(), filepath.Ext(d.Name()))
+		if len(req.Barcodes) > 0 {
+			for _, bc := range req.Barcodes {
+				if bc == tgtBC {
+					doSubmit = true
 					break
 				}
 			}
-			if doSubmit == false {
-				return nil
-			}
+		} else {
+			doSubmit = true
+		}
 
-			svc.logInfo(js, fmt.Sprintf("submit %s", filePath))
-			cmd := exec.Command(path.Join(svc.HathiTrust.RCloneBin, "rclone"),
-				"--config", svc.HathiTrust.RCloneConfig,
-				"copyto", filePath,
-				fmt.Sprintf("%s:%s/%s", svc.HathiTrust.RCloneRemote, svc.HathiTrust.RemoteDir, d.Name()))
-			svc.logInfo(js, fmt.Sprintf("Submit command: %v", cmd))
-			out, err := cmd.CombinedOutput()
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("Unable to submit %s: %s:%s", d.Name(), err.Error(), out))
-				return nil
-			}
-			submitted++
+		if doSubmit == false {
+			return nil
+		}
 
-			svc.logInfo(js, fmt.Sprintf("update status for %s", tgtBC))
-			var mdRec metadata
-			err = svc.GDB.InnerJoins("HathiTrustStatus").Where("barcode=?", tgtBC).First(&mdRec).Error
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("Unable to load metadata for %s: %s", tgtBC, err.Error()))
-				return nil
-			}
-			now := time.Now()
-			mdRec.HathiTrustStatus.PackageSubmittedAt = &now
-			mdRec.HathiTrustStatus.PackageStatus = "submitted"
-			err = svc.GDB.Model(&mdRec.HathiTrustStatus).Select("PackageSubmittedAt", "PackageStatus").Updates(mdRec.HathiTrustStatus).Error
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("Unable to update hathitrust status for %s: %s", tgtBC, err.Error()))
-				return nil
+		for _, ps := range priorSubmissions {
+			subName := strings.TrimSuffix(ps.Name, ".zip")
+			if subName == tgtBC {
+				svc.logInfo(js, fmt.Sprintf("package for %s already exists in the submission directory", tgtBC))
+				doSubmit = false
+				break
 			}
+		}
+		if doSubmit == false {
+			return nil
+		}
 
+		svc.logInfo(js, fmt.Sprintf("submit %s", filePath))
+		cmd := exec.CommandContext(js.context(), path.Join(svc.HathiTrust.RCloneBin, "rclone"),
+			"--config", svc.HathiTrust.RCloneConfig,
+			"copyto", filePath,
+			fmt.Sprintf("%s:%s/%s", svc.HathiTrust.RCloneRemote, svc.HathiTrust.RemoteDir, d.Name()))
+		svc.logInfo(js, fmt.Sprintf("Submit command: %v", cmd))
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("Unable to submit %s: %s:%s", d.Name(), err.Error(), out))
 			return nil
-		})
+		}
+		submitted++
 
+		svc.logInfo(js, fmt.Sprintf("update status for %s", tgtBC))
+		var mdRec metadata
+		err = svc.GDB.InnerJoins("HathiTrustStatus").Where("barcode=?", tgtBC).First(&mdRec).Error
 		if err != nil {
-			svc.logFatal(js, fmt.Sprintf("Unable to traverse order dir: %s", err.Error()))
-			return
+			svc.logError(js, fmt.Sprintf("Unable to load metadata for %s: %s", tgtBC, err.Error()))
+			return nil
 		}
+		now := time.Now()
+		mdRec.HathiTrustStatus.PackageSubmittedAt = &now
+		mdRec.HathiTrustStatus.PackageStatus = "submitted"
+		err = svc.GDB.Model(&mdRec.HathiTrustStatus).Select("PackageSubmittedAt", "PackageStatus").Updates(mdRec.HathiTrustStatus).Error
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("Unable to update hathitrust status for %s: %s", tgtBC, err.Error()))
+			return nil
+		}
+
+		return nil
+	})
 
-		svc.logInfo(js, fmt.Sprintf("%d packages submitted", submitted))
-		svc.jobDone(js)
-	}()
+	if err != nil {
+		svc.logFatal(js, fmt.Sprintf("Unable to traverse order dir: %s", err.Error()))
+		return nil
+	}
 
-	c.String(http.StatusOK, "package submit request started")
+	svc.logInfo(js, fmt.Sprintf("%d packages submitted", submitted))
+	svc.jobDone(js)
+	return nil
 }
 
 func (svc *ServiceContext) validateHathiTrustRequestor(computeID string) (*staffMember, error) {
@@ -868,7 +932,7 @@ func (svc *ServiceContext) validateHathiTrustRequestor(computeID string) (*staff
 }
 
 func (svc *ServiceContext) listHathiTrustSubmissions(c *gin.Context) {
-	resp, err := svc.getHathiTrustDirectoryContent()
+	resp, err := svc.getHathiTrustDirectoryContent(c.Request.Context())
 	if err != nil {
 		log.Printf("ERROR: listHathiTrustSubmissions failed: %s", err.Error())
 		c.String(http.StatusInternalServerError, err.Error())
@@ -877,9 +941,9 @@ func (svc *ServiceContext) listHathiTrustSubmissions(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
-func (svc *ServiceContext) getHathiTrustDirectoryContent() ([]hathiTrustSubmission, error) {
+func (svc *ServiceContext) getHathiTrustDirectoryContent(ctx context.Context) ([]hathiTrustSubmission, error) {
 	// rclone lsjson hathitrust:virginia
-	cmd := exec.Command(path.Join(svc.HathiTrust.RCloneBin, "rclone"),
+	cmd := exec.CommandContext(ctx, path.Join(svc.HathiTrust.RCloneBin, "rclone"),
 		"--config", svc.HathiTrust.RCloneConfig,
 		"lsjson",
 		fmt.Sprintf("%s:%s", svc.HathiTrust.RCloneRemote, svc.HathiTrust.RemoteDir))
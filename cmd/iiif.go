@@ -3,17 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
 	"time"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type iiifContext struct {
@@ -27,6 +21,11 @@ func (iifp *iiifContext) S3Key() string {
 }
 
 func (svc *ServiceContext) publishToIIIF(js *jobStatus, mf *masterFile, srcPath string, overwrite bool) error {
+	return svc.publishToIIIFWithProfile(js, mf, srcPath, overwrite, jp2Settings{})
+}
+
+// publishToIIIFWithProfile publishes a master file to IIIF, encoding tifs with the requested JP2 profile and encoder
+func (svc *ServiceContext) publishToIIIFWithProfile(js *jobStatus, mf *masterFile, srcPath string, overwrite bool, settings jp2Settings) error {
 	svc.logInfo(js, fmt.Sprintf("Publish master file %s from %s to IIIF; overwrite %t", mf.PID, srcPath, overwrite))
 
 	svc.logInfo(js, "Validate file type is TIF or JP2")
@@ -47,7 +46,7 @@ func (svc *ServiceContext) publishToIIIF(js *jobStatus, mf *masterFile, srcPath
 	}
 
 	if iiifExist {
-		svc.logInfo(js, fmt.Sprintf("MasterFile %s already has a JP2 file on S3: %s/%s", mf.PID, svc.IIIF.Bucket, iiifInfo.S3Key()))
+		svc.logInfo(js, fmt.Sprintf("MasterFile %s already has a JP2 file in IIIF storage: %s/%s", mf.PID, svc.IIIF.Storage.location(), iiifInfo.S3Key()))
 		if overwrite == false {
 			svc.logInfo(js, "Overwrite not requested; nothing more to do")
 			return nil
@@ -55,112 +54,95 @@ func (svc *ServiceContext) publishToIIIF(js *jobStatus, mf *masterFile, srcPath
 		svc.logInfo(js, "Existing file will be overwritten")
 	}
 
+	defer os.Remove(iiifInfo.StagePath)
 	switch fileType {
 	case "jp2":
 		svc.logInfo(js, fmt.Sprintf("MasterFile %s is already jp2; send directly to IIIF staging: %s", mf.PID, iiifInfo.StagePath))
-		copyFile(srcPath, iiifInfo.StagePath, 0664)
-	case "tiff":
-		svc.logInfo(js, fmt.Sprintf("Compressing %s to %s using imagemagick...", srcPath, iiifInfo.StagePath))
+		_, err = copyFile(srcPath, iiifInfo.StagePath, 0664)
+		if err != nil {
+			return fmt.Errorf("unable to copy %s to IIIF staging: %s", srcPath, err.Error())
+		}
+		settings = jp2Settings{}
+		err = validateJP2(iiifInfo.StagePath, mf, nil)
+		if err != nil {
+			return err
+		}
+	case "tif", "tiff":
+		settings = svc.resolveJP2Settings(mf.UnitID, settings)
+		svc.logInfo(js, fmt.Sprintf("Compressing %s to %s using jp2 profile %s and encoder %s...", srcPath, iiifInfo.StagePath, settings.Profile, settings.Encoder))
 		rawFileInfo, _ := os.Stat(srcPath)
-		firstPage := fmt.Sprintf("%s[0]", srcPath) // need the [0] as some tifs have multiple pages. only want the first.
-		cmdArray := []string{firstPage, "-define", "jp2:rate=50 jp2:progression-order=RPCL jp2:number-resolutions=7", iiifInfo.StagePath}
 		startTime := time.Now()
-		cmd := exec.Command("magick", cmdArray...)
-		svc.logInfo(js, fmt.Sprintf("%+v", cmd))
-		_, err = cmd.Output()
+		settings.Encoder, err = svc.encodeJP2(js, srcPath, iiifInfo.StagePath, settings)
 		if err != nil {
 			return err
 		}
 		elapsed := time.Since(startTime)
 		svc.logInfo(js, fmt.Sprintf("...compression complete; tif size %.2fM, elapsed time %.2f seconds", float64(rawFileInfo.Size())/1000000.0, elapsed.Seconds()))
+		profile, _ := getJP2Profile(settings.Profile)
+		err = validateJP2(iiifInfo.StagePath, mf, profile)
+		if err != nil {
+			return err
+		}
+		svc.logInfo(js, fmt.Sprintf("Generated jp2 %s is valid", iiifInfo.StagePath))
 	}
 
-	svc.logInfo(js, fmt.Sprintf("Upload staged  jp2 file %s to S3 IIIF bucket %s:%s", iiifInfo.StagePath, svc.IIIF.Bucket, iiifInfo.S3Key()))
-	err = svc.uploadToIIIF(iiifInfo.StagePath, iiifInfo.S3Key())
-
-	svc.logInfo(js, fmt.Sprintf("%s has been published to IIIF", mf.PID))
-	defer os.Remove(iiifInfo.StagePath)
-	return nil
-}
+	svc.logInfo(js, fmt.Sprintf("Upload staged jp2 file %s to IIIF storage %s:%s", iiifInfo.StagePath, svc.IIIF.Storage.location(), iiifInfo.S3Key()))
+	err = svc.uploadToIIIF(js, iiifInfo.StagePath, iiifInfo.S3Key())
+	if err != nil {
+		return fmt.Errorf("unable to upload %s to iiif: %s", iiifInfo.StagePath, err.Error())
+	}
 
-func (svc *ServiceContext) uploadToIIIF(srcPath string, s3Key string) error {
-	jp2File, err := os.Open(srcPath)
+	err = svc.saveJP2TechMeta(mf, iiifInfo.StagePath, settings)
 	if err != nil {
-		return err
+		svc.logError(js, fmt.Sprintf("Unable to save jp2 tech metadata for %s: %s", mf.PID, err.Error()))
 	}
 
-	_, err = svc.IIIF.S3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(svc.IIIF.Bucket),
-		Key:    aws.String(s3Key),
-		Body:   jp2File,
-	})
+	svc.logInfo(js, fmt.Sprintf("%s has been published to IIIF", mf.PID))
+	return nil
+}
 
+func (svc *ServiceContext) uploadToIIIF(js *jobStatus, srcPath string, key string) error {
+	start := time.Now()
+	err := svc.IIIF.Storage.put(js.context(), srcPath, key)
 	if err != nil {
 		return err
 	}
+	svc.logTransferRate(js, "Uploaded", srcPath, time.Since(start))
 	return nil
 }
 
 func (svc *ServiceContext) iiifExists(iiifInfo iiifContext) (bool, error) {
-	out, err := svc.IIIF.S3Client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-		Bucket:  aws.String(svc.IIIF.Bucket),
-		Prefix:  aws.String(iiifInfo.BucketPrefix),
-		MaxKeys: aws.Int32(1),
-	})
-	if err != nil {
-		return false, err
-	}
-	if len(out.Contents) == 0 {
-		return false, nil
-	}
-
-	imgInfo := out.Contents[0]
-	if imgInfo.Size == nil || imgInfo.Size != nil && *imgInfo.Size == 0 {
-		return false, nil
-	}
-
-	return true, nil
+	return svc.IIIF.Storage.exists(context.TODO(), iiifInfo.S3Key())
 }
 
-func (svc *ServiceContext) downlodFromIIIF(js *jobStatus, s3Key string, destFileName string) error {
-	svc.logInfo(js, fmt.Sprintf("Download masterfile %s from IIIF to %s", s3Key, destFileName))
-	resp, err := svc.IIIF.S3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(svc.IIIF.Bucket),
-		Key:    aws.String(s3Key),
-	})
+func (svc *ServiceContext) downlodFromIIIF(js *jobStatus, key string, destFileName string) error {
+	svc.logInfo(js, fmt.Sprintf("Download masterfile %s from IIIF to %s", key, destFileName))
+	start := time.Now()
+	err := svc.IIIF.Storage.get(js.context(), key, destFileName)
 	if err != nil {
 		return err
 	}
+	svc.logTransferRate(js, fmt.Sprintf("Masterfile %s downloaded from IIIF;", key), destFileName, time.Since(start))
+	return nil
+}
 
-	defer resp.Body.Close()
-	destFile, err := os.Create(destFileName)
+// logTransferRate logs the size of a transferred file and the throughput of the transfer
+func (svc *ServiceContext) logTransferRate(js *jobStatus, prefix string, fileName string, elapsed time.Duration) {
+	fi, err := os.Stat(fileName)
 	if err != nil {
-		return fmt.Errorf("unable to create destination %s for iiif download: %s", destFileName, err.Error())
+		return
 	}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("unable to read image data from %s: %s", s3Key, err.Error())
+	sizeMB := float64(fi.Size()) / 1000000.0
+	rate := 0.0
+	if elapsed.Seconds() > 0 {
+		rate = sizeMB / elapsed.Seconds()
 	}
-	_, err = destFile.Write(body)
-	if err != nil {
-		return fmt.Errorf("unable to write image data from %s to %s: %s", s3Key, destFileName, err.Error())
-	}
-	svc.logInfo(js, fmt.Sprintf("Masterfile %s downloaded from IIIF to %s", s3Key, destFileName))
-	return nil
+	svc.logInfo(js, fmt.Sprintf("%s %s %.2fM in %.2f seconds (%.2fM/sec)", prefix, fileName, sizeMB, elapsed.Seconds(), rate))
 }
 
-func (svc *ServiceContext) unpublishIIIF(js *jobStatus, s3Key string) error {
-	svc.logInfo(js, fmt.Sprintf("Removing masterfile published to IIIF as %s", s3Key))
-	var objectIds []types.ObjectIdentifier
-	objectIds = append(objectIds, types.ObjectIdentifier{Key: aws.String(s3Key)})
-	_, err := svc.IIIF.S3Client.DeleteObjects(context.TODO(), &s3.DeleteObjectsInput{
-		Bucket: aws.String(svc.IIIF.Bucket),
-		Delete: &types.Delete{Objects: objectIds},
-	})
-	if err != nil {
-		return err
-	}
-	return nil
+func (svc *ServiceContext) unpublishIIIF(js *jobStatus, key string) error {
+	svc.logInfo(js, fmt.Sprintf("Removing masterfile published to IIIF as %s", key))
+	return svc.IIIF.Storage.remove(js.context(), key)
 }
 
 func (svc *ServiceContext) getIIIFContext(mfPID string) iiifContext {
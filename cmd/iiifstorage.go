@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// iiifStorage is where the jp2 images served by the IIIF server are published. Keys are the
+// relative image paths generated by getIIIFContext.
+type iiifStorage interface {
+	// location describes where images are stored for log messages
+	location() string
+	// put stores an image along with its checksums
+	put(ctx context.Context, srcPath string, key string) error
+	get(ctx context.Context, key string, destPath string) error
+	exists(ctx context.Context, key string) (bool, error)
+	// checksums returns the checksums recorded when the image was stored. They are blank for
+	// images stored before checksums were recorded.
+	checksums(ctx context.Context, key string) (*fileChecksums, error)
+	remove(ctx context.Context, key string) error
+}
+
+// s3IIIFStorage publishes images to an S3 bucket. Transfers use the s3 managers so large images
+// are streamed in parts instead of being held in memory.
+type s3IIIFStorage struct {
+	client     *s3.Client
+	uploader   *manager.Uploader
+	downloader *manager.Downloader
+	bucket     string
+}
+
+// part size and number of concurrent parts for s3 transfers
+const iiifPartSize = 16 * 1024 * 1024
+const iiifTransferConcurrency = 4
+
+// fileIIIFStorage publishes images to a local directory; used for development and on-prem IIIF servers
+type fileIIIFStorage struct {
+	rootDir string
+}
+
+func newIIIFStorage(cfg IIIFConfig) (iiifStorage, error) {
+	switch cfg.Storage {
+	case "s3":
+		awsCfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRetryMaxAttempts(5))
+		if err != nil {
+			return nil, fmt.Errorf("unable to load s3 config: %s", err.Error())
+		}
+		client := s3.NewFromConfig(awsCfg)
+		storage := s3IIIFStorage{client: client, bucket: cfg.Bucket}
+		storage.uploader = manager.NewUploader(client, func(u *manager.Uploader) {
+			u.PartSize = iiifPartSize
+			u.Concurrency = iiifTransferConcurrency
+		})
+		storage.downloader = manager.NewDownloader(client, func(d *manager.Downloader) {
+			d.PartSize = iiifPartSize
+			d.Concurrency = iiifTransferConcurrency
+		})
+		return &storage, nil
+	case "file":
+		err := os.MkdirAll(cfg.StorageDir, 0775)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create iiif storage directory %s: %s", cfg.StorageDir, err.Error())
+		}
+		return &fileIIIFStorage{rootDir: cfg.StorageDir}, nil
+	}
+	return nil, fmt.Errorf("%s is not a supported iiif storage type", cfg.Storage)
+}
+
+func (s *s3IIIFStorage) location() string {
+	return fmt.Sprintf("s3://%s", s.bucket)
+}
+
+// put hashes the image as it is uploaded. The checksums are only known once the upload is done,
+// so they are added to the object metadata with a server side copy.
+func (s *s3IIIFStorage) put(ctx context.Context, srcPath string, key string) error {
+	jp2File, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer jp2File.Close()
+
+	cw := newChecksumWriter()
+	_, err = s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   io.TeeReader(jp2File, cw),
+	})
+	if err != nil {
+		return err
+	}
+	sums := cw.checksums()
+	_, err = s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(fmt.Sprintf("%s/%s", s.bucket, key)),
+		MetadataDirective: types.MetadataDirectiveReplace,
+		Metadata:          map[string]string{"md5": sums.MD5, "sha256": sums.SHA256},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to add checksums to %s: %s", key, err.Error())
+	}
+	return nil
+}
+
+func (s *s3IIIFStorage) get(ctx context.Context, key string, destPath string) error {
+	destFile, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %s", destPath, err.Error())
+	}
+	defer destFile.Close()
+
+	_, err = s.downloader.Download(ctx, destFile, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		os.Remove(destPath)
+		return err
+	}
+	return nil
+}
+
+func (s *s3IIIFStorage) exists(ctx context.Context, key string) (bool, error) {
+	out, err := s.head(ctx, key)
+	if err != nil || out == nil {
+		return false, err
+	}
+	return out.ContentLength != nil && *out.ContentLength > 0, nil
+}
+
+func (s *s3IIIFStorage) checksums(ctx context.Context, key string) (*fileChecksums, error) {
+	out, err := s.head(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		return nil, fmt.Errorf("%s not found", key)
+	}
+	return &fileChecksums{MD5: out.Metadata["md5"], SHA256: out.Metadata["sha256"]}, nil
+}
+
+// head returns the metadata for the object with the exact key, or nil if there is no such object
+func (s *s3IIIFStorage) head(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *s3IIIFStorage) remove(ctx context.Context, key string) error {
+	var objectIds []types.ObjectIdentifier
+	objectIds = append(objectIds, types.ObjectIdentifier{Key: aws.String(key)})
+	_, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(s.bucket),
+		Delete: &types.Delete{Objects: objectIds},
+	})
+	return err
+}
+
+func (s *fileIIIFStorage) location() string {
+	return s.rootDir
+}
+
+func (s *fileIIIFStorage) put(ctx context.Context, srcPath string, key string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	destPath := path.Join(s.rootDir, key)
+	err = os.MkdirAll(filepath.Dir(destPath), 0775)
+	if err != nil {
+		return err
+	}
+	// write to a temp file first so the IIIF server never sees a partial image
+	tmpPath := destPath + ".tmp"
+	cw := newChecksumWriter()
+	err = writeIIIFFile(io.TeeReader(src, cw), tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, destPath)
+	if err != nil {
+		return err
+	}
+	sumsJSON, _ := json.Marshal(cw.checksums())
+	return os.WriteFile(destPath+".checksums", sumsJSON, 0664)
+}
+
+func (s *fileIIIFStorage) get(ctx context.Context, key string, destPath string) error {
+	src, err := os.Open(path.Join(s.rootDir, key))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return writeIIIFFile(src, destPath)
+}
+
+func (s *fileIIIFStorage) exists(ctx context.Context, key string) (bool, error) {
+	fi, err := os.Stat(path.Join(s.rootDir, key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return fi.Size() > 0, nil
+}
+
+func (s *fileIIIFStorage) checksums(ctx context.Context, key string) (*fileChecksums, error) {
+	exists, err := s.exists(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if exists == false {
+		return nil, fmt.Errorf("%s not found", key)
+	}
+	var sums fileChecksums
+	raw, err := os.ReadFile(path.Join(s.rootDir, key) + ".checksums")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &sums, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(raw, &sums)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksums for %s: %s", key, err.Error())
+	}
+	return &sums, nil
+}
+
+func (s *fileIIIFStorage) remove(ctx context.Context, key string) error {
+	for _, fn := range []string{path.Join(s.rootDir, key), path.Join(s.rootDir, key) + ".checksums"} {
+		err := os.Remove(fn)
+		if err != nil && errors.Is(err, os.ErrNotExist) == false {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeIIIFFile(src io.Reader, destPath string) error {
+	destFile, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %s", destPath, err.Error())
+	}
+	defer destFile.Close()
+	_, err = io.Copy(destFile, src)
+	if err != nil {
+		return fmt.Errorf("unable to write image data to %s: %s", destPath, err.Error())
+	}
+	return nil
+}
+
+// verifyIIIFChecksum downloads a published image and compares its checksum to the one recorded when it
+// was stored. Returns nil if there is no recorded checksum to compare against.
+func (svc *ServiceContext) verifyIIIFChecksum(ctx context.Context, key string) (*bool, error) {
+	stored, err := svc.IIIF.Storage.checksums(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if stored.SHA256 == "" && stored.MD5 == "" {
+		return nil, nil
+	}
+
+	tmpFile, err := os.CreateTemp("", "iiif-verify-*.jp2")
+	if err != nil {
+		return nil, err
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+	err = svc.IIIF.Storage.get(ctx, key, tmpFile.Name())
+	if err != nil {
+		return nil, err
+	}
+	current, err := computeChecksums(tmpFile.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	match := current.MD5 == stored.MD5
+	if stored.SHA256 != "" {
+		match = current.SHA256 == stored.SHA256
+	}
+	return &match, nil
+}
@@ -1,20 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"math"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
-	"runtime/debug"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -28,8 +26,6 @@ type tifMetadata struct {
 	Location    string
 }
 
-const maxJP2Batches = 5
-
 type jp2Source struct {
 	MasterFile *masterFile
 	Path       string
@@ -135,82 +131,101 @@ func (svc *ServiceContext) importOrderImages(c *gin.Context) {
 		svc.logInfo(js, fmt.Sprintf("Unit with staff_notes [%s] already exists; using it", staffNotes))
 	}
 
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				svc.logFatal(js, fmt.Sprintf("fatal error while ingesting images: %v", r))
-				log.Printf("ERROR: Panic recovered during guest image ingest: %v", r)
-				debug.PrintStack()
-			}
-		}()
+	err = svc.enqueueJob(js, "ImportOrderImages", orderImportJob{UnitID: tgtUnit.ID, From: req.From, Target: req.Target, SrcDir: srcDir})
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		cnt := 0
-		err = filepath.Walk(srcDir, func(fullPath string, entry os.FileInfo, err error) error {
-			if err != nil || entry.IsDir() {
-				return nil
-			}
+	out := orderImportResp{
+		JobID:  js.ID,
+		UnitID: tgtUnit.ID,
+	}
+	c.JSON(http.StatusOK, out)
+}
 
-			// Grab the file extension - including the dot
-			ext := filepath.Ext(entry.Name())
-			if strings.ToLower(ext) != ".tif" || strings.Index(entry.Name(), "._") == 0 {
-				// skip non .tif files and macOS temp files
-				return nil
-			}
+type orderImportJob struct {
+	UnitID int64
+	From   string
+	Target string
+	SrcDir string
+}
 
-			tifFile := tifInfo{path: fullPath, filename: entry.Name(), size: entry.Size()}
-			svc.logInfo(js, fmt.Sprintf("ingest %s", tifFile.path))
+func (svc *ServiceContext) runImportOrderImages(js *jobStatus, payload []byte) error {
+	var req orderImportJob
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid ImportOrderImages payload: %s", err.Error())
+	}
+	srcDir := req.SrcDir
+	var tgtUnit unit
+	err = svc.GDB.First(&tgtUnit, req.UnitID).Error
+	if err != nil {
+		return fmt.Errorf("unable to load unit %d: %s", req.UnitID, err.Error())
+	}
 
-			newMF, err := svc.getOrCreateMasterFile(js, tifFile, &tgtUnit, false)
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("Create masterfile failed: %s", err.Error()))
-				return nil
-			}
+	cnt := 0
+	err = filepath.Walk(srcDir, func(fullPath string, entry os.FileInfo, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
 
-			err = svc.publishToIIIF(nil, newMF, tifFile.path, false)
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("IIIF publish failed: %s", err.Error()))
-				return nil
-			}
+		// Grab the file extension - including the dot
+		ext := filepath.Ext(entry.Name())
+		if strings.ToLower(ext) != ".tif" || strings.Index(entry.Name(), "._") == 0 {
+			// skip non .tif files and macOS temp files
+			return nil
+		}
 
-			if req.From == "from_fineArts" {
-				if newMF.DateArchived == nil {
-					archiveMD5, err := svc.archiveFineArtsFile(tifFile.path, req.Target, newMF)
-					if err != nil {
-						svc.logError(js, fmt.Sprintf("archive failed: %s", err.Error()))
-						return nil
-					}
-					if archiveMD5 != newMF.MD5 {
-						svc.logError(js, fmt.Sprintf("archived MD5 does not match source MD5 for %s", newMF.Filename))
-					}
-				}
-			}
+		tifFile := tifInfo{path: fullPath, filename: entry.Name(), size: entry.Size()}
+		svc.logInfo(js, fmt.Sprintf("ingest %s", tifFile.path))
 
-			cnt++
+		newMF, err := svc.getOrCreateMasterFile(js, tifFile, &tgtUnit, false)
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("Create masterfile failed: %s", err.Error()))
 			return nil
-		})
+		}
 
+		err = svc.publishToIIIF(nil, newMF, tifFile.path, false)
 		if err != nil {
-			svc.logFatal(js, err.Error())
-		} else {
-			svc.logInfo(js, fmt.Sprintf("%d masterfiles processed", cnt))
-			tgtUnit.UnitStatus = "done"
-			if req.From == "from_fineArts" && tgtUnit.DateArchived == nil {
-				now := time.Now()
-				tgtUnit.DateArchived = &now
-				svc.GDB.Model(&tgtUnit).Select("UnitStatus", "DateArchived").Updates(tgtUnit)
-			} else {
-				svc.GDB.Model(&tgtUnit).Select("UnitStatus").Updates(tgtUnit)
+			svc.logError(js, fmt.Sprintf("IIIF publish failed: %s", err.Error()))
+			return nil
+		}
+
+		if req.From == "from_fineArts" {
+			if newMF.DateArchived == nil {
+				archiveMD5, err := svc.archiveFineArtsFile(tifFile.path, req.Target, newMF)
+				if err != nil {
+					svc.logError(js, fmt.Sprintf("archive failed: %s", err.Error()))
+					return nil
+				}
+				if archiveMD5 != newMF.MD5 {
+					svc.logError(js, fmt.Sprintf("archived MD5 does not match source MD5 for %s", newMF.Filename))
+				}
 			}
 		}
 
-		svc.jobDone(js)
-	}()
+		cnt++
+		return nil
+	})
 
-	out := orderImportResp{
-		JobID:  js.ID,
-		UnitID: tgtUnit.ID,
+	if err != nil {
+		svc.logFatal(js, err.Error())
+	} else {
+		svc.logInfo(js, fmt.Sprintf("%d masterfiles processed", cnt))
+		tgtUnit.UnitStatus = "done"
+		if req.From == "from_fineArts" && tgtUnit.DateArchived == nil {
+			now := time.Now()
+			tgtUnit.DateArchived = &now
+			svc.GDB.Model(&tgtUnit).Select("UnitStatus", "DateArchived").Updates(tgtUnit)
+		} else {
+			svc.GDB.Model(&tgtUnit).Select("UnitStatus").Updates(tgtUnit)
+		}
 	}
-	c.JSON(http.StatusOK, out)
+
+	svc.jobDone(js)
+	return nil
 }
 
 func (svc *ServiceContext) importImages(js *jobStatus, tgtUnit *unit, srcDir string) error {
@@ -242,20 +257,23 @@ func (svc *ServiceContext) importImages(js *jobStatus, tgtUnit *unit, srcDir str
 		return err
 	}
 
-	// set up parallel jp2 batch processing
-	filePerBatch := int(math.Ceil(float64(len(tifFiles)) / float64(maxJP2Batches)))
-	batches := uint(math.Ceil(float64(len(tifFiles)) / float64(filePerBatch)))
-	jp2Batch := make([]jp2Source, 0)
-	var jp2WG sync.WaitGroup
-	svc.logInfo(js, fmt.Sprintf("IIIF processing: %d masterfiles with a max of %d batches; %d files per batch, %d batches", len(tifFiles), maxJP2Batches, filePerBatch, batches))
+	// jp2 conversions run in the background using the service-wide jp2 pool
+	jp2Batch := svc.newIIIFPublishBatch(js, false)
+	svc.logInfo(js, fmt.Sprintf("IIIF processing: %d masterfiles with a max of %d concurrent conversions", len(tifFiles), svc.JP2Pool.size()))
 	startTime := time.Now()
 
 	for _, fi := range tifFiles {
+		if js.canceled() {
+			// let any in-progress conversions wind down before giving up
+			jp2Batch.wait()
+			return fmt.Errorf("import canceled before %s", fi.path)
+		}
 		svc.logInfo(js, fmt.Sprintf("Import %s", fi.path))
 
 		// grab metadata from exif headers
-		tifMD, err := extractTifMetadata(fi.path)
+		tifMD, err := extractTifMetadata(js.context(), fi.path)
 		if err != nil {
+			jp2Batch.wait()
 			return err
 		}
 		svc.logInfo(js, fmt.Sprintf("Extracted the following TIF metadata: %+v", *tifMD))
@@ -263,6 +281,7 @@ func (svc *ServiceContext) importImages(js *jobStatus, tgtUnit *unit, srcDir str
 		// See if this masterfile has already been created...
 		newMF, err := svc.loadMasterFile(fi.filename)
 		if err != nil {
+			jp2Batch.wait()
 			return err
 		}
 		if newMF.ID == 0 {
@@ -283,6 +302,7 @@ func (svc *ServiceContext) importImages(js *jobStatus, tgtUnit *unit, srcDir str
 
 			err = svc.GDB.Create(&newMF).Error
 			if err != nil {
+				jp2Batch.wait()
 				return err
 			}
 			svc.logInfo(js, fmt.Sprintf("Master file %s created", fi.filename))
@@ -292,7 +312,7 @@ func (svc *ServiceContext) importImages(js *jobStatus, tgtUnit *unit, srcDir str
 
 		if newMF.ImageTechMeta.ID == 0 {
 			svc.logInfo(js, "Create image tech metadata")
-			err = svc.createImageTechMetadata(newMF, fi.path)
+			err = svc.createImageTechMetadata(js, newMF, fi.path)
 			if err != nil {
 				svc.logError(js, fmt.Sprintf("Unable to create image tech metadata: %s", err.Error()))
 			}
@@ -323,28 +343,12 @@ func (svc *ServiceContext) importImages(js *jobStatus, tgtUnit *unit, srcDir str
 			}
 		}
 
-		jp2Batch = append(jp2Batch, jp2Source{MasterFile: newMF, Path: fi.path})
-		if len(jp2Batch) == filePerBatch {
-			svc.logInfo(js, fmt.Sprintf("Start JP2 processing for a batch of %d master files", len(jp2Batch)))
-			jp2WG.Add(1)
-
-			batchCopy := make([]jp2Source, len(jp2Batch))
-			cnt := copy(batchCopy, jp2Batch)
-			if cnt == 0 {
-				return fmt.Errorf("unable to start iiif batch processing; source copy failed")
-			}
-
-			go func() {
-				defer jp2WG.Done()
-				svc.batchIIIFPublish(js, batchCopy, false)
-			}()
-
-			jp2Batch = make([]jp2Source, 0)
-		}
+		jp2Batch.add(jp2Source{MasterFile: newMF, Path: fi.path})
 
 		if tgtUnit.ThrowAway == false && tgtUnit.DateArchived == nil {
 			archiveMD5, err := svc.archiveFile(js, fi.path, tgtUnit.ID, newMF)
 			if err != nil {
+				jp2Batch.wait()
 				return fmt.Errorf("Archive failed: %s", err.Error())
 			}
 			if archiveMD5 != newMF.MD5 {
@@ -355,6 +359,7 @@ func (svc *ServiceContext) importImages(js *jobStatus, tgtUnit *unit, srcDir str
 		if tgtUnit.IntendedUse.ID != 110 && tgtUnit.IntendedUse.DeliverableFormat != "pdf" {
 			err = svc.createPatronDeliverable(js, tgtUnit, newMF, fi.path, assembleDir, callNumber, location)
 			if err != nil {
+				jp2Batch.wait()
 				return fmt.Errorf("Create patron deliverable failed: %s", err.Error())
 			}
 		}
@@ -374,17 +379,8 @@ func (svc *ServiceContext) importImages(js *jobStatus, tgtUnit *unit, srcDir str
 		}
 	}
 
-	if len(jp2Batch) > 0 {
-		svc.logInfo(js, fmt.Sprintf("Start FINAL JP2 processing for a batch of %d master files", len(jp2Batch)))
-		jp2WG.Add(1)
-		go func() {
-			defer jp2WG.Done()
-			svc.batchIIIFPublish(js, jp2Batch, false)
-		}()
-	}
-
 	svc.logInfo(js, fmt.Sprintf("%d master files processed; await completion of IIIF publish", len(tifFiles)))
-	jp2WG.Wait()
+	iiifErr := jp2Batch.wait()
 
 	elapsed := time.Since(startTime)
 	svc.logInfo(js, fmt.Sprintf("%d master files ingested; total time %.2f seconds", len(tifFiles), elapsed.Seconds()))
@@ -392,6 +388,9 @@ func (svc *ServiceContext) importImages(js *jobStatus, tgtUnit *unit, srcDir str
 	tgtUnit.DateArchived = &now
 	svc.GDB.Model(tgtUnit).Select("DateArchived").Updates(*tgtUnit)
 	svc.checkOrderArchiveComplete(js, tgtUnit.OrderID)
+	if iiifErr != nil {
+		return iiifErr
+	}
 
 	svc.logInfo(js, "Images for Unit successfully imported.")
 	return nil
@@ -427,7 +426,7 @@ func (svc *ServiceContext) getOrCreateMasterFile(js *jobStatus, srcTifInfo tifIn
 				svc.logError(js, fmt.Sprintf("unable to delete existing tech metadata record %d: %s", newMF.ImageTechMeta.ID, err.Error()))
 			}
 		}
-		err = svc.createImageTechMetadata(newMF, srcTifInfo.path)
+		err = svc.createImageTechMetadata(js, newMF, srcTifInfo.path)
 		if err != nil {
 			svc.logError(js, fmt.Sprintf("unable to create image tech metadata: %s", err.Error()))
 		}
@@ -454,22 +453,9 @@ func (svc *ServiceContext) loadMasterFile(filename string) (*masterFile, error)
 	return &newMF, nil
 }
 
-func (svc *ServiceContext) batchIIIFPublish(js *jobStatus, items []jp2Source, overwrite bool) {
-	svc.logInfo(js, fmt.Sprintf("Process batch of %d master files", len(items)))
-	startTime := time.Now()
-	for _, item := range items {
-		err := svc.publishToIIIF(js, item.MasterFile, item.Path, overwrite)
-		if err != nil {
-			svc.logError(js, fmt.Sprintf("Unable to publish master file %s to IIIF: %s", item.MasterFile.PID, err.Error()))
-		}
-	}
-	elapsed := time.Since(startTime)
-	svc.logInfo(js, fmt.Sprintf("Finished IIIF processing for a batch of %d files; total time %.2f seconds", len(items), elapsed.Seconds()))
-}
-
-func extractTifMetadata(tifPath string) (*tifMetadata, error) {
+func extractTifMetadata(ctx context.Context, tifPath string) (*tifMetadata, error) {
 	cmdArray := []string{"-json", "-iptc:OwnerID", "-iptc:headline", "-iptc:caption-abstract", "-iptc:sub-location", tifPath}
-	stdout, err := exec.Command("exiftool", cmdArray...).Output()
+	stdout, err := exec.CommandContext(ctx, "exiftool", cmdArray...).Output()
 	if err != nil {
 		return nil, err
 	}
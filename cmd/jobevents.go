@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// jobEventBroker fans out job events to the clients streaming a job as they are logged
+type jobEventBroker struct {
+	lock        sync.Mutex
+	subscribers map[int64]map[chan event]bool
+}
+
+type jobEventsResponse struct {
+	Total  int64   `json:"total"`
+	Offset int     `json:"offset"`
+	Limit  int     `json:"limit"`
+	Events []event `json:"events"`
+}
+
+func (b *jobEventBroker) subscribe(jobID int64) chan event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[int64]map[chan event]bool)
+	}
+	if b.subscribers[jobID] == nil {
+		b.subscribers[jobID] = make(map[chan event]bool)
+	}
+	ch := make(chan event, 100)
+	b.subscribers[jobID][ch] = true
+	return ch
+}
+
+func (b *jobEventBroker) unsubscribe(jobID int64, ch chan event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, found := b.subscribers[jobID][ch]; found {
+		delete(b.subscribers[jobID], ch)
+		close(ch)
+	}
+	if len(b.subscribers[jobID]) == 0 {
+		delete(b.subscribers, jobID)
+	}
+}
+
+// publish sends an event to all clients streaming the job. Slow clients that have
+// fallen too far behind miss the event; they can catch up with /jobs/:id/events
+func (b *jobEventBroker) publish(e event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for ch := range b.subscribers[e.JobStatusID] {
+		select {
+		case ch <- e:
+		default:
+			log.Printf("WARNING: job %d event stream is full; event %d dropped", e.JobStatusID, e.ID)
+		}
+	}
+}
+
+// finish closes the streams for a job that has ended
+func (b *jobEventBroker) finish(jobID int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for ch := range b.subscribers[jobID] {
+		close(ch)
+	}
+	delete(b.subscribers, jobID)
+}
+
+func (svc *ServiceContext) getJobEvents(c *gin.Context) {
+	jobID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	var js jobStatus
+	err := svc.GDB.First(&js, jobID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.String(http.StatusNotFound, "not found")
+		} else {
+			c.String(http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	resp := jobEventsResponse{Offset: offset, Limit: limit, Events: make([]event, 0)}
+	err = svc.GDB.Model(&event{}).Where("job_status_id=?", jobID).Count(&resp.Total).Error
+	if err != nil {
+		log.Printf("ERROR: unable to count events for job %d: %s", jobID, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = svc.GDB.Where("job_status_id=?", jobID).Order("id asc").Offset(offset).Limit(limit).Find(&resp.Events).Error
+	if err != nil {
+		log.Printf("ERROR: unable to get events for job %d: %s", jobID, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// streamJobEvents sends all events logged so far for a job, then pushes new events as server-sent
+// events until the job ends or the client disconnects. Reconnecting clients send Last-Event-ID and
+// only receive the events they missed.
+func (svc *ServiceContext) streamJobEvents(c *gin.Context) {
+	jobID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	var js jobStatus
+	err := svc.GDB.First(&js, jobID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.String(http.StatusNotFound, "not found")
+		} else {
+			c.String(http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	lastID, _ := strconv.ParseInt(c.GetHeader("Last-Event-ID"), 10, 64)
+	log.Printf("INFO: stream events for job %d after event %d", jobID, lastID)
+
+	// subscribe before reading the prior events so nothing logged in between is missed
+	events := svc.JobEvents.subscribe(jobID)
+	defer svc.JobEvents.unsubscribe(jobID, events)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	var prior []event
+	err = svc.GDB.Where("job_status_id=? and id>?", jobID, lastID).Order("id asc").Find(&prior).Error
+	if err != nil {
+		log.Printf("ERROR: unable to get events for job %d: %s", jobID, err.Error())
+		c.Render(-1, sse.Event{Event: "error", Data: err.Error()})
+		return
+	}
+	for _, e := range prior {
+		sendJobEvent(c, e)
+		lastID = e.ID
+	}
+	c.Writer.Flush()
+
+	// the job may have ended before the subscription was made
+	err = svc.GDB.First(&js, jobID).Error
+	if err == nil && js.EndedAt != nil {
+		sendJobDone(c, &js)
+		return
+	}
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			log.Printf("INFO: client disconnected from job %d event stream", jobID)
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(c.Writer, ": keep-alive\n\n")
+			c.Writer.Flush()
+		case e, open := <-events:
+			if open == false {
+				// the job has ended
+				svc.GDB.First(&js, jobID)
+				sendJobDone(c, &js)
+				return
+			}
+			if e.ID > lastID {
+				sendJobEvent(c, e)
+				lastID = e.ID
+				c.Writer.Flush()
+			}
+		}
+	}
+}
+
+func sendJobEvent(c *gin.Context, e event) {
+	c.Render(-1, sse.Event{Id: fmt.Sprintf("%d", e.ID), Event: "event", Data: e})
+}
+
+func sendJobDone(c *gin.Context, js *jobStatus) {
+	c.Render(-1, sse.Event{Event: "done", Data: js})
+	c.Writer.Flush()
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// jobPayload holds the request data needed by a worker to run (or re-run) a queued job.
+// The job_statuses record tracks the state of the job; this is just the input.
+type jobPayload struct {
+	ID          int64
+	JobStatusID int64 `gorm:"index"`
+	JobType     string
+	Payload     string `gorm:"type:text"`
+	CreatedAt   time.Time
+}
+
+// jobHandler executes a queued job. A returned error is recorded as a fatal job error; handlers
+// that finish (or fail) the job themselves return nil.
+type jobHandler struct {
+	run func(js *jobStatus, payload []byte) error
+	// requeue is true for jobs that are safe to restart from the beginning if they
+	// were interrupted by a service restart
+	requeue bool
+}
+
+// errJobWaiting is returned by handlers that have handed work to an external service, like OCR. The job
+// releases its worker and waits with its payload saved; it is re-queued and run again from the start
+// once the work is done. Handlers that return it must be safe to re-run.
+var errJobWaiting = errors.New("job is waiting on an external service")
+
+// unitJobRequest is the payload for jobs that only need to know the target unit
+type unitJobRequest struct {
+	UnitID int64
+}
+
+type jobQueue struct {
+	jobs     chan int64
+	handlers map[string]jobHandler
+	// cancel functions for the jobs currently being run by a worker, keyed by job ID
+	running map[int64]context.CancelFunc
+	lock    sync.Mutex
+}
+
+func (svc *ServiceContext) initJobQueue(workers int) {
+	svc.JobQueue.jobs = make(chan int64, 1000)
+	svc.JobQueue.running = make(map[int64]context.CancelFunc)
+	svc.JobQueue.handlers = map[string]jobHandler{
+		"APTrustSubmit":                 {run: svc.runAPTrustSubmit},
+		"AuditUnitMasterFiles":          {run: svc.runAuditUnitMasterFiles, requeue: true},
+		"AuditYear":                     {run: svc.runAuditYear, requeue: true},
+		"BackfillSHA256":                {run: svc.runBackfillSHA256, requeue: true},
+		"CloneMasterFiles":              {run: svc.runCloneMasterFiles},
+		"CollectionAdd":                 {run: svc.runCollectionBulkAdd},
+		"CollectionExport":              {run: svc.runExportCollection, requeue: true},
+		"CopyArchivedFilesToProduction": {run: svc.runCopyFromArchive, requeue: true},
+		"CreatePatronDeliverables":      {run: svc.runCreatePatronDeliverables, requeue: true},
+		"CreatePDFBundle":               {run: svc.runCreatePDFBundle, requeue: true},
+		"DeleteMasterFiles":             {run: svc.runDeleteMasterFiles},
+		"AddMasterFiles":                {run: svc.runAddMasterFiles},
+		"FinalizeUnit":                  {run: svc.runFinalizeUnit, requeue: true},
+		"HathiTrustMetadata":            {run: svc.runHathiTrustMetadata},
+		"HathiTrustPackage":             {run: svc.runHathiTrustPackage, requeue: true},
+		"HathiTrustPackgeSubmit":        {run: svc.runHathiTrustPackageSubmit},
+		"ImportOrderImages":             {run: svc.runImportOrderImages, requeue: true},
+		"OCR":                           {run: svc.runOCR, requeue: true},
+		"ReplaceMasterFiles":            {run: svc.runReplaceMasterFiles},
+		"RepublishIIIF":                 {run: svc.runRepublishIIIF, requeue: true},
+		"Script":                        {run: svc.runQueuedScript},
+		"UnitIIIF":                      {run: svc.runPublishUnitImagesToIIIF, requeue: true},
+		"UpdateIIIF":                    {run: svc.runUpdateMasterFileIIIF, requeue: true},
+	}
+
+	log.Printf("INFO: start %d job workers", workers)
+	for i := 0; i < workers; i++ {
+		go svc.jobWorker(i + 1)
+	}
+}
+
+// enqueueJob saves the job payload and queues the job for processing by the worker pool
+func (svc *ServiceContext) enqueueJob(js *jobStatus, jobType string, payload any) error {
+	if _, found := svc.JobQueue.handlers[jobType]; found == false {
+		return fmt.Errorf("%s is not a supported job type", jobType)
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("unable to serialize %s job payload: %s", jobType, err.Error())
+	}
+
+	jp := jobPayload{JobStatusID: js.ID, JobType: jobType, Payload: string(payloadBytes)}
+	err = svc.GDB.Create(&jp).Error
+	if err != nil {
+		return fmt.Errorf("unable to save %s job payload: %s", jobType, err.Error())
+	}
+
+	js.Status = "pending"
+	err = svc.GDB.Model(js).Select("status").Updates(jobStatus{Status: "pending"}).Error
+	if err != nil {
+		return fmt.Errorf("unable to set %s job status to pending: %s", jobType, err.Error())
+	}
+
+	log.Printf("INFO: queue %s job %d", jobType, js.ID)
+	svc.pushJob(js.ID)
+	return nil
+}
+
+// saveJobPayload replaces the payload of a running job with one that records its progress, so the
+// job resumes from that point if it is requeued after a restart
+func (svc *ServiceContext) saveJobPayload(js *jobStatus, payload any) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("unable to serialize job payload: %s", err.Error())
+	}
+	err = svc.GDB.Model(&jobPayload{}).Where("job_status_id=?", js.ID).Update("payload", string(payloadBytes)).Error
+	if err != nil {
+		return fmt.Errorf("unable to save job payload: %s", err.Error())
+	}
+	return nil
+}
+
+func (svc *ServiceContext) pushJob(jobID int64) {
+	select {
+	case svc.JobQueue.jobs <- jobID:
+	default:
+		// the queue is full; don't block the request. the job will be picked up when a worker is free
+		log.Printf("WARNING: job queue is full; job %d will wait for an open slot", jobID)
+		go func() {
+			svc.JobQueue.jobs <- jobID
+		}()
+	}
+}
+
+func (svc *ServiceContext) jobWorker(workerID int) {
+	for jobID := range svc.JobQueue.jobs {
+		log.Printf("INFO: worker %d starts job %d", workerID, jobID)
+		svc.runQueuedJob(jobID)
+		log.Printf("INFO: worker %d finished job %d", workerID, jobID)
+	}
+}
+
+func (svc *ServiceContext) runQueuedJob(jobID int64) {
+	var js jobStatus
+	err := svc.GDB.First(&js, jobID).Error
+	if err != nil {
+		log.Printf("ERROR: unable to load queued job %d: %s", jobID, err.Error())
+		return
+	}
+	if js.Status != "pending" {
+		log.Printf("INFO: job %d has status %s and will not be run", jobID, js.Status)
+		return
+	}
+
+	// register the cancel func before the job leaves the pending state so a cancel
+	// request made while the job is starting up can always find it
+	ctx, cancel := context.WithCancel(context.Background())
+	js.ctx = ctx
+	svc.JobQueue.lock.Lock()
+	svc.JobQueue.running[js.ID] = cancel
+	svc.JobQueue.lock.Unlock()
+	defer func() {
+		svc.JobQueue.lock.Lock()
+		delete(svc.JobQueue.running, js.ID)
+		svc.JobQueue.lock.Unlock()
+		cancel()
+	}()
+
+	// only start the job if it is still pending; it may have been canceled while waiting
+	now := time.Now()
+	resp := svc.GDB.Model(&js).Where("status=?", "pending").Select("status", "started_at").Updates(jobStatus{Status: "running", StartedAt: &now})
+	if resp.Error != nil {
+		svc.logFatal(&js, fmt.Sprintf("Unable to start job: %s", resp.Error.Error()))
+		return
+	}
+	if resp.RowsAffected == 0 {
+		log.Printf("INFO: job %d is no longer pending and will not be run", jobID)
+		return
+	}
+	js.Status = "running"
+	js.StartedAt = &now
+
+	var jp jobPayload
+	err = svc.GDB.Where("job_status_id=?", jobID).Limit(1).Find(&jp).Error
+	if err != nil {
+		svc.logFatal(&js, fmt.Sprintf("Unable to load job payload: %s", err.Error()))
+		return
+	}
+	if jp.ID == 0 {
+		svc.logFatal(&js, "Job payload not found")
+		return
+	}
+	waiting := false
+	defer func() {
+		if waiting == false {
+			svc.GDB.Delete(&jp)
+		}
+	}()
+
+	handler, found := svc.JobQueue.handlers[jp.JobType]
+	if found == false {
+		svc.logFatal(&js, fmt.Sprintf("%s is not a supported job type", jp.JobType))
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR: Panic recovered during %s job %d: %v", jp.JobType, jobID, r)
+			debug.PrintStack()
+			svc.logFatal(&js, fmt.Sprintf("Panic recovered: %v", r))
+		}
+	}()
+
+	err = handler.run(&js, []byte(jp.Payload))
+	if errors.Is(err, errJobWaiting) {
+		if js.canceled() {
+			// canceled while submitting; the re-run finds its requests canceled and fails through the handler
+			svc.cancelOCRRequests(js.ID)
+		}
+		waiting = true
+		svc.parkJob(&js)
+	} else if err != nil {
+		svc.logFatal(&js, err.Error())
+	} else if js.canceled() {
+		// the handler stopped early without finishing the job
+		svc.jobCanceled(&js, "Job canceled")
+	}
+}
+
+// parkJob moves a job that is waiting on an external service out of the running state so its worker can take
+// another job. If the work finished before the job was parked, it is re-queued right away.
+func (svc *ServiceContext) parkJob(js *jobStatus) {
+	err := svc.GDB.Model(js).Where("status=?", "running").Select("status").Updates(jobStatus{Status: "waiting"}).Error
+	if err != nil {
+		svc.logFatal(js, fmt.Sprintf("Unable to set job status to waiting: %s", err.Error()))
+		return
+	}
+	js.Status = "waiting"
+	svc.logInfo(js, "Job is waiting on an external service; it will resume when the work is done")
+	if svc.hasPendingOCRRequest(js.ID) == false {
+		svc.resumeWaitingJob(js.ID)
+	}
+}
+
+// resumeWaitingJob re-queues a job that is waiting on an external service
+func (svc *ServiceContext) resumeWaitingJob(jobID int64) {
+	resp := svc.GDB.Model(&jobStatus{}).Where("id=? and status=?", jobID, "waiting").Update("status", "pending")
+	if resp.Error != nil {
+		log.Printf("ERROR: unable to resume waiting job %d: %s", jobID, resp.Error.Error())
+		return
+	}
+	if resp.RowsAffected > 0 {
+		log.Printf("INFO: waiting job %d has been re-queued", jobID)
+		svc.pushJob(jobID)
+	}
+}
+
+// cancelJob stops a pending or running job. Running jobs are stopped at the next cancellation check
+// and any external commands they have started are killed.
+func (svc *ServiceContext) cancelJob(c *gin.Context) {
+	jobID := c.Param("id")
+	var js jobStatus
+	err := svc.GDB.First(&js, jobID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.String(http.StatusNotFound, "not found")
+		} else {
+			c.String(http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	if js.EndedAt != nil {
+		log.Printf("INFO: job %d has already ended with status %s and cannot be canceled", js.ID, js.Status)
+		c.String(http.StatusBadRequest, fmt.Sprintf("job has already ended with status %s", js.Status))
+		return
+	}
+
+	log.Printf("INFO: cancel request for %s job %d with status %s", js.Name, js.ID, js.Status)
+	if js.Status == "pending" {
+		// not yet started by a worker. only cancel if it is still pending; if a worker has just
+		// picked it up, cancel it as a running job below
+		now := time.Now()
+		resp := svc.GDB.Model(&js).Where("status=?", "pending").Select("ended_at", "status").Updates(jobStatus{EndedAt: &now, Status: "canceled"})
+		if resp.Error != nil {
+			log.Printf("ERROR: unable to cancel pending job %d: %s", js.ID, resp.Error.Error())
+			c.String(http.StatusInternalServerError, resp.Error.Error())
+			return
+		}
+		if resp.RowsAffected > 0 {
+			e := event{JobStatusID: js.ID, Level: Warn, Text: "Job canceled before it started"}
+			if svc.GDB.Create(&e).Error == nil {
+				svc.JobEvents.publish(e)
+			}
+			svc.JobEvents.finish(js.ID)
+			svc.GDB.Where("job_status_id=?", js.ID).Delete(&jobPayload{})
+			c.String(http.StatusOK, "canceled")
+			return
+		}
+	}
+
+	if js.Status == "waiting" {
+		// resume the job so it fails through its own error handling when it finds its requests canceled
+		svc.logInfo(&js, "Cancel requested")
+		svc.cancelOCRRequests(js.ID)
+		svc.resumeWaitingJob(js.ID)
+		c.String(http.StatusOK, "cancel requested")
+		return
+	}
+
+	svc.JobQueue.lock.Lock()
+	cancel, found := svc.JobQueue.running[js.ID]
+	svc.JobQueue.lock.Unlock()
+	if found == false {
+		log.Printf("INFO: job %d is not being run by a worker and cannot be canceled", js.ID)
+		c.String(http.StatusBadRequest, "job cannot be canceled")
+		return
+	}
+
+	svc.logInfo(&js, "Cancel requested")
+	cancel()
+	c.String(http.StatusOK, "cancel requested")
+}
+
+// recoverJobs is called at startup to find jobs orphaned by a restart. Jobs that never started
+// and jobs that are safe to re-run are queued again; all others are marked as failed.
+func (svc *ServiceContext) recoverJobs() {
+	log.Printf("INFO: check for jobs interrupted by a service restart")
+	var orphans []jobStatus
+	err := svc.GDB.Where("status in ? and ended_at is null", []string{"pending", "running"}).Order("id asc").Find(&orphans).Error
+	if err != nil {
+		log.Printf("ERROR: unable to find interrupted jobs: %s", err.Error())
+		return
+	}
+
+	requeued := 0
+	for _, orphan := range orphans {
+		js := orphan
+		var jp jobPayload
+		err = svc.GDB.Where("job_status_id=?", js.ID).Limit(1).Find(&jp).Error
+		if err != nil {
+			log.Printf("ERROR: unable to get payload for interrupted job %d: %s", js.ID, err.Error())
+			continue
+		}
+		if jp.ID == 0 {
+			svc.logFatal(&js, "Job was interrupted by a service restart and cannot be resumed; resubmit the request")
+			continue
+		}
+
+		handler, found := svc.JobQueue.handlers[jp.JobType]
+		if found == false {
+			svc.logFatal(&js, fmt.Sprintf("Job was interrupted by a service restart and type %s is no longer supported", jp.JobType))
+			svc.GDB.Delete(&jp)
+			continue
+		}
+
+		if js.Status == "running" && handler.requeue == false {
+			svc.logFatal(&js, "Job was interrupted by a service restart and is not safe to restart automatically; resubmit the request")
+			svc.GDB.Delete(&jp)
+			continue
+		}
+
+		if js.Status == "running" {
+			svc.logInfo(&js, "Job was interrupted by a service restart and has been re-queued")
+			svc.GDB.Model(&js).Select("status").Updates(jobStatus{Status: "pending"})
+		} else {
+			svc.logInfo(&js, "Pending job has been re-queued after a service restart")
+		}
+		svc.pushJob(js.ID)
+		requeued++
+	}
+	log.Printf("INFO: %d interrupted jobs found, %d re-queued", len(orphans), requeued)
+
+	// jobs waiting on external work are resumed by a callback or deadline; resume any that have neither left
+	var waiting []jobStatus
+	err = svc.GDB.Where("status=? and ended_at is null", "waiting").Find(&waiting).Error
+	if err != nil {
+		log.Printf("ERROR: unable to find waiting jobs: %s", err.Error())
+		return
+	}
+	for _, js := range waiting {
+		if svc.hasPendingOCRRequest(js.ID) == false {
+			svc.resumeWaitingJob(js.ID)
+		}
+	}
+}
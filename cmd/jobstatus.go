@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -12,7 +16,7 @@ import (
 
 type eventLevel uint
 
-// Event levels for job status reporting from rails enum:[:info, :warning, :error, :fatal] - warning is never used
+// Event levels for job status reporting from rails enum:[:info, :warning, :error, :fatal] - warning is only used for canceled jobs
 const (
 	Info  eventLevel = 0
 	Warn  eventLevel = 1
@@ -20,18 +24,27 @@ const (
 	Fatal eventLevel = 3
 )
 
+// MarshalJSON reports the event level by name rather than the rails enum value
+func (l eventLevel) MarshalJSON() ([]byte, error) {
+	names := []string{"info", "warning", "error", "fatal"}
+	if int(l) >= len(names) {
+		return json.Marshal(fmt.Sprintf("%d", l))
+	}
+	return json.Marshal(names[l])
+}
+
 type event struct {
-	ID          int64
-	JobStatusID int64
-	Level       eventLevel
-	Text        string
-	CreatedAt   time.Time
+	ID          int64      `json:"id"`
+	JobStatusID int64      `json:"jobID"`
+	Level       eventLevel `json:"level"`
+	Text        string     `json:"text"`
+	CreatedAt   time.Time  `json:"createdAt"`
 }
 
 type jobStatus struct {
 	ID             int64      `json:"id"`
-	OriginatorID   int64      `json:"-"`
-	OriginatorType string     `json:"-"`
+	OriginatorID   int64      `json:"originatorID"`
+	OriginatorType string     `json:"originatorType"`
 	Name           string     `json:"name"`
 	Status         string     `json:"status"`
 	Failures       uint       `json:"failures"`
@@ -41,6 +54,22 @@ type jobStatus struct {
 	EndedAt        *time.Time `json:"endedAt"`
 	CreatedAt      time.Time  `json:"-"`
 	UpdatedAt      time.Time  `json:"-"`
+
+	// set by the worker running the job; it is canceled when a cancel is requested
+	ctx context.Context
+}
+
+// context returns the context for a running job. Jobs that are not run by a worker can't be canceled
+func (status *jobStatus) context() context.Context {
+	if status == nil || status.ctx == nil {
+		return context.Background()
+	}
+	return status.ctx
+}
+
+// canceled returns true if a cancel has been requested for a running job
+func (status *jobStatus) canceled() bool {
+	return status.context().Err() != nil
 }
 
 func (svc *ServiceContext) createJobStatus(job string, origType string, origID int64) (*jobStatus, error) {
@@ -59,15 +88,22 @@ func (svc *ServiceContext) jobDone(status *jobStatus) {
 		log.Printf("INFO: job has finished")
 		return
 	}
+	if status.canceled() {
+		svc.jobCanceled(status, "Job canceled")
+		return
+	}
 	if status.EndedAt == nil {
 		e := event{JobStatusID: status.ID, Level: Info, Text: "job finished"}
 		err := svc.GDB.Create(&e).Error
 		if err != nil {
 			log.Printf("ERROR: unable to log job %d done event: %s", status.ID, err.Error())
+		} else {
+			svc.JobEvents.publish(e)
 		}
 
 		now := time.Now()
 		svc.GDB.Model(&status).Select("ended_at", "status").Updates(jobStatus{EndedAt: &now, Status: "finished"})
+		svc.JobEvents.finish(status.ID)
 		log.Printf("INFO: [job %d finished] %s", status.ID, status.Name)
 	}
 }
@@ -82,6 +118,8 @@ func (svc *ServiceContext) logInfo(status *jobStatus, text string) {
 	err := svc.GDB.Create(&e).Error
 	if err != nil {
 		log.Printf("ERROR: unable to log job %d info event [%s]: %s", status.ID, text, err.Error())
+	} else {
+		svc.JobEvents.publish(e)
 	}
 }
 
@@ -95,6 +133,8 @@ func (svc *ServiceContext) logError(status *jobStatus, text string) {
 	err := svc.GDB.Create(&e).Error
 	if err != nil {
 		log.Printf("ERROR: unable to log job %d error event [%s]: %s", status.ID, text, err.Error())
+	} else {
+		svc.JobEvents.publish(e)
 	}
 	svc.GDB.Model(status).Select("failures").Updates(jobStatus{Failures: status.Failures + 1})
 }
@@ -104,15 +144,42 @@ func (svc *ServiceContext) logFatal(status *jobStatus, text string) {
 		log.Printf("ERROR: %s", text)
 		return
 	}
+	if status.canceled() {
+		svc.jobCanceled(status, fmt.Sprintf("Job canceled: %s", text))
+		return
+	}
 	if status.EndedAt == nil {
 		log.Printf("INFO: [job %d fatal]: %s", status.ID, text)
 		e := event{JobStatusID: status.ID, Level: Fatal, Text: text}
 		err := svc.GDB.Create(&e).Error
 		if err != nil {
 			log.Printf("ERROR: unable to log job %d fatal event [%s]: %s", status.ID, text, err.Error())
+		} else {
+			svc.JobEvents.publish(e)
 		}
 		now := time.Now()
 		svc.GDB.Model(status).Select("ended_at", "status", "error").Updates(jobStatus{EndedAt: &now, Status: "failure", Error: text})
+		svc.JobEvents.finish(status.ID)
+	}
+}
+
+func (svc *ServiceContext) jobCanceled(status *jobStatus, text string) {
+	if status == nil {
+		log.Printf("INFO: %s", text)
+		return
+	}
+	if status.EndedAt == nil {
+		log.Printf("INFO: [job %d canceled]: %s", status.ID, text)
+		e := event{JobStatusID: status.ID, Level: Warn, Text: text}
+		err := svc.GDB.Create(&e).Error
+		if err != nil {
+			log.Printf("ERROR: unable to log job %d canceled event [%s]: %s", status.ID, text, err.Error())
+		} else {
+			svc.JobEvents.publish(e)
+		}
+		now := time.Now()
+		svc.GDB.Model(status).Select("ended_at", "status").Updates(jobStatus{EndedAt: &now, Status: "canceled"})
+		svc.JobEvents.finish(status.ID)
 	}
 }
 
@@ -130,3 +197,108 @@ func (svc *ServiceContext) getJobStatus(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, js)
 }
+
+type jobSearchResponse struct {
+	Total  int64            `json:"total"`
+	Offset int              `json:"offset"`
+	Limit  int              `json:"limit"`
+	Counts map[string]int64 `json:"counts"`
+	Jobs   []jobStatus      `json:"jobs"`
+}
+
+// searchJobs returns a page of job status records matching the request filters, newest first.
+// Supported params: name, status, originatorType, originatorID, startedAfter, startedBefore,
+// endedAfter, endedBefore, minFailures, offset and limit. Dates are YYYY-MM-DD or RFC3339.
+// Counts has the number of matching jobs for each status.
+func (svc *ServiceContext) searchJobs(c *gin.Context) {
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	jobQ := svc.GDB.Model(&jobStatus{})
+	if name := c.Query("name"); name != "" {
+		jobQ = jobQ.Where("name=?", name)
+	}
+	if status := c.Query("status"); status != "" {
+		jobQ = jobQ.Where("status=?", status)
+	}
+	if origType := c.Query("originatorType"); origType != "" {
+		jobQ = jobQ.Where("originator_type=?", origType)
+	}
+	if origIDStr := c.Query("originatorID"); origIDStr != "" {
+		origID, err := strconv.ParseInt(origIDStr, 10, 64)
+		if err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("invalid originatorID %s", origIDStr))
+			return
+		}
+		jobQ = jobQ.Where("originator_id=?", origID)
+	}
+	if failStr := c.Query("minFailures"); failStr != "" {
+		minFailures, err := strconv.ParseUint(failStr, 10, 32)
+		if err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("invalid minFailures %s", failStr))
+			return
+		}
+		jobQ = jobQ.Where("failures>=?", minFailures)
+	}
+
+	dateFilters := []struct {
+		param string
+		where string
+	}{
+		{"startedAfter", "started_at>=?"},
+		{"startedBefore", "started_at<?"},
+		{"endedAfter", "ended_at>=?"},
+		{"endedBefore", "ended_at<?"},
+	}
+	for _, df := range dateFilters {
+		val := c.Query(df.param)
+		if val == "" {
+			continue
+		}
+		tgtDate, err := parseJobSearchDate(val)
+		if err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("invalid %s %s", df.param, val))
+			return
+		}
+		jobQ = jobQ.Where(df.where, tgtDate)
+	}
+
+	type statusCount struct {
+		Status string
+		Total  int64
+	}
+	var statusCounts []statusCount
+	err := jobQ.Session(&gorm.Session{}).Select("status, count(*) as total").Group("status").Scan(&statusCounts).Error
+	if err != nil {
+		log.Printf("ERROR: unable to get job counts: %s", err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp := jobSearchResponse{Offset: offset, Limit: limit, Counts: make(map[string]int64), Jobs: make([]jobStatus, 0)}
+	for _, sc := range statusCounts {
+		resp.Counts[sc.Status] = sc.Total
+		resp.Total += sc.Total
+	}
+
+	err = jobQ.Session(&gorm.Session{}).Order("id desc").Offset(offset).Limit(limit).Find(&resp.Jobs).Error
+	if err != nil {
+		log.Printf("ERROR: unable to search jobs: %s", err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func parseJobSearchDate(val string) (time.Time, error) {
+	out, err := time.ParseInLocation("2006-01-02", val, time.Local)
+	if err == nil {
+		return out, nil
+	}
+	return time.Parse(time.RFC3339, val)
+}
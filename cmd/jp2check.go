@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// JPEG 2000 codestream markers used for validation
+const (
+	j2kSOC = 0xFF4F
+	j2kSIZ = 0xFF51
+	j2kCOD = 0xFF52
+	j2kSOT = 0xFF90
+	j2kEOC = 0xFFD9
+)
+
+// jp2Header is the image information read from the header of a JP2 file or raw J2K codestream
+type jp2Header struct {
+	Width       uint
+	Height      uint
+	Components  int
+	Resolutions int
+	Layers      int
+}
+
+// readJP2Header reads the image size and coding parameters from the main header of a JP2 codestream
+// without decoding the image. The codestream must be complete; a missing end of codestream marker
+// means the encoder did not finish writing the file.
+func readJP2Header(jp2Path string) (*jp2Header, error) {
+	f, err := os.Open(jp2Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	csStart, csLen, err := findJ2KCodestream(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	if csLen < 4 {
+		return nil, fmt.Errorf("codestream is too short")
+	}
+	cs := io.NewSectionReader(f, csStart, csLen)
+
+	eoc := make([]byte, 2)
+	_, err = cs.ReadAt(eoc, csLen-2)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read end of codestream: %s", err.Error())
+	}
+	if binary.BigEndian.Uint16(eoc) != j2kEOC {
+		return nil, fmt.Errorf("codestream is truncated; end of codestream marker not found")
+	}
+
+	marker := make([]byte, 2)
+	if _, err := io.ReadFull(cs, marker); err != nil || binary.BigEndian.Uint16(marker) != j2kSOC {
+		return nil, fmt.Errorf("codestream does not begin with a start of codestream marker")
+	}
+
+	var hdr jp2Header
+	foundSIZ := false
+	foundCOD := false
+	for {
+		if _, err := io.ReadFull(cs, marker); err != nil {
+			return nil, fmt.Errorf("codestream main header is incomplete")
+		}
+		code := binary.BigEndian.Uint16(marker)
+		if code == j2kSOT {
+			break
+		}
+		if _, err := io.ReadFull(cs, marker); err != nil {
+			return nil, fmt.Errorf("codestream main header is incomplete")
+		}
+		segLen := int(binary.BigEndian.Uint16(marker))
+		if segLen < 2 {
+			return nil, fmt.Errorf("invalid marker segment length %d", segLen)
+		}
+		seg := make([]byte, segLen-2)
+		if _, err := io.ReadFull(cs, seg); err != nil {
+			return nil, fmt.Errorf("codestream main header is incomplete")
+		}
+
+		switch code {
+		case j2kSIZ:
+			// Rsiz, Xsiz, Ysiz, XOsiz, YOsiz, XTsiz, YTsiz, XTOsiz, YTOsiz, Csiz
+			if len(seg) < 36 {
+				return nil, fmt.Errorf("invalid SIZ marker segment")
+			}
+			xSiz := binary.BigEndian.Uint32(seg[2:6])
+			ySiz := binary.BigEndian.Uint32(seg[6:10])
+			xOff := binary.BigEndian.Uint32(seg[10:14])
+			yOff := binary.BigEndian.Uint32(seg[14:18])
+			hdr.Width = uint(xSiz - xOff)
+			hdr.Height = uint(ySiz - yOff)
+			hdr.Components = int(binary.BigEndian.Uint16(seg[34:36]))
+			foundSIZ = true
+		case j2kCOD:
+			// Scod, progression order, layers, MCT, decomposition levels
+			if len(seg) < 6 {
+				return nil, fmt.Errorf("invalid COD marker segment")
+			}
+			hdr.Layers = int(binary.BigEndian.Uint16(seg[2:4]))
+			hdr.Resolutions = int(seg[5]) + 1
+			foundCOD = true
+		}
+	}
+
+	if foundSIZ == false {
+		return nil, fmt.Errorf("codestream has no SIZ marker")
+	}
+	if foundCOD == false {
+		return nil, fmt.Errorf("codestream has no COD marker")
+	}
+	return &hdr, nil
+}
+
+// findJ2KCodestream returns the offset and length of the codestream in a JP2 file. Raw J2K
+// codestreams are returned as is.
+func findJ2KCodestream(r io.ReaderAt, size int64) (int64, int64, error) {
+	sig := make([]byte, 12)
+	if _, err := r.ReadAt(sig, 0); err != nil {
+		return 0, 0, fmt.Errorf("file is too small to be a JP2")
+	}
+	if binary.BigEndian.Uint16(sig[0:2]) == j2kSOC {
+		return 0, size, nil
+	}
+	if binary.BigEndian.Uint32(sig[0:4]) != 12 || string(sig[4:8]) != "jP  " || binary.BigEndian.Uint32(sig[8:12]) != 0x0D0A870A {
+		return 0, 0, fmt.Errorf("invalid JP2 signature")
+	}
+
+	offset := int64(12)
+	boxHdr := make([]byte, 16)
+	for offset < size {
+		if _, err := r.ReadAt(boxHdr[0:8], offset); err != nil {
+			return 0, 0, fmt.Errorf("invalid JP2 box at offset %d", offset)
+		}
+		boxLen := int64(binary.BigEndian.Uint32(boxHdr[0:4]))
+		boxType := string(boxHdr[4:8])
+		hdrLen := int64(8)
+		switch boxLen {
+		case 0:
+			// box extends to the end of the file
+			boxLen = size - offset
+		case 1:
+			if _, err := r.ReadAt(boxHdr[8:16], offset+8); err != nil {
+				return 0, 0, fmt.Errorf("invalid JP2 box at offset %d", offset)
+			}
+			boxLen = int64(binary.BigEndian.Uint64(boxHdr[8:16]))
+			hdrLen = 16
+		}
+		if boxLen < hdrLen || offset+boxLen > size {
+			return 0, 0, fmt.Errorf("JP2 %s box at offset %d extends past the end of the file", boxType, offset)
+		}
+		if boxType == "jp2c" {
+			return offset + hdrLen, boxLen - hdrLen, nil
+		}
+		offset += boxLen
+	}
+	return 0, 0, fmt.Errorf("JP2 file has no codestream")
+}
+
+// validateJP2 checks a generated JP2 before it is published: the codestream must be complete, the
+// dimensions must match the master file tech metadata and the number of resolution levels must match
+// the encoding profile. Pass a nil profile to skip the resolution check.
+func validateJP2(jp2Path string, mf *masterFile, profile *jp2Profile) error {
+	hdr, err := readJP2Header(jp2Path)
+	if err != nil {
+		return fmt.Errorf("invalid jp2 %s: %s", jp2Path, err.Error())
+	}
+	tm := mf.ImageTechMeta
+	if tm.Width > 0 && tm.Height > 0 && (hdr.Width != tm.Width || hdr.Height != tm.Height) {
+		return fmt.Errorf("jp2 %s is %dx%d but %s is %dx%d", jp2Path, hdr.Width, hdr.Height, mf.Filename, tm.Width, tm.Height)
+	}
+	if profile != nil {
+		expected := expectedJP2Resolutions(profile.resolutions, hdr.Width, hdr.Height)
+		if hdr.Resolutions != expected {
+			return fmt.Errorf("jp2 %s has %d resolution levels but profile %s requires %d", jp2Path, hdr.Resolutions, profile.Name, expected)
+		}
+	}
+	return nil
+}
+
+// expectedJP2Resolutions returns the profile resolution count, reduced for images too small to have
+// that many levels
+func expectedJP2Resolutions(resolutions int, width uint, height uint) int {
+	minDim := min(width, height)
+	if minDim == 0 {
+		return resolutions
+	}
+	maxRes := bits.Len(minDim)
+	return min(resolutions, maxRes)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testJ2K struct {
+	width  uint32
+	height uint32
+	levels byte
+	siz    bool
+	cod    bool
+	eoc    bool
+}
+
+// validTestJ2K describes a complete single component 100x80 codestream with 5 decomposition levels
+func validTestJ2K() testJ2K {
+	return testJ2K{width: 100, height: 80, levels: 5, siz: true, cod: true, eoc: true}
+}
+
+// makeTestJ2K builds a raw codestream with the main header markers described by cs, a single
+// empty tile part and an optional end of codestream marker
+func makeTestJ2K(cs testJ2K) []byte {
+	var buf bytes.Buffer
+	put16 := func(v uint16) { binary.Write(&buf, binary.BigEndian, v) }
+	put32 := func(v uint32) { binary.Write(&buf, binary.BigEndian, v) }
+
+	put16(j2kSOC)
+	if cs.siz {
+		put16(j2kSIZ)
+		put16(41)
+		put16(0) // Rsiz
+		put32(cs.width)
+		put32(cs.height)
+		put32(0) // XOsiz, YOsiz
+		put32(0)
+		put32(cs.width) // one tile
+		put32(cs.height)
+		put32(0) // XTOsiz, YTOsiz
+		put32(0)
+		put16(1)                   // Csiz
+		buf.Write([]byte{7, 1, 1}) // 8 bit unsigned, no subsampling
+	}
+	if cs.cod {
+		put16(j2kCOD)
+		put16(12)
+		buf.Write([]byte{0, 0}) // Scod, progression order
+		put16(1)                // layers
+		buf.Write([]byte{0, cs.levels, 4, 4, 0, 0})
+	}
+	put16(j2kSOT)
+	put16(10)
+	buf.Write(make([]byte, 8))
+	if cs.eoc {
+		put16(j2kEOC)
+	}
+	return buf.Bytes()
+}
+
+// makeTestJP2 wraps a codestream in the JP2 signature, ftyp and jp2c boxes. A jp2cLen of 0 uses the
+// actual codestream size.
+func makeTestJP2(codestream []byte, jp2cLen uint32) []byte {
+	var buf bytes.Buffer
+	put32 := func(v uint32) { binary.Write(&buf, binary.BigEndian, v) }
+
+	put32(12)
+	buf.WriteString("jP  ")
+	put32(0x0D0A870A)
+	put32(20)
+	buf.WriteString("ftypjp2 ")
+	put32(0)
+	buf.WriteString("jp2 ")
+	if jp2cLen == 0 {
+		jp2cLen = uint32(len(codestream) + 8)
+	}
+	put32(jp2cLen)
+	buf.WriteString("jp2c")
+	buf.Write(codestream)
+	return buf.Bytes()
+}
+
+func TestFindJ2KCodestream(t *testing.T) {
+	cs := makeTestJ2K(validTestJ2K())
+	xlBox := makeTestJP2(nil, 0)[:32]
+	xlBox = binary.BigEndian.AppendUint32(xlBox, 1)
+	xlBox = append(xlBox, "jp2c"...)
+	xlBox = binary.BigEndian.AppendUint64(xlBox, uint64(len(cs)+16))
+	xlBox = append(xlBox, cs...)
+	toEOF := makeTestJP2(cs, 0)
+	binary.BigEndian.PutUint32(toEOF[32:36], 0)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		offset  int64
+		length  int64
+		wantErr string
+	}{
+		{"raw codestream", cs, 0, int64(len(cs)), ""},
+		{"jp2", makeTestJP2(cs, 0), 40, int64(len(cs)), ""},
+		{"extended box length", xlBox, 48, int64(len(cs)), ""},
+		{"box to end of file", toEOF, 40, int64(len(cs)), ""},
+		{"too small", []byte{0, 0, 0, 12}, 0, 0, "too small"},
+		{"bad signature", append([]byte("\x00\x00\x00\x0cjP  \x00\x00\x00\x00"), cs...), 0, 0, "signature"},
+		{"truncated box", makeTestJP2(cs, 0)[:50], 0, 0, "extends past the end"},
+		{"no codestream", makeTestJP2(nil, 0)[:32], 0, 0, "no codestream"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			offset, length, err := findJ2KCodestream(bytes.NewReader(tc.data), int64(len(tc.data)))
+			if tc.wantErr != "" {
+				if err == nil || strings.Contains(err.Error(), tc.wantErr) == false {
+					t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if offset != tc.offset || length != tc.length {
+				t.Errorf("got offset %d length %d, want offset %d length %d", offset, length, tc.offset, tc.length)
+			}
+		})
+	}
+}
+
+func TestReadJP2Header(t *testing.T) {
+	noSIZ := validTestJ2K()
+	noSIZ.siz = false
+	noCOD := validTestJ2K()
+	noCOD.cod = false
+	noEOC := validTestJ2K()
+	noEOC.eoc = false
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"raw codestream", makeTestJ2K(validTestJ2K()), ""},
+		{"jp2", makeTestJP2(makeTestJ2K(validTestJ2K()), 0), ""},
+		{"truncated codestream", makeTestJ2K(noEOC), "truncated"},
+		{"truncated jp2", makeTestJP2(makeTestJ2K(noEOC), 0), "truncated"},
+		{"missing SIZ", makeTestJ2K(noSIZ), "no SIZ marker"},
+		{"missing COD", makeTestJ2K(noCOD), "no COD marker"},
+		{"missing SOC", makeTestJP2(makeTestJ2K(validTestJ2K())[2:], 0), "start of codestream"},
+	}
+	dir := t.TempDir()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			jp2Path := filepath.Join(dir, strings.ReplaceAll(tc.name, " ", "_")+".jp2")
+			err := os.WriteFile(jp2Path, tc.data, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hdr, err := readJP2Header(jp2Path)
+			if tc.wantErr != "" {
+				if err == nil || strings.Contains(err.Error(), tc.wantErr) == false {
+					t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			want := jp2Header{Width: 100, Height: 80, Components: 1, Resolutions: 6, Layers: 1}
+			if *hdr != want {
+				t.Errorf("got header %+v, want %+v", *hdr, want)
+			}
+		})
+	}
+}
+
+func TestExpectedJP2Resolutions(t *testing.T) {
+	tests := []struct {
+		name        string
+		resolutions int
+		width       uint
+		height      uint
+		want        int
+	}{
+		{"large image", 6, 4000, 3000, 6},
+		{"limited by height", 6, 4000, 20, 5},
+		{"limited by width", 8, 100, 3000, 7},
+		{"single pixel", 6, 1, 1, 1},
+		{"unknown size", 6, 0, 0, 6},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := expectedJP2Resolutions(tc.resolutions, tc.width, tc.height)
+			if got != tc.want {
+				t.Errorf("got %d resolutions, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateJP2Resolutions(t *testing.T) {
+	wrongLevels := validTestJ2K()
+	wrongLevels.levels = 3
+	dir := t.TempDir()
+	mf := &masterFile{Filename: "000000001_0001.tif", ImageTechMeta: imageTechMeta{Width: 100, Height: 80}}
+	profile := &jp2Profile{Name: "test", resolutions: 6}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"matching levels", makeTestJ2K(validTestJ2K()), ""},
+		{"wrong levels", makeTestJ2K(wrongLevels), "has 4 resolution levels but profile test requires 6"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			jp2Path := filepath.Join(dir, strings.ReplaceAll(tc.name, " ", "_")+".jp2")
+			err := os.WriteFile(jp2Path, tc.data, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = validateJP2(jp2Path, mf, profile)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+				return
+			}
+			if err == nil || strings.Contains(err.Error(), tc.wantErr) == false {
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jp2Pool limits the number of JP2 conversions running at once across all jobs so concurrent
+// finalizations share the same set of encoder processes
+type jp2Pool struct {
+	slots chan struct{}
+}
+
+func newJP2Pool(size int) *jp2Pool {
+	return &jp2Pool{slots: make(chan struct{}, size)}
+}
+
+// acquire blocks until a conversion slot is free or the context is done
+func (p *jp2Pool) acquire(ctx context.Context) error {
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *jp2Pool) release() {
+	<-p.slots
+}
+
+// size is the maximum number of conversions that can run at once
+func (p *jp2Pool) size() int {
+	return cap(p.slots)
+}
+
+// iiifPublishBatch publishes the master files of a job to IIIF using the service JP2 pool and
+// collects the files that failed
+type iiifPublishBatch struct {
+	svc       *ServiceContext
+	js        *jobStatus
+	overwrite bool
+	jp2       jp2Settings
+	wg        sync.WaitGroup
+	lock      sync.Mutex
+	total     int
+	failures  []string
+	startTime time.Time
+}
+
+func (svc *ServiceContext) newIIIFPublishBatch(js *jobStatus, overwrite bool) *iiifPublishBatch {
+	return &iiifPublishBatch{svc: svc, js: js, overwrite: overwrite, failures: make([]string, 0), startTime: time.Now()}
+}
+
+// add queues a master file for publishing. It is published as soon as a JP2 pool slot is free.
+func (b *iiifPublishBatch) add(item jp2Source) {
+	b.lock.Lock()
+	b.total++
+	b.lock.Unlock()
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		err := b.svc.JP2Pool.acquire(b.js.context())
+		if err != nil {
+			b.failed(item, err)
+			return
+		}
+		defer b.svc.JP2Pool.release()
+		err = b.svc.publishToIIIFWithProfile(b.js, item.MasterFile, item.Path, b.overwrite, b.jp2)
+		if err != nil {
+			b.failed(item, err)
+		}
+	}()
+}
+
+func (b *iiifPublishBatch) failed(item jp2Source, err error) {
+	b.svc.logError(b.js, fmt.Sprintf("Unable to publish master file %s to IIIF: %s", item.MasterFile.PID, err.Error()))
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures = append(b.failures, item.MasterFile.Filename)
+}
+
+// wait blocks until all queued master files have been published and returns an error listing
+// the files that failed
+func (b *iiifPublishBatch) wait() error {
+	b.wg.Wait()
+	elapsed := time.Since(b.startTime)
+	b.svc.logInfo(b.js, fmt.Sprintf("Finished IIIF processing for %d files with %d failures; total time %.2f seconds", b.total, len(b.failures), elapsed.Seconds()))
+	if len(b.failures) > 0 {
+		return fmt.Errorf("%d of %d master files failed to publish to IIIF: %s", len(b.failures), b.total, strings.Join(b.failures, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// jp2Profile is a named set of JP2 encoding settings along with the equivalent arguments for each
+// supported encoder
+type jp2Profile struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	resolutions int      // number of resolution levels in the generated codestream
+	magick      []string // imagemagick jp2 defines
+	opj         []string // opj_compress arguments
+	kakadu      []string // kdu_compress arguments
+}
+
+const defaultJP2Profile = "standard"
+const defaultJP2Encoder = "magick"
+
+var jp2Profiles = []jp2Profile{
+	{Name: "standard", resolutions: 7, Description: "Lossy compression used for IIIF access images",
+		magick: []string{"jp2:rate=50", "jp2:progression-order=RPCL", "jp2:number-resolutions=7"},
+		opj:    []string{"-r", "50", "-p", "RPCL", "-n", "7", "-I"},
+		kakadu: []string{"-rate", "0.48", "Corder=RPCL", "Clevels=6", "Creversible=no"},
+	},
+	{Name: "lossless", resolutions: 7, Description: "Reversible compression suitable for archival copies",
+		magick: []string{"jp2:rate=1", "jp2:progression-order=RPCL", "jp2:number-resolutions=7"},
+		opj:    []string{"-p", "RPCL", "-n", "7"},
+		kakadu: []string{"Creversible=yes", "Corder=RPCL", "Clevels=6"},
+	},
+	{Name: "visually-lossless", resolutions: 7, Description: "Light lossy compression with no visible artifacts",
+		magick: []string{"jp2:rate=10", "jp2:progression-order=RPCL", "jp2:number-resolutions=7"},
+		opj:    []string{"-r", "10", "-p", "RPCL", "-n", "7", "-I"},
+		kakadu: []string{"-rate", "2.4", "Corder=RPCL", "Clevels=6", "Creversible=no"},
+	},
+	{Name: "hathitrust", resolutions: 6, Description: "Settings required for HathiTrust JP2 submissions",
+		magick: []string{"jp2:rate=20", "jp2:progression-order=RLCP", "jp2:number-resolutions=6", "jp2:layer-number=8"},
+		opj:    []string{"-r", "20", "-p", "RLCP", "-n", "6", "-b", "64,64", "-I"},
+		kakadu: []string{"-rate", "1.2", "Corder=RLCP", "Clevels=5", "Clayers=8", "Cblk={64,64}",
+			"Cuse_sop=yes", "Cuse_eph=yes", "Creversible=no", "-no_weights"},
+	},
+	{Name: "fast", resolutions: 5, Description: "Heavier compression with fewer resolution levels for quick bulk publishing",
+		magick: []string{"jp2:rate=80", "jp2:progression-order=RPCL", "jp2:number-resolutions=5"},
+		opj:    []string{"-r", "80", "-p", "RPCL", "-n", "5", "-I"},
+		kakadu: []string{"-rate", "0.3", "Corder=RPCL", "Clevels=4", "Creversible=no"},
+	},
+}
+
+// jp2Encoders maps the supported encoder names to the binary used to run them
+var jp2Encoders = map[string]string{
+	"magick": "magick",
+	"opj":    "opj_compress",
+	"kakadu": "kdu_compress",
+}
+
+// jp2Settings are the JP2 profile and encoder requested for a publish. Blank values fall back to the
+// unit settings and then the defaults.
+type jp2Settings struct {
+	Profile string `json:"profile"`
+	Encoder string `json:"encoder"`
+}
+
+// unitJP2Profile is the JP2 profile and encoder used when publishing the master files of a unit
+type unitJP2Profile struct {
+	ID      int64
+	UnitID  int64  `gorm:"uniqueIndex"`
+	Profile string `json:"profile"`
+	Encoder string `json:"encoder"`
+}
+
+// jp2TechMeta records how the published JP2 for a master file was generated. Profile and encoder are
+// blank when the master file was already a JP2 and was published as is.
+type jp2TechMeta struct {
+	ID           int64     `json:"-"`
+	MasterFileID int64     `gorm:"uniqueIndex" json:"masterFileID"`
+	Profile      string    `json:"profile"`
+	Encoder      string    `json:"encoder"`
+	FileSize     int64     `json:"fileSize"`
+	PublishedAt  time.Time `json:"publishedAt"`
+}
+
+func getJP2Profile(name string) (*jp2Profile, error) {
+	for idx := range jp2Profiles {
+		if jp2Profiles[idx].Name == name {
+			return &jp2Profiles[idx], nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not a supported jp2 profile", name)
+}
+
+// validate checks that any requested profile and encoder are supported
+func (s jp2Settings) validate() error {
+	if s.Profile != "" {
+		if _, err := getJP2Profile(s.Profile); err != nil {
+			return err
+		}
+	}
+	if s.Encoder != "" {
+		if _, found := jp2Encoders[s.Encoder]; found == false {
+			return fmt.Errorf("%s is not a supported jp2 encoder", s.Encoder)
+		}
+	}
+	return nil
+}
+
+// resolveJP2Settings fills in blank settings from the unit JP2 profile and then the defaults
+func (svc *ServiceContext) resolveJP2Settings(unitID int64, req jp2Settings) jp2Settings {
+	if req.Profile == "" || req.Encoder == "" {
+		var unitSettings unitJP2Profile
+		err := svc.GDB.Where("unit_id=?", unitID).Limit(1).Find(&unitSettings).Error
+		if err != nil {
+			log.Printf("ERROR: unable to get jp2 profile for unit %d: %s", unitID, err.Error())
+		}
+		if req.Profile == "" {
+			req.Profile = unitSettings.Profile
+		}
+		if req.Encoder == "" {
+			req.Encoder = unitSettings.Encoder
+		}
+	}
+	if req.Profile == "" {
+		req.Profile = defaultJP2Profile
+	}
+	if req.Encoder == "" {
+		req.Encoder = defaultJP2Encoder
+	}
+	return req
+}
+
+// encodeJP2 compresses a tif to JP2 with the requested profile and encoder. If the encoder is not
+// installed imagemagick is used instead. Returns the name of the encoder that was used.
+func (svc *ServiceContext) encodeJP2(js *jobStatus, srcPath string, destPath string, settings jp2Settings) (string, error) {
+	profile, err := getJP2Profile(settings.Profile)
+	if err != nil {
+		return "", err
+	}
+	encoder := settings.Encoder
+	if _, err := exec.LookPath(jp2Encoders[encoder]); err != nil && encoder != defaultJP2Encoder {
+		svc.logInfo(js, fmt.Sprintf("JP2 encoder %s is not installed; using %s", encoder, defaultJP2Encoder))
+		encoder = defaultJP2Encoder
+	}
+
+	var cmdArray []string
+	switch encoder {
+	case "opj":
+		cmdArray = append([]string{"-i", srcPath, "-o", destPath}, profile.opj...)
+	case "kakadu":
+		cmdArray = append([]string{"-i", srcPath, "-o", destPath}, profile.kakadu...)
+	default:
+		// need the [0] as some tifs have multiple pages. only want the first.
+		cmdArray = []string{fmt.Sprintf("%s[0]", srcPath)}
+		for _, define := range profile.magick {
+			cmdArray = append(cmdArray, "-define", define)
+		}
+		cmdArray = append(cmdArray, destPath)
+	}
+
+	cmd := exec.CommandContext(js.context(), jp2Encoders[encoder], cmdArray...)
+	svc.logInfo(js, fmt.Sprintf("%+v", cmd))
+	_, err = cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return encoder, fmt.Errorf("%s failed: %s", jp2Encoders[encoder], strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return encoder, err
+	}
+	return encoder, nil
+}
+
+// saveJP2TechMeta records the profile and encoder used to generate the published JP2 for a master file
+func (svc *ServiceContext) saveJP2TechMeta(mf *masterFile, jp2File string, settings jp2Settings) error {
+	tm := jp2TechMeta{MasterFileID: mf.ID, Profile: settings.Profile, Encoder: settings.Encoder, PublishedAt: time.Now()}
+	if fi, err := os.Stat(jp2File); err == nil {
+		tm.FileSize = fi.Size()
+	}
+	var existing jp2TechMeta
+	err := svc.GDB.Where("master_file_id=?", mf.ID).Limit(1).Find(&existing).Error
+	if err != nil {
+		return err
+	}
+	tm.ID = existing.ID
+	return svc.GDB.Save(&tm).Error
+}
+
+// getJP2Profiles returns the available JP2 profiles and the encoders installed on this server
+func (svc *ServiceContext) getJP2Profiles(c *gin.Context) {
+	type encoderInfo struct {
+		Name      string `json:"name"`
+		Installed bool   `json:"installed"`
+	}
+	encoders := make([]encoderInfo, 0)
+	for _, name := range []string{"magick", "opj", "kakadu"} {
+		_, err := exec.LookPath(jp2Encoders[name])
+		encoders = append(encoders, encoderInfo{Name: name, Installed: err == nil})
+	}
+	c.JSON(http.StatusOK, gin.H{"default": defaultJP2Profile, "profiles": jp2Profiles, "encoders": encoders})
+}
+
+// updateUnitJP2Profile sets the JP2 profile and encoder used when publishing the master files of a unit.
+// Blank values clear the unit setting so the defaults are used.
+func (svc *ServiceContext) updateUnitJP2Profile(c *gin.Context) {
+	unitID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	var req jp2Settings
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		log.Printf("ERROR: unable to parse unit %d jp2 profile request: %s", unitID, err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	err = req.validate()
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var tgtUnit unit
+	err = svc.GDB.First(&tgtUnit, unitID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.String(http.StatusNotFound, "not found")
+		} else {
+			c.String(http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	var settings unitJP2Profile
+	err = svc.GDB.Where("unit_id=?", unitID).Limit(1).Find(&settings).Error
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	settings.UnitID = unitID
+	settings.Profile = req.Profile
+	settings.Encoder = req.Encoder
+	err = svc.GDB.Save(&settings).Error
+	if err != nil {
+		log.Printf("ERROR: unable to save unit %d jp2 profile: %s", unitID, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("INFO: unit %d jp2 profile set to [%s] encoder [%s]", unitID, req.Profile, req.Encoder)
+	c.JSON(http.StatusOK, svc.resolveJP2Settings(unitID, jp2Settings{}))
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"runtime/debug"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/gzip"
@@ -25,7 +25,7 @@ func main() {
 	gin.SetMode(gin.ReleaseMode)
 	gin.DisableConsoleColor()
 	router := gin.Default()
-	router.Use(gzip.Gzip(gzip.DefaultCompression))
+	router.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithExcludedPathsRegexs([]string{"^/jobs/[0-9]+/stream"})))
 	corsCfg := cors.DefaultConfig()
 	corsCfg.AllowAllOrigins = true
 	corsCfg.AllowCredentials = true
@@ -44,6 +44,7 @@ func main() {
 	router.POST("/audit", svc.authMiddleware, svc.auditMasterFiles)
 	router.POST("/audit/fix/jp2", svc.authMiddleware, svc.fixFailedJP2Audit)
 	router.POST("/audit/fix/md5", svc.authMiddleware, svc.checkMissingMD5Audit)
+	router.POST("/audit/fix/sha256", svc.authMiddleware, svc.backfillSHA256)
 
 	router.POST("/phash", svc.authMiddleware, svc.generateMasterFilesPHash)
 
@@ -62,9 +63,19 @@ func main() {
 	router.POST("/collections/:id/add", svc.authMiddleware, svc.collectionBulkAdd)
 	router.POST("/collections/:id/export", svc.authMiddleware, svc.exportCollection)
 
+	router.GET("/jobs", svc.searchJobs)
 	router.GET("/jobs/:id", svc.getJobStatus)
+	router.GET("/jobs/:id/events", svc.getJobEvents)
+	router.GET("/jobs/:id/stream", svc.streamJobEvents)
+	router.POST("/jobs/:id/cancel", svc.authMiddleware, svc.cancelJob)
+
+	router.POST("/iiif/republish", svc.authMiddleware, svc.republishIIIF)
+
+	router.GET("/jp2/profiles", svc.getJP2Profiles)
 
 	router.POST("/metadata/:id/publish", svc.authMiddleware, svc.publishToVirgo)
+	router.GET("/metadata/:id/manifest", svc.getIIIFManifest)
+	router.POST("/metadata/:id/manifest", svc.authMiddleware, svc.publishIIIFManifest)
 
 	router.GET("/ocr/languages", svc.getOCRLanguages)
 	router.POST("/ocr", svc.authMiddleware, svc.handleOCRRequest)
@@ -80,14 +91,18 @@ func main() {
 	router.POST("/units/:id/copy", svc.authMiddleware, svc.downloadFromArchive)
 	router.POST("/units/:id/deliverables", svc.authMiddleware, svc.createPatronDeliverables)
 	router.POST("/units/:id/finalize", svc.authMiddleware, svc.finalizeUnit)
+	router.POST("/units/:id/finalize/preflight", svc.authMiddleware, svc.finalizePreflight)
 	router.POST("/units/:id/iiif", svc.authMiddleware, svc.publishUnitImagesToIIIF)
 	router.GET("/units/:id/pdf", svc.getUnitPDFBundle)
 	router.POST("/units/:id/ocr-settings", svc.authMiddleware, svc.updateUnitOCRSettings)
+	router.POST("/units/:id/jp2-profile", svc.authMiddleware, svc.updateUnitJP2Profile)
+	router.GET("/units/:id/ocr/report", svc.getUnitOCRReport)
 
 	router.POST("/units/:id/attach", svc.authMiddleware, svc.attachFile)
 	router.GET("/units/:id/attachments/:file", svc.getAttachment)
 	router.DELETE("/units/:id/attachments/:file", svc.authMiddleware, svc.deleteAttachment)
 
+	router.GET("/masterfiles/:id/audits", svc.getMasterFileAudits)
 	router.POST("/masterfiles/:id/deaccession", svc.authMiddleware, svc.deaccessionMasterFile)
 	router.POST("/masterfiles/:id/iiif", svc.authMiddleware, svc.updateMasterFileIIIF)
 	router.DELETE("/masterfiles/:id/iiif", svc.authMiddleware, svc.deleteMasterFileIIIF)
@@ -146,17 +161,7 @@ func (svc *ServiceContext) runScript(c *gin.Context) {
 	}
 
 	log.Printf("INFO: script request %+v", req)
-	scripts := map[string]any{
-		"createBondLocations": svc.createBondLocations,
-		"createBondUnits":     svc.createBondUnits,
-		"ingestBondImages":    svc.ingestBondImages,
-		"generateBondMapping": svc.generateBondMapping,
-		"tribuneCheck":        svc.validateTribuneMount,
-		"tribuneSetup":        svc.setupTribuneQA,
-		"tribuneFix":          svc.fixTribuneHeaders,
-	}
-
-	tgtScript := scripts[req.Name]
+	tgtScript := svc.getScript(req.Name)
 	if tgtScript == nil {
 		log.Printf("ERROR: unrecognized script name %s", req.Name)
 		c.String(http.StatusBadRequest, fmt.Sprintf("%s is not a known script", req.Name))
@@ -165,10 +170,12 @@ func (svc *ServiceContext) runScript(c *gin.Context) {
 
 	var js *jobStatus
 	if req.DevMode || req.Name == "tribuneCheck" {
-		log.Printf("INFO: running %s in dev mode - not using goroutine and no job logs", req.Name)
-		err = tgtScript.(func(*gin.Context, *jobStatus, map[string]any) error)(c, js, req.Params)
+		log.Printf("INFO: running %s in dev mode - not queued and no job logs", req.Name)
+		err = tgtScript(js, req.Params)
 		if err != nil {
 			svc.logFatal(js, err.Error())
+			c.String(http.StatusInternalServerError, err.Error())
+			return
 		}
 		c.String(http.StatusOK, fmt.Sprintf("script %s has completed", req.Name))
 		return
@@ -182,23 +189,46 @@ func (svc *ServiceContext) runScript(c *gin.Context) {
 		return
 	}
 
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("ERROR: Panic recovered: %v", r)
-				debug.PrintStack()
-				svc.logFatal(js, fmt.Sprintf("%v", r))
-			}
-		}()
-		err = tgtScript.(func(*gin.Context, *jobStatus, map[string]any) error)(c, js, req.Params)
-		if err != nil {
-			svc.logFatal(js, err.Error())
-		}
-		svc.jobDone(js)
-	}()
+	err = svc.enqueueJob(js, "Script", req)
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
 }
 
+func (svc *ServiceContext) getScript(name string) func(*jobStatus, map[string]any) error {
+	scripts := map[string]func(*jobStatus, map[string]any) error{
+		"createBondLocations": svc.createBondLocations,
+		"createBondUnits":     svc.createBondUnits,
+		"ingestBondImages":    svc.ingestBondImages,
+		"generateBondMapping": svc.generateBondMapping,
+		"tribuneCheck":        svc.validateTribuneMount,
+		"tribuneSetup":        svc.setupTribuneQA,
+		"tribuneFix":          svc.fixTribuneHeaders,
+	}
+	return scripts[name]
+}
+
+func (svc *ServiceContext) runQueuedScript(js *jobStatus, payload []byte) error {
+	var req scriptParams
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid script payload: %s", err.Error())
+	}
+	tgtScript := svc.getScript(req.Name)
+	if tgtScript == nil {
+		return fmt.Errorf("%s is not a known script", req.Name)
+	}
+	err = tgtScript(js, req.Params)
+	if err != nil {
+		return err
+	}
+	svc.jobDone(js)
+	return nil
+}
+
 // func (svc *ServiceContext) hack(c *gin.Context) {
 // 	unitID := int64(49877)
 // 	js, err := svc.createJobStatus("RepublishIIIF", "Unit", unitID)
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// IIIF Presentation 3.0 manifest structure. Only the parts needed for image sequences are included.
+type iiifLangMap map[string][]string
+
+type iiifMetadataEntry struct {
+	Label iiifLangMap `json:"label"`
+	Value iiifLangMap `json:"value"`
+}
+
+type iiifManifest struct {
+	Context    string              `json:"@context"`
+	ID         string              `json:"id"`
+	Type       string              `json:"type"`
+	Label      iiifLangMap         `json:"label"`
+	Metadata   []iiifMetadataEntry `json:"metadata,omitempty"`
+	Items      []iiifCanvas        `json:"items"`
+	Structures []iiifRange         `json:"structures,omitempty"`
+}
+
+type iiifCanvas struct {
+	ID     string               `json:"id"`
+	Type   string               `json:"type"`
+	Label  iiifLangMap          `json:"label"`
+	Width  uint                 `json:"width"`
+	Height uint                 `json:"height"`
+	Items  []iiifAnnotationPage `json:"items"`
+}
+
+type iiifAnnotationPage struct {
+	ID    string           `json:"id"`
+	Type  string           `json:"type"`
+	Items []iiifAnnotation `json:"items"`
+}
+
+type iiifAnnotation struct {
+	ID         string        `json:"id"`
+	Type       string        `json:"type"`
+	Motivation string        `json:"motivation"`
+	Body       iiifImageBody `json:"body"`
+	Target     string        `json:"target"`
+}
+
+type iiifImageBody struct {
+	ID      string             `json:"id"`
+	Type    string             `json:"type"`
+	Format  string             `json:"format"`
+	Width   uint               `json:"width"`
+	Height  uint               `json:"height"`
+	Service []iiifImageService `json:"service"`
+}
+
+type iiifImageService struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Profile string `json:"profile"`
+}
+
+type iiifRange struct {
+	ID    string          `json:"id"`
+	Type  string          `json:"type"`
+	Label iiifLangMap     `json:"label"`
+	Items []iiifReference `json:"items"`
+}
+
+type iiifReference struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+func iiifLabel(val string) iiifLangMap {
+	return iiifLangMap{"none": []string{val}}
+}
+
+// buildIIIFManifest generates a IIIF Presentation 3.0 manifest for a metadata record. Canvases are
+// the master files from units included in the DL, or all master files for the metadata if none are.
+// Ranges group the canvases by component, or by location for records without components. The manifest id
+// is the URL it is published to in IIIF storage.
+func (svc *ServiceContext) buildIIIFManifest(md *metadata) (*iiifManifest, error) {
+	var masterFiles []masterFile
+	err := svc.GDB.Joins("inner join units u on u.id=master_files.unit_id").
+		Preload("ImageTechMeta").Preload("Component").Preload("Component.ComponentType").
+		Preload("Locations").Preload("Locations.ContainerType").
+		Where("master_files.metadata_id=? and u.include_in_dl=? and master_files.deaccessioned_at is null", md.ID, true).
+		Order("master_files.unit_id asc, master_files.filename asc").Find(&masterFiles).Error
+	if err != nil {
+		return nil, fmt.Errorf("unable to get master files for metadata %d: %s", md.ID, err.Error())
+	}
+	if len(masterFiles) == 0 {
+		err = svc.GDB.Preload("ImageTechMeta").Preload("Component").Preload("Component.ComponentType").
+			Preload("Locations").Preload("Locations.ContainerType").
+			Where("metadata_id=? and deaccessioned_at is null", md.ID).
+			Order("unit_id asc, filename asc").Find(&masterFiles).Error
+		if err != nil {
+			return nil, fmt.Errorf("unable to get master files for metadata %d: %s", md.ID, err.Error())
+		}
+	}
+	if len(masterFiles) == 0 {
+		return nil, fmt.Errorf("metadata %d has no master files", md.ID)
+	}
+
+	manifestID := svc.getIIIFManifestID(md.PID)
+	canvasBase := strings.TrimSuffix(manifestID, ".json")
+	out := iiifManifest{
+		Context: "http://iiif.io/api/presentation/3/context.json",
+		ID:      manifestID,
+		Type:    "Manifest",
+		Label:   iiifLabel(md.Title),
+		Items:   make([]iiifCanvas, 0, len(masterFiles)),
+	}
+	if md.CreatorName != "" {
+		out.Metadata = append(out.Metadata, iiifMetadataEntry{Label: iiifLabel("Creator"), Value: iiifLabel(md.CreatorName)})
+	}
+	if md.CallNumber != "" {
+		out.Metadata = append(out.Metadata, iiifMetadataEntry{Label: iiifLabel("Call Number"), Value: iiifLabel(md.CallNumber)})
+	}
+
+	// ranges are keyed by component or location ID; different components can share a label
+	rangeIdx := make(map[string]int)
+	for _, mf := range masterFiles {
+		tm := mf.ImageTechMeta
+		if tm.Width == 0 || tm.Height == 0 {
+			log.Printf("WARNING: master file %s has no image dimensions and will not be included in the manifest for %s", mf.PID, md.PID)
+			continue
+		}
+		canvasID := fmt.Sprintf("%s/canvas/%s", canvasBase, mf.PID)
+		label := mf.Title
+		if label == "" {
+			label = mf.Filename
+		}
+		imageURL := fmt.Sprintf("%s/%s", svc.IIIF.ImageURL, mf.PID)
+		canvas := iiifCanvas{ID: canvasID, Type: "Canvas", Label: iiifLabel(label), Width: tm.Width, Height: tm.Height,
+			Items: []iiifAnnotationPage{{
+				ID:   fmt.Sprintf("%s/page", canvasID),
+				Type: "AnnotationPage",
+				Items: []iiifAnnotation{{
+					ID:         fmt.Sprintf("%s/page/image", canvasID),
+					Type:       "Annotation",
+					Motivation: "painting",
+					Target:     canvasID,
+					Body: iiifImageBody{
+						ID:      fmt.Sprintf("%s/full/full/0/default.jpg", imageURL),
+						Type:    "Image",
+						Format:  "image/jpeg",
+						Width:   tm.Width,
+						Height:  tm.Height,
+						Service: []iiifImageService{{ID: imageURL, Type: "ImageService2", Profile: "level2"}},
+					},
+				}},
+			}},
+		}
+		out.Items = append(out.Items, canvas)
+
+		rangeKey := ""
+		rangeLabel := ""
+		if mf.Component != nil {
+			rangeKey = fmt.Sprintf("component/%d", mf.Component.ID)
+			rangeLabel = mf.Component.Name()
+		} else if loc := mf.location(); loc != nil {
+			rangeKey = fmt.Sprintf("location/%d", loc.ID)
+			rangeLabel = locationLabel(loc)
+		}
+		if rangeLabel == "" {
+			continue
+		}
+		idx, found := rangeIdx[rangeKey]
+		if found == false {
+			idx = len(out.Structures)
+			rangeIdx[rangeKey] = idx
+			out.Structures = append(out.Structures, iiifRange{ID: fmt.Sprintf("%s/range/%d", canvasBase, idx+1),
+				Type: "Range", Label: iiifLabel(rangeLabel), Items: make([]iiifReference, 0)})
+		}
+		out.Structures[idx].Items = append(out.Structures[idx].Items, iiifReference{ID: canvasID, Type: "Canvas"})
+	}
+	if len(out.Items) == 0 {
+		return nil, fmt.Errorf("metadata %d has no master files with image dimensions", md.ID)
+	}
+	return &out, nil
+}
+
+// locationLabel describes a location as container and folder; eg: Box 3, Folder 12
+func locationLabel(loc *location) string {
+	parts := make([]string, 0)
+	if loc.ContainerID != "" {
+		name := loc.ContainerType.Name
+		if name == "" {
+			name = "Container"
+		}
+		parts = append(parts, fmt.Sprintf("%s %s", strings.ToUpper(name[0:1])+name[1:], loc.ContainerID))
+	}
+	if loc.FolderID != "" {
+		parts = append(parts, fmt.Sprintf("Folder %s", loc.FolderID))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// getIIIFManifestKey returns the IIIF storage key for the manifest of a metadata record
+func getIIIFManifestKey(mdPID string) string {
+	return fmt.Sprintf("manifests/%s.json", mdPID)
+}
+
+// getIIIFManifestID returns the id of the manifest for a metadata record: the public URL of its IIIF storage key
+func (svc *ServiceContext) getIIIFManifestID(mdPID string) string {
+	return fmt.Sprintf("%s/%s", svc.IIIF.ManifestStoreURL, getIIIFManifestKey(mdPID))
+}
+
+// writeIIIFManifest saves a manifest to IIIF storage and returns the storage key
+func (svc *ServiceContext) writeIIIFManifest(ctx context.Context, mdPID string, manifest *iiifManifest) (string, error) {
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	tmpFile, err := os.CreateTemp("", "manifest-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(manifestJSON)
+	tmpFile.Close()
+	if err != nil {
+		return "", err
+	}
+	key := getIIIFManifestKey(mdPID)
+	err = svc.IIIF.Storage.put(ctx, tmpFile.Name(), key)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// getIIIFManifest generates and returns the IIIF manifest for a metadata record
+func (svc *ServiceContext) getIIIFManifest(c *gin.Context) {
+	md, ok := svc.loadManifestMetadata(c)
+	if ok == false {
+		return
+	}
+	manifest, err := svc.buildIIIFManifest(md)
+	if err != nil {
+		log.Printf("ERROR: unable to build iiif manifest for metadata %d: %s", md.ID, err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, manifest)
+}
+
+// publishIIIFManifest generates the IIIF manifest for a metadata record and writes it to IIIF storage
+func (svc *ServiceContext) publishIIIFManifest(c *gin.Context) {
+	md, ok := svc.loadManifestMetadata(c)
+	if ok == false {
+		return
+	}
+	manifest, err := svc.buildIIIFManifest(md)
+	if err != nil {
+		log.Printf("ERROR: unable to build iiif manifest for metadata %d: %s", md.ID, err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	key, err := svc.writeIIIFManifest(c.Request.Context(), md.PID, manifest)
+	if err != nil {
+		log.Printf("ERROR: unable to write iiif manifest for metadata %d: %s", md.ID, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("INFO: iiif manifest for metadata %d with %d canvases written to %s/%s", md.ID, len(manifest.Items), svc.IIIF.Storage.location(), key)
+	c.String(http.StatusOK, key)
+}
+
+func (svc *ServiceContext) loadManifestMetadata(c *gin.Context) (*metadata, bool) {
+	mdID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	var md metadata
+	err := svc.GDB.First(&md, mdID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.String(http.StatusNotFound, "not found")
+		} else {
+			c.String(http.StatusInternalServerError, err.Error())
+		}
+		return nil, false
+	}
+	return &md, true
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -26,56 +27,71 @@ func (svc *ServiceContext) replaceMasterFiles(c *gin.Context) {
 		return
 	}
 
-	go func() {
-		unitDir := fmt.Sprintf("%09d", unitID)
-		srcDir := path.Join(svc.ProcessingDir, "finalization", "unit_update", unitDir)
-		svc.logInfo(js, fmt.Sprintf("Looking for new *.tif files in %s", srcDir))
-		files, err := svc.getTifFiles(js, srcDir, unitID)
-		if err != nil {
-			svc.logFatal(js, fmt.Sprintf("Unable to get .tif files in %s: %s", srcDir, err.Error()))
-			return
-		}
+	err = svc.enqueueJob(js, "ReplaceMasterFiles", unitJobRequest{UnitID: unitID})
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		if len(files) == 0 {
-			svc.logFatal(js, "No replacement .tif files found")
-			return
-		}
+	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+}
 
-		for _, tifFile := range files {
+func (svc *ServiceContext) runReplaceMasterFiles(js *jobStatus, payload []byte) error {
+	var req unitJobRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid ReplaceMasterFiles payload: %s", err.Error())
+	}
+	unitID := req.UnitID
 
-			svc.logInfo(js, fmt.Sprintf("Replacing master file %s", tifFile.filename))
-			var mf masterFile
-			err := svc.GDB.Preload("ImageTechMeta").Where("filename=?", tifFile.filename).First(&mf).Error
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("Masterfile %s was not found in unit. Skipping.", tifFile.filename))
-				continue
-			}
-			mf.Filesize = tifFile.size
-			mf.MD5 = md5Checksum(tifFile.path)
-			err = svc.GDB.Model(&mf).Select("Filesize", "MD5").Updates(mf).Error
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("Unable to save updates to %s: %s", mf.Filename, err.Error()))
-			}
-			if mf.ImageTechMeta.ID > 0 {
-				svc.GDB.Delete(&mf.ImageTechMeta)
-			}
-			svc.createImageTechMetadata(&mf, tifFile.path)
-			svc.publishToIIIF(js, &mf, tifFile.path, true)
-			archiveMD5, err := svc.archiveFile(js, tifFile.path, unitID, &mf)
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("Unable to archive %s: %s", mf.Filename, err.Error()))
-			}
-			if archiveMD5 != mf.MD5 {
-				svc.logError(js, fmt.Sprintf("Archived MD5 does not match for %s", mf.Filename))
-			}
-		}
+	unitDir := fmt.Sprintf("%09d", unitID)
+	srcDir := path.Join(svc.ProcessingDir, "finalization", "unit_update", unitDir)
+	svc.logInfo(js, fmt.Sprintf("Looking for new *.tif files in %s", srcDir))
+	files, err := svc.getTifFiles(js, srcDir, unitID)
+	if err != nil {
+		svc.logFatal(js, fmt.Sprintf("Unable to get .tif files in %s: %s", srcDir, err.Error()))
+		return nil
+	}
 
-		svc.logInfo(js, "Cleaning up working files")
-		os.RemoveAll(srcDir)
-		svc.jobDone(js)
-	}()
+	if len(files) == 0 {
+		svc.logFatal(js, "No replacement .tif files found")
+		return nil
+	}
 
-	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+	for _, tifFile := range files {
+
+		svc.logInfo(js, fmt.Sprintf("Replacing master file %s", tifFile.filename))
+		var mf masterFile
+		err := svc.GDB.Preload("ImageTechMeta").Where("filename=?", tifFile.filename).First(&mf).Error
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("Masterfile %s was not found in unit. Skipping.", tifFile.filename))
+			continue
+		}
+		mf.Filesize = tifFile.size
+		mf.MD5 = md5Checksum(tifFile.path)
+		err = svc.GDB.Model(&mf).Select("Filesize", "MD5").Updates(mf).Error
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("Unable to save updates to %s: %s", mf.Filename, err.Error()))
+		}
+		if mf.ImageTechMeta.ID > 0 {
+			svc.GDB.Delete(&mf.ImageTechMeta)
+		}
+		svc.createImageTechMetadata(js, &mf, tifFile.path)
+		svc.publishToIIIF(js, &mf, tifFile.path, true)
+		archiveMD5, err := svc.archiveFile(js, tifFile.path, unitID, &mf)
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("Unable to archive %s: %s", mf.Filename, err.Error()))
+		}
+		if archiveMD5 != mf.MD5 {
+			svc.logError(js, fmt.Sprintf("Archived MD5 does not match for %s", mf.Filename))
+		}
+	}
+
+	svc.logInfo(js, "Cleaning up working files")
+	os.RemoveAll(srcDir)
+	svc.jobDone(js)
+	return nil
 }
 
 func (svc *ServiceContext) assignMasterFileComponent(c *gin.Context) {
@@ -258,115 +274,135 @@ func (svc *ServiceContext) deleteMasterFiles(c *gin.Context) {
 	}
 	svc.logInfo(js, fmt.Sprintf("These masterfiles will be removed %v", req.Filenames))
 
-	go func() {
-		svc.logInfo(js, "Load unit and masterfiles")
-		var tgtUnit unit
-		err = svc.GDB.Preload("MasterFiles", func(db *gorm.DB) *gorm.DB {
-			return db.Order("master_files.filename ASC")
-		}).First(&tgtUnit, unitID).Error
-		if err != nil {
-			svc.logFatal(js, fmt.Sprintf("Unable to load unit %d: %s", unitID, err.Error()))
-			return
-		}
+	err = svc.enqueueJob(js, "DeleteMasterFiles", deleteMasterFilesRequest{UnitID: unitID, Filenames: req.Filenames})
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		if tgtUnit.DateDLDeliverablesReady != nil {
-			svc.logFatal(js, "Cannot delete from units that have been published")
-			return
-		}
+	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+}
 
-		unitDir := fmt.Sprintf("%09d", unitID)
-		tgtFN := req.Filenames[0]
-		req.Filenames = req.Filenames[1:]
-		for _, mf := range tgtUnit.MasterFiles {
-			if mf.Filename != tgtFN {
-				continue
-			}
+type deleteMasterFilesRequest struct {
+	UnitID    int64
+	Filenames []string
+}
 
-			svc.logInfo(js, fmt.Sprintf("Delete %s", mf.Filename))
-			if mf.OriginalMfID == nil && mf.DeaccessionedAt == nil {
-				svc.removeArchive(js, unitID, mf.Filename)
+func (svc *ServiceContext) runDeleteMasterFiles(js *jobStatus, payload []byte) error {
+	var req deleteMasterFilesRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid DeleteMasterFiles payload: %s", err.Error())
+	}
+	unitID := req.UnitID
 
-				iiifInfo := svc.getIIIFContext(mf.PID)
-				err = svc.unpublishIIIF(js, iiifInfo.S3Key())
-				if err != nil {
-					svc.logError(js, fmt.Sprintf("Unable to unpublish IIIF resource for master file %d: %s", mf.ID, err.Error()))
-				}
-			} else {
-				// clone
-				clonedFile := path.Join(svc.ProcessingDir, "finalization", unitDir, mf.Filename)
-				if pathExists(clonedFile) {
-					svc.logInfo(js, fmt.Sprintf("Removing cloned tif from in_process dir: %s", clonedFile))
-					os.Remove(clonedFile)
-				}
-			}
+	svc.logInfo(js, "Load unit and masterfiles")
+	var tgtUnit unit
+	err = svc.GDB.Preload("MasterFiles", func(db *gorm.DB) *gorm.DB {
+		return db.Order("master_files.filename ASC")
+	}).First(&tgtUnit, unitID).Error
+	if err != nil {
+		svc.logFatal(js, fmt.Sprintf("Unable to load unit %d: %s", unitID, err.Error()))
+		return nil
+	}
 
-			svc.logInfo(js, fmt.Sprintf("Removing master file and image tech metadata for %s", tgtFN))
-			svc.GDB.Where("master_file_id=?", mf.ID).Delete(&imageTechMeta{})
-			svc.GDB.Delete(&masterFile{}, mf.ID)
+	if tgtUnit.DateDLDeliverablesReady != nil {
+		svc.logFatal(js, "Cannot delete from units that have been published")
+		return nil
+	}
 
-			if len(req.Filenames) > 0 {
-				tgtFN = req.Filenames[0]
-				req.Filenames = req.Filenames[1:]
-			} else {
-				break
-			}
+	unitDir := fmt.Sprintf("%09d", unitID)
+	tgtFN := req.Filenames[0]
+	req.Filenames = req.Filenames[1:]
+	for _, mf := range tgtUnit.MasterFiles {
+		if mf.Filename != tgtFN {
+			continue
 		}
 
-		svc.GDB.Preload("MasterFiles", func(db *gorm.DB) *gorm.DB {
-			return db.Order("master_files.filename ASC")
-		}).First(&tgtUnit, unitID) // reload masterfiles list
-
-		svc.logInfo(js, "Updating remaining master files to correct page number gaps")
-		prevPage := -1
-		currPage := 1
-		changeTitle := true
-		for _, mf := range tgtUnit.MasterFiles {
-			// if page titles are not a number, can't consider them to be sequential
-			titleInt, _ := strconv.Atoi(mf.Title)
-			if fmt.Sprintf("%d", titleInt) != mf.Title {
-				changeTitle = false
+		svc.logInfo(js, fmt.Sprintf("Delete %s", mf.Filename))
+		if mf.OriginalMfID == nil && mf.DeaccessionedAt == nil {
+			svc.removeArchive(js, unitID, mf.Filename)
+
+			iiifInfo := svc.getIIIFContext(mf.PID)
+			err = svc.unpublishIIIF(js, iiifInfo.S3Key())
+			if err != nil {
+				svc.logError(js, fmt.Sprintf("Unable to unpublish IIIF resource for master file %d: %s", mf.ID, err.Error()))
 			}
-			if prevPage > -1 && prevPage+1 != currPage {
-				changeTitle = false
+		} else {
+			// clone
+			clonedFile := path.Join(svc.ProcessingDir, "finalization", unitDir, mf.Filename)
+			if pathExists(clonedFile) {
+				svc.logInfo(js, fmt.Sprintf("Removing cloned tif from in_process dir: %s", clonedFile))
+				os.Remove(clonedFile)
 			}
+		}
 
-			mfPg, err := getMasterFilePageNum(mf.Filename)
+		svc.logInfo(js, fmt.Sprintf("Removing master file and image tech metadata for %s", tgtFN))
+		svc.GDB.Where("master_file_id=?", mf.ID).Delete(&imageTechMeta{})
+		svc.GDB.Delete(&masterFile{}, mf.ID)
+
+		if len(req.Filenames) > 0 {
+			tgtFN = req.Filenames[0]
+			req.Filenames = req.Filenames[1:]
+		} else {
+			break
+		}
+	}
+
+	svc.GDB.Preload("MasterFiles", func(db *gorm.DB) *gorm.DB {
+		return db.Order("master_files.filename ASC")
+	}).First(&tgtUnit, unitID) // reload masterfiles list
+
+	svc.logInfo(js, "Updating remaining master files to correct page number gaps")
+	prevPage := -1
+	currPage := 1
+	changeTitle := true
+	for _, mf := range tgtUnit.MasterFiles {
+		// if page titles are not a number, can't consider them to be sequential
+		titleInt, _ := strconv.Atoi(mf.Title)
+		if fmt.Sprintf("%d", titleInt) != mf.Title {
+			changeTitle = false
+		}
+		if prevPage > -1 && prevPage+1 != currPage {
+			changeTitle = false
+		}
+
+		mfPg, err := getMasterFilePageNum(mf.Filename)
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("Skipping rename of masterfile with invalid filename %s", mf.Filename))
+		} else if mfPg > currPage {
+			origFN := mf.Filename
+			pageStr := fmt.Sprintf("%04d", currPage)
+			newFN := fmt.Sprintf("%s_%s.tif", unitDir, pageStr)
+			svc.logInfo(js, fmt.Sprintf("Update MF filename from %s to %s", origFN, newFN))
+			mf.Filename = newFN
+
+			// see if the title is a number and that it is the different
+			// from the new page number portion. If so, update it
+			if titleInt != currPage && changeTitle {
+				mf.Title = fmt.Sprintf("%d", currPage)
+			}
+			err = svc.GDB.Model(&mf).Select("Filename", "Title").Updates(mf).Error
 			if err != nil {
-				svc.logError(js, fmt.Sprintf("Skipping rename of masterfile with invalid filename %s", mf.Filename))
-			} else if mfPg > currPage {
-				origFN := mf.Filename
-				pageStr := fmt.Sprintf("%04d", currPage)
-				newFN := fmt.Sprintf("%s_%s.tif", unitDir, pageStr)
-				svc.logInfo(js, fmt.Sprintf("Update MF filename from %s to %s", origFN, newFN))
-				mf.Filename = newFN
-
-				// see if the title is a number and that it is the different
-				// from the new page number portion. If so, update it
-				if titleInt != currPage && changeTitle {
-					mf.Title = fmt.Sprintf("%d", currPage)
-				}
-				err = svc.GDB.Model(&mf).Select("Filename", "Title").Updates(mf).Error
-				if err != nil {
-					log.Printf("ERR: %s", err.Error())
-				}
-
-				if mf.OriginalMfID == nil && mf.DeaccessionedAt == nil {
-					svc.renameArchive(js, unitID, origFN, mf.MD5, newFN)
-				} else {
-					origClonedFile := path.Join(svc.ProcessingDir, "finalization", unitDir, origFN)
-					newClonedFile := path.Join(svc.ProcessingDir, "finalization", unitDir, newFN)
-					svc.logInfo(js, fmt.Sprintf("Rename cloned file %s -> %s", origClonedFile, newClonedFile))
-					os.Rename(newClonedFile, newClonedFile)
-				}
+				log.Printf("ERR: %s", err.Error())
 			}
 
-			prevPage = currPage
-			currPage++
+			if mf.OriginalMfID == nil && mf.DeaccessionedAt == nil {
+				svc.renameArchive(js, unitID, origFN, mf.MD5, newFN)
+			} else {
+				origClonedFile := path.Join(svc.ProcessingDir, "finalization", unitDir, origFN)
+				newClonedFile := path.Join(svc.ProcessingDir, "finalization", unitDir, newFN)
+				svc.logInfo(js, fmt.Sprintf("Rename cloned file %s -> %s", origClonedFile, newClonedFile))
+				os.Rename(newClonedFile, newClonedFile)
+			}
 		}
-		svc.jobDone(js)
-	}()
 
-	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+		prevPage = currPage
+		currPage++
+	}
+	svc.jobDone(js)
+	return nil
 }
 
 func (svc *ServiceContext) addMasterFiles(c *gin.Context) {
@@ -378,141 +414,156 @@ func (svc *ServiceContext) addMasterFiles(c *gin.Context) {
 		return
 	}
 
-	go func() {
-		svc.logInfo(js, "Load unit and masterfiles")
-		var tgtUnit unit
-		err = svc.GDB.
-			Preload("MasterFiles", func(db *gorm.DB) *gorm.DB {
-				return db.Order("master_files.filename ASC")
-			}).
-			Preload("MasterFiles.ImageTechMeta").
-			Preload("MasterFiles.Locations").
-			Preload("MasterFiles.Locations.ContainerType").
-			First(&tgtUnit, unitID).Error
+	err = svc.enqueueJob(js, "AddMasterFiles", unitJobRequest{UnitID: unitID})
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("INFO: return add master files job id: %d", js.ID)
+	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+}
+
+func (svc *ServiceContext) runAddMasterFiles(js *jobStatus, payload []byte) error {
+	var req unitJobRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid AddMasterFiles payload: %s", err.Error())
+	}
+	unitID := req.UnitID
+
+	svc.logInfo(js, "Load unit and masterfiles")
+	var tgtUnit unit
+	err = svc.GDB.
+		Preload("MasterFiles", func(db *gorm.DB) *gorm.DB {
+			return db.Order("master_files.filename ASC")
+		}).
+		Preload("MasterFiles.ImageTechMeta").
+		Preload("MasterFiles.Locations").
+		Preload("MasterFiles.Locations.ContainerType").
+		First(&tgtUnit, unitID).Error
+	if err != nil {
+		svc.logFatal(js, fmt.Sprintf("Unable to load unit %d: %s", unitID, err.Error()))
+		return nil
+	}
+
+	srcDir := path.Join(svc.ProcessingDir, "finalization", "unit_update", fmt.Sprintf("%09d", tgtUnit.ID))
+	svc.logInfo(js, fmt.Sprintf("Looking for new *.tif files in %s", srcDir))
+	files, err := svc.getTifFiles(js, srcDir, unitID)
+	if err != nil {
+		svc.logFatal(js, fmt.Sprintf("Unable to get .tif files in %s: %s", srcDir, err.Error()))
+		return nil
+	}
+
+	if len(files) == 0 {
+		svc.logFatal(js, "No tif files found")
+		return nil
+	}
+
+	newPage := -1
+	prevPage := -1
+	for _, fi := range files {
+		pageNum, err := getMasterFilePageNum(fi.filename)
 		if err != nil {
-			svc.logFatal(js, fmt.Sprintf("Unable to load unit %d: %s", unitID, err.Error()))
-			return
+			svc.logFatal(js, fmt.Sprintf("Invalid filename %s", fi.filename))
+			return nil
+		}
+		if newPage == -1 {
+			newPage = pageNum
+			prevPage = newPage
+		} else {
+			if pageNum > prevPage+1 {
+				svc.logFatal(js, fmt.Sprintf("Gap in sequence number of new master files; %d to %d", pageNum, prevPage+1))
+				return nil
+			}
+			prevPage = pageNum
 		}
+	}
+
+	lastPageNum, err := getMasterFilePageNum(tgtUnit.MasterFiles[len(tgtUnit.MasterFiles)-1].Filename)
+	if err != nil {
+		svc.logFatal(js, fmt.Sprintf("Invalid last filename %s", tgtUnit.MasterFiles[len(tgtUnit.MasterFiles)-1].Filename))
+		return nil
+	}
+	if newPage > lastPageNum+1 {
+		svc.logFatal(js, fmt.Sprintf("New master file sequence number gap (from %d to %d)", lastPageNum, newPage))
+		return nil
+	}
 
-		srcDir := path.Join(svc.ProcessingDir, "finalization", "unit_update", fmt.Sprintf("%09d", tgtUnit.ID))
-		svc.logInfo(js, fmt.Sprintf("Looking for new *.tif files in %s", srcDir))
-		files, err := svc.getTifFiles(js, srcDir, unitID)
+	if newPage <= lastPageNum {
+		// rename/rearchive files to make room for new files to be inserted
+		// If components are involved, return the ID of the component at the insertion point
+		err := svc.makeGapForInsertion(js, &tgtUnit, files)
 		if err != nil {
-			svc.logFatal(js, fmt.Sprintf("Unable to get .tif files in %s: %s", srcDir, err.Error()))
-			return
+			svc.logFatal(js, fmt.Sprintf("Unable to create gap for ne image insertion: %s", err.Error()))
+			return nil
 		}
+	}
 
-		if len(files) == 0 {
-			svc.logFatal(js, "No tif files found")
-			return
-		}
+	// grab the first existing master file and see if it has location data.
+	// if it does, the cotainer type for all will be the same. pull it
+	var existingLoc *location
+	var componentID *int64
+	if len(tgtUnit.MasterFiles) > 0 {
+		existingLoc = tgtUnit.MasterFiles[0].location()
+		componentID = tgtUnit.MasterFiles[0].ComponentID
+	}
 
-		newPage := -1
-		prevPage := -1
-		for _, fi := range files {
-			pageNum, err := getMasterFilePageNum(fi.filename)
-			if err != nil {
-				svc.logFatal(js, fmt.Sprintf("Invalid filename %s", fi.filename))
-				return
-			}
-			if newPage == -1 {
-				newPage = pageNum
-				prevPage = newPage
-			} else {
-				if pageNum > prevPage+1 {
-					svc.logFatal(js, fmt.Sprintf("Gap in sequence number of new master files; %d to %d", pageNum, prevPage+1))
-					return
-				}
-				prevPage = pageNum
-			}
+	// Create new master files for the tif file found in the src dir
+	svc.logInfo(js, fmt.Sprintf("Adding %d new master files...", len(files)))
+	for _, tf := range files {
+		// create MF and tech metadata
+		md5 := md5Checksum(tf.path)
+		pgNum, err := getMasterFilePageNum(tf.filename)
+		if err != nil {
+			svc.logFatal(js, fmt.Sprintf("Invalid new image filename %s", tf.filename))
+			return nil
 		}
-
-		lastPageNum, err := getMasterFilePageNum(tgtUnit.MasterFiles[len(tgtUnit.MasterFiles)-1].Filename)
+		newMF := masterFile{Filename: tf.filename, Title: fmt.Sprintf("%d", pgNum), Filesize: tf.size,
+			MD5: md5, UnitID: tgtUnit.ID, ComponentID: componentID, MetadataID: tgtUnit.MetadataID}
+		err = svc.GDB.Create(&newMF).Error
 		if err != nil {
-			svc.logFatal(js, fmt.Sprintf("Invalid last filename %s", tgtUnit.MasterFiles[len(tgtUnit.MasterFiles)-1].Filename))
-			return
+			svc.logFatal(js, fmt.Sprintf("Unable to create %s: %s", tf.filename, err.Error()))
+			return nil
 		}
-		if newPage > lastPageNum+1 {
-			svc.logFatal(js, fmt.Sprintf("New master file sequence number gap (from %d to %d)", lastPageNum, newPage))
-			return
+		svc.logInfo(js, fmt.Sprintf("Created masterfile for %s, PID: %s", tf.filename, newMF.PID))
+		if existingLoc != nil {
+			svc.logInfo(js, fmt.Sprintf("Adding location %+v", *existingLoc))
+			svc.GDB.Exec("INSERT into master_file_locations (master_file_id, location_id) values (?,?)", newMF.ID, existingLoc.ID)
 		}
 
-		if newPage <= lastPageNum {
-			// rename/rearchive files to make room for new files to be inserted
-			// If components are involved, return the ID of the component at the insertion point
-			err := svc.makeGapForInsertion(js, &tgtUnit, files)
-			if err != nil {
-				svc.logFatal(js, fmt.Sprintf("Unable to create gap for ne image insertion: %s", err.Error()))
-				return
-			}
+		svc.logInfo(js, fmt.Sprintf("Create image tech metadata for %s", tf.filename))
+		err = svc.createImageTechMetadata(js, &newMF, tf.path)
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("Unable to create %s tech metadata: %s", tf.filename, err.Error()))
 		}
 
-		// grab the first existing master file and see if it has location data.
-		// if it does, the cotainer type for all will be the same. pull it
-		var existingLoc *location
-		var componentID *int64
-		if len(tgtUnit.MasterFiles) > 0 {
-			existingLoc = tgtUnit.MasterFiles[0].location()
-			componentID = tgtUnit.MasterFiles[0].ComponentID
+		err = svc.publishToIIIF(js, &newMF, tf.path, true)
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("Unable to publish %s to IIIF: %s", tf.filename, err.Error()))
 		}
 
-		// Create new master files for the tif file found in the src dir
-		svc.logInfo(js, fmt.Sprintf("Adding %d new master files...", len(files)))
-		for _, tf := range files {
-			// create MF and tech metadata
-			md5 := md5Checksum(tf.path)
-			pgNum, err := getMasterFilePageNum(tf.filename)
-			if err != nil {
-				svc.logFatal(js, fmt.Sprintf("Invalid new image filename %s", tf.filename))
-				return
-			}
-			newMF := masterFile{Filename: tf.filename, Title: fmt.Sprintf("%d", pgNum), Filesize: tf.size,
-				MD5: md5, UnitID: tgtUnit.ID, ComponentID: componentID, MetadataID: tgtUnit.MetadataID}
-			err = svc.GDB.Create(&newMF).Error
-			if err != nil {
-				svc.logFatal(js, fmt.Sprintf("Unable to create %s: %s", tf.filename, err.Error()))
-				return
-			}
-			svc.logInfo(js, fmt.Sprintf("Created masterfile for %s, PID: %s", tf.filename, newMF.PID))
-			if existingLoc != nil {
-				svc.logInfo(js, fmt.Sprintf("Adding location %+v", *existingLoc))
-				svc.GDB.Exec("INSERT into master_file_locations (master_file_id, location_id) values (?,?)", newMF.ID, existingLoc.ID)
-			}
-
-			svc.logInfo(js, fmt.Sprintf("Create image tech metadata for %s", tf.filename))
-			err = svc.createImageTechMetadata(&newMF, tf.path)
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("Unable to create %s tech metadata: %s", tf.filename, err.Error()))
-			}
-
-			err = svc.publishToIIIF(js, &newMF, tf.path, true)
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("Unable to publish %s to IIIF: %s", tf.filename, err.Error()))
-			}
-
-			// archive file, validate checksum and set archived date
-			newMD5, err := svc.archiveFile(js, tf.path, unitID, &newMF)
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("Unable to archive %s: %s", tf.filename, err.Error()))
-			}
-
-			if newMD5 != newMF.MD5 {
-				svc.logError(js, fmt.Sprintf("Archived MD5 does not match for %s: %s vs %s", tf.filename, newMD5, newMF.MD5))
-			}
+		// archive file, validate checksum and set archived date
+		newMD5, err := svc.archiveFile(js, tf.path, unitID, &newMF)
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("Unable to archive %s: %s", tf.filename, err.Error()))
+		}
 
-			now := time.Now()
-			newMF.DateArchived = &now
-			svc.GDB.Model(&newMF).Select("DateArchived").Updates(newMF)
+		if newMD5 != newMF.MD5 {
+			svc.logError(js, fmt.Sprintf("Archived MD5 does not match for %s: %s vs %s", tf.filename, newMD5, newMF.MD5))
 		}
 
-		svc.logInfo(js, "Cleaning up working files")
-		os.RemoveAll(srcDir)
+		now := time.Now()
+		newMF.DateArchived = &now
+		svc.GDB.Model(&newMF).Select("DateArchived").Updates(newMF)
+	}
 
-		svc.jobDone(js)
-	}()
+	svc.logInfo(js, "Cleaning up working files")
+	os.RemoveAll(srcDir)
 
-	log.Printf("INFO: return add master files job id: %d", js.ID)
-	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+	svc.jobDone(js)
+	return nil
 }
 
 func (svc *ServiceContext) updateMasterFileTechMetadata(c *gin.Context) {
@@ -556,7 +607,7 @@ func (svc *ServiceContext) updateMasterFileTechMetadata(c *gin.Context) {
 		return
 	}
 
-	err = svc.createImageTechMetadata(&tgtMF, archiveFile)
+	err = svc.createImageTechMetadata(js, &tgtMF, archiveFile)
 	if err != nil {
 		log.Printf("ERROR: unable to create image tech metadata: %s", err.Error())
 	}
@@ -621,13 +672,7 @@ func (svc *ServiceContext) updateMasterFileIIIF(c *gin.Context) {
 		return
 	}
 
-	unitDir := fmt.Sprintf("%09d", tgtMF.UnitID)
-	archiveFile := path.Join(svc.ArchiveDir, unitDir, tgtMF.Filename)
-	if strings.Contains(tgtMF.Unit.StaffNotes, "Archive: ") {
-		srcDir := strings.Split(tgtMF.Unit.StaffNotes, "Archive: ")[1]
-		archiveFile = path.Join(svc.ArchiveDir, srcDir, tgtMF.Filename)
-	}
-
+	archiveFile := svc.getIIIFSourceFile(&tgtMF)
 	if pathExists(archiveFile) == false {
 		svc.logFatal(js, fmt.Sprintf("Master file %d archive %s does not exist", mfID, archiveFile))
 		c.String(http.StatusBadRequest, "archive not found")
@@ -647,20 +692,66 @@ func (svc *ServiceContext) updateMasterFileIIIF(c *gin.Context) {
 		return
 	}
 
-	go func() {
-		err = svc.publishToIIIF(js, &tgtMF, archiveFile, true)
-		if err != nil {
-			svc.logFatal(js, fmt.Sprintf("Update IIIF for master file %d from archive %s failed: %s", mfID, archiveFile, err.Error()))
-			c.String(http.StatusInternalServerError, err.Error())
-			return
-		}
+	jp2 := jp2Settings{Profile: c.Query("profile"), Encoder: c.Query("encoder")}
+	err = jp2.validate()
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
 
-		svc.jobDone(js)
-	}()
+	err = svc.enqueueJob(js, "UpdateIIIF", masterFileIIIFRequest{MasterFileID: mfID, ArchiveFile: archiveFile, JP2: jp2})
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
 	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
 }
 
+// getIIIFSourceFile returns the archived image used to publish a master file to IIIF. Units whose
+// images were archived elsewhere have the archive directory in the staff notes.
+func (svc *ServiceContext) getIIIFSourceFile(mf *masterFile) string {
+	unitDir := fmt.Sprintf("%09d", mf.UnitID)
+	archiveFile := path.Join(svc.ArchiveDir, unitDir, mf.Filename)
+	if strings.Contains(mf.Unit.StaffNotes, "Archive: ") {
+		srcDir := strings.Split(mf.Unit.StaffNotes, "Archive: ")[1]
+		archiveFile = path.Join(svc.ArchiveDir, srcDir, mf.Filename)
+	}
+	return archiveFile
+}
+
+type masterFileIIIFRequest struct {
+	MasterFileID int64
+	ArchiveFile  string
+	JP2          jp2Settings
+}
+
+func (svc *ServiceContext) runUpdateMasterFileIIIF(js *jobStatus, payload []byte) error {
+	var req masterFileIIIFRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid UpdateIIIF payload: %s", err.Error())
+	}
+	mfID := req.MasterFileID
+	archiveFile := req.ArchiveFile
+	var tgtMF masterFile
+	err = svc.GDB.Preload("Unit").Preload("ImageTechMeta").First(&tgtMF, mfID).Error
+	if err != nil {
+		return fmt.Errorf("unable to load master file %d: %s", mfID, err.Error())
+	}
+
+	err = svc.publishToIIIFWithProfile(js, &tgtMF, archiveFile, true, req.JP2)
+	if err != nil {
+		svc.logFatal(js, fmt.Sprintf("Update IIIF for master file %d from archive %s failed: %s", mfID, archiveFile, err.Error()))
+		return nil
+	}
+
+	svc.jobDone(js)
+	return nil
+}
+
 func (svc *ServiceContext) deaccessionMasterFile(c *gin.Context) {
 	mfID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
 	js, err := svc.createJobStatus("DeaccessionMasterFile", "MasterFile", mfID)
@@ -1,39 +1,39 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"sort"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 func (svc *ServiceContext) getOCRLanguages(c *gin.Context) {
 	log.Printf("INFO: request for OCR languages")
-	langs, err := ioutil.ReadFile("./assets/tesseract-langs.txt")
+	langList, err := getOCRLanguageList()
 	if err != nil {
 		log.Printf("ERROR: unable to read OCR languages: %s", err.Error())
 		c.String(http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	langList := strings.Split(string(langs), "\n")
 	sort.Strings(langList)
 	c.String(http.StatusOK, strings.Join(langList, ","))
 }
 
+type ocrJobRequest struct {
+	Type   string `json:"type"`
+	ID     int64  `json:"id"`
+	Engine string `json:"engine"` // remote (default) or local
+}
+
 func (svc *ServiceContext) handleOCRRequest(c *gin.Context) {
-	type ocrReq struct {
-		Type string `json:"type"`
-		ID   int64  `json:"id"`
-	}
-	var req ocrReq
+	var req ocrJobRequest
 	err := c.ShouldBindJSON(&req)
 	if err != nil {
 		log.Printf("ERROR: could not parse OCR request: %s", err.Error())
@@ -46,6 +46,24 @@ func (svc *ServiceContext) handleOCRRequest(c *gin.Context) {
 		c.String(http.StatusBadRequest, fmt.Sprintf("%s is not a supported ocr type", req.Type))
 		return
 	}
+	engine, err := svc.getOCREngine(req.Engine)
+	if err != nil {
+		log.Printf("ERROR: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if engine.name() == "local" {
+		// the local engine only has trained data for some of the supported languages
+		hint, err := svc.getOCRLanguageHint(req.Type, req.ID)
+		if err == nil {
+			_, err = tesseractLanguage(hint)
+		}
+		if err != nil {
+			log.Printf("ERROR: local ocr request for %s %d rejected: %s", req.Type, req.ID, err.Error())
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
 	log.Printf("INFO: request for OCR on %s:%d", req.Type, req.ID)
 	itemType := "Unit"
 	if req.Type != "unit" {
@@ -58,62 +76,68 @@ func (svc *ServiceContext) handleOCRRequest(c *gin.Context) {
 		return
 	}
 
-	go func() {
-		if req.Type == "unit" {
-			var tgtUnit unit
-			err = svc.GDB.Preload("Metadata").Preload("Metadata.OcrHint").First(&tgtUnit, req.ID).Error
-			if err != nil {
-				svc.logFatal(js, fmt.Sprintf("Unable to load unit %d: %s", req.ID, err.Error()))
-				return
-			}
-			err = svc.requestUnitOCR(js, tgtUnit.Metadata.PID, tgtUnit.ID, tgtUnit.Metadata.OcrLanguageHint)
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("Unable to request unit OCR: %s", err.Error()))
-			}
-		} else {
-			err = svc.requestMasterFileOCR(js, req.ID)
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("Unable to request masterfile OCR: %s", err.Error()))
-			}
-		}
-		svc.jobDone(js)
-	}()
+	err = svc.enqueueJob(js, "OCR", req)
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
 	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
 }
 
-func (svc *ServiceContext) requestUnitOCR(js *jobStatus, metadataPID string, unitID int64, lang string) error {
-	svc.logInfo(js, "Requesting OCR for unit")
-	callbackURL := fmt.Sprintf("%s/callbacks/%d/ocr", svc.ServiceURL, js.ID)
-	callbackURL = url.QueryEscape(callbackURL)
-	ocrURL := fmt.Sprintf("%s/%s?lang=%s&unit=%d&force=true&callback=%s", svc.OcrURL, metadataPID, lang, unitID, callbackURL)
-	svc.logInfo(js, fmt.Sprintf("OCR request URL: %s", ocrURL))
-	_, getErr := svc.getRequest(ocrURL)
-	if getErr != nil {
-		return fmt.Errorf("ocr request failed %d:%s", getErr.StatusCode, getErr.Message)
-	}
-	svc.logInfo(js, "OCR Request successfully submitted. Awaiting results.")
-	svc.OcrRequests = append(svc.OcrRequests, js.ID)
-	done := false
-	for done == false {
-		time.Sleep(30 * time.Second)
-		found := false
-		for _, jsID := range svc.OcrRequests {
-			if jsID == js.ID {
-				found = true
-				break
-			}
-		}
-		if found == false {
-			done = true
-		}
+func (svc *ServiceContext) runOCR(js *jobStatus, payload []byte) error {
+	var req ocrJobRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid OCR payload: %s", err.Error())
 	}
 
-	svc.logInfo(js, "OCR request finished")
+	engine, err := svc.getOCREngine(req.Engine)
+	if err != nil {
+		return err
+	}
+	svc.logInfo(js, fmt.Sprintf("Use %s OCR engine", engine.name()))
 
+	if req.Type == "unit" {
+		var tgtUnit unit
+		err = svc.GDB.Preload("Metadata").Preload("Metadata.OcrHint").First(&tgtUnit, req.ID).Error
+		if err != nil {
+			svc.logFatal(js, fmt.Sprintf("Unable to load unit %d: %s", req.ID, err.Error()))
+			return nil
+		}
+		err = engine.ocrUnit(js, &tgtUnit)
+		if errors.Is(err, errJobWaiting) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("unit OCR failed: %s", err.Error())
+		}
+		err = svc.generateUnitOCRQuality(js, tgtUnit.ID, tgtUnit.Metadata.OcrLanguageHint)
+	} else {
+		err = engine.ocrMasterFile(js, req.ID)
+		if errors.Is(err, errJobWaiting) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("masterfile OCR failed: %s", err.Error())
+		}
+		err = svc.generateMasterFileOCRQuality(js, req.ID)
+	}
+	if err != nil {
+		svc.logError(js, fmt.Sprintf("Unable to check OCR quality: %s", err.Error()))
+	}
+	svc.jobDone(js)
 	return nil
 }
 
+func (svc *ServiceContext) requestUnitOCR(js *jobStatus, metadataPID string, unitID int64, lang string) error {
+	svc.logInfo(js, "Requesting OCR for unit")
+	ocrURL := fmt.Sprintf("%s/%s?lang=%s&unit=%d&force=true", svc.OcrURL, metadataPID, lang, unitID)
+	svc.logInfo(js, fmt.Sprintf("OCR request URL: %s", ocrURL))
+	return svc.submitOCRRequest(js, "Unit", unitID, ocrURL)
+}
+
 func (svc *ServiceContext) requestMasterFileOCR(js *jobStatus, mfID int64) error {
 	svc.logInfo(js, "Requesting OCR for master file")
 
@@ -129,65 +153,44 @@ func (svc *ServiceContext) requestMasterFileOCR(js *jobStatus, mfID int64) error
 	}
 
 	lang := tgtMD.OcrLanguageHint
-	callbackURL := fmt.Sprintf("%s/callbacks/%d/ocr", svc.ServiceURL, js.ID)
-	callbackURL = url.QueryEscape(callbackURL)
-	ocrURL := fmt.Sprintf("%s/%s?lang=%s&force=true&callback=%s", svc.OcrURL, tgtMF.PID, lang, callbackURL)
+	ocrURL := fmt.Sprintf("%s/%s?lang=%s&force=true", svc.OcrURL, tgtMF.PID, lang)
 	svc.logInfo(js, fmt.Sprintf("Masterfile OCR request URL: %s", ocrURL))
-	_, getErr := svc.getRequest(ocrURL)
-	if getErr != nil {
-		return fmt.Errorf("ocr request failed %d:%s", getErr.StatusCode, getErr.Message)
-	}
-	svc.logInfo(js, "OCR Request successfully submitted. Awaiting results.")
-	svc.OcrRequests = append(svc.OcrRequests, js.ID)
-	done := false
-	for done == false {
-		time.Sleep(30 * time.Second)
-		found := false
-		for _, jsID := range svc.OcrRequests {
-			if jsID == js.ID {
-				found = true
-				break
-			}
-		}
-		if found == false {
-			done = true
-		}
-	}
-
-	svc.logInfo(js, "OCR request finished")
-
-	return nil
+	return svc.submitOCRRequest(js, "MasterFile", mfID, ocrURL)
 }
 
+// ocrDoneCallback receives the result of an OCR request. The callback URL given to the OCR service
+// includes the request ID and a signed token; callbacks without a valid token for a pending request are rejected.
 func (svc *ServiceContext) ocrDoneCallback(c *gin.Context) {
 	jobID, _ := strconv.ParseInt(c.Param("jid"), 10, 64)
-	log.Printf("INFO: received ocr done callback for job %d", jobID)
-
-	// whatever happens, clear out the pending request when done using a defer func
-	defer func() {
-		log.Printf("INFO: remove pending ocr job %d", jobID)
-		jsIdx := -1
-		for idx, jsID := range svc.OcrRequests {
-			if jsID == jobID {
-				jsIdx = idx
-				break
-			}
-		}
-		if jsIdx > -1 {
-			svc.OcrRequests = append(svc.OcrRequests[:jsIdx], svc.OcrRequests[jsIdx+1:]...)
-		} else {
-			log.Printf("ERROR: could not find pending OCR job %d", jobID)
-		}
-	}()
+	reqID, _ := strconv.ParseInt(c.Query("req"), 10, 64)
+	log.Printf("INFO: received ocr done callback for job %d request %d", jobID, reqID)
+
+	if svc.validOCRCallbackToken(jobID, reqID, c.Query("token")) == false {
+		log.Printf("WARNING: rejecting ocr callback for job %d request %d with an invalid token", jobID, reqID)
+		c.String(http.StatusForbidden, "invalid callback token")
+		return
+	}
+
+	var req ocrRequest
+	err := svc.GDB.Where("id=? and job_status_id=?", reqID, jobID).Limit(1).Find(&req).Error
+	if err != nil {
+		log.Printf("ERROR: unable to get ocr request %d for job %d: %s", reqID, jobID, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if req.ID == 0 || req.Status != "pending" {
+		log.Printf("WARNING: rejecting ocr callback for job %d; request %d is not pending", jobID, reqID)
+		c.String(http.StatusBadRequest, "no pending ocr request")
+		return
+	}
 
 	var pendingJob jobStatus
-	err := svc.GDB.First(&pendingJob, jobID).Error
+	err = svc.GDB.First(&pendingJob, jobID).Error
 	if err != nil {
 		log.Printf("ERROR: unable to get job status %d: %s", jobID, err.Error())
 		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
-	svc.logInfo(&pendingJob, "Received OCR callback")
 
 	type ocrRespData struct {
 		Status  string `json:"status"`
@@ -200,12 +203,22 @@ func (svc *ServiceContext) ocrDoneCallback(c *gin.Context) {
 		c.String(http.StatusBadRequest, qpErr.Error())
 		return
 	}
+	svc.logInfo(&pendingJob, "Received OCR callback")
 
+	status := "success"
 	if cbResp.Status == "success" {
 		svc.logInfo(&pendingJob, "OCR request completed successfully")
 	} else {
+		status = "failed"
 		svc.logInfo(&pendingJob, fmt.Sprintf("OCR request failed: %s", cbResp.Message))
 	}
 
+	if svc.completeOCRRequest(&req, status, cbResp.Message) == false {
+		log.Printf("WARNING: ocr request %d for job %d was completed before the callback was processed", reqID, jobID)
+		svc.logInfo(&pendingJob, "OCR callback received after the request was no longer pending; result ignored")
+	} else {
+		svc.resumeWaitingJob(jobID)
+	}
+
 	c.String(http.StatusOK, "ok")
 }
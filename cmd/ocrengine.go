@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// ocrEngine generates OCR text for the master files of a unit or for a single master file
+type ocrEngine interface {
+	name() string
+	ocrUnit(js *jobStatus, tgtUnit *unit) error
+	ocrMasterFile(js *jobStatus, mfID int64) error
+}
+
+// remoteOCREngine sends OCR requests to the external OCR service and waits for its callback.
+// The OCR service saves the results to the master files.
+type remoteOCREngine struct {
+	svc *ServiceContext
+}
+
+// localOCREngine runs tesseract against the archived master files and saves the results itself,
+// including the word coordinates as ALTO XML
+type localOCREngine struct {
+	svc *ServiceContext
+}
+
+// getOCREngine returns the named OCR engine. The remote OCR service is the default.
+func (svc *ServiceContext) getOCREngine(engineName string) (ocrEngine, error) {
+	switch engineName {
+	case "", "remote":
+		return &remoteOCREngine{svc: svc}, nil
+	case "local":
+		return &localOCREngine{svc: svc}, nil
+	}
+	return nil, fmt.Errorf("%s is not a supported ocr engine", engineName)
+}
+
+// getUnitOCREngine returns the configured OCR engine for finalization and HathiTrust packaging. Only the
+// local engine saves word coordinates; languages it has no trained data for fall back to the remote engine.
+func (svc *ServiceContext) getUnitOCREngine(js *jobStatus, langHint string) ocrEngine {
+	if svc.OcrEngine == "local" {
+		_, err := tesseractLanguage(langHint)
+		if err == nil {
+			return &localOCREngine{svc: svc}
+		}
+		svc.logInfo(js, fmt.Sprintf("Local OCR is not available, coordinate OCR will not be generated: %s", err.Error()))
+	}
+	return &remoteOCREngine{svc: svc}
+}
+
+func (e *remoteOCREngine) name() string {
+	return "remote"
+}
+
+func (e *remoteOCREngine) ocrUnit(js *jobStatus, tgtUnit *unit) error {
+	return e.svc.requestUnitOCR(js, tgtUnit.Metadata.PID, tgtUnit.ID, tgtUnit.Metadata.OcrLanguageHint)
+}
+
+func (e *remoteOCREngine) ocrMasterFile(js *jobStatus, mfID int64) error {
+	return e.svc.requestMasterFileOCR(js, mfID)
+}
+
+func (e *localOCREngine) name() string {
+	return "local"
+}
+
+func (e *localOCREngine) ocrUnit(js *jobStatus, tgtUnit *unit) error {
+	svc := e.svc
+	lang, err := tesseractLanguage(tgtUnit.Metadata.OcrLanguageHint)
+	if err != nil {
+		return err
+	}
+
+	var masterFiles []masterFile
+	err = svc.GDB.Where("unit_id=? and deaccessioned_at is null", tgtUnit.ID).Order("filename asc").Find(&masterFiles).Error
+	if err != nil {
+		return fmt.Errorf("unable to get unit master files: %s", err.Error())
+	}
+	if len(masterFiles) == 0 {
+		return fmt.Errorf("unit %d has no master files", tgtUnit.ID)
+	}
+
+	svc.logInfo(js, fmt.Sprintf("Run local OCR with language %s on %d master files", lang, len(masterFiles)))
+	failed := 0
+	for idx := range masterFiles {
+		if js.canceled() {
+			return js.context().Err()
+		}
+		mf := &masterFiles[idx]
+		err = e.ocr(js, mf, lang)
+		if err != nil {
+			if js.canceled() {
+				return js.context().Err()
+			}
+			svc.logError(js, fmt.Sprintf("OCR failed for %s: %s", mf.Filename, err.Error()))
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d master files failed OCR", failed, len(masterFiles))
+	}
+	svc.logInfo(js, "Local OCR complete")
+	return nil
+}
+
+func (e *localOCREngine) ocrMasterFile(js *jobStatus, mfID int64) error {
+	svc := e.svc
+	var tgtMF masterFile
+	err := svc.GDB.First(&tgtMF, mfID).Error
+	if err != nil {
+		return err
+	}
+	if tgtMF.MetadataID == nil {
+		return fmt.Errorf("master file %d has no metadata", mfID)
+	}
+	var tgtMD metadata
+	err = svc.GDB.First(&tgtMD, *tgtMF.MetadataID).Error
+	if err != nil {
+		return err
+	}
+	lang, err := tesseractLanguage(tgtMD.OcrLanguageHint)
+	if err != nil {
+		return err
+	}
+	svc.logInfo(js, fmt.Sprintf("Run local OCR with language %s on %s", lang, tgtMF.Filename))
+	return e.ocr(js, &tgtMF, lang)
+}
+
+// ocr runs tesseract on the archived tif for a master file. The plain text is saved as the master file
+// transcription and the ALTO XML with word coordinates is saved in the archive next to the tif.
+func (e *localOCREngine) ocr(js *jobStatus, mf *masterFile, lang string) error {
+	archiveFile := e.svc.getArchiveFileName(mf)
+	if pathExists(archiveFile) == false {
+		return fmt.Errorf("%s not found", archiveFile)
+	}
+
+	workDir, err := os.MkdirTemp("", "ocr")
+	if err != nil {
+		return fmt.Errorf("unable to create ocr working directory: %s", err.Error())
+	}
+	defer os.RemoveAll(workDir)
+
+	// tesseract adds the .txt and .xml extensions to the output base name
+	outBase := path.Join(workDir, strings.TrimSuffix(mf.Filename, filepath.Ext(mf.Filename)))
+	cmd := exec.CommandContext(js.context(), "tesseract", archiveFile, outBase, "-l", lang, "txt", "alto")
+	_, err = cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("tesseract failed: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return fmt.Errorf("unable to run tesseract: %s", err.Error())
+	}
+
+	txt, err := os.ReadFile(outBase + ".txt")
+	if err != nil {
+		return fmt.Errorf("unable to read ocr text: %s", err.Error())
+	}
+	altoFile := e.svc.getArchiveALTOFileName(mf)
+	_, err = copyFile(outBase+".xml", altoFile, 0664)
+	if err != nil {
+		return fmt.Errorf("unable to archive ocr coordinates to %s: %s", altoFile, err.Error())
+	}
+
+	mf.TranscriptionText = strings.TrimRightFunc(string(txt), unicode.IsSpace)
+	err = e.svc.GDB.Model(mf).Select("TranscriptionText").Updates(*mf).Error
+	if err != nil {
+		return fmt.Errorf("unable to save transcription for %s: %s", mf.Filename, err.Error())
+	}
+	return nil
+}
+
+// getArchiveALTOFileName returns the archive path of the ALTO XML OCR coordinates for a master file
+func (svc *ServiceContext) getArchiveALTOFileName(mf *masterFile) string {
+	archiveFile := svc.getArchiveFileName(mf)
+	return strings.TrimSuffix(archiveFile, filepath.Ext(archiveFile)) + ".xml"
+}
+
+// getOCRLanguageList returns the tesseract languages and scripts available for OCR
+func getOCRLanguageList() ([]string, error) {
+	langs, err := os.ReadFile("./assets/tesseract-langs.txt")
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0)
+	for _, lang := range strings.Split(string(langs), "\n") {
+		lang = strings.TrimSpace(lang)
+		if lang != "" {
+			out = append(out, lang)
+		}
+	}
+	return out, nil
+}
+
+// getInstalledTesseractLanguages returns the languages and scripts that have tesseract trained data installed
+func getInstalledTesseractLanguages() ([]string, error) {
+	out, err := exec.Command("tesseract", "--list-langs").Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tesseract languages: %s", err.Error())
+	}
+	langs := make([]string, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "List of available languages") {
+			continue
+		}
+		langs = append(langs, line)
+	}
+	return langs, nil
+}
+
+// tesseractLanguage converts a metadata OCR language hint (one or more languages joined by +) to
+// a tesseract -l value. Script models like Latin or Cyrillic live in the tesseract script directory.
+// Languages that are supported but have no trained data installed for the local engine are rejected.
+func tesseractLanguage(hint string) (string, error) {
+	if hint == "" {
+		return "", errors.New("no OCR language hint is set")
+	}
+	available, err := getOCRLanguageList()
+	if err != nil {
+		return "", fmt.Errorf("unable to read OCR languages: %s", err.Error())
+	}
+	installed, err := getInstalledTesseractLanguages()
+	if err != nil {
+		return "", err
+	}
+	langs := make([]string, 0)
+	for _, lang := range strings.Split(hint, "+") {
+		if slices.Contains(available, lang) == false {
+			return "", fmt.Errorf("%s is not a supported OCR language", lang)
+		}
+		if unicode.IsUpper([]rune(lang)[0]) {
+			lang = "script/" + lang
+		}
+		if slices.Contains(installed, lang) == false {
+			return "", fmt.Errorf("%s is not installed for the local OCR engine; use the remote engine", lang)
+		}
+		langs = append(langs, lang)
+	}
+	return strings.Join(langs, "+"), nil
+}
+
+// getOCRLanguageHint returns the OCR language hint of the metadata for a unit or master file
+func (svc *ServiceContext) getOCRLanguageHint(itemType string, itemID int64) (string, error) {
+	if itemType == "unit" {
+		var tgtUnit unit
+		err := svc.GDB.Preload("Metadata").First(&tgtUnit, itemID).Error
+		if err != nil {
+			return "", fmt.Errorf("unable to load unit %d: %s", itemID, err.Error())
+		}
+		if tgtUnit.Metadata == nil {
+			return "", fmt.Errorf("unit %d has no metadata", itemID)
+		}
+		return tgtUnit.Metadata.OcrLanguageHint, nil
+	}
+	var tgtMF masterFile
+	err := svc.GDB.First(&tgtMF, itemID).Error
+	if err != nil {
+		return "", fmt.Errorf("unable to load master file %d: %s", itemID, err.Error())
+	}
+	if tgtMF.MetadataID == nil {
+		return "", fmt.Errorf("master file %d has no metadata", itemID)
+	}
+	var tgtMD metadata
+	err = svc.GDB.First(&tgtMD, *tgtMF.MetadataID).Error
+	if err != nil {
+		return "", fmt.Errorf("unable to load metadata %d: %s", *tgtMF.MetadataID, err.Error())
+	}
+	return tgtMD.OcrLanguageHint, nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// pages with a mean word confidence or dictionary hit rate below these are flagged for review
+const ocrMinConfidence = 0.6
+const ocrMinDictionaryHitRate = 0.5
+
+// ocrQuality is the OCR quality measured for a master file. Confidence is only available for master
+// files with ALTO coordinate OCR from the local engine; the remote OCR service returns plain text
+// without word confidence. The dictionary hit rate is only available for languages with a dictionary.
+type ocrQuality struct {
+	ID                int64      `json:"-"`
+	MasterFileID      int64      `gorm:"uniqueIndex" json:"masterFileID"`
+	Filename          string     `gorm:"-" json:"filename"`
+	Language          string     `json:"language"`
+	WordCount         int        `json:"wordCount"`
+	MeanConfidence    *float64   `json:"meanConfidence"`
+	DictionaryHitRate *float64   `json:"dictionaryHitRate"`
+	EmptyPage         bool       `json:"emptyPage"`
+	NeedsReview       bool       `json:"needsReview"`
+	CheckedAt         *time.Time `json:"checkedAt"`
+}
+
+type ocrQualityReport struct {
+	UnitID         int64        `json:"unitID"`
+	Language       string       `json:"language"`
+	Pages          int          `json:"pages"`
+	Checked        int          `json:"checked"`
+	NeedsReview    int          `json:"needsReview"`
+	EmptyPages     int          `json:"emptyPages"`
+	MeanConfidence *float64     `json:"meanConfidence"`
+	NoConfidence   int          `json:"noConfidence"`
+	Note           string       `json:"note,omitempty"`
+	Results        []ocrQuality `json:"results"`
+}
+
+// ocrWord is a recognized word and the engine confidence (0-1) in it, or -1 if unknown
+type ocrWord struct {
+	text       string
+	confidence float64
+}
+
+// generateUnitOCRQuality measures and saves the OCR quality of all master files in a unit
+func (svc *ServiceContext) generateUnitOCRQuality(js *jobStatus, unitID int64, lang string) error {
+	var masterFiles []masterFile
+	err := svc.GDB.Where("unit_id=? and deaccessioned_at is null", unitID).Order("filename asc").Find(&masterFiles).Error
+	if err != nil {
+		return fmt.Errorf("unable to get unit master files: %s", err.Error())
+	}
+	svc.logInfo(js, fmt.Sprintf("Check OCR quality of %d master files", len(masterFiles)))
+	dict := loadOCRDictionary(lang)
+	review := 0
+	for idx := range masterFiles {
+		q, err := svc.saveOCRQuality(&masterFiles[idx], lang, dict)
+		if err != nil {
+			return err
+		}
+		if q.NeedsReview {
+			review++
+		}
+	}
+	if review > 0 {
+		svc.logInfo(js, fmt.Sprintf("%d master files have OCR results that need review", review))
+	}
+	return nil
+}
+
+// generateMasterFileOCRQuality measures and saves the OCR quality of a single master file
+func (svc *ServiceContext) generateMasterFileOCRQuality(js *jobStatus, mfID int64) error {
+	var mf masterFile
+	err := svc.GDB.First(&mf, mfID).Error
+	if err != nil {
+		return err
+	}
+	lang := ""
+	if mf.MetadataID != nil {
+		var md metadata
+		err = svc.GDB.First(&md, *mf.MetadataID).Error
+		if err != nil {
+			return err
+		}
+		lang = md.OcrLanguageHint
+	}
+	q, err := svc.saveOCRQuality(&mf, lang, loadOCRDictionary(lang))
+	if err != nil {
+		return err
+	}
+	if q.NeedsReview {
+		svc.logInfo(js, fmt.Sprintf("OCR results for %s need review", mf.Filename))
+	}
+	return nil
+}
+
+func (svc *ServiceContext) saveOCRQuality(mf *masterFile, lang string, dict map[string]bool) (*ocrQuality, error) {
+	words, err := svc.getOCRWords(mf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get ocr words for %s: %s", mf.Filename, err.Error())
+	}
+	q := measureOCRQuality(words, dict)
+	q.MasterFileID = mf.ID
+	q.Language = lang
+
+	var existing ocrQuality
+	err = svc.GDB.Where("master_file_id=?", mf.ID).Limit(1).Find(&existing).Error
+	if err != nil {
+		return nil, fmt.Errorf("unable to get ocr quality for %s: %s", mf.Filename, err.Error())
+	}
+	q.ID = existing.ID
+	err = svc.GDB.Save(q).Error
+	if err != nil {
+		return nil, fmt.Errorf("unable to save ocr quality for %s: %s", mf.Filename, err.Error())
+	}
+	return q, nil
+}
+
+// getOCRWords returns the words from the master file ALTO coordinate OCR if it exists, or from the
+// plain transcription text with unknown confidence if it does not. Master files OCRed by the remote
+// engine only have the plain text, so their mean confidence is never set.
+func (svc *ServiceContext) getOCRWords(mf *masterFile) ([]ocrWord, error) {
+	altoFile := svc.getArchiveALTOFileName(mf)
+	if pathExists(altoFile) == false {
+		words := make([]ocrWord, 0)
+		for _, w := range strings.Fields(mf.TranscriptionText) {
+			words = append(words, ocrWord{text: w, confidence: -1})
+		}
+		return words, nil
+	}
+
+	f, err := os.Open(altoFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	words := make([]ocrWord, 0)
+	decoder := xml.NewDecoder(f)
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("invalid alto xml %s: %s", altoFile, err.Error())
+		}
+		elem, ok := tok.(xml.StartElement)
+		if ok == false || elem.Name.Local != "String" {
+			continue
+		}
+		w := ocrWord{confidence: -1}
+		for _, attr := range elem.Attr {
+			if attr.Name.Local == "CONTENT" {
+				w.text = attr.Value
+			} else if attr.Name.Local == "WC" {
+				if wc, err := strconv.ParseFloat(attr.Value, 64); err == nil {
+					w.confidence = wc
+				}
+			}
+		}
+		if strings.TrimSpace(w.text) != "" {
+			words = append(words, w)
+		}
+	}
+	return words, nil
+}
+
+// measureOCRQuality computes the quality metrics for the words of one page
+func measureOCRQuality(words []ocrWord, dict map[string]bool) *ocrQuality {
+	now := time.Now()
+	q := ocrQuality{WordCount: len(words), EmptyPage: len(words) == 0, CheckedAt: &now}
+
+	confTotal := 0.0
+	confCnt := 0
+	dictCnt := 0
+	hits := 0
+	for _, w := range words {
+		if w.confidence >= 0 {
+			confTotal += w.confidence
+			confCnt++
+		}
+		if dict != nil {
+			norm := normalizeOCRWord(w.text)
+			if len([]rune(norm)) > 1 {
+				dictCnt++
+				if dict[norm] {
+					hits++
+				}
+			}
+		}
+	}
+	if confCnt > 0 {
+		mean := confTotal / float64(confCnt)
+		q.MeanConfidence = &mean
+	}
+	if dictCnt > 0 {
+		rate := float64(hits) / float64(dictCnt)
+		q.DictionaryHitRate = &rate
+	}
+
+	q.NeedsReview = q.EmptyPage ||
+		(q.MeanConfidence != nil && *q.MeanConfidence < ocrMinConfidence) ||
+		(q.DictionaryHitRate != nil && *q.DictionaryHitRate < ocrMinDictionaryHitRate)
+	return &q
+}
+
+// normalizeOCRWord lowercases a word and strips surrounding punctuation. Words containing
+// anything other than letters, apostrophes or hyphens are not dictionary words and return blank.
+func normalizeOCRWord(word string) string {
+	word = strings.ToLower(strings.TrimFunc(word, func(r rune) bool {
+		return unicode.IsLetter(r) == false
+	}))
+	for _, r := range word {
+		if unicode.IsLetter(r) == false && r != '\'' && r != '-' {
+			return ""
+		}
+	}
+	return word
+}
+
+// loadOCRDictionary loads the word lists for the languages in an OCR language hint. Word lists are
+// expanded word lists (hunspell unmunch output) named by tesseract language code in assets/dictionaries.
+// Returns nil if there are no word lists for any of the languages.
+func loadOCRDictionary(lang string) map[string]bool {
+	var dict map[string]bool
+	for _, l := range strings.Split(lang, "+") {
+		if l == "" {
+			continue
+		}
+		raw, err := os.ReadFile(path.Join("./assets/dictionaries", fmt.Sprintf("%s.dic", l)))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) == false {
+				log.Printf("ERROR: unable to read %s dictionary: %s", l, err.Error())
+			}
+			continue
+		}
+		if dict == nil {
+			dict = make(map[string]bool)
+		}
+		for idx, line := range strings.Split(string(raw), "\n") {
+			// hunspell style files start with the word count and may have flags after a slash
+			word, _, _ := strings.Cut(strings.TrimSpace(line), "/")
+			word = strings.TrimSpace(word)
+			if idx == 0 {
+				if _, err := strconv.Atoi(word); err == nil {
+					continue
+				}
+			}
+			if word != "" {
+				dict[strings.ToLower(word)] = true
+			}
+		}
+	}
+	return dict
+}
+
+// getUnitOCRReport returns the OCR quality measured for each master file in a unit
+func (svc *ServiceContext) getUnitOCRReport(c *gin.Context) {
+	unitID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+	var tgtUnit unit
+	err := svc.GDB.Preload("Metadata").First(&tgtUnit, unitID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.String(http.StatusNotFound, "not found")
+		} else {
+			c.String(http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	var masterFiles []masterFile
+	err = svc.GDB.Where("unit_id=? and deaccessioned_at is null", unitID).Order("filename asc").Find(&masterFiles).Error
+	if err != nil {
+		log.Printf("ERROR: unable to get master files for unit %d ocr report: %s", unitID, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	mfIDs := make([]int64, 0, len(masterFiles))
+	for _, mf := range masterFiles {
+		mfIDs = append(mfIDs, mf.ID)
+	}
+	var results []ocrQuality
+	err = svc.GDB.Where("master_file_id in ?", mfIDs).Find(&results).Error
+	if err != nil {
+		log.Printf("ERROR: unable to get ocr quality for unit %d: %s", unitID, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	byMF := make(map[int64]ocrQuality)
+	for _, q := range results {
+		byMF[q.MasterFileID] = q
+	}
+
+	out := ocrQualityReport{UnitID: unitID, Pages: len(masterFiles), Results: make([]ocrQuality, 0, len(masterFiles))}
+	if tgtUnit.Metadata != nil {
+		out.Language = tgtUnit.Metadata.OcrLanguageHint
+	}
+	confTotal := 0.0
+	confCnt := 0
+	for _, mf := range masterFiles {
+		q, found := byMF[mf.ID]
+		if found == false {
+			// not checked yet
+			q = ocrQuality{MasterFileID: mf.ID}
+		} else {
+			out.Checked++
+			if q.NeedsReview {
+				out.NeedsReview++
+			}
+			if q.EmptyPage {
+				out.EmptyPages++
+			}
+			if q.MeanConfidence != nil {
+				confTotal += *q.MeanConfidence
+				confCnt++
+			} else if q.EmptyPage == false {
+				out.NoConfidence++
+			}
+		}
+		q.Filename = mf.Filename
+		out.Results = append(out.Results, q)
+	}
+	if confCnt > 0 {
+		mean := confTotal / float64(confCnt)
+		out.MeanConfidence = &mean
+	}
+	if out.NoConfidence > 0 {
+		out.Note = fmt.Sprintf("%d pages have no word confidence; they have no coordinate OCR from the local engine "+
+			"and the remote OCR service does not return confidence. Review them by dictionary hit rate.", out.NoConfidence)
+	}
+	c.JSON(http.StatusOK, out)
+}
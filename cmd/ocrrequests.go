@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+// ocrRequest tracks an OCR request submitted to the OCR service on behalf of a job. It stays
+// pending until the service calls back with the result or the request deadline passes.
+type ocrRequest struct {
+	ID          int64
+	JobStatusID int64 `gorm:"index"`
+	ItemType    string
+	ItemID      int64
+	Status      string `gorm:"index"` // pending, success, failed, timeout, canceled or abandoned
+	Message     string `gorm:"type:text"`
+	SubmittedAt time.Time
+	DeadlineAt  time.Time
+	CompletedAt *time.Time
+}
+
+// ocrRequestRegistry holds the settings for OCR requests made on behalf of jobs
+type ocrRequestRegistry struct {
+	timeout time.Duration
+}
+
+// submitOCRRequest adds a signed callback URL to an OCR service request and sends it. Jobs do not wait
+// for the result; errJobWaiting is returned so the worker is released, and the job is re-queued when the
+// callback arrives or the request deadline passes. Requests are saved to the DB so the re-queued job picks
+// up the result of the request it already submitted instead of starting a new one.
+func (svc *ServiceContext) submitOCRRequest(js *jobStatus, itemType string, itemID int64, ocrURL string) error {
+	var prior ocrRequest
+	err := svc.GDB.Where("job_status_id=? and item_type=? and item_id=?", js.ID, itemType, itemID).Order("id desc").Limit(1).Find(&prior).Error
+	if err != nil {
+		return fmt.Errorf("unable to check for prior ocr requests: %s", err.Error())
+	}
+	if prior.ID > 0 {
+		if prior.Status == "pending" && time.Now().After(prior.DeadlineAt) {
+			svc.completeOCRRequest(&prior, "timeout", "no callback received")
+		}
+		switch prior.Status {
+		case "success":
+			svc.logInfo(js, fmt.Sprintf("OCR request submitted at %s has finished", prior.SubmittedAt.Format(time.RFC3339)))
+			return nil
+		case "pending":
+			svc.logInfo(js, fmt.Sprintf("OCR request submitted at %s is still pending", prior.SubmittedAt.Format(time.RFC3339)))
+			return errJobWaiting
+		case "timeout":
+			return fmt.Errorf("no ocr callback received by %s", prior.DeadlineAt.Format(time.RFC3339))
+		}
+		return fmt.Errorf("ocr %s: %s", prior.Status, prior.Message)
+	}
+
+	now := time.Now()
+	req := ocrRequest{JobStatusID: js.ID, ItemType: itemType, ItemID: itemID, Status: "pending",
+		SubmittedAt: now, DeadlineAt: now.Add(svc.OcrRequests.timeout)}
+	err = svc.GDB.Create(&req).Error
+	if err != nil {
+		return fmt.Errorf("unable to save ocr request: %s", err.Error())
+	}
+
+	callbackURL := fmt.Sprintf("%s/callbacks/%d/ocr?req=%d&token=%s", svc.ServiceURL, js.ID, req.ID, svc.ocrCallbackToken(js.ID, req.ID))
+	_, getErr := svc.getRequest(fmt.Sprintf("%s&callback=%s", ocrURL, url.QueryEscape(callbackURL)))
+	if getErr != nil {
+		svc.completeOCRRequest(&req, "failed", getErr.Message)
+		return fmt.Errorf("ocr request failed %d:%s", getErr.StatusCode, getErr.Message)
+	}
+	svc.logInfo(js, fmt.Sprintf("OCR Request successfully submitted. Awaiting results until %s.", req.DeadlineAt.Format(time.RFC3339)))
+	return errJobWaiting
+}
+
+// hasPendingOCRRequest returns true if the job has an OCR request that has not been completed
+func (svc *ServiceContext) hasPendingOCRRequest(jobID int64) bool {
+	var cnt int64
+	err := svc.GDB.Model(&ocrRequest{}).Where("job_status_id=? and status=?", jobID, "pending").Count(&cnt).Error
+	if err != nil {
+		log.Printf("ERROR: unable to check for pending ocr requests for job %d: %s", jobID, err.Error())
+		return true
+	}
+	return cnt > 0
+}
+
+// cancelOCRRequests cancels the pending OCR requests of a job; late callbacks for them are ignored
+func (svc *ServiceContext) cancelOCRRequests(jobID int64) {
+	now := time.Now()
+	err := svc.GDB.Model(&ocrRequest{}).Where("job_status_id=? and status=?", jobID, "pending").
+		Select("status", "message", "completed_at").
+		Updates(ocrRequest{Status: "canceled", Message: "job canceled", CompletedAt: &now}).Error
+	if err != nil {
+		log.Printf("ERROR: unable to cancel ocr requests for job %d: %s", jobID, err.Error())
+	}
+}
+
+// expireOCRRequests runs for the life of the service. Once a minute it times out pending OCR requests
+// that are past their deadline and re-queues the jobs waiting on them.
+func (svc *ServiceContext) expireOCRRequests() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		var expired []ocrRequest
+		err := svc.GDB.Where("status=? and deadline_at <= ?", "pending", time.Now()).Find(&expired).Error
+		if err != nil {
+			log.Printf("ERROR: unable to find expired ocr requests: %s", err.Error())
+			continue
+		}
+		for idx := range expired {
+			req := &expired[idx]
+			if svc.completeOCRRequest(req, "timeout", "no callback received") {
+				log.Printf("INFO: ocr request %d for job %d timed out", req.ID, req.JobStatusID)
+				svc.resumeWaitingJob(req.JobStatusID)
+			}
+		}
+	}
+}
+
+// completeOCRRequest sets the final status of a pending request. Returns false if the request was no longer pending.
+func (svc *ServiceContext) completeOCRRequest(req *ocrRequest, status string, message string) bool {
+	now := time.Now()
+	resp := svc.GDB.Model(req).Where("status=?", "pending").Select("status", "message", "completed_at").
+		Updates(ocrRequest{Status: status, Message: message, CompletedAt: &now})
+	if resp.Error != nil {
+		log.Printf("ERROR: unable to update ocr request %d status to %s: %s", req.ID, status, resp.Error.Error())
+		return false
+	}
+	if resp.RowsAffected == 0 {
+		return false
+	}
+	req.Status = status
+	req.Message = message
+	req.CompletedAt = &now
+	return true
+}
+
+// abandonOCRRequests is called at startup to close out pending requests for jobs that have ended
+// and will never collect the result
+func (svc *ServiceContext) abandonOCRRequests() {
+	ended := svc.GDB.Table("job_statuses").Select("id").Where("ended_at is not null")
+	now := time.Now()
+	resp := svc.GDB.Model(&ocrRequest{}).Where("status=? and job_status_id in (?)", "pending", ended).
+		Select("status", "message", "completed_at").
+		Updates(ocrRequest{Status: "abandoned", Message: "job ended before the ocr callback was received", CompletedAt: &now})
+	if resp.Error != nil {
+		log.Printf("ERROR: unable to clean up pending ocr requests: %s", resp.Error.Error())
+		return
+	}
+	log.Printf("INFO: %d ocr requests for ended jobs abandoned", resp.RowsAffected)
+}
+
+// ocrCallbackToken signs the job and request IDs in an OCR callback URL so callbacks can only
+// come from the service the request was sent to
+func (svc *ServiceContext) ocrCallbackToken(jobID int64, reqID int64) string {
+	mac := hmac.New(sha256.New, []byte(svc.TrackSys.JWTKey))
+	mac.Write([]byte(fmt.Sprintf("ocr:%d:%d", jobID, reqID)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (svc *ServiceContext) validOCRCallbackToken(jobID int64, reqID int64, token string) bool {
+	if token == "" {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(svc.ocrCallbackToken(jobID, reqID)))
+}
@@ -217,7 +217,7 @@ func (svc *ServiceContext) createPatronDeliverable(js *jobStatus, tgtUnit *unit,
 	cmdArray = append(cmdArray, "-limit", "memory", "2048MiB", "-limit", "map", "4096MiB")
 
 	cmdArray = append(cmdArray, destPath)
-	cmd := exec.Command("magick", cmdArray...)
+	cmd := exec.CommandContext(js.context(), "magick", cmdArray...)
 	svc.logInfo(js, fmt.Sprintf("%+v", cmd))
 	cmdOut, err := cmd.CombinedOutput()
 	if err != nil {
@@ -4,6 +4,7 @@ import (
 	"archive/zip"
 	"bufio"
 	"crypto/md5"
+	"encoding/json"
 	"fmt"
 	"io/fs"
 	"log"
@@ -11,7 +12,6 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"runtime/debug"
 	"strconv"
 	"strings"
 	"time"
@@ -50,40 +50,55 @@ func (svc *ServiceContext) getUnitPDFBundle(c *gin.Context) {
 		return
 	}
 
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("ERROR: Panic recovered during pdf bundle generation for unit %d: %v", unitID, r)
-				debug.PrintStack()
-				svc.logFatal(js, fmt.Sprintf("%v", r))
-			}
-		}()
-
-		svc.logInfo(js, fmt.Sprintf("Generate pdf files for metadata records [%v]", metadataPIDs))
-		for _, mdPID := range metadataPIDs {
-			svc.logInfo(js, fmt.Sprintf("Request pdf for metadata %s", mdPID))
-			if err := svc.requestMetadataPDF(js, unitID, mdPID, assembleDir); err != nil {
-				svc.logFatal(js, fmt.Sprintf("Unable to get metadata %s pdf: %s", mdPID, err.Error()))
-				return
-			}
-		}
+	err = svc.enqueueJob(js, "CreatePDFBundle", pdfBundleRequest{UnitID: unitID, AssembleDir: assembleDir, MetadataPIDs: metadataPIDs})
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		if err := svc.createPDFBundle(js, unitID, assembleDir); err != nil {
-			svc.logFatal(js, fmt.Sprintf("Unable to create zip bundle for unit %d: %s", unitID, err.Error()))
-			return
-		}
+	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+}
 
-		svc.logInfo(js, "Bundle created, cleaning up assembly directory")
-		if err := os.RemoveAll(assembleDir); err != nil {
-			svc.logInfo(js, fmt.Sprintf("Unable to remove assembly directory %s: %s", assembleDir, err.Error()))
+type pdfBundleRequest struct {
+	UnitID       int64
+	AssembleDir  string
+	MetadataPIDs []string
+}
+
+func (svc *ServiceContext) runCreatePDFBundle(js *jobStatus, payload []byte) error {
+	var req pdfBundleRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid CreatePDFBundle payload: %s", err.Error())
+	}
+	unitID := req.UnitID
+	assembleDir := req.AssembleDir
+	metadataPIDs := req.MetadataPIDs
+
+	svc.logInfo(js, fmt.Sprintf("Generate pdf files for metadata records [%v]", metadataPIDs))
+	for _, mdPID := range metadataPIDs {
+		svc.logInfo(js, fmt.Sprintf("Request pdf for metadata %s", mdPID))
+		if err := svc.requestMetadataPDF(js, unitID, mdPID, assembleDir); err != nil {
+			svc.logFatal(js, fmt.Sprintf("Unable to get metadata %s pdf: %s", mdPID, err.Error()))
+			return nil
 		}
+	}
+
+	if err := svc.createPDFBundle(js, unitID, assembleDir); err != nil {
+		svc.logFatal(js, fmt.Sprintf("Unable to create zip bundle for unit %d: %s", unitID, err.Error()))
+		return nil
+	}
 
-		dlLink := fmt.Sprintf("https://digiservdelivery.lib.virginia.edu/pdf_%d.zip", unitID)
-		svc.logInfo(js, fmt.Sprintf("Bundle can be downloaded from <a href=\"%s\">%s</a>", dlLink, dlLink))
-		svc.jobDone(js)
-	}()
+	svc.logInfo(js, "Bundle created, cleaning up assembly directory")
+	if err := os.RemoveAll(assembleDir); err != nil {
+		svc.logInfo(js, fmt.Sprintf("Unable to remove assembly directory %s: %s", assembleDir, err.Error()))
+	}
 
-	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+	dlLink := fmt.Sprintf("https://digiservdelivery.lib.virginia.edu/pdf_%d.zip", unitID)
+	svc.logInfo(js, fmt.Sprintf("Bundle can be downloaded from <a href=\"%s\">%s</a>", dlLink, dlLink))
+	svc.jobDone(js)
+	return nil
 }
 
 func (svc *ServiceContext) requestMetadataPDF(js *jobStatus, unitID int64, mdPID, pdfDir string) error {
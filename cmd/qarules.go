@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// qaRules are the checks applied to the files in a unit finalization directory. Zero
+// values disable the image checks. In tifPattern, {unit} is replaced by the 9 digit unit ID.
+type qaRules struct {
+	MinFileSize       int64    `json:"minFileSize"`
+	TifPattern        string   `json:"tifPattern"`
+	SidecarExtensions []string `json:"sidecarExtensions"`
+	MinWidth          uint     `json:"minWidth"`
+	MinHeight         uint     `json:"minHeight"`
+	MinResolution     uint     `json:"minResolution"`
+	ColorSpaces       []string `json:"colorSpaces"`
+	BitDepths         []uint   `json:"bitDepths"`
+	RequireICCProfile bool     `json:"requireICCProfile"`
+}
+
+// qaRuleSet is the full QA configuration. Rules for a unit come from the first match of: the
+// intended use ID, the academic status name of the customer that placed the order, then the default
+// rules. TrackSys orders have no type, so the customer academic status (Faculty, Graduate Student, ...)
+// is what distinguishes one kind of order from another. An override only needs the settings that differ
+// from the default rules; everything else is inherited from them.
+type qaRuleSet struct {
+	AutoPublishCutoffYear     int                `json:"autoPublishCutoffYear"`
+	NoDeliverableIntendedUses []int64            `json:"noDeliverableIntendedUses"`
+	Default                   qaRules            `json:"default"`
+	IntendedUse               map[string]qaRules `json:"intendedUse"`
+	CustomerAcademicStatus    map[string]qaRules `json:"customerAcademicStatus"`
+}
+
+// unitQARules are the QA rules resolved for a unit and the name of the rule set they came from
+type unitQARules struct {
+	name  string
+	rules qaRules
+}
+
+// qaRuleResult is the pass/fail result of one rule for all files in a unit
+type qaRuleResult struct {
+	Rule     string   `json:"rule"`
+	Passed   bool     `json:"passed"`
+	Failures []string `json:"failures"`
+}
+
+func defaultQARules() *qaRuleSet {
+	return &qaRuleSet{
+		AutoPublishCutoffYear:     1923,
+		NoDeliverableIntendedUses: []int64{110},
+		Default: qaRules{
+			MinFileSize:       1024 * 1024,
+			TifPattern:        `^{unit}_\w{4,}\.tif$`,
+			SidecarExtensions: []string{".txt"},
+		},
+	}
+}
+
+// loadQARules reads the QA rule set from a JSON file. Settings missing from the file use the defaults.
+func loadQARules(filename string) (*qaRuleSet, error) {
+	rules := defaultQARules()
+	if filename == "" {
+		return rules, nil
+	}
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read qa rules %s: %s", filename, err.Error())
+	}
+	err = json.Unmarshal(raw, rules)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse qa rules %s: %s", filename, err.Error())
+	}
+
+	// decode each override again on top of the default rules so unset fields are inherited
+	var overrides struct {
+		IntendedUse            map[string]json.RawMessage `json:"intendedUse"`
+		CustomerAcademicStatus map[string]json.RawMessage `json:"customerAcademicStatus"`
+	}
+	err = json.Unmarshal(raw, &overrides)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse qa rules %s: %s", filename, err.Error())
+	}
+	for k, v := range overrides.IntendedUse {
+		rules.IntendedUse[k], err = rules.Default.merge(v)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse intendedUse %s qa rules: %s", k, err.Error())
+		}
+	}
+	for k, v := range overrides.CustomerAcademicStatus {
+		rules.CustomerAcademicStatus[k], err = rules.Default.merge(v)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse customerAcademicStatus %s qa rules: %s", k, err.Error())
+		}
+	}
+
+	all := map[string]qaRules{"default": rules.Default}
+	for k, v := range rules.IntendedUse {
+		all[fmt.Sprintf("intendedUse %s", k)] = v
+	}
+	for k, v := range rules.CustomerAcademicStatus {
+		all[fmt.Sprintf("customerAcademicStatus %s", k)] = v
+	}
+	for name, r := range all {
+		if r.TifPattern == "" {
+			return nil, fmt.Errorf("%s qa rules are missing tifPattern", name)
+		}
+		_, err := regexp.Compile(strings.ReplaceAll(r.TifPattern, "{unit}", "000000000"))
+		if err != nil {
+			return nil, fmt.Errorf("%s qa rules tifPattern is invalid: %s", name, err.Error())
+		}
+	}
+	return rules, nil
+}
+
+// merge returns a copy of the rules with the settings from the JSON override applied
+func (r qaRules) merge(override json.RawMessage) (qaRules, error) {
+	out := r
+	out.SidecarExtensions = slices.Clone(r.SidecarExtensions)
+	out.ColorSpaces = slices.Clone(r.ColorSpaces)
+	out.BitDepths = slices.Clone(r.BitDepths)
+	err := json.Unmarshal(override, &out)
+	return out, err
+}
+
+// deliverablesRequired returns false for units with intended uses that do not get patron deliverables
+func (rs *qaRuleSet) deliverablesRequired(tgtUnit *unit) bool {
+	return tgtUnit.IntendedUseID == nil || slices.Contains(rs.NoDeliverableIntendedUses, *tgtUnit.IntendedUseID) == false
+}
+
+// getUnitQARules returns the rules that apply to the target unit. Resolve them once and pass them to each check.
+func (svc *ServiceContext) getUnitQARules(tgtUnit *unit) unitQARules {
+	rs := svc.QARules
+	if tgtUnit.IntendedUseID != nil {
+		key := fmt.Sprintf("%d", *tgtUnit.IntendedUseID)
+		if r, found := rs.IntendedUse[key]; found {
+			return unitQARules{name: fmt.Sprintf("intended use %s", key), rules: r}
+		}
+	}
+	if len(rs.CustomerAcademicStatus) > 0 {
+		var statusName string
+		q := "select a.name from orders o inner join customers c on c.id = o.customer_id"
+		q += " inner join academic_statuses a on a.id = c.academic_status_id where o.id = ?"
+		err := svc.GDB.Raw(q, tgtUnit.OrderID).Scan(&statusName).Error
+		if err != nil {
+			log.Printf("ERROR: unable to get academic status for order %d: %s", tgtUnit.OrderID, err.Error())
+		} else if r, found := rs.CustomerAcademicStatus[statusName]; found {
+			return unitQARules{name: fmt.Sprintf("customer academic status %s", statusName), rules: r}
+		}
+	}
+	return unitQARules{name: "default", rules: rs.Default}
+}
+
+// evaluateQARules applies the unit QA rules to the files in srcDir. Image rules require
+// reading the tech metadata of each tif, so they are only run when configured.
+func (svc *ServiceContext) evaluateQARules(ctx context.Context, tgtUnit *unit, rules qaRules, srcDir string) ([]qaRuleResult, error) {
+	pattern := strings.ReplaceAll(rules.TifPattern, "{unit}", fmt.Sprintf("%09d", tgtUnit.ID))
+	mfRegex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tif pattern %s: %s", pattern, err.Error())
+	}
+
+	results := make(map[string]*qaRuleResult)
+	ruleNames := []string{"tifName", "tifSequence", "sidecarExtensions"}
+	if rules.MinFileSize > 0 {
+		ruleNames = append(ruleNames, "minFileSize")
+	}
+	imageRules := make([]string, 0)
+	if rules.MinWidth > 0 || rules.MinHeight > 0 {
+		imageRules = append(imageRules, "minDimensions")
+	}
+	if rules.MinResolution > 0 {
+		imageRules = append(imageRules, "minResolution")
+	}
+	if len(rules.ColorSpaces) > 0 {
+		imageRules = append(imageRules, "colorSpace")
+	}
+	if len(rules.BitDepths) > 0 {
+		imageRules = append(imageRules, "bitDepth")
+	}
+	ruleNames = append(ruleNames, imageRules...)
+	for _, name := range ruleNames {
+		results[name] = &qaRuleResult{Rule: name, Passed: true, Failures: make([]string, 0)}
+	}
+	fail := func(rule, msg string) {
+		results[rule].Passed = false
+		results[rule].Failures = append(results[rule].Failures, msg)
+	}
+
+	tifFiles := make([]tifInfo, 0)
+	err = filepath.Walk(srcDir, func(fPath string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() || f.Name() == ".DS_Store" {
+			return nil
+		}
+		ext := filepath.Ext(f.Name())
+		if ext != ".tif" {
+			if slices.Contains(rules.SidecarExtensions, ext) == false {
+				fail("sidecarExtensions", fmt.Sprintf("Unexpected file found: %s", fPath))
+			}
+			return nil
+		}
+		if mfRegex.MatchString(f.Name()) == false {
+			fail("tifName", fmt.Sprintf("Incorrectly named .tif file found: %s", fPath))
+		} else {
+			tifFiles = append(tifFiles, tifInfo{filename: f.Name(), path: fPath, size: f.Size()})
+		}
+		if rules.MinFileSize > 0 && f.Size() < rules.MinFileSize {
+			fail("minFileSize", fmt.Sprintf("%s filesize is less than %d and is very likely an incorrect file.", fPath, rules.MinFileSize))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tifFiles) == 0 {
+		fail("tifSequence", fmt.Sprintf("No .tif files found in %s", srcDir))
+	}
+	sort.Slice(tifFiles, func(i, j int) bool {
+		return tifFiles[i].filename < tifFiles[j].filename
+	})
+	for idx, tf := range tifFiles {
+		mfPageNum, err := getMasterFilePageNum(tf.filename)
+		if err != nil {
+			fail("tifName", fmt.Sprintf("Invalid .tif filename found: %s", tf.filename))
+		} else if idx+1 != mfPageNum {
+			fail("tifSequence", fmt.Sprintf("Out of sequence .tif file found: %s", tf.filename))
+		}
+	}
+
+	if len(imageRules) > 0 {
+		for _, tf := range tifFiles {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			tm, err := getImageTechMetadata(ctx, tf.path)
+			if err != nil {
+				for _, name := range imageRules {
+					fail(name, fmt.Sprintf("Unable to read %s tech metadata: %s", tf.filename, err.Error()))
+				}
+				continue
+			}
+			if (rules.MinWidth > 0 && tm.Width < rules.MinWidth) || (rules.MinHeight > 0 && tm.Height < rules.MinHeight) {
+				fail("minDimensions", fmt.Sprintf("%s is %dx%d; the minimum is %dx%d", tf.filename, tm.Width, tm.Height, rules.MinWidth, rules.MinHeight))
+			}
+			if rules.MinResolution > 0 && tm.Resolution < rules.MinResolution {
+				fail("minResolution", fmt.Sprintf("%s resolution %d is less than %d", tf.filename, tm.Resolution, rules.MinResolution))
+			}
+			if len(rules.ColorSpaces) > 0 && slices.Contains(rules.ColorSpaces, tm.ColorSpace) == false {
+				fail("colorSpace", fmt.Sprintf("%s color space %s is not one of %v", tf.filename, tm.ColorSpace, rules.ColorSpaces))
+			}
+			if len(rules.BitDepths) > 0 && slices.Contains(rules.BitDepths, tm.Depth) == false {
+				fail("bitDepth", fmt.Sprintf("%s bit depth %d is not one of %v", tf.filename, tm.Depth, rules.BitDepths))
+			}
+		}
+	}
+
+	out := make([]qaRuleResult, 0, len(ruleNames))
+	for _, name := range ruleNames {
+		out = append(out, *results[name])
+	}
+	return out, nil
+}
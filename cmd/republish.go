@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// iiifRepublishRequest selects the master files to regenerate in IIIF. All of the set criteria
+// must match; at least one is required. Dates are YYYY-MM-DD and match the master file archive date.
+type iiifRepublishRequest struct {
+	MetadataID   int64  `json:"metadataID"`
+	OrderID      int64  `json:"orderID"`
+	CollectionID int64  `json:"collectionID"`
+	StartDate    string `json:"startDate"`
+	EndDate      string `json:"endDate"`
+	Profile      string `json:"profile"`
+	Encoder      string `json:"encoder"`
+
+	// progress of a running job; a requeued job resumes after the last master file
+	LastMasterFileID int64 `json:"lastMasterFileID,omitempty"`
+	Processed        int   `json:"processed,omitempty"`
+	Failed           int   `json:"failed,omitempty"`
+	Skipped          int   `json:"skipped,omitempty"`
+}
+
+const republishPageSize = 200
+
+// curl -X POST https://dpg-jobs.lib.virginia.edu/iiif/republish -H "Content-Type: application/json" --data '{"orderID": 11864, "profile": "hathitrust"}'
+func (svc *ServiceContext) republishIIIF(c *gin.Context) {
+	var req iiifRepublishRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		log.Printf("ERROR: unable to parse iiif republish request: %s", err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.MetadataID == 0 && req.OrderID == 0 && req.CollectionID == 0 && req.StartDate == "" && req.EndDate == "" {
+		c.String(http.StatusBadRequest, "a metadata, order, collection or date range is required")
+		return
+	}
+	_, _, err = req.dateRange()
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	err = jp2Settings{Profile: req.Profile, Encoder: req.Encoder}.validate()
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	origType := ""
+	origID := int64(0)
+	if req.MetadataID > 0 {
+		origType = "Metadata"
+		origID = req.MetadataID
+	} else if req.CollectionID > 0 {
+		origType = "Metadata"
+		origID = req.CollectionID
+	} else if req.OrderID > 0 {
+		origType = "Order"
+		origID = req.OrderID
+	}
+	js, err := svc.createJobStatus("RepublishIIIF", origType, origID)
+	if err != nil {
+		log.Printf("ERROR: unable to create RepublishIIIF job status: %s", err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	err = svc.enqueueJob(js, "RepublishIIIF", req)
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+}
+
+// dateRange parses the request dates. The end date is inclusive so the returned end is the start of the following day.
+func (req *iiifRepublishRequest) dateRange() (*time.Time, *time.Time, error) {
+	var start, end *time.Time
+	if req.StartDate != "" {
+		t, err := time.ParseInLocation("2006-01-02", req.StartDate, time.Local)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid start date %s", req.StartDate)
+		}
+		start = &t
+	}
+	if req.EndDate != "" {
+		t, err := time.ParseInLocation("2006-01-02", req.EndDate, time.Local)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid end date %s", req.EndDate)
+		}
+		t = t.AddDate(0, 0, 1)
+		end = &t
+	}
+	if start != nil && end != nil && end.After(*start) == false {
+		return nil, nil, fmt.Errorf("end date %s is before start date %s", req.EndDate, req.StartDate)
+	}
+	return start, end, nil
+}
+
+func (svc *ServiceContext) runRepublishIIIF(js *jobStatus, payload []byte) error {
+	var req iiifRepublishRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid RepublishIIIF payload: %s", err.Error())
+	}
+	start, end, err := req.dateRange()
+	if err != nil {
+		return err
+	}
+
+	mfQ := svc.GDB.Preload("Unit").Preload("ImageTechMeta").
+		Where("master_files.deaccessioned_at is null and master_files.original_mf_id is null")
+	if req.MetadataID > 0 {
+		svc.logInfo(js, fmt.Sprintf("Republish master files for metadata %d", req.MetadataID))
+		mfQ = mfQ.Where("master_files.metadata_id=?", req.MetadataID)
+	}
+	if req.CollectionID > 0 {
+		svc.logInfo(js, fmt.Sprintf("Republish master files for collection %d", req.CollectionID))
+		mfQ = mfQ.Where("master_files.metadata_id in (?)", svc.GDB.Table("metadata").Select("id").Where("parent_metadata_id=?", req.CollectionID))
+	}
+	if req.OrderID > 0 {
+		svc.logInfo(js, fmt.Sprintf("Republish master files for order %d", req.OrderID))
+		mfQ = mfQ.Where("master_files.unit_id in (?)", svc.GDB.Table("units").Select("id").Where("order_id=?", req.OrderID))
+	}
+	if start != nil {
+		svc.logInfo(js, fmt.Sprintf("Republish master files archived on or after %s", req.StartDate))
+		mfQ = mfQ.Where("master_files.date_archived >= ?", *start)
+	}
+	if end != nil {
+		svc.logInfo(js, fmt.Sprintf("Republish master files archived on or before %s", req.EndDate))
+		mfQ = mfQ.Where("master_files.date_archived < ?", *end)
+	}
+
+	if req.LastMasterFileID > 0 {
+		svc.logInfo(js, fmt.Sprintf("Resume republish after master file %d; %d master files already processed", req.LastMasterFileID, req.Processed))
+		mfQ = mfQ.Where("master_files.id > ?", req.LastMasterFileID)
+	}
+
+	// master files are published a page at a time and the progress is saved after each page completes
+	jp2 := jp2Settings{Profile: req.Profile, Encoder: req.Encoder}
+	svc.logInfo(js, fmt.Sprintf("Republish master files to IIIF with profile [%s] and encoder [%s]", jp2.Profile, jp2.Encoder))
+	var masterFiles []masterFile
+	err = mfQ.FindInBatches(&masterFiles, republishPageSize, func(tx *gorm.DB, page int) error {
+		svc.logInfo(js, fmt.Sprintf("Republish page %d of master files; total processed: %d", page, req.Processed))
+		batch := svc.newIIIFPublishBatch(js, true)
+		batch.jp2 = jp2
+		for idx := range masterFiles {
+			if js.canceled() {
+				batch.wait()
+				return js.context().Err()
+			}
+			mf := &masterFiles[idx]
+			if mf.ImageTechMeta.Width == 0 || mf.ImageTechMeta.Height == 0 {
+				svc.logError(js, fmt.Sprintf("Skip %s: invalid tech metadata; width and height are zero", mf.Filename))
+				req.Skipped++
+				continue
+			}
+			archiveFile := svc.getIIIFSourceFile(mf)
+			if pathExists(archiveFile) == false {
+				svc.logError(js, fmt.Sprintf("Skip %s: archive file %s does not exist", mf.Filename, archiveFile))
+				req.Skipped++
+				continue
+			}
+			batch.add(jp2Source{MasterFile: mf, Path: archiveFile})
+		}
+		batch.wait()
+		if js.canceled() {
+			return js.context().Err()
+		}
+
+		req.Processed += len(masterFiles)
+		req.Failed += len(batch.failures)
+		req.LastMasterFileID = masterFiles[len(masterFiles)-1].ID
+		err := svc.saveJobPayload(js, req)
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("Unable to save republish progress: %s", err.Error()))
+		}
+		return nil
+	}).Error
+	if js.canceled() {
+		return js.context().Err()
+	}
+	if err != nil {
+		return fmt.Errorf("unable to republish master files: %s", err.Error())
+	}
+	if req.Processed == 0 {
+		svc.logInfo(js, "No master files match the republish request")
+		svc.jobDone(js)
+		return nil
+	}
+
+	svc.logInfo(js, fmt.Sprintf("Republish results: %d master files, %d published, %d failed, %d skipped",
+		req.Processed, req.Processed-req.Failed-req.Skipped, req.Failed, req.Skipped))
+	if req.Failed > 0 || req.Skipped > 0 {
+		return fmt.Errorf("%d of %d master files could not be republished", req.Failed+req.Skipped, req.Processed)
+	}
+	svc.jobDone(js)
+	return nil
+}
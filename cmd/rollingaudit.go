@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const rollingAuditBatchSize = 100
+const rollingAuditSummaryPeriod = 7 * 24 * time.Hour
+
+// rollingAuditDefaultFilesize is used to throttle by size when neither the master file nor the archive has a filesize
+const rollingAuditDefaultFilesize = 100 * 1024 * 1024
+
+// rollingAudit continuously re-verifies archived master files at the configured daily throughput. Master
+// files that have never been audited go first, in ID order from a cursor saved with the audit run. After
+// that the least recently audited master files are re-verified, so files checked by a year audit are not
+// audited again until everything else has been. Each week of audits is an audit run that is summarized by email.
+type rollingAudit struct {
+	filesPerDay int
+	bytesPerDay float64
+	avgFilesize int64
+	email       string
+	// master files that could not be audited this week; skipped until the next run starts
+	failed map[int64]bool
+}
+
+func (svc *ServiceContext) startRollingAudit(cfg AuditConfig) {
+	if cfg.FilesPerDay == 0 && cfg.GBPerDay == 0 {
+		log.Printf("INFO: rolling fixity audit is disabled")
+		return
+	}
+	ra := rollingAudit{filesPerDay: cfg.FilesPerDay, bytesPerDay: cfg.GBPerDay * 1024.0 * 1024.0 * 1024.0,
+		avgFilesize: rollingAuditDefaultFilesize, email: cfg.Email, failed: make(map[int64]bool)}
+	svc.logRollingAuditCycle(&ra)
+	go svc.runRollingAudit(&ra)
+}
+
+// logRollingAuditCycle reports how long it takes to re-verify every archived master file at the configured
+// throughput and sets the average filesize used to throttle master files without a filesize
+func (svc *ServiceContext) logRollingAuditCycle(ra *rollingAudit) {
+	var totals struct {
+		Files int64
+		Bytes int64
+		Sized int64
+	}
+	err := svc.GDB.Table("master_files").Select("count(*) as files, coalesce(sum(filesize),0) as bytes, coalesce(sum(filesize > 0),0) as sized").
+		Where("date_archived is not null and deaccessioned_at is null and original_mf_id is null").
+		Scan(&totals).Error
+	if err != nil {
+		log.Printf("ERROR: unable to get archived master file totals: %s", err.Error())
+		return
+	}
+	if totals.Sized > 0 {
+		ra.avgFilesize = totals.Bytes / totals.Sized
+	}
+	days := 0.0
+	if ra.filesPerDay > 0 {
+		days = float64(totals.Files) / float64(ra.filesPerDay)
+	}
+	if ra.bytesPerDay > 0 {
+		days = max(days, float64(totals.Files*ra.avgFilesize)/ra.bytesPerDay)
+	}
+	log.Printf("INFO: rolling fixity audit of %d archived master files (%.2f GB) completes a cycle every %.1f days",
+		totals.Files, float64(totals.Bytes)/(1024.0*1024.0*1024.0), days)
+}
+
+func (svc *ServiceContext) runRollingAudit(ra *rollingAudit) {
+	run, err := svc.getRollingAuditRun()
+	for err != nil {
+		log.Printf("ERROR: unable to start rolling fixity audit: %s", err.Error())
+		time.Sleep(5 * time.Minute)
+		run, err = svc.getRollingAuditRun()
+	}
+	log.Printf("INFO: rolling fixity audit run %d started at %s; never audited master files continue after %d", run.ID, run.StartedAt.Format("2006-01-02 03:04:05 PM"), run.LastMasterFileID)
+
+	for {
+		if time.Since(run.StartedAt) >= rollingAuditSummaryPeriod {
+			svc.finishAuditRun(run)
+			svc.sendRollingAuditSummary(ra, run)
+			ra.failed = make(map[int64]bool)
+			next, err := svc.startRollingAuditRun(run.LastMasterFileID)
+			if err != nil {
+				log.Printf("ERROR: unable to start next rolling fixity audit run: %s", err.Error())
+				time.Sleep(5 * time.Minute)
+				continue
+			}
+			run = next
+			log.Printf("INFO: rolling fixity audit run %d started", run.ID)
+		}
+
+		batch, err := svc.getUnauditedMasterFiles(ra, run.LastMasterFileID)
+		unaudited := len(batch) > 0
+		if err == nil && unaudited == false {
+			batch, err = svc.getLeastRecentlyAuditedMasterFiles(ra)
+		}
+		if err != nil {
+			log.Printf("ERROR: unable to get master files for rolling fixity audit: %s", err.Error())
+			time.Sleep(5 * time.Minute)
+			continue
+		}
+		if len(batch) == 0 {
+			// there are no archived master files that can be audited
+			time.Sleep(time.Hour)
+			continue
+		}
+
+		for _, mf := range batch {
+			start := time.Now()
+			_, err := svc.performAudit(context.Background(), run.ID, &mf, false)
+			if err != nil {
+				log.Printf("ERROR: rolling fixity audit of master file %d failed: %s", mf.ID, err.Error())
+				ra.failed[mf.ID] = true
+			}
+			time.Sleep(ra.delay(mf.Filesize) - time.Since(start))
+		}
+		if unaudited {
+			svc.saveAuditRunCursor(run, batch[len(batch)-1].ID)
+		}
+	}
+}
+
+// delay is the time allotted to auditing a master file so the configured files and bytes per day are not
+// exceeded. Master files without a filesize are throttled as if they were the average size.
+func (ra *rollingAudit) delay(filesize int64) time.Duration {
+	day := 24 * time.Hour
+	wait := time.Duration(0)
+	if ra.filesPerDay > 0 {
+		wait = day / time.Duration(ra.filesPerDay)
+	}
+	if ra.bytesPerDay > 0 {
+		if filesize <= 0 {
+			filesize = ra.avgFilesize
+		}
+		wait = max(wait, time.Duration(float64(filesize)/ra.bytesPerDay*float64(day)))
+	}
+	return wait
+}
+
+// getRollingAuditRun continues the rolling audit run that was in progress when the service stopped, or starts a
+// new one from the cursor of the last rolling audit run
+func (svc *ServiceContext) getRollingAuditRun() (*auditRun, error) {
+	var run auditRun
+	err := svc.GDB.Where("type=?", "rolling").Order("id desc").Limit(1).Find(&run).Error
+	if err != nil {
+		return nil, err
+	}
+	if run.ID > 0 && run.FinishedAt == nil {
+		return &run, nil
+	}
+	return svc.startRollingAuditRun(run.LastMasterFileID)
+}
+
+// startRollingAuditRun starts a rolling audit run that continues with the never audited master files after the given one
+func (svc *ServiceContext) startRollingAuditRun(lastMasterFileID int64) (*auditRun, error) {
+	run, err := svc.startAuditRun(nil, "rolling")
+	if err != nil {
+		return nil, err
+	}
+	svc.saveAuditRunCursor(run, lastMasterFileID)
+	return run, nil
+}
+
+// rollingAuditQuery selects the archived master files that can be audited, skipping those that failed this week
+func (svc *ServiceContext) rollingAuditQuery(ra *rollingAudit) *gorm.DB {
+	mfQ := svc.GDB.Table("master_files").
+		Select("master_files.id as id, master_files.pid as pid, master_files.filename as filename, master_files.md5 as md5, coalesce(master_files.filesize,0) as filesize, unit_id, u.staff_notes as staff_notes").
+		Joins("inner join units u on u.id = unit_id").
+		Where("master_files.date_archived is not null and master_files.deaccessioned_at is null and master_files.original_mf_id is null")
+	if len(ra.failed) > 0 {
+		skipIDs := make([]int64, 0, len(ra.failed))
+		for id := range ra.failed {
+			skipIDs = append(skipIDs, id)
+		}
+		mfQ = mfQ.Where("master_files.id not in ?", skipIDs)
+	}
+	return mfQ
+}
+
+// getUnauditedMasterFiles returns the next archived master files after the cursor that have never been audited
+func (svc *ServiceContext) getUnauditedMasterFiles(ra *rollingAudit, lastMasterFileID int64) ([]auditItem, error) {
+	var batch []auditItem
+	err := svc.rollingAuditQuery(ra).
+		Joins("left join master_file_audits a on a.master_file_id = master_files.id").
+		Where("a.id is null and master_files.id > ?", lastMasterFileID).
+		Order("master_files.id asc").Limit(rollingAuditBatchSize).Scan(&batch).Error
+	return batch, err
+}
+
+// getLeastRecentlyAuditedMasterFiles returns the archived master files with the oldest audits. The
+// audited_at index created by -dbmigrate keeps this from sorting every audit.
+func (svc *ServiceContext) getLeastRecentlyAuditedMasterFiles(ra *rollingAudit) ([]auditItem, error) {
+	var batch []auditItem
+	err := svc.rollingAuditQuery(ra).
+		Joins("inner join master_file_audits a on a.master_file_id = master_files.id").
+		Order("a.audited_at asc").Limit(rollingAuditBatchSize).Scan(&batch).Error
+	return batch, err
+}
+
+// sendRollingAuditSummary totals the latest audit history of each master file in a rolling audit run and sends it
+// with the audit results email. Master files that could not be audited are counted as errors.
+func (svc *ServiceContext) sendRollingAuditSummary(ra *rollingAudit, run *auditRun) {
+	var summary auditYearResults
+	err := svc.getAuditRunTotals(run.ID, &summary)
+	if err != nil {
+		log.Printf("ERROR: unable to summarize rolling fixity audit run %d: %s", run.ID, err.Error())
+		summary.FatalError = err.Error()
+	}
+
+	// master files that failed before any history was saved for them
+	if len(ra.failed) > 0 {
+		failedIDs := make([]int64, 0, len(ra.failed))
+		for id := range ra.failed {
+			failedIDs = append(failedIDs, id)
+		}
+		var withHistory int64
+		err = svc.GDB.Model(&masterFileAuditHistory{}).Where("audit_run_id=? and master_file_id in ?", run.ID, failedIDs).
+			Distinct("master_file_id").Count(&withHistory).Error
+		if err != nil {
+			log.Printf("ERROR: unable to count failed master files for rolling fixity audit run %d: %s", run.ID, err.Error())
+		} else {
+			noHistory := uint(int64(len(failedIDs)) - withHistory)
+			summary.MasterFileCount += noHistory
+			summary.MasterFileErrorCount += noHistory
+		}
+	}
+
+	summary.Year = "Weekly Rolling"
+	summary.Rolling = true
+	summary.StartedAt = run.StartedAt.Format("2006-01-02 03:04:05 PM")
+	if run.FinishedAt != nil {
+		summary.FinishedAt = run.FinishedAt.Format("2006-01-02 03:04:05 PM")
+	}
+	log.Printf("INFO: rolling fixity audit run %d audited %d master files; %d succeeded", run.ID, summary.MasterFileCount, summary.SuccessCount)
+	svc.sendAuditResultsEmail(ra.email, summary)
+}
@@ -3,10 +3,11 @@ package main
 import (
 	"archive/zip"
 	"bytes"
-	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"log"
@@ -23,8 +24,6 @@ import (
 
 	"html/template"
 
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/golang-jwt/jwt/v5"
 
 	"github.com/gin-gonic/gin"
@@ -52,10 +51,11 @@ type archivesSpaceContext struct {
 
 // IIIFContext contains service info for all IIIF related requests
 type IIIFContext struct {
-	ManifestURL string
-	StagingDir  string
-	Bucket      string
-	S3Client    *s3.Client
+	ManifestURL      string
+	ManifestStoreURL string
+	ImageURL         string
+	StagingDir       string
+	Storage          iiifStorage
 }
 
 // ServiceContext contains common data used by all handlers
@@ -75,11 +75,16 @@ type ServiceContext struct {
 	ReindexURL    string
 	XMLReindexURL string
 	OcrURL        string
+	OcrEngine     string
 	PdfURL        string
 	HTTPClient    *http.Client
 	Templates     htmlTemplates
-	OcrRequests   []int64
+	OcrRequests   ocrRequestRegistry
+	JP2Pool       *jp2Pool
 	JSTORCookies  []*http.Cookie
+	JobQueue      jobQueue
+	JobEvents     jobEventBroker
+	QARules       *qaRuleSet
 }
 
 // RequestError contains http status code and message for a failed HTTP request
@@ -101,22 +106,26 @@ func InitializeService(version string, cfg *ServiceConfig) *ServiceContext {
 		ReindexURL:    cfg.ReindexURL,
 		XMLReindexURL: cfg.XMLReindexURL,
 		OcrURL:        cfg.OcrURL,
+		OcrEngine:     cfg.OcrEngine,
 		PdfURL:        cfg.PdfURL,
 		ServiceURL:    cfg.ServiceURL,
-		OcrRequests:   make([]int64, 0),
 	}
 
+	ctx.OcrRequests.timeout = time.Duration(cfg.OcrTimeout) * time.Minute
+	ctx.JP2Pool = newJP2Pool(cfg.JP2Workers)
+
 	ctx.IIIF.StagingDir = cfg.IIIF.StagingDir
 	ctx.IIIF.ManifestURL = cfg.IIIF.ManifestURL
+	ctx.IIIF.ManifestStoreURL = strings.TrimSuffix(cfg.IIIF.ManifestStoreURL, "/")
+	ctx.IIIF.ImageURL = cfg.IIIF.ImageURL
 
-	log.Printf("INFO: initialize s3 session...")
-	ctx.IIIF.Bucket = cfg.IIIF.Bucket
-	awsCfg, err := config.LoadDefaultConfig(context.TODO())
+	log.Printf("INFO: initialize %s iiif storage...", cfg.IIIF.Storage)
+	storage, err := newIIIFStorage(cfg.IIIF)
 	if err != nil {
-		log.Fatalf("unable to load s3 config: %s", err.Error())
+		log.Fatal(err)
 	}
-	ctx.IIIF.S3Client = s3.NewFromConfig(awsCfg)
-	log.Printf("INFO: s3 session established")
+	ctx.IIIF.Storage = storage
+	log.Printf("INFO: iiif storage %s initialized", ctx.IIIF.Storage.location())
 
 	log.Printf("INFO: connecting to DB...")
 	connectStr := fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true",
@@ -140,6 +149,34 @@ func InitializeService(version string, cfg *ServiceConfig) *ServiceContext {
 	ctx.GDB = gdb
 	log.Printf("INFO: DB Connection established")
 
+	// the job service tables live in the shared TrackSys database. They are only created or altered
+	// when explicitly requested; otherwise startup fails if any are missing.
+	serviceTables := []any{&jobPayload{}, &finalizeCheckpoint{}, &ocrRequest{}, &ocrQuality{}, &unitJP2Profile{},
+		&jp2TechMeta{}, &masterFileFixity{}, &auditRun{}, &masterFileAuditHistory{}}
+	if cfg.DB.Migrate {
+		log.Printf("INFO: create or update job service tables")
+		err = ctx.GDB.AutoMigrate(serviceTables...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// the rolling audit picks the least recently audited master files
+		if ctx.GDB.Migrator().HasIndex("master_file_audits", "index_master_file_audits_on_audited_at") == false {
+			err = ctx.GDB.Exec("create index index_master_file_audits_on_audited_at on master_file_audits (audited_at)").Error
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	} else {
+		log.Printf("INFO: verify job service tables exist")
+		for _, tbl := range serviceTables {
+			if ctx.GDB.Migrator().HasTable(tbl) == false {
+				stmt := &gorm.Statement{DB: ctx.GDB}
+				stmt.Parse(tbl)
+				log.Fatalf("Table %s does not exist; run once with -dbmigrate to create the job service tables", stmt.Schema.Table)
+			}
+		}
+	}
+
 	log.Printf("INFO: initialize archivesSpace")
 	var es externalSystem
 	err = ctx.GDB.Where("name=?", "ArchivesSpace").Find(&es).Error
@@ -150,6 +187,12 @@ func InitializeService(version string, cfg *ServiceConfig) *ServiceContext {
 	ctx.ArchivesSpace.Pass = cfg.ArchivesSpace.Pass
 	ctx.ArchivesSpace.APIURL = es.APIURL
 
+	log.Printf("INFO: load qa rules")
+	ctx.QARules, err = loadQARules(cfg.QARulesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	log.Printf("INFO: load html templates")
 	ctx.Templates.AuditResults, err = template.New("audit.html").ParseFiles("./templates/audit.html")
 	if err != nil {
@@ -192,6 +235,12 @@ func InitializeService(version string, cfg *ServiceConfig) *ServiceContext {
 	}
 	log.Printf("INFO: HTTP Client created")
 
+	ctx.initJobQueue(cfg.JobWorkers)
+	ctx.recoverJobs()
+	ctx.abandonOCRRequests()
+	go ctx.expireOCRRequests()
+	ctx.startRollingAudit(cfg.Audit)
+
 	return &ctx
 }
 
@@ -399,17 +448,75 @@ func handleAPIResponse(logURL string, resp *http.Response, err error) ([]byte, *
 	return bodyBytes, nil
 }
 
+// fileChecksums are the fixity checksums of a file
+type fileChecksums struct {
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256"`
+}
+
+// checksumWriter computes all fixity checksums from a single pass over the data written to it
+type checksumWriter struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func newChecksumWriter() *checksumWriter {
+	return &checksumWriter{md5: md5.New(), sha256: sha256.New()}
+}
+
+func (cw *checksumWriter) Write(p []byte) (int, error) {
+	cw.md5.Write(p)
+	return cw.sha256.Write(p)
+}
+
+func (cw *checksumWriter) checksums() *fileChecksums {
+	return &fileChecksums{MD5: fmt.Sprintf("%x", cw.md5.Sum(nil)), SHA256: fmt.Sprintf("%x", cw.sha256.Sum(nil))}
+}
+
+// computeChecksums streams a file once to compute all of its checksums without holding it in memory
+func computeChecksums(filename string) (*fileChecksums, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cw := newChecksumWriter()
+	_, err = io.Copy(cw, f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compute checksums for %s: %s", filename, err.Error())
+	}
+	return cw.checksums(), nil
+}
+
 func md5Checksum(filename string) string {
-	if pathExists(filename) {
-		data, _ := os.ReadFile(filename)
-		md5 := fmt.Sprintf("%x", md5.Sum(data))
-		return md5
+	return streamChecksum(filename, md5.New())
+}
+
+func sha256Checksum(filename string) string {
+	return streamChecksum(filename, sha256.New())
+}
+
+func streamChecksum(filename string, h hash.Hash) string {
+	f, err := os.Open(filename)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		log.Printf("ERROR: unable to compute checksum for %s: %s", filename, err.Error())
+		return ""
 	}
-	return ""
+	return fmt.Sprintf("%x", h.Sum(nil))
 }
+
 func getMasterFilePageNum(filename string) (int, error) {
 	noExt := strings.ReplaceAll(filename, ".tif", "")
-	numStr := strings.Split(noExt, "_")[1]
+	parts := strings.Split(noExt, "_")
+	if len(parts) < 2 {
+		return 0, fmt.Errorf("cannot parse page number from invalid masterfile name %s", filename)
+	}
+	numStr := parts[1]
 	num, err := strconv.ParseInt(numStr, 10, 0)
 	if err != nil {
 		return 0, fmt.Errorf("cannot parse page number from invalid masterfile name %s: %s", filename, err.Error())
@@ -460,26 +567,52 @@ func addFileToZip(zipFilePath string, zw *zip.Writer, filePath string, fileName
 
 // copy file from src to dest, set permissions and return the MD5 checksum of the copy
 func copyFile(src string, dest string, mode fs.FileMode) (string, error) {
-	origFile, err := os.Open(src)
+	sums, err := copyFileWithChecksums(src, dest, mode)
 	if err != nil {
 		return "", err
 	}
+	return sums.MD5, nil
+}
+
+// copyFileWithChecksums copies a file and returns all checksums of the copied data. The checksums
+// are computed as the data is copied so the file is only read once.
+func copyFileWithChecksums(src string, dest string, mode fs.FileMode) (*fileChecksums, error) {
+	origFile, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
 	defer origFile.Close()
 
 	destFile, err := os.Create(dest)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer destFile.Close()
 
-	_, err = io.Copy(destFile, origFile)
+	cw := newChecksumWriter()
+	_, err = io.Copy(io.MultiWriter(destFile, cw), origFile)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	err = destFile.Close()
+	if err != nil {
+		return nil, err
 	}
-	destFile.Close()
 
 	os.Chmod(dest, mode)
-	return md5Checksum(dest), nil
+	return cw.checksums(), nil
+}
+
+// verifyCopiedFile re-reads a copied file and checks it against the checksums of the data read from the source
+func verifyCopiedFile(dest string, srcSums *fileChecksums) error {
+	destSums, err := computeChecksums(dest)
+	if err != nil {
+		return err
+	}
+	if destSums.MD5 != srcSums.MD5 {
+		return fmt.Errorf("copy %s MD5 checksum %s does not match original %s", dest, destSums.MD5, srcSums.MD5)
+	}
+	return nil
 }
 
 func copyAll(srcDir string, destDir string) error {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,32 +12,48 @@ import (
 	"time"
 )
 
-func (svc *ServiceContext) createImageTechMetadata(mf *masterFile, mfPath string) error {
-	cmdArray := []string{"-json", mfPath}
-	cmd := exec.Command("exiftool", cmdArray...)
-	log.Printf("INFO: get %s tech metadata with: %+v", mf.PID, cmd)
+func (svc *ServiceContext) createImageTechMetadata(js *jobStatus, mf *masterFile, mfPath string) error {
+	log.Printf("INFO: get %s tech metadata from %s", mf.PID, mfPath)
+	md, err := getImageTechMetadata(js.context(), mfPath)
+	if err != nil {
+		return err
+	}
+	md.MasterFileID = mf.ID
+
+	log.Printf("INFO: %s tech metadata: %+v", mf.PID, *md)
+	err = svc.GDB.Create(md).Error
+	if err != nil {
+		return err
+	}
+	mf.ImageTechMeta = *md
+	return nil
+}
+
+// getImageTechMetadata reads the tech metadata for an image with exiftool
+func getImageTechMetadata(ctx context.Context, imgPath string) (*imageTechMeta, error) {
+	cmdArray := []string{"-json", imgPath}
+	cmd := exec.CommandContext(ctx, "exiftool", cmdArray...)
 	stdout, err := cmd.Output()
 	if err != nil {
 		log.Printf("ERROR: unable to get tech metadata: %s: %s", stdout, err.Error())
-		return err
+		return nil, err
 	}
 
 	var jsonDataArray []map[string]any
 	err = json.Unmarshal(stdout, &jsonDataArray)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if len(jsonDataArray) == 0 {
-		return errors.New("no metadata returned")
+		return nil, errors.New("no metadata returned")
 	}
 	jsonMD := jsonDataArray[0]
 	md := imageTechMeta{
-		MasterFileID: mf.ID,
-		ImageFormat:  fmt.Sprintf("%v", jsonMD["FileType"]),
-		Width:        getUInt(jsonMD, "ImageWidth"),
-		Height:       getUInt(jsonMD, "ImageHeight"),
-		Depth:        getDepth(jsonMD),
-		Resolution:   getUInt(jsonMD, "XResolution"),
+		ImageFormat: fmt.Sprintf("%v", jsonMD["FileType"]),
+		Width:       getUInt(jsonMD, "ImageWidth"),
+		Height:      getUInt(jsonMD, "ImageHeight"),
+		Depth:       getDepth(jsonMD),
+		Resolution:  getUInt(jsonMD, "XResolution"),
 	}
 
 	if jsonMD["Compression"] != nil {
@@ -87,14 +104,7 @@ func (svc *ServiceContext) createImageTechMetadata(mf *masterFile, mfPath string
 	if jsonMD["FocalLength"] != nil {
 		md.FocalLength = getFocalLength(jsonMD)
 	}
-
-	log.Printf("INFO: %s tech metadata: %+v", mf.PID, md)
-	err = svc.GDB.Create(&md).Error
-	if err != nil {
-		return err
-	}
-	mf.ImageTechMeta = md
-	return nil
+	return &md, nil
 }
 
 func getUInt(data map[string]any, fieldName string) uint {
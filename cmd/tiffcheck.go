@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// TIFF tags used for structural validation
+const (
+	tiffImageWidth     = 256
+	tiffImageLength    = 257
+	tiffCompression    = 259
+	tiffPhotometric    = 262
+	tiffStripOffsets   = 273
+	tiffStripByteCount = 279
+	tiffXResolution    = 282
+	tiffYResolution    = 283
+	tiffTileWidth      = 322
+	tiffTileLength     = 323
+	tiffTileOffsets    = 324
+	tiffTileByteCounts = 325
+	tiffICCProfile     = 34675
+)
+
+// supported TIFF compression schemes: none, CCITT bilevel, LZW, JPEG, deflate, PackBits and old deflate
+var tiffCompressions = map[uint64]string{1: "none", 2: "CCITT RLE", 3: "CCITT G3", 4: "CCITT G4", 5: "LZW", 7: "JPEG",
+	8: "deflate", 32773: "PackBits", 32946: "deflate"}
+
+// tiffNoICCWarning is reported for images without an embedded ICC profile
+const tiffNoICCWarning = "no embedded ICC profile"
+
+// byte size of each TIFF field type
+var tiffTypeSizes = map[uint16]uint64{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4, 16: 8, 17: 8, 18: 8}
+
+// tiffValidation is the result of a structural check of a TIFF file. Problems make the file
+// unusable; warnings are for issues that may be acceptable, like a missing ICC profile.
+type tiffValidation struct {
+	File     string   `json:"file"`
+	Problems []string `json:"problems"`
+	Warnings []string `json:"warnings"`
+}
+
+type tiffEntry struct {
+	fieldType uint16
+	count     uint64
+	data      []byte // inline value bytes; nil if the value is stored elsewhere in the file
+	offset    uint64
+}
+
+type tiffReader struct {
+	r     io.ReaderAt
+	size  uint64
+	order binary.ByteOrder
+	big   bool
+}
+
+// validateTIFF checks the structure of a TIFF file without decoding the image: the IFD chain, the
+// required baseline tags, that all strip/tile data is within the file, compression support and
+// the presence of an embedded ICC profile.
+func validateTIFF(tifPath string) tiffValidation {
+	out := tiffValidation{File: filepath.Base(tifPath), Problems: make([]string, 0), Warnings: make([]string, 0)}
+	f, err := os.Open(tifPath)
+	if err != nil {
+		out.Problems = append(out.Problems, fmt.Sprintf("unable to open: %s", err.Error()))
+		return out
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		out.Problems = append(out.Problems, fmt.Sprintf("unable to stat: %s", err.Error()))
+		return out
+	}
+
+	tr := tiffReader{r: f, size: uint64(fi.Size())}
+	ifdOffset, err := tr.readHeader()
+	if err != nil {
+		out.Problems = append(out.Problems, err.Error())
+		return out
+	}
+
+	visited := make(map[uint64]bool)
+	for ifdNum := 0; ifdOffset != 0; ifdNum++ {
+		if visited[ifdOffset] {
+			out.Problems = append(out.Problems, fmt.Sprintf("IFD %d at offset %d creates a loop in the IFD chain", ifdNum, ifdOffset))
+			break
+		}
+		if ifdNum >= 1000 {
+			out.Problems = append(out.Problems, "IFD chain has more than 1000 entries")
+			break
+		}
+		visited[ifdOffset] = true
+
+		entries, next, err := tr.readIFD(ifdOffset)
+		if err != nil {
+			out.Problems = append(out.Problems, fmt.Sprintf("IFD %d: %s", ifdNum, err.Error()))
+			break
+		}
+		tr.checkIFD(ifdNum, entries, &out)
+		ifdOffset = next
+	}
+	return out
+}
+
+func (tr *tiffReader) readHeader() (uint64, error) {
+	hdr := make([]byte, 16)
+	if tr.size < 8 {
+		return 0, fmt.Errorf("file is too small to be a TIFF")
+	}
+	n, _ := tr.r.ReadAt(hdr, 0)
+	switch string(hdr[0:2]) {
+	case "II":
+		tr.order = binary.LittleEndian
+	case "MM":
+		tr.order = binary.BigEndian
+	default:
+		return 0, fmt.Errorf("invalid TIFF byte order marker")
+	}
+
+	switch tr.order.Uint16(hdr[2:4]) {
+	case 42:
+		return uint64(tr.order.Uint32(hdr[4:8])), nil
+	case 43:
+		if n < 16 || tr.order.Uint16(hdr[4:6]) != 8 {
+			return 0, fmt.Errorf("invalid BigTIFF header")
+		}
+		tr.big = true
+		return tr.order.Uint64(hdr[8:16]), nil
+	}
+	return 0, fmt.Errorf("invalid TIFF version number")
+}
+
+func (tr *tiffReader) readIFD(offset uint64) (map[uint16]tiffEntry, uint64, error) {
+	countSize, entrySize, offsetSize := uint64(2), uint64(12), uint64(4)
+	if tr.big {
+		countSize, entrySize, offsetSize = 8, 20, 8
+	}
+	if tr.inFile(offset, countSize) == false {
+		return nil, 0, fmt.Errorf("offset %d is beyond the end of the file", offset)
+	}
+	buf := make([]byte, countSize)
+	if _, err := tr.r.ReadAt(buf, int64(offset)); err != nil {
+		return nil, 0, fmt.Errorf("unable to read entry count: %s", err.Error())
+	}
+	var count uint64
+	if tr.big {
+		count = tr.order.Uint64(buf)
+	} else {
+		count = uint64(tr.order.Uint16(buf))
+	}
+	if count == 0 || count > tr.size/entrySize {
+		return nil, 0, fmt.Errorf("directory at offset %d has an invalid entry count %d", offset, count)
+	}
+	tableSize := count*entrySize + offsetSize
+	if tr.inFile(offset+countSize, tableSize) == false {
+		return nil, 0, fmt.Errorf("directory with %d entries at offset %d is truncated", count, offset)
+	}
+
+	table := make([]byte, tableSize)
+	if _, err := tr.r.ReadAt(table, int64(offset+countSize)); err != nil {
+		return nil, 0, fmt.Errorf("unable to read directory: %s", err.Error())
+	}
+	entries := make(map[uint16]tiffEntry)
+	for i := uint64(0); i < count; i++ {
+		raw := table[i*entrySize : (i+1)*entrySize]
+		tag := tr.order.Uint16(raw[0:2])
+		e := tiffEntry{fieldType: tr.order.Uint16(raw[2:4])}
+		valBytes := raw[8:12]
+		if tr.big {
+			e.count = tr.order.Uint64(raw[4:12])
+			valBytes = raw[12:20]
+		} else {
+			e.count = uint64(tr.order.Uint32(raw[4:8]))
+		}
+		if typeSize, ok := tiffTypeSizes[e.fieldType]; ok && e.count <= uint64(len(valBytes))/typeSize {
+			e.data = valBytes
+		} else if tr.big {
+			e.offset = tr.order.Uint64(valBytes)
+		} else {
+			e.offset = uint64(tr.order.Uint32(valBytes))
+		}
+		entries[tag] = e
+	}
+
+	var next uint64
+	if tr.big {
+		next = tr.order.Uint64(table[count*entrySize:])
+	} else {
+		next = uint64(tr.order.Uint32(table[count*entrySize:]))
+	}
+	return entries, next, nil
+}
+
+// inFile returns true if the length bytes starting at offset are all within the file
+func (tr *tiffReader) inFile(offset, length uint64) bool {
+	return length <= tr.size && offset <= tr.size-length
+}
+
+// values returns the integer values of a SHORT, LONG or LONG8 entry
+func (tr *tiffReader) values(e tiffEntry) ([]uint64, error) {
+	typeSize, ok := tiffTypeSizes[e.fieldType]
+	if ok == false || (e.fieldType != 3 && e.fieldType != 4 && e.fieldType != 16) {
+		return nil, fmt.Errorf("unexpected field type %d", e.fieldType)
+	}
+	raw := e.data
+	if raw == nil {
+		if e.count > tr.size/typeSize || tr.inFile(e.offset, typeSize*e.count) == false {
+			return nil, fmt.Errorf("data at offset %d is beyond the end of the file", e.offset)
+		}
+		raw = make([]byte, typeSize*e.count)
+		if _, err := tr.r.ReadAt(raw, int64(e.offset)); err != nil {
+			return nil, err
+		}
+	}
+	out := make([]uint64, e.count)
+	for i := uint64(0); i < e.count; i++ {
+		switch e.fieldType {
+		case 3:
+			out[i] = uint64(tr.order.Uint16(raw[i*2:]))
+		case 4:
+			out[i] = uint64(tr.order.Uint32(raw[i*4:]))
+		case 16:
+			out[i] = tr.order.Uint64(raw[i*8:])
+		}
+	}
+	return out, nil
+}
+
+func (tr *tiffReader) checkIFD(ifdNum int, entries map[uint16]tiffEntry, out *tiffValidation) {
+	problem := func(msg string, args ...any) {
+		out.Problems = append(out.Problems, fmt.Sprintf("IFD %d: %s", ifdNum, fmt.Sprintf(msg, args...)))
+	}
+
+	// all out-of-line tag data must be within the file
+	tags := make([]int, 0, len(entries))
+	for tag := range entries {
+		tags = append(tags, int(tag))
+	}
+	sort.Ints(tags)
+	for _, tag := range tags {
+		e := entries[uint16(tag)]
+		typeSize, ok := tiffTypeSizes[e.fieldType]
+		if ok == false {
+			out.Warnings = append(out.Warnings, fmt.Sprintf("IFD %d: tag %d has unknown field type %d", ifdNum, tag, e.fieldType))
+			continue
+		}
+		if e.data == nil && (e.count > tr.size/typeSize || tr.inFile(e.offset, typeSize*e.count) == false) {
+			problem("tag %d data is beyond the end of the file", tag)
+		}
+	}
+
+	required := []uint16{tiffImageWidth, tiffImageLength, tiffPhotometric}
+	if ifdNum == 0 {
+		required = append(required, tiffXResolution, tiffYResolution)
+	}
+	for _, tag := range required {
+		if _, found := entries[tag]; found == false {
+			problem("missing required tag %d", tag)
+		}
+	}
+	for _, tag := range []uint16{tiffImageWidth, tiffImageLength} {
+		if e, found := entries[tag]; found {
+			vals, err := tr.values(e)
+			if err != nil || len(vals) != 1 || vals[0] == 0 {
+				problem("invalid image dimension tag %d", tag)
+			}
+		}
+	}
+
+	compression := uint64(1)
+	if e, found := entries[tiffCompression]; found {
+		vals, err := tr.values(e)
+		if err != nil || len(vals) == 0 {
+			problem("invalid compression tag")
+		} else {
+			compression = vals[0]
+		}
+	}
+	if _, ok := tiffCompressions[compression]; ok == false {
+		problem("unsupported compression %d", compression)
+	}
+
+	offsetTag, countTag, kind := uint16(tiffStripOffsets), uint16(tiffStripByteCount), "strip"
+	if _, tiled := entries[tiffTileOffsets]; tiled {
+		offsetTag, countTag, kind = tiffTileOffsets, tiffTileByteCounts, "tile"
+		for _, tag := range []uint16{tiffTileWidth, tiffTileLength} {
+			if _, found := entries[tag]; found == false {
+				problem("tiled image is missing required tag %d", tag)
+			}
+		}
+	}
+	offsetEntry, hasOffsets := entries[offsetTag]
+	countEntry, hasCounts := entries[countTag]
+	if hasOffsets == false || hasCounts == false {
+		problem("missing %s offsets or byte counts", kind)
+		return
+	}
+	offsets, err := tr.values(offsetEntry)
+	if err != nil {
+		problem("unable to read %s offsets: %s", kind, err.Error())
+		return
+	}
+	counts, err := tr.values(countEntry)
+	if err != nil {
+		problem("unable to read %s byte counts: %s", kind, err.Error())
+		return
+	}
+	if len(offsets) != len(counts) {
+		problem("%d %s offsets but %d byte counts", len(offsets), kind, len(counts))
+		return
+	}
+	for i := range offsets {
+		if counts[i] == 0 {
+			problem("%s %d is empty", kind, i)
+		} else if tr.inFile(offsets[i], counts[i]) == false {
+			problem("%s %d at offset %d with %d bytes is beyond the end of the %d byte file", kind, i, offsets[i], counts[i], tr.size)
+		}
+	}
+
+	if ifdNum == 0 {
+		if _, found := entries[tiffICCProfile]; found == false {
+			out.Warnings = append(out.Warnings, tiffNoICCWarning)
+		}
+	}
+}
+
+// validateTIFFs structurally checks all tif files in the unit finalization directory and reports every
+// problem before any images are imported
+func (svc *ServiceContext) validateTIFFs(js *jobStatus, srcDir string, rules qaRules) error {
+	svc.logInfo(js, fmt.Sprintf("Validate structure of .tif files in %s", srcDir))
+	results, err := checkTIFFDirectory(js, srcDir, rules.RequireICCProfile)
+	if err != nil {
+		return err
+	}
+	badCnt := 0
+	for _, res := range results {
+		for _, msg := range res.Warnings {
+			svc.logInfo(js, fmt.Sprintf("%s: %s", res.File, msg))
+		}
+		if len(res.Problems) > 0 {
+			badCnt++
+			for _, msg := range res.Problems {
+				svc.logError(js, fmt.Sprintf("%s: %s", res.File, msg))
+			}
+		}
+	}
+	if badCnt > 0 {
+		return fmt.Errorf("%d of %d .tif files failed validation", badCnt, len(results))
+	}
+	svc.logInfo(js, fmt.Sprintf("All %d .tif files are valid", len(results)))
+	return nil
+}
+
+// checkTIFFDirectory validates every tif file in a directory. If requireICC is set, a missing ICC profile is a problem
+// instead of a warning.
+func checkTIFFDirectory(js *jobStatus, srcDir string, requireICC bool) ([]tiffValidation, error) {
+	results := make([]tiffValidation, 0)
+	err := filepath.Walk(srcDir, func(fPath string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() || filepath.Ext(f.Name()) != ".tif" {
+			return nil
+		}
+		if js.canceled() {
+			return js.context().Err()
+		}
+		res := validateTIFF(fPath)
+		if requireICC {
+			warnings := make([]string, 0, len(res.Warnings))
+			for _, w := range res.Warnings {
+				if w == tiffNoICCWarning {
+					res.Problems = append(res.Problems, w)
+				} else {
+					warnings = append(warnings, w)
+				}
+			}
+			res.Warnings = warnings
+		}
+		results = append(results, res)
+		return nil
+	})
+	return results, err
+}
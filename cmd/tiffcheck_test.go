@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testTIFFTag struct {
+	tag       uint16
+	fieldType uint16
+	count     uint64
+	value     uint64 // inline value, or the offset of out-of-line data
+}
+
+// baselineTIFFTags describes a 10x10 single strip image. The resolution rationals are out of line in
+// classic TIFF and inline in BigTIFF; the 100 bytes of strip data start at offset 256.
+func baselineTIFFTags() []testTIFFTag {
+	return []testTIFFTag{
+		{tiffImageWidth, 3, 1, 10},
+		{tiffImageLength, 3, 1, 10},
+		{tiffPhotometric, 3, 1, 2},
+		{tiffStripOffsets, 4, 1, 256},
+		{tiffStripByteCount, 4, 1, 100},
+		{tiffXResolution, 5, 1, 200},
+		{tiffYResolution, 5, 1, 208},
+	}
+}
+
+// makeTestTIFF builds a size byte TIFF with a single IFD containing tags. next is the offset of the next IFD.
+func makeTestTIFF(order binary.ByteOrder, big bool, tags []testTIFFTag, next uint64, size int) []byte {
+	buf := make([]byte, size)
+	if order == binary.LittleEndian {
+		copy(buf, "II")
+	} else {
+		copy(buf, "MM")
+	}
+	putValue := func(val []byte, t testTIFFTag) {
+		switch {
+		case t.fieldType == 3:
+			order.PutUint16(val, uint16(t.value))
+		case t.fieldType == 4 || len(val) == 4:
+			order.PutUint32(val, uint32(t.value))
+		default:
+			order.PutUint64(val, t.value)
+		}
+	}
+
+	if big {
+		order.PutUint16(buf[2:], 43)
+		order.PutUint16(buf[4:], 8)
+		order.PutUint64(buf[8:], 16)
+		pos := 16
+		order.PutUint64(buf[pos:], uint64(len(tags)))
+		pos += 8
+		for _, t := range tags {
+			order.PutUint16(buf[pos:], t.tag)
+			order.PutUint16(buf[pos+2:], t.fieldType)
+			order.PutUint64(buf[pos+4:], t.count)
+			putValue(buf[pos+12:pos+20], t)
+			pos += 20
+		}
+		order.PutUint64(buf[pos:], next)
+		return buf
+	}
+
+	order.PutUint16(buf[2:], 42)
+	order.PutUint32(buf[4:], 8)
+	pos := 8
+	order.PutUint16(buf[pos:], uint16(len(tags)))
+	pos += 2
+	for _, t := range tags {
+		order.PutUint16(buf[pos:], t.tag)
+		order.PutUint16(buf[pos+2:], t.fieldType)
+		order.PutUint32(buf[pos+4:], uint32(t.count))
+		putValue(buf[pos+8:pos+12], t)
+		pos += 12
+	}
+	order.PutUint32(buf[pos:], uint32(next))
+	return buf
+}
+
+func writeTestTIFF(t *testing.T, dir string, name string, data []byte) string {
+	t.Helper()
+	tifPath := filepath.Join(dir, name)
+	err := os.WriteFile(tifPath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tifPath
+}
+
+func TestTIFFReadHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		offset  uint64
+		big     bool
+		wantErr string
+	}{
+		{"classic little endian", makeTestTIFF(binary.LittleEndian, false, baselineTIFFTags(), 0, 512), 8, false, ""},
+		{"classic big endian", makeTestTIFF(binary.BigEndian, false, baselineTIFFTags(), 0, 512), 8, false, ""},
+		{"bigtiff", makeTestTIFF(binary.LittleEndian, true, baselineTIFFTags(), 0, 512), 16, true, ""},
+		{"too small", []byte("II*\x00"), 0, false, "too small"},
+		{"bad byte order", append([]byte("XX*\x00"), make([]byte, 12)...), 0, false, "byte order"},
+		{"bad version", append([]byte("II\x2a\x01"), make([]byte, 12)...), 0, false, "version"},
+		{"bigtiff bad offset size", append([]byte("II\x2b\x00\x04\x00\x00\x00"), make([]byte, 8)...), 0, false, "BigTIFF"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := tiffReader{r: bytes.NewReader(tc.data), size: uint64(len(tc.data))}
+			offset, err := tr.readHeader()
+			if tc.wantErr != "" {
+				if err == nil || strings.Contains(err.Error(), tc.wantErr) == false {
+					t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if offset != tc.offset || tr.big != tc.big {
+				t.Errorf("got offset %d big %t, want offset %d big %t", offset, tr.big, tc.offset, tc.big)
+			}
+		})
+	}
+}
+
+func TestTIFFReadIFD(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		big     bool
+		offset  uint64
+		wantErr string
+	}{
+		{"classic", makeTestTIFF(binary.LittleEndian, false, baselineTIFFTags(), 0, 512), false, 8, ""},
+		{"bigtiff", makeTestTIFF(binary.BigEndian, true, baselineTIFFTags(), 0, 512), true, 16, ""},
+		{"offset out of bounds", makeTestTIFF(binary.LittleEndian, false, baselineTIFFTags(), 0, 512), false, 5000, "beyond the end"},
+		{"truncated directory", makeTestTIFF(binary.LittleEndian, false, baselineTIFFTags(), 0, 512)[:90], false, 8, "truncated"},
+		{"empty directory", makeTestTIFF(binary.LittleEndian, false, nil, 0, 512), false, 8, "invalid entry count"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := tiffReader{r: bytes.NewReader(tc.data), size: uint64(len(tc.data)), big: tc.big, order: binary.LittleEndian}
+			if tc.data[0] == 'M' {
+				tr.order = binary.BigEndian
+			}
+			entries, next, err := tr.readIFD(tc.offset)
+			if tc.wantErr != "" {
+				if err == nil || strings.Contains(err.Error(), tc.wantErr) == false {
+					t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if len(entries) != len(baselineTIFFTags()) || next != 0 {
+				t.Fatalf("got %d entries and next %d, want %d entries and next 0", len(entries), next, len(baselineTIFFTags()))
+			}
+			width, err := tr.values(entries[tiffImageWidth])
+			if err != nil || len(width) != 1 || width[0] != 10 {
+				t.Errorf("got width %v (%v), want [10]", width, err)
+			}
+			strip, err := tr.values(entries[tiffStripOffsets])
+			if err != nil || len(strip) != 1 || strip[0] != 256 {
+				t.Errorf("got strip offsets %v (%v), want [256]", strip, err)
+			}
+		})
+	}
+}
+
+func TestValidateTIFF(t *testing.T) {
+	without := func(tag uint16) []testTIFFTag {
+		out := make([]testTIFFTag, 0)
+		for _, tt := range baselineTIFFTags() {
+			if tt.tag != tag {
+				out = append(out, tt)
+			}
+		}
+		return out
+	}
+	with := func(tags ...testTIFFTag) []testTIFFTag {
+		return append(baselineTIFFTags(), tags...)
+	}
+	badStrip := baselineTIFFTags()
+	badStrip[3].value = 1000
+
+	tests := []struct {
+		name    string
+		data    []byte
+		problem string // expected problem substring; empty for a valid file
+	}{
+		{"classic", makeTestTIFF(binary.LittleEndian, false, baselineTIFFTags(), 0, 512), ""},
+		{"bigtiff", makeTestTIFF(binary.BigEndian, true, baselineTIFFTags(), 0, 512), ""},
+		{"truncated ifd", makeTestTIFF(binary.LittleEndian, false, baselineTIFFTags(), 0, 512)[:90], "truncated"},
+		{"ifd out of bounds", makeTestTIFF(binary.LittleEndian, false, baselineTIFFTags(), 0, 512)[:8], "beyond the end of the file"},
+		{"strip out of bounds", makeTestTIFF(binary.LittleEndian, false, badStrip, 0, 512), "strip 0 at offset 1000"},
+		{"missing photometric", makeTestTIFF(binary.LittleEndian, false, without(tiffPhotometric), 0, 512), "missing required tag 262"},
+		{"ccitt g4 compression", makeTestTIFF(binary.LittleEndian, false, with(testTIFFTag{tiffCompression, 3, 1, 4}), 0, 512), ""},
+		{"unsupported compression", makeTestTIFF(binary.LittleEndian, false, with(testTIFFTag{tiffCompression, 3, 1, 99}), 0, 512), "unsupported compression 99"},
+		{"ifd loop", makeTestTIFF(binary.LittleEndian, false, baselineTIFFTags(), 8, 512), "loop"},
+	}
+	dir := t.TempDir()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res := validateTIFF(writeTestTIFF(t, dir, strings.ReplaceAll(tc.name, " ", "_")+".tif", tc.data))
+			if tc.problem == "" {
+				if len(res.Problems) > 0 {
+					t.Fatalf("unexpected problems: %v", res.Problems)
+				}
+				if len(res.Warnings) != 1 || res.Warnings[0] != tiffNoICCWarning {
+					t.Errorf("got warnings %v, want only %q", res.Warnings, tiffNoICCWarning)
+				}
+				return
+			}
+			for _, p := range res.Problems {
+				if strings.Contains(p, tc.problem) {
+					return
+				}
+			}
+			t.Errorf("expected a problem containing %q, got %v", tc.problem, res.Problems)
+		})
+	}
+}
+
+func TestCheckTIFFDirectoryRequireICC(t *testing.T) {
+	dir := t.TempDir()
+	writeTestTIFF(t, dir, "000000001_0001.tif", makeTestTIFF(binary.LittleEndian, false, baselineTIFFTags(), 0, 512))
+
+	results, err := checkTIFFDirectory(nil, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || len(results[0].Problems) != 0 || len(results[0].Warnings) != 1 {
+		t.Fatalf("without requireICC got %+v, want a single warning", results)
+	}
+
+	results, err = checkTIFFDirectory(nil, dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || len(results[0].Problems) != 1 || len(results[0].Warnings) != 0 {
+		t.Fatalf("with requireICC got %+v, want a single problem and no warnings", results)
+	}
+	if results[0].Problems[0] != tiffNoICCWarning {
+		t.Errorf("got problem %q, want %q", results[0].Problems[0], tiffNoICCWarning)
+	}
+}
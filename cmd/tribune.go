@@ -10,7 +10,6 @@ import (
 	"slices"
 	"strings"
 
-	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
@@ -53,7 +52,7 @@ type mets struct {
 //	curl -X POST https://dpg-jobs.lib.virginia.edu/script -H "Content-Type: application/json" \
 //		--data '{"computeID": "lf6f", "name": "tribuneFix", \
 //		"params": { "orderID": 12826, "unitID": 60953, "start": 1 }}'
-func (svc *ServiceContext) fixTribuneHeaders(c *gin.Context, js *jobStatus, params map[string]any) error {
+func (svc *ServiceContext) fixTribuneHeaders(js *jobStatus, params map[string]any) error {
 	orderF, ok := params["orderID"].(float64)
 	if !ok {
 		return fmt.Errorf("invalid orderID param: %s", params["orderID"])
@@ -102,7 +101,7 @@ func (svc *ServiceContext) fixTribuneHeaders(c *gin.Context, js *jobStatus, para
 		cmd := make([]string, 0)
 		cmd = append(cmd, fmt.Sprintf("-iptc:DocumentNotes=%s", imgOrigin))
 		cmd = append(cmd, archivePath)
-		_, err := exec.Command("exiftool", cmd...).Output()
+		_, err := exec.CommandContext(js.context(), "exiftool", cmd...).Output()
 		if err != nil {
 			svc.logError(js, fmt.Sprintf("Unable to set original filename in exifheaders: %s", err.Error()))
 			continue
@@ -133,7 +132,7 @@ func (svc *ServiceContext) fixTribuneHeaders(c *gin.Context, js *jobStatus, para
 //		"params": {
 //	   "directory": "/Users/lf6f/dev/tracksys-dev/sandbox/digiserv-production/tribune_data", \
 //	   "lccn": "sn95079521"}}'
-func (svc *ServiceContext) validateTribuneMount(c *gin.Context, js *jobStatus, params map[string]any) error {
+func (svc *ServiceContext) validateTribuneMount(js *jobStatus, params map[string]any) error {
 	baseDir := fmt.Sprintf("%s", params["directory"])
 	lccnDir := fmt.Sprintf("%s", params["lccn"])
 	printPath := path.Join(baseDir, lccnDir, "print")
@@ -172,7 +171,7 @@ func (svc *ServiceContext) validateTribuneMount(c *gin.Context, js *jobStatus, p
 //		"params": {"orderID": 12826, \
 //	   "directory": "/Users/lf6f/dev/tracksys-dev/sandbox/digiserv-production/tribune_data", \
 //	   "lccn": "sn95079521", "date": "1950"}}'
-func (svc *ServiceContext) setupTribuneQA(c *gin.Context, js *jobStatus, params map[string]any) error {
+func (svc *ServiceContext) setupTribuneQA(js *jobStatus, params map[string]any) error {
 	// first grab orderID and ensure the order exists
 	orderF, ok := params["orderID"].(float64)
 	if !ok {
@@ -377,7 +376,7 @@ func (svc *ServiceContext) setupTribuneQA(c *gin.Context, js *jobStatus, params
 			cmd := make([]string, 0)
 			cmd = append(cmd, fmt.Sprintf("-iptc:DocumentNotes=%s", imgOrigin))
 			cmd = append(cmd, destPath)
-			_, err = exec.Command("exiftool", cmd...).Output()
+			_, err = exec.CommandContext(js.context(), "exiftool", cmd...).Output()
 			if err != nil {
 				svc.logError(js, fmt.Sprintf("Unable to set original filename in exifheaders: %s", err.Error()))
 			} else {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,6 +15,15 @@ import (
 	"gorm.io/gorm"
 )
 
+type cloneRequest struct {
+	UnitID   int64 `json:"unitID"`
+	AllFiles bool  `json:"all"`
+	Files    []struct {
+		ID    int64  `json:"id"`
+		Title string `json:"title"`
+	} `json:"masterfiles"`
+}
+
 func (svc *ServiceContext) cloneMasterFiles(c *gin.Context) {
 	unitID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
 	js, err := svc.createJobStatus("CloneMasterFiles", "Unit", unitID)
@@ -23,14 +33,6 @@ func (svc *ServiceContext) cloneMasterFiles(c *gin.Context) {
 		return
 	}
 
-	type cloneRequest struct {
-		UnitID   int64 `json:"unitID"`
-		AllFiles bool  `json:"all"`
-		Files    []struct {
-			ID    int64  `json:"id"`
-			Title string `json:"title"`
-		} `json:"masterfiles"`
-	}
 	var req []cloneRequest
 	err = c.ShouldBindJSON(&req)
 	if err != nil {
@@ -47,59 +49,85 @@ func (svc *ServiceContext) cloneMasterFiles(c *gin.Context) {
 		return
 	}
 
-	go func() {
-		pageNum := 1
-		failed := false
-		for _, cr := range req {
-			svc.logInfo(js, fmt.Sprintf("Loading clone source unit %d", cr.UnitID))
-			var srcUnit unit
-			err = svc.GDB.
-				Preload("MasterFiles", func(db *gorm.DB) *gorm.DB {
-					return db.Order("master_files.filename ASC")
-				}).
-				Preload("MasterFiles.ImageTechMeta").
-				Preload("MasterFiles.Locations").
-				First(&srcUnit, cr.UnitID).Error
+	err = svc.enqueueJob(js, "CloneMasterFiles", cloneMasterFilesRequest{UnitID: unitID, Sources: req})
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+}
+
+type cloneMasterFilesRequest struct {
+	UnitID  int64
+	Sources []cloneRequest
+}
+
+func (svc *ServiceContext) runCloneMasterFiles(js *jobStatus, payload []byte) error {
+	var req cloneMasterFilesRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid CloneMasterFiles payload: %s", err.Error())
+	}
+	unitID := req.UnitID
+
+	var destUnit unit
+	err = svc.GDB.First(&destUnit, unitID).Error
+	if err != nil {
+		return fmt.Errorf("unable to load destination unit %d: %s", unitID, err.Error())
+	}
+
+	pageNum := 1
+	failed := false
+	for _, cr := range req.Sources {
+		svc.logInfo(js, fmt.Sprintf("Loading clone source unit %d", cr.UnitID))
+		var srcUnit unit
+		err = svc.GDB.
+			Preload("MasterFiles", func(db *gorm.DB) *gorm.DB {
+				return db.Order("master_files.filename ASC")
+			}).
+			Preload("MasterFiles.ImageTechMeta").
+			Preload("MasterFiles.Locations").
+			First(&srcUnit, cr.UnitID).Error
+		if err != nil {
+			svc.logFatal(js, fmt.Sprintf("Unable to load unit %d: %s", cr.UnitID, err.Error()))
+			failed = true
+			return nil
+		}
+
+		if cr.AllFiles {
+			cloneCnt, err := svc.cloneAllMasterFiles(js, &srcUnit, &destUnit, pageNum)
 			if err != nil {
-				svc.logFatal(js, fmt.Sprintf("Unable to load unit %d: %s", cr.UnitID, err.Error()))
-				failed = true
-				return
+				svc.logFatal(js, err.Error())
+				break
 			}
-
-			if cr.AllFiles {
-				cloneCnt, err := svc.cloneAllMasterFiles(js, &srcUnit, &destUnit, pageNum)
-				if err != nil {
-					svc.logFatal(js, err.Error())
-					break
-				}
-				pageNum += cloneCnt
-			} else {
-				for _, mfInfo := range cr.Files {
-					mf := findMasterfile(&srcUnit, mfInfo.ID)
-					if mf == nil {
-						svc.logError(js, fmt.Sprintf("Unable to find masterfile %d in source unit %d. Skipping.", mfInfo.ID, srcUnit.ID))
-					} else {
-						err = svc.cloneMasterFile(js, &srcUnit, mf, &destUnit, mf.Title, pageNum)
-						if err != nil {
-							svc.logFatal(js, err.Error())
-							failed = true
-							break
-						}
+			pageNum += cloneCnt
+		} else {
+			for _, mfInfo := range cr.Files {
+				mf := findMasterfile(&srcUnit, mfInfo.ID)
+				if mf == nil {
+					svc.logError(js, fmt.Sprintf("Unable to find masterfile %d in source unit %d. Skipping.", mfInfo.ID, srcUnit.ID))
+				} else {
+					err = svc.cloneMasterFile(js, &srcUnit, mf, &destUnit, mf.Title, pageNum)
+					if err != nil {
+						svc.logFatal(js, err.Error())
+						failed = true
+						break
 					}
-					pageNum++
 				}
-			}
-			if failed {
-				break
+				pageNum++
 			}
 		}
-		svc.logInfo(js, fmt.Sprintf("%d masterfiles cloned into unit. Flagging unit as cloned", (pageNum-1)))
-		destUnit.Reorder = true
-		err = svc.GDB.Model(&destUnit).Select("Reorder").Updates(destUnit).Error
-		svc.jobDone(js)
-	}()
-
-	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+		if failed {
+			break
+		}
+	}
+	svc.logInfo(js, fmt.Sprintf("%d masterfiles cloned into unit. Flagging unit as cloned", (pageNum-1)))
+	destUnit.Reorder = true
+	err = svc.GDB.Model(&destUnit).Select("Reorder").Updates(destUnit).Error
+	svc.jobDone(js)
+	return nil
 }
 
 func (svc *ServiceContext) publishUnitImagesToIIIF(c *gin.Context) {
@@ -112,6 +140,13 @@ func (svc *ServiceContext) publishUnitImagesToIIIF(c *gin.Context) {
 	}
 
 	overwrite, _ := strconv.ParseBool(c.Query("overwrite"))
+	jp2 := jp2Settings{Profile: c.Query("profile"), Encoder: c.Query("encoder")}
+	err = jp2.validate()
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
 
 	svc.logInfo(js, fmt.Sprintf("Loading target unit %d", unitID))
 	var tgtUnit unit
@@ -125,35 +160,66 @@ func (svc *ServiceContext) publishUnitImagesToIIIF(c *gin.Context) {
 		return
 	}
 
-	go func() {
-		svc.logInfo(js, fmt.Sprintf("Publishing %d master files to IIIF with overwrite=%t", len(tgtUnit.MasterFiles), overwrite))
-		unitDir := fmt.Sprintf("%09d", tgtUnit.ID)
-		for _, mf := range tgtUnit.MasterFiles {
-			svc.logInfo(js, fmt.Sprintf("Processing master file %s", mf.Filename))
-			if mf.DeaccessionedAt != nil {
-				svc.logInfo(js, fmt.Sprintf("Master file %s has been deaccessioned will not be published to IIIF", mf.Filename))
-				continue
-			}
-			if mf.OriginalMfID != nil {
-				svc.logInfo(js, fmt.Sprintf("Master file %s is a clone and will not be published to IIIF", mf.Filename))
-				continue
-			}
+	err = svc.enqueueJob(js, "UnitIIIF", unitIIIFRequest{UnitID: unitID, Overwrite: overwrite, JP2: jp2})
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
-			archiveFile := path.Join(svc.ArchiveDir, unitDir, mf.Filename)
-			if pathExists(archiveFile) == false {
-				svc.logError(js, fmt.Sprintf("Master file does not exist in the archive at %s", archiveFile))
-				continue
-			}
+	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+}
 
-			err = svc.publishToIIIF(js, &mf, archiveFile, overwrite)
-			if err != nil {
-				svc.logError(js, fmt.Sprintf("Publish %s to IIIF Failed: %s", archiveFile, err.Error()))
-			}
+type unitIIIFRequest struct {
+	UnitID    int64
+	Overwrite bool
+	JP2       jp2Settings
+}
+
+func (svc *ServiceContext) runPublishUnitImagesToIIIF(js *jobStatus, payload []byte) error {
+	var req unitIIIFRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid UnitIIIF payload: %s", err.Error())
+	}
+	unitID := req.UnitID
+	overwrite := req.Overwrite
+
+	var tgtUnit unit
+	err = svc.GDB.
+		Preload("MasterFiles", func(db *gorm.DB) *gorm.DB {
+			return db.Order("master_files.filename ASC")
+		}).Preload("MasterFiles.ImageTechMeta").First(&tgtUnit, unitID).Error
+	if err != nil {
+		return fmt.Errorf("unable to load unit %d: %s", unitID, err.Error())
+	}
+
+	svc.logInfo(js, fmt.Sprintf("Publishing %d master files to IIIF with overwrite=%t", len(tgtUnit.MasterFiles), overwrite))
+	unitDir := fmt.Sprintf("%09d", tgtUnit.ID)
+	for _, mf := range tgtUnit.MasterFiles {
+		svc.logInfo(js, fmt.Sprintf("Processing master file %s", mf.Filename))
+		if mf.DeaccessionedAt != nil {
+			svc.logInfo(js, fmt.Sprintf("Master file %s has been deaccessioned will not be published to IIIF", mf.Filename))
+			continue
+		}
+		if mf.OriginalMfID != nil {
+			svc.logInfo(js, fmt.Sprintf("Master file %s is a clone and will not be published to IIIF", mf.Filename))
+			continue
 		}
-		svc.jobDone(js)
-	}()
 
-	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+		archiveFile := path.Join(svc.ArchiveDir, unitDir, mf.Filename)
+		if pathExists(archiveFile) == false {
+			svc.logError(js, fmt.Sprintf("Master file does not exist in the archive at %s", archiveFile))
+			continue
+		}
+
+		err = svc.publishToIIIFWithProfile(js, &mf, archiveFile, overwrite, req.JP2)
+		if err != nil {
+			svc.logError(js, fmt.Sprintf("Publish %s to IIIF Failed: %s", archiveFile, err.Error()))
+		}
+	}
+	svc.jobDone(js)
+	return nil
 }
 
 func (svc *ServiceContext) createPatronDeliverables(c *gin.Context) {
@@ -165,88 +231,103 @@ func (svc *ServiceContext) createPatronDeliverables(c *gin.Context) {
 		return
 	}
 
-	go func() {
-		svc.logInfo(js, fmt.Sprintf("Loading target unit %d", unitID))
-		var tgtUnit unit
-		err = svc.GDB.
-			Preload("MasterFiles", func(db *gorm.DB) *gorm.DB {
-				return db.Order("master_files.filename ASC")
-			}).Preload("MasterFiles.ImageTechMeta").
-			Preload("IntendedUse").Preload("Metadata").First(&tgtUnit, unitID).Error
-		if err != nil {
-			svc.logFatal(js, fmt.Sprintf("Unable to load unit %d: %s", unitID, err.Error()))
-			return
-		}
+	err = svc.enqueueJob(js, "CreatePatronDeliverables", unitJobRequest{UnitID: unitID})
+	if err != nil {
+		svc.logFatal(js, err.Error())
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		// this can be called as part of a re-order or after finalization. for re-orders, the images will already exist in unit_dir
-		unitDir := path.Join(svc.ProcessingDir, "finalization", fmt.Sprintf("%09d", unitID))
-		assembleDir := path.Join(svc.ProcessingDir, "finalization", "tmp", fmt.Sprintf("%09d", unitID))
+	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+}
 
-		if tgtUnit.IntendedUse.DeliverableFormat == "pdf" {
-			err = svc.createPatronPDF(js, &tgtUnit)
-			if err != nil {
-				svc.logFatal(js, fmt.Sprintf("Unable to create patron PDF deliverable: %s", err.Error()))
-				return
-			}
-		} else {
-			svc.logInfo(js, "Unit requires the creation of zipped patron deliverables.")
-			err = ensureDirExists(assembleDir, 0755)
-			if err != nil {
-				svc.logFatal(js, fmt.Sprintf("Unable to create %s: %s", assembleDir, err.Error()))
-				return
-			}
+func (svc *ServiceContext) runCreatePatronDeliverables(js *jobStatus, payload []byte) error {
+	var req unitJobRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return fmt.Errorf("invalid CreatePatronDeliverables payload: %s", err.Error())
+	}
+	unitID := req.UnitID
 
-			// make sure images are available in the finalization dir
-			if svc.unitImagesAvailable(js, &tgtUnit, assembleDir) == false {
-				if tgtUnit.Reorder {
-					svc.logInfo(js, "Creating deliverables for a reorder")
-					// in this case, each cloned masterfile will have a reference to the original.
-					// use this to get to the original unit and recalculate directories
-					svc.copyOriginalFiles(js, &tgtUnit, unitDir)
-				} else {
-					archiveDir := path.Join(svc.ArchiveDir, fmt.Sprintf("%09d", unitID))
-					svc.logInfo(js, fmt.Sprintf("Creating deliverables from the archive %s", archiveDir))
-					copyAll(archiveDir, unitDir)
-				}
+	svc.logInfo(js, fmt.Sprintf("Loading target unit %d", unitID))
+	var tgtUnit unit
+	err = svc.GDB.
+		Preload("MasterFiles", func(db *gorm.DB) *gorm.DB {
+			return db.Order("master_files.filename ASC")
+		}).Preload("MasterFiles.ImageTechMeta").
+		Preload("IntendedUse").Preload("Metadata").First(&tgtUnit, unitID).Error
+	if err != nil {
+		svc.logFatal(js, fmt.Sprintf("Unable to load unit %d: %s", unitID, err.Error()))
+		return nil
+	}
+
+	// this can be called as part of a re-order or after finalization. for re-orders, the images will already exist in unit_dir
+	unitDir := path.Join(svc.ProcessingDir, "finalization", fmt.Sprintf("%09d", unitID))
+	assembleDir := path.Join(svc.ProcessingDir, "finalization", "tmp", fmt.Sprintf("%09d", unitID))
+
+	if tgtUnit.IntendedUse.DeliverableFormat == "pdf" {
+		err = svc.createPatronPDF(js, &tgtUnit)
+		if err != nil {
+			svc.logFatal(js, fmt.Sprintf("Unable to create patron PDF deliverable: %s", err.Error()))
+			return nil
+		}
+	} else {
+		svc.logInfo(js, "Unit requires the creation of zipped patron deliverables.")
+		err = ensureDirExists(assembleDir, 0755)
+		if err != nil {
+			svc.logFatal(js, fmt.Sprintf("Unable to create %s: %s", assembleDir, err.Error()))
+			return nil
+		}
+
+		// make sure images are available in the finalization dir
+		if svc.unitImagesAvailable(js, &tgtUnit, assembleDir) == false {
+			if tgtUnit.Reorder {
+				svc.logInfo(js, "Creating deliverables for a reorder")
+				// in this case, each cloned masterfile will have a reference to the original.
+				// use this to get to the original unit and recalculate directories
+				svc.copyOriginalFiles(js, &tgtUnit, unitDir)
 			} else {
-				svc.logInfo(js, fmt.Sprintf("All files needed to generate unit %d deliverables exist in %s", unitID, assembleDir))
+				archiveDir := path.Join(svc.ArchiveDir, fmt.Sprintf("%09d", unitID))
+				svc.logInfo(js, fmt.Sprintf("Creating deliverables from the archive %s", archiveDir))
+				copyAll(archiveDir, unitDir)
 			}
+		} else {
+			svc.logInfo(js, fmt.Sprintf("All files needed to generate unit %d deliverables exist in %s", unitID, assembleDir))
+		}
 
-			for _, mf := range tgtUnit.MasterFiles {
-				mfPath := path.Join(unitDir, mf.Filename)
-				callNumber := ""
-				location := ""
-				if tgtUnit.Metadata.Type == "SirsiMetadata" {
-					callNumber = tgtUnit.Metadata.CallNumber
-					location = svc.getMarcLocation(tgtUnit.Metadata)
-				}
-				err = svc.createPatronDeliverable(js, &tgtUnit, &mf, mfPath, assembleDir, callNumber, location)
-				if err != nil {
-					svc.logFatal(js, fmt.Sprintf("Deliverable creation failed for %s: %s", mf.Filename, err.Error()))
-					return
-				}
+		for _, mf := range tgtUnit.MasterFiles {
+			mfPath := path.Join(unitDir, mf.Filename)
+			callNumber := ""
+			location := ""
+			if tgtUnit.Metadata.Type == "SirsiMetadata" {
+				callNumber = tgtUnit.Metadata.CallNumber
+				location = svc.getMarcLocation(tgtUnit.Metadata)
 			}
-
-			err = svc.zipPatronDeliverables(js, &tgtUnit)
+			err = svc.createPatronDeliverable(js, &tgtUnit, &mf, mfPath, assembleDir, callNumber, location)
 			if err != nil {
-				svc.logFatal(js, fmt.Sprintf("Zip creation failed: %s", err.Error()))
-				return
+				svc.logFatal(js, fmt.Sprintf("Deliverable creation failed for %s: %s", mf.Filename, err.Error()))
+				return nil
 			}
+		}
 
+		err = svc.zipPatronDeliverables(js, &tgtUnit)
+		if err != nil {
+			svc.logFatal(js, fmt.Sprintf("Zip creation failed: %s", err.Error()))
+			return nil
 		}
 
-		now := time.Now()
-		tgtUnit.DatePatronDeliverablesReady = &now
-		svc.GDB.Model(&tgtUnit).Select("DatePatronDeliverablesReady").Updates(tgtUnit)
-		svc.logInfo(js, "Deliverables created. Date deliverables ready has been updated.")
+	}
 
-		svc.logInfo(js, "Cleaning up working directories")
-		os.RemoveAll(unitDir)
-		os.RemoveAll(assembleDir)
-		svc.jobDone(js)
-	}()
+	now := time.Now()
+	tgtUnit.DatePatronDeliverablesReady = &now
+	svc.GDB.Model(&tgtUnit).Select("DatePatronDeliverablesReady").Updates(tgtUnit)
+	svc.logInfo(js, "Deliverables created. Date deliverables ready has been updated.")
 
-	c.String(http.StatusOK, fmt.Sprintf("%d", js.ID))
+	svc.logInfo(js, "Cleaning up working directories")
+	os.RemoveAll(unitDir)
+	os.RemoveAll(assembleDir)
+	svc.jobDone(js)
+	return nil
 }
 
 func (svc *ServiceContext) updateUnitOCRSettings(c *gin.Context) {
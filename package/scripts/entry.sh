@@ -6,6 +6,8 @@
 # set blank options variables
 SMTP_USER_OPT=""
 SMTP_PASS_OPT=""
+WORKERS_OPT=""
+QA_RULES_OPT=""
 
 # SMTP username
 if [ -n "${SMPT_USER}" ]; then
@@ -17,6 +19,65 @@ if [ -n "${SMPT_PASS}" ]; then
    SMTP_PASS_OPT="-smtppass ${SMPT_PASS}"
 fi
 
+# number of background job workers
+if [ -n "${DPG_JOB_WORKERS}" ]; then
+   WORKERS_OPT="-workers ${DPG_JOB_WORKERS}"
+fi
+
+# number of concurrent JP2 conversions
+if [ -n "${DPG_JP2_WORKERS}" ]; then
+   JP2_WORKERS_OPT="-jp2workers ${DPG_JP2_WORKERS}"
+fi
+
+# create or update the job service tables at startup
+if [ "${DPG_DB_MIGRATE}" = "true" ]; then
+   DB_MIGRATE_OPT="-dbmigrate"
+fi
+
+# finalization QA rules file
+if [ -n "${DPG_QA_RULES}" ]; then
+   QA_RULES_OPT="-qarules ${DPG_QA_RULES}"
+fi
+
+# minutes to wait for OCR callbacks
+if [ -n "${DPG_OCR_TIMEOUT}" ]; then
+   OCR_TIMEOUT_OPT="-ocrtimeout ${DPG_OCR_TIMEOUT}"
+fi
+
+# OCR engine used by finalization and HathiTrust packaging; remote (default) or local
+if [ -n "${DPG_OCR_ENGINE}" ]; then
+   OCR_ENGINE_OPT="-ocrengine ${DPG_OCR_ENGINE}"
+fi
+
+# public URL of the IIIF storage that published manifests are served from
+if [ -n "${IIIF_MAN_STORE_URL}" ]; then
+   IIIF_MAN_STORE_OPT="-iiifmanstore ${IIIF_MAN_STORE_URL}"
+fi
+
+# IIIF image server used in generated manifests
+if [ -n "${IIIF_IMAGE_URL}" ]; then
+   IIIF_IMAGE_OPT="-iiifimage ${IIIF_IMAGE_URL}"
+fi
+
+# rolling fixity audit throughput; disabled unless one of the limits is set
+if [ -n "${DPG_AUDIT_FILES_PER_DAY}" ]; then
+   AUDIT_FILES_OPT="-auditfiles ${DPG_AUDIT_FILES_PER_DAY}"
+fi
+if [ -n "${DPG_AUDIT_GB_PER_DAY}" ]; then
+   AUDIT_GB_OPT="-auditgb ${DPG_AUDIT_GB_PER_DAY}"
+fi
+if [ -n "${DPG_AUDIT_EMAIL}" ]; then
+   AUDIT_EMAIL_OPT="-auditemail ${DPG_AUDIT_EMAIL}"
+fi
+
+# IIIF image storage type and directory for file storage
+if [ -n "${IIIF_STORE}" ]; then
+   IIIF_STORE_OPT="-iiifstore ${IIIF_STORE}"
+fi
+if [ -n "${IIIF_STORE_DIR}" ]; then
+   IIIF_DIR_OPT="-iiifdir ${IIIF_STORE_DIR}"
+fi
+
 # run the server
 umask 0002
 cd bin; ./dpg-jobs-ws               \
@@ -55,7 +116,20 @@ cd bin; ./dpg-jobs-ws               \
   -pdf        ${DPG_PDF}            \
   -service    ${DPG_SERVICE_URL}    \
   ${SMTP_USER_OPT}                  \
-  ${SMTP_PASS_OPT}
+  ${SMTP_PASS_OPT}                  \
+  ${WORKERS_OPT}                     \
+  ${JP2_WORKERS_OPT}                 \
+  ${QA_RULES_OPT}                    \
+  ${DB_MIGRATE_OPT}                  \
+  ${OCR_TIMEOUT_OPT}                 \
+  ${OCR_ENGINE_OPT}                  \
+  ${IIIF_STORE_OPT}                  \
+  ${IIIF_DIR_OPT}                    \
+  ${IIIF_IMAGE_OPT}                  \
+  ${IIIF_MAN_STORE_OPT}              \
+  ${AUDIT_FILES_OPT}                 \
+  ${AUDIT_GB_OPT}                    \
+  ${AUDIT_EMAIL_OPT}
 
 # return the status
 exit $?